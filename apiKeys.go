@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// Scopes that can be granted to API keys
+const (
+	scopeAll          = "*"
+	scopeHighPriority = "high_priority"
+	scopeCacheAdmin   = "cache_admin"
+)
+
+// apiKey is a named credential accepted by the authentication middleware
+type apiKey struct {
+	Label  string
+	Token  string
+	Scopes map[string]bool
+}
+
+// HasScope reports whether the key was granted the scope
+func (k *apiKey) HasScope(scope string) bool {
+	return k != nil && (k.Scopes[scopeAll] || k.Scopes[scope])
+}
+
+// Parse API keys in the form "label:token:scope1|scope2,label2:token2"
+func parseAPIKeys(spec string) []apiKey {
+	var keys []apiKey
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+			log.Printf("Ignoring malformed API key entry for %q", parts[0])
+			continue
+		}
+		key := apiKey{Label: parts[0], Token: parts[1], Scopes: map[string]bool{}}
+		if len(parts) == 3 {
+			for _, scope := range strings.Split(parts[2], "|") {
+				if scope = strings.TrimSpace(scope); scope != "" {
+					key.Scopes[scope] = true
+				}
+			}
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Parse per-key scheduling weights in the form "label=weight,label2=weight2"
+func parseKeyWeights(spec string) map[string]int {
+	weights := make(map[string]int)
+	for _, entry := range strings.Split(spec, ",") {
+		label, weightStr, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			continue
+		}
+		weight, err := strconv.Atoi(strings.TrimSpace(weightStr))
+		if err != nil || weight < 1 {
+			log.Printf("Ignoring invalid weight for API key %q", label)
+			continue
+		}
+		weights[strings.TrimSpace(label)] = weight
+	}
+	return weights
+}
+
+// Name returns the label of the key, or "anonymous" when there is none
+func (k *apiKey) Name() string {
+	if k == nil {
+		return "anonymous"
+	}
+	return k.Label
+}
+
+type apiKeyContextKey struct{}
+
+// Attach the authenticated API key to a request context
+func withAPIKey(ctx context.Context, key *apiKey) context.Context {
+	return context.WithValue(ctx, apiKeyContextKey{}, key)
+}
+
+// Return the API key that authenticated the request, if any
+func apiKeyFromContext(ctx context.Context) *apiKey {
+	key, _ := ctx.Value(apiKeyContextKey{}).(*apiKey)
+	return key
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+)
+
+// Headers carrying the artifact checksum and its signature. X-Checksum-Sha256
+// is always sent, X-Artifact-SHA256 only together with the signature.
+const (
+	headerChecksumSHA256    = "X-Checksum-Sha256"
+	headerArtifactSHA256    = "X-Artifact-SHA256"
+	headerArtifactSignature = "X-Artifact-Signature"
+)
+
+// artifactSigner signs artifact checksums with Ed25519 so clients can verify
+// that an artifact came from this service
+type artifactSigner struct {
+	key ed25519.PrivateKey
+}
+
+// Load a PKCS#8 PEM encoded Ed25519 private key, e.g. created with
+// `openssl genpkey -algorithm ed25519`. Returns nil when no path is configured.
+func loadArtifactSigner(path string) (*artifactSigner, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading signing key: %v", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("signing key is not PEM encoded")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing signing key: %v", err)
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("signing key is not an Ed25519 key")
+	}
+	return &artifactSigner{key: key}, nil
+}
+
+// Sign returns the base64 Ed25519 signature of the hex SHA-256 checksum, or
+// an empty string when signing is disabled
+func (s *artifactSigner) Sign(checksum string) string {
+	if s == nil {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(s.key, []byte(checksum)))
+}
+
+// Set the checksum header for a file, and the signature headers when signing
+// is enabled. The file is hashed once for both, and left at its start again
+// so it can be streamed afterwards. Returns the hex checksum.
+func setChecksumHeaders(w http.ResponseWriter, signer *artifactSigner, file io.ReadSeeker) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", fmt.Errorf("error hashing artifact: %v", err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", fmt.Errorf("error rewinding artifact: %v", err)
+	}
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	setChecksumHeader(w, signer, checksum)
+	return checksum, nil
+}
+
+// Set the checksum header, and the signature headers when signing is enabled,
+// for an artifact with a known checksum
+func setChecksumHeader(w http.ResponseWriter, signer *artifactSigner, checksum string) {
+	w.Header().Set(headerChecksumSHA256, checksum)
+	if signature := signer.Sign(checksum); signature != "" {
+		w.Header().Set(headerArtifactSHA256, checksum)
+		w.Header().Set(headerArtifactSignature, signature)
+	}
+}
+
+// Signing key handler publishing the public key used to verify artifacts
+func signingKeyHandler(signer *artifactSigner) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if signer == nil {
+			http.Error(w, "Artifact signing is not enabled", http.StatusNotFound)
+			return
+		}
+		public := signer.key.Public().(ed25519.PublicKey)
+		der, err := x509.MarshalPKIXPublicKey(public)
+		if err != nil {
+			loggerFrom(r.Context()).Error("Failed to encode public key", "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		response := map[string]string{
+			"algorithm":  "ed25519",
+			"signed":     "hex-encoded SHA-256 of the artifact",
+			"public_key": base64.StdEncoding.EncodeToString(public),
+			"pem":        string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			loggerFrom(r.Context()).Error("Failed to write signing key", "error", err)
+		}
+	}
+}
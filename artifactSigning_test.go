@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"math/rand"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeTestArtifact writes random content and returns its path and the hex
+// SHA-256 computed independently of the code under test
+func writeTestArtifact(t *testing.T, size int) (string, string) {
+	t.Helper()
+	data := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(data)
+	path := filepath.Join(t.TempDir(), "app-b1.apk")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	return path, hex.EncodeToString(sum[:])
+}
+
+// newTestSigner writes a PEM signing key and loads it like ARTIFACT_SIGNING_KEY
+func newTestSigner(t *testing.T) (*artifactSigner, ed25519.PublicKey) {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "signing.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	signer, err := loadArtifactSigner(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer, public
+}
+
+func TestSetChecksumHeaders(t *testing.T) {
+	path, want := writeTestArtifact(t, 300<<10)
+
+	t.Run("unsigned", func(t *testing.T) {
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		rec := httptest.NewRecorder()
+		checksum, err := setChecksumHeaders(rec, nil, file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if checksum != want || rec.Header().Get(headerChecksumSHA256) != want {
+			t.Errorf("checksum %q, header %q, want %q", checksum, rec.Header().Get(headerChecksumSHA256), want)
+		}
+		if rec.Header().Get(headerArtifactSHA256) != "" || rec.Header().Get(headerArtifactSignature) != "" {
+			t.Error("signature headers set without a signing key")
+		}
+
+		// The file is rewound so it can be streamed in full
+		rest, err := io.ReadAll(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sum := sha256.Sum256(rest); hex.EncodeToString(sum[:]) != want {
+			t.Error("the file was not rewound after hashing")
+		}
+	})
+
+	t.Run("signed", func(t *testing.T) {
+		signer, public := newTestSigner(t)
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		rec := httptest.NewRecorder()
+		if _, err := setChecksumHeaders(rec, signer, file); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Header().Get(headerChecksumSHA256) != want || rec.Header().Get(headerArtifactSHA256) != want {
+			t.Errorf("checksum headers %q and %q, want %q", rec.Header().Get(headerChecksumSHA256), rec.Header().Get(headerArtifactSHA256), want)
+		}
+		signature, err := base64.StdEncoding.DecodeString(rec.Header().Get(headerArtifactSignature))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ed25519.Verify(public, []byte(want), signature) {
+			t.Error("the signature doesn't verify against the public key")
+		}
+	})
+}
+
+func TestBase64ArtifactChecksum(t *testing.T) {
+	path, want := writeTestArtifact(t, 64<<10)
+	rec := httptest.NewRecorder()
+	writeBase64Artifact(context.Background(), rec, path, "app-b1.apk", "application/vnd.android.package-archive", 1<<20, nil)
+
+	if got := rec.Header().Get(headerChecksumSHA256); got != want {
+		t.Errorf("checksum header %q, want %q", got, want)
+	}
+	var resp Base64ArtifactResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.SHA256 != want {
+		t.Errorf("sha256 in the response %q, want %q", resp.SHA256, want)
+	}
+	data, err := base64.StdEncoding.DecodeString(resp.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original, _ := os.ReadFile(path)
+	if !bytes.Equal(data, original) {
+		t.Error("the decoded data differs from the artifact")
+	}
+}
+
+func TestLoadArtifactSignerInvalid(t *testing.T) {
+	if signer, err := loadArtifactSigner(""); signer != nil || err != nil {
+		t.Errorf("without a path got %v, %v, want signing disabled", signer, err)
+	}
+	path := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(path, []byte("not a key"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadArtifactSigner(path); err == nil {
+		t.Error("a file without a PEM key was accepted")
+	}
+}
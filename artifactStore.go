@@ -0,0 +1,439 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Directory holding the retained files of a build
+func buildArtifactDir(config Config, buildID string) string {
+	return filepath.Join(config.ArtifactDir, buildID)
+}
+
+// Path of the failure bundle of a build
+func failureBundlePath(config Config, buildID string) string {
+	return filepath.Join(buildArtifactDir(config, buildID), fmt.Sprintf("failure-%s.zip", buildID))
+}
+
+// Reject a built artifact smaller than minSize bytes
+func checkArtifactSize(path string, minSize int64) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("error reading artifact: %v", err)
+	}
+	if info.Size() < minSize {
+		return fmt.Errorf("artifact %s is %d bytes, expected at least %d", filepath.Base(path), info.Size(), minSize)
+	}
+	return nil
+}
+
+// Name of the artifact of a build, including the version when it was computed
+// from git
+func artifactFilename(buildID, ext string, version *gitVersion) string {
+	if version != nil {
+		return fmt.Sprintf("app-%s-%s%s", version.filenameTag(), buildID, ext)
+	}
+	return fmt.Sprintf("app-%s%s", buildID, ext)
+}
+
+// Copy a built artifact into the build's retained directory and describe it
+func retainArtifact(config Config, buildID, src, filename string) (BuildResult, error) {
+	dir := buildArtifactDir(config, buildID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return BuildResult{}, fmt.Errorf("error creating artifact directory: %v", err)
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return BuildResult{}, fmt.Errorf("error opening artifact: %v", err)
+	}
+	defer in.Close()
+
+	out, err := os.Create(filepath.Join(dir, filename))
+	if err != nil {
+		return BuildResult{}, fmt.Errorf("error creating retained artifact: %v", err)
+	}
+	defer out.Close()
+
+	// Hash while copying so the artifact is only read once
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(out, hash), in)
+	if err != nil {
+		return BuildResult{}, fmt.Errorf("error copying artifact: %v", err)
+	}
+	if err := out.Close(); err != nil {
+		return BuildResult{}, fmt.Errorf("error writing retained artifact: %v", err)
+	}
+
+	return BuildResult{
+		BuildID:     buildID,
+		Filename:    filename,
+		Size:        size,
+		SHA256:      hex.EncodeToString(hash.Sum(nil)),
+		ArtifactURL: "/artifacts/" + buildID,
+	}, nil
+}
+
+// Retain the artifact of a successful build and point the build's record at
+// the copy, so /artifacts/{id} serves it. Returns the path of the copy.
+func retainBuildArtifact(svc *buildService, buildID, src, filename string) (BuildResult, string, error) {
+	result, err := retainArtifact(svc.config, buildID, src, filename)
+	if err != nil {
+		return BuildResult{}, "", err
+	}
+	svc.registry.Update(buildID, func(record *BuildRecord) {
+		record.ArtifactURL = result.ArtifactURL
+	})
+	return result, filepath.Join(buildArtifactDir(svc.config, buildID), filename), nil
+}
+
+// Set an ETag from the file's size and modification time, so conditional and
+// HEAD requests don't need to read retained files
+func setFileETag(w http.ResponseWriter, info os.FileInfo) {
+	w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, info.Size(), info.ModTime().UnixNano()))
+}
+
+// Find the retained artifact of a build, ignoring failure bundles. Builds of
+// platform "all" keep one per platform; platform picks one of them.
+func findArtifact(config Config, buildID, platform string) (string, error) {
+	entries, err := os.ReadDir(buildArtifactDir(config, buildID))
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() || !strings.HasPrefix(name, "app-") {
+			continue
+		}
+		if platform == "" || hasPrimaryExtension(name, platform) {
+			return filepath.Join(buildArtifactDir(config, buildID), name), nil
+		}
+	}
+	return "", os.ErrNotExist
+}
+
+// Report whether name is a primary artifact of the platform
+func hasPrimaryExtension(name, platform string) bool {
+	for _, ext := range primaryArtifactExtensions[platform] {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// Directory holding additional outputs of a build
+func extraArtifactDir(config Config, buildID string) string {
+	return filepath.Join(buildArtifactDir(config, buildID), "extras")
+}
+
+// File extensions of the primary artifact for each platform, in order of preference
+var primaryArtifactExtensions = map[string][]string{
+	"android": {".apk", ".aab"},
+	"ios":     {".ipa", ".tar.gz", ".app"},
+}
+
+// Split the files EAS wrote to outputDir into the primary artifact and the
+// extras (mapping files, symbols, ...). The expected filename wins, otherwise
+// the first file with a primary extension for the platform is used.
+func collectBuildOutputs(outputDir, platform, expected string) (string, []string, error) {
+	var files []string
+	err := filepath.WalkDir(outputDir, func(path string, d os.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			files = append(files, path)
+		}
+		return err
+	})
+	if err != nil {
+		return "", nil, fmt.Errorf("error reading output directory: %v", err)
+	}
+
+	primary := ""
+	for _, file := range files {
+		if filepath.Base(file) == expected {
+			primary = file
+		}
+	}
+	for _, ext := range primaryArtifactExtensions[platform] {
+		for _, file := range files {
+			if primary == "" && strings.HasSuffix(file, ext) {
+				primary = file
+			}
+		}
+	}
+	if primary == "" {
+		return "", nil, fmt.Errorf("no %s artifact found in %s", platform, outputDir)
+	}
+
+	var extras []string
+	for _, file := range files {
+		if file != primary {
+			extras = append(extras, file)
+		}
+	}
+	return primary, extras, nil
+}
+
+// Copy extra build outputs into the retained directory and return their download URLs
+func retainExtraArtifacts(config Config, buildID, outputDir string, files []string) ([]string, error) {
+	if len(files) == 0 {
+		return nil, nil
+	}
+	dir := extraArtifactDir(config, buildID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating artifact directory: %v", err)
+	}
+
+	var urls []string
+	for _, file := range files {
+		// Flatten nested outputs into a single directory level
+		rel, err := filepath.Rel(outputDir, file)
+		if err != nil {
+			continue
+		}
+		name := strings.ReplaceAll(filepath.ToSlash(rel), "/", "_")
+		if err := copyFile(file, filepath.Join(dir, name)); err != nil {
+			return urls, err
+		}
+		urls = append(urls, fmt.Sprintf("/artifacts/%s/extras/%s", buildID, name))
+	}
+	return urls, nil
+}
+
+// Copy a file's contents to dest
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("error opening %s: %v", src, err)
+	}
+	defer in.Close()
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return fmt.Errorf("error creating %s: %v", dest, err)
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return fmt.Errorf("error copying %s: %v", src, err)
+	}
+	return out.Close()
+}
+
+// downloadTracker counts the retained files of each build being served, so
+// the janitor doesn't delete them mid-download
+type downloadTracker struct {
+	mu     sync.Mutex
+	builds map[string]int
+}
+
+func newDownloadTracker() *downloadTracker {
+	return &downloadTracker{builds: make(map[string]int)}
+}
+
+// Begin marks a download of the build's files, until the returned function
+// is called
+func (d *downloadTracker) Begin(buildID string) func() {
+	d.mu.Lock()
+	d.builds[buildID]++
+	d.mu.Unlock()
+	return func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if d.builds[buildID]--; d.builds[buildID] <= 0 {
+			delete(d.builds, buildID)
+		}
+	}
+}
+
+// RemoveIdle deletes the build's directory at path unless its files are being
+// downloaded, reporting whether it did. The check and the removal happen under
+// the lock, so a download beginning meanwhile waits and then finds nothing.
+func (d *downloadTracker) RemoveIdle(buildID, path string) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.builds[buildID] > 0 {
+		return false, nil
+	}
+	return true, os.RemoveAll(path)
+}
+
+// Periodically delete retained build directories older than the retention
+// window, and temporary build directories left behind by builds that never
+// finished, e.g. when the service crashed
+func startArtifactJanitor(config Config, downloads *downloadTracker) {
+	// Nothing builds yet, so every temporary directory is left over
+	pruneTempDirs(os.TempDir(), config.TempDirPrefix, 0)
+	if config.ArtifactRetention <= 0 {
+		return
+	}
+	interval := min(config.ArtifactRetention/10, time.Hour)
+	go func() {
+		for {
+			pruneArtifacts(config.ArtifactDir, config.ArtifactRetention, downloads)
+			// A running build's directory is never older than BUILD_TIMEOUT
+			pruneTempDirs(os.TempDir(), config.TempDirPrefix, config.BuildTimeout+time.Hour)
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// File marking the temporary directories of builds, so the janitor leaves
+// other directories with the same prefix alone
+const tempDirMarker = ".expo-build-service"
+
+// Create the temporary directory of a build
+func createBuildTempDir(prefix, buildID string) (string, error) {
+	dir, err := os.MkdirTemp("", prefix+buildID)
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filepath.Join(dir, tempDirMarker), nil, 0644); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return dir, nil
+}
+
+// Delete temporary build directories untouched for longer than age
+func pruneTempDirs(dir, prefix string, age time.Duration) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Println("Failed to read temporary directory:", err)
+		return
+	}
+	cutoff := time.Now().Add(-age)
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), prefix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		if _, err := os.Stat(filepath.Join(path, tempDirMarker)); err != nil {
+			continue
+		}
+		if err := os.RemoveAll(path); err != nil {
+			log.Printf("Failed to remove orphaned build directory %s: %v", path, err)
+			continue
+		}
+		log.Printf("Removed orphaned build directory %s", path)
+	}
+}
+
+func pruneArtifacts(dir string, retention time.Duration, downloads *downloadTracker) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("Failed to read artifact directory:", err)
+		}
+		return
+	}
+
+	cutoff := time.Now().Add(-retention)
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.ModTime().Before(cutoff) {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		removed, err := downloads.RemoveIdle(entry.Name(), path)
+		if err != nil {
+			log.Printf("Failed to remove expired artifacts %s: %v", path, err)
+			continue
+		}
+		if !removed {
+			log.Printf("Keeping expired artifacts %s until their download finished", path)
+			continue
+		}
+		log.Printf("Removed expired artifacts %s", path)
+	}
+}
+
+// Collect the configured paths (relative to each root, globs allowed) and the
+// build output into a zip file for debugging a failed build
+func writeFailureBundle(ctx context.Context, dest string, roots map[string]string, paths []string, buildOutput string) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return fmt.Errorf("error creating artifact directory: %v", err)
+	}
+
+	file, err := os.Create(dest)
+	if err != nil {
+		return fmt.Errorf("error creating failure bundle: %v", err)
+	}
+	defer file.Close()
+
+	zw := zip.NewWriter(file)
+
+	if buildOutput != "" {
+		entry, err := zw.Create("build-output.log")
+		if err != nil {
+			return fmt.Errorf("error writing failure bundle: %v", err)
+		}
+		if _, err := io.WriteString(entry, buildOutput); err != nil {
+			return fmt.Errorf("error writing failure bundle: %v", err)
+		}
+	}
+
+	for label, root := range roots {
+		for _, pattern := range paths {
+			matches, err := filepath.Glob(filepath.Join(root, pattern))
+			if err != nil {
+				loggerFrom(ctx).Warn("Invalid failure bundle path", "pattern", pattern, "error", err)
+				continue
+			}
+			for _, match := range matches {
+				if err := addToZip(ctx, zw, root, label, match); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("error finalizing failure bundle: %v", err)
+	}
+	return nil
+}
+
+// Add a file or directory tree to the zip under label/<path relative to root>
+func addToZip(ctx context.Context, zw *zip.Writer, root, label, path string) error {
+	return filepath.WalkDir(path, func(p string, d os.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return nil
+		}
+
+		src, err := os.Open(p)
+		if err != nil {
+			loggerFrom(ctx).Warn("Skipping file in failure bundle", "file", p, "error", err)
+			return nil
+		}
+		defer src.Close()
+
+		entry, err := zw.Create(filepath.ToSlash(filepath.Join(label, rel)))
+		if err != nil {
+			return fmt.Errorf("error writing failure bundle: %v", err)
+		}
+		if _, err := io.Copy(entry, src); err != nil {
+			return fmt.Errorf("error writing failure bundle: %v", err)
+		}
+		return nil
+	})
+}
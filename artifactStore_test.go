@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckArtifactSize(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, size int) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, make([]byte, size), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	empty := write("empty.apk", 0)
+	tiny := write("tiny.ipa", 200)
+	exact := write("exact.apk", 1<<10)
+
+	for _, tc := range []struct {
+		name    string
+		path    string
+		minSize int64
+		wantErr string // Empty when accepted
+	}{
+		{"zero bytes", empty, 1 << 10, "artifact empty.apk is 0 bytes, expected at least 1024"},
+		{"zero bytes without a minimum", empty, 0, ""},
+		{"below the minimum", tiny, 1 << 10, "artifact tiny.ipa is 200 bytes"},
+		{"at the minimum", exact, 1 << 10, ""},
+		{"missing", filepath.Join(dir, "missing.apk"), 1, "error reading artifact"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := checkArtifactSize(tc.path, tc.minSize)
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("got %v, want an error containing %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+// Each platform is held to its own MIN_ARTIFACT_SIZE_*
+func TestCheckArtifactSizePerPlatform(t *testing.T) {
+	config := Config{MinArtifactSize: map[string]int64{"android": parseSize("1KB", 0), "ios": parseSize("2MB", 0)}}
+	path := filepath.Join(t.TempDir(), "app.ipa")
+	if err := os.WriteFile(path, make([]byte, 1<<20), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkArtifactSize(path, config.MinArtifactSize["ios"]); err == nil {
+		t.Error("1MB artifact passed a 2MB iOS minimum")
+	}
+	if err := checkArtifactSize(path, config.MinArtifactSize["android"]); err != nil {
+		t.Errorf("1MB artifact failed the 1KB Android minimum: %v", err)
+	}
+}
+
+// The artifact of every successful build is kept and served from
+// /artifacts/{id} after the build directory is gone
+func TestRetainBuildArtifact(t *testing.T) {
+	svc := &buildService{
+		config:    Config{ArtifactDir: t.TempDir()},
+		registry:  newBuildRegistry(0, 0, newEventHub(0, nil)),
+		downloads: newDownloadTracker(),
+	}
+	svc.registry.Add(BuildRecord{ID: "b1", Status: statusBuilding})
+	built, want := writeTestArtifact(t, 64<<10)
+
+	result, retained, err := retainBuildArtifact(svc, "b1", built, "app-b1.apk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.SHA256 != want {
+		t.Errorf("sha256 %q, want %q", result.SHA256, want)
+	}
+	if record, _ := svc.registry.Get("b1"); record.ArtifactURL != "/artifacts/b1" {
+		t.Errorf("artifact URL %q, want /artifacts/b1", record.ArtifactURL)
+	}
+	if err := os.Remove(built); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(retained); err != nil {
+		t.Errorf("retained copy missing: %v", err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/artifacts/b1", nil)
+	r.SetPathValue("id", "b1")
+	rec := httptest.NewRecorder()
+	artifactHandler(svc)(rec, r)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d, want 200", rec.Code)
+	}
+	if sum := sha256.Sum256(rec.Body.Bytes()); hex.EncodeToString(sum[:]) != want {
+		t.Error("the download differs from the artifact")
+	}
+}
+
+// Write a build directory under dir last modified long ago
+func writeExpiredBuildDir(t *testing.T, dir, buildID string) string {
+	t.Helper()
+	path := filepath.Join(dir, buildID, "app-"+buildID+".apk")
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("apk"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(filepath.Dir(path), old, old); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPruneArtifactsKeepsDownloads(t *testing.T) {
+	dir := t.TempDir()
+	downloading := writeExpiredBuildDir(t, dir, "b1")
+	idle := writeExpiredBuildDir(t, dir, "b2")
+	downloads := newDownloadTracker()
+
+	end := downloads.Begin("b1")
+	pruneArtifacts(dir, time.Hour, downloads)
+	if _, err := os.Stat(downloading); err != nil {
+		t.Errorf("artifact removed mid-download: %v", err)
+	}
+	if _, err := os.Stat(idle); !os.IsNotExist(err) {
+		t.Errorf("expired artifact kept: %v", err)
+	}
+
+	end()
+	pruneArtifacts(dir, time.Hour, downloads)
+	if _, err := os.Stat(downloading); !os.IsNotExist(err) {
+		t.Errorf("expired artifact kept after its download: %v", err)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Privileged actions recorded in the audit log
+const (
+	auditBuild      = "build"
+	auditCancel     = "build_cancel"
+	auditUpdate     = "update"
+	auditCacheEvict = "cache_evict"
+	auditCacheClear = "cache_clear"
+	auditLockout    = "auth_lockout"
+)
+
+// auditEntry is a single line of the audit log
+type auditEntry struct {
+	Time   time.Time `json:"time"`
+	Key    string    `json:"key"`
+	Action string    `json:"action"`
+	Target string    `json:"target"`
+	Result string    `json:"result"`
+	// PrevHash and Hash chain the entries when AUDIT_HASH_CHAIN is enabled.
+	// Hash is the SHA-256 of the entry encoded with Hash left empty.
+	PrevHash string `json:"prev_hash,omitempty"`
+	Hash     string `json:"hash,omitempty"`
+}
+
+// auditLogger appends privileged actions to a separate JSON lines file.
+// With chaining enabled every entry includes the hash of the previous one,
+// so removing or editing entries breaks the chain.
+type auditLogger struct {
+	mu       sync.Mutex
+	file     *os.File
+	chain    bool
+	prevHash string
+}
+
+// Open the audit log for appending, resuming the hash chain from its last
+// entry. Returns nil when no path is configured.
+func newAuditLogger(path string, chain bool) (*auditLogger, error) {
+	if path == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("error creating audit log directory: %v", err)
+	}
+
+	audit := &auditLogger{chain: chain}
+	if chain {
+		prevHash, err := lastAuditHash(path)
+		if err != nil {
+			return nil, err
+		}
+		audit.prevHash = prevHash
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("error opening audit log %s: %v", path, err)
+	}
+	audit.file = file
+	return audit, nil
+}
+
+// Read the hash of the last entry of an existing audit log
+func lastAuditHash(path string) (string, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("error reading audit log %s: %v", path, err)
+	}
+	defer file.Close()
+
+	var last auditEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) > 0 {
+			last = auditEntry{}
+			if err := json.Unmarshal(scanner.Bytes(), &last); err != nil {
+				return "", fmt.Errorf("audit log %s has a malformed entry: %v", path, err)
+			}
+		}
+	}
+	return last.Hash, scanner.Err()
+}
+
+// Record appends an entry for a privileged action. Failures are logged but
+// never fail the action itself.
+func (a *auditLogger) Record(key *apiKey, action, target, result string) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	entry := auditEntry{Time: time.Now().UTC(), Key: key.Name(), Action: action, Target: target, Result: result}
+	if a.chain {
+		entry.PrevHash = a.prevHash
+		unhashed, err := json.Marshal(entry)
+		if err != nil {
+			log.Println("Failed to encode audit entry:", err)
+			return
+		}
+		sum := sha256.Sum256(unhashed)
+		entry.Hash = hex.EncodeToString(sum[:])
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Println("Failed to encode audit entry:", err)
+		return
+	}
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		log.Println("Failed to write audit entry:", err)
+		return
+	}
+	a.prevHash = entry.Hash
+}
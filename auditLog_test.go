@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Read the entries of an audit log
+func readAuditLog(t *testing.T, path string) []auditEntry {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var entries []auditEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("malformed audit entry %q: %v", scanner.Text(), err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func newTestAuditLogger(t *testing.T, chain bool) (*auditLogger, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "audit", "audit.log")
+	audit, err := newAuditLogger(path, chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { audit.file.Close() })
+	return audit, path
+}
+
+func TestAuditLogHashChain(t *testing.T) {
+	audit, path := newTestAuditLogger(t, true)
+	key := &apiKey{Label: "ci"}
+	audit.Record(key, auditBuild, "b1 https://github.com/owner/app.git", "accepted")
+	audit.Record(key, auditCancel, "b1", "cancelled")
+	audit.file.Close()
+
+	// Reopening continues the chain from the last entry
+	reopened, err := newAuditLogger(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened.Record(nil, auditCacheClear, "npm", "3 evicted, 0 skipped in use")
+	reopened.file.Close()
+
+	entries := readAuditLog(t, path)
+	if len(entries) != 3 {
+		t.Fatalf("got %d entries, want 3", len(entries))
+	}
+	prev := ""
+	for i, entry := range entries {
+		if entry.PrevHash != prev {
+			t.Errorf("entry %d prev_hash %q, want %q", i, entry.PrevHash, prev)
+		}
+		unhashed := entry
+		unhashed.Hash = ""
+		encoded, _ := json.Marshal(unhashed)
+		sum := sha256.Sum256(encoded)
+		if entry.Hash != hex.EncodeToString(sum[:]) {
+			t.Errorf("entry %d hash doesn't match its contents", i)
+		}
+		prev = entry.Hash
+	}
+	if entries[0].Key != "ci" || entries[2].Key != "anonymous" || entries[2].Action != auditCacheClear {
+		t.Errorf("entries %+v", entries)
+	}
+}
+
+func TestAuditLogWithoutChain(t *testing.T) {
+	audit, path := newTestAuditLogger(t, false)
+	audit.Record(&apiKey{Label: "ci"}, auditBuild, "b1", "accepted")
+	entries := readAuditLog(t, path)
+	if len(entries) != 1 || entries[0].Hash != "" || entries[0].PrevHash != "" || entries[0].Result != "accepted" {
+		t.Errorf("entries %+v", entries)
+	}
+
+	var disabled *auditLogger
+	disabled.Record(nil, auditBuild, "b1", "accepted") // No audit log, no panic
+	if audit, err := newAuditLogger("", true); audit != nil || err != nil {
+		t.Errorf("got %v, %v without a path", audit, err)
+	}
+}
+
+// Every privileged endpoint records who did what and how it ended
+func TestPrivilegedActionsAreAudited(t *testing.T) {
+	audit, path := newTestAuditLogger(t, false)
+	registry := newBuildRegistry(0, 0, newEventHub(0, nil))
+	svc := &buildService{config: Config{BuildTimeout: time.Minute, AllowedPlatforms: []string{"android"}}, audit: audit, registry: registry}
+	ci := &apiKey{Label: "ci", Scopes: map[string]bool{}}
+	asKey := func(r *http.Request, key *apiKey) *http.Request {
+		return r.WithContext(withAPIKey(r.Context(), key))
+	}
+
+	// Cancelling a running build
+	registry.Add(BuildRecord{ID: "b1", Status: statusQueued})
+	_, cancel := context.WithCancelCause(context.Background())
+	registry.SetCancel("b1", cancel)
+	r := httptest.NewRequest(http.MethodPost, "/build/b1/cancel", nil)
+	r.SetPathValue("id", "b1")
+	cancelBuildHandler(svc)(httptest.NewRecorder(), asKey(r, ci))
+
+	// Evicting a cache without the cache_admin scope
+	r = httptest.NewRequest(http.MethodDelete, "/caches/npm/abc", nil)
+	r.SetPathValue("cache", "npm")
+	r.SetPathValue("key", "abc")
+	cacheEvictHandler(svc)(httptest.NewRecorder(), asKey(r, ci))
+
+	// Requesting high priority without the high_priority scope
+	body := `{"repo_url":"https://github.com/owner/app.git","platform":"android","priority":"high"}`
+	buildHandler(svc)(httptest.NewRecorder(), asKey(httptest.NewRequest(http.MethodPost, "/build", strings.NewReader(body)), ci))
+
+	// Updating with a wrong token, then the right one
+	t.Setenv("UPDATE_AUTH_TOKEN", "update-secret")
+	update := updateHandler(Config{UpdateScriptPath: "/bin/true", UpdateLockFile: filepath.Join(t.TempDir(), "update.lock")}, audit, nil)
+	r = httptest.NewRequest(http.MethodPost, "/update", nil)
+	r.Header.Set("Authorization", "Bearer wrong")
+	update(httptest.NewRecorder(), r)
+	r = httptest.NewRequest(http.MethodPost, "/update", nil)
+	r.Header.Set("Authorization", "Bearer update-secret")
+	update(httptest.NewRecorder(), r)
+
+	want := []auditEntry{
+		{Key: "ci", Action: auditCancel, Target: "b1", Result: "cancelled"},
+		{Key: "ci", Action: auditCacheEvict, Target: "npm/abc", Result: "denied: missing cache_admin scope"},
+		{Key: "ci", Action: auditBuild, Target: "https://github.com/owner/app.git", Result: "denied: missing high_priority scope"},
+		{Key: "anonymous", Action: auditUpdate, Target: "/bin/true", Result: "denied: invalid token"},
+		{Key: "update", Action: auditUpdate, Target: "/bin/true", Result: "started"},
+	}
+	entries := readAuditLog(t, path)
+	if len(entries) != len(want) {
+		t.Fatalf("got %d entries, want %d: %+v", len(entries), len(want), entries)
+	}
+	for i, entry := range entries {
+		if entry.Time.IsZero() {
+			t.Errorf("entry %d has no time", i)
+		}
+		entry.Time = time.Time{}
+		if entry != want[i] {
+			t.Errorf("entry %d is %+v, want %+v", i, entry, want[i])
+		}
+	}
+}
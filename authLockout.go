@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// authLockout locks a client IP out of the token-protected endpoints after
+// repeated failed authentication. Behind a trusted proxy the client IP is
+// taken from X-Forwarded-For, as for the rate limit. Every lockout of the same IP lasts twice as
+// long as the previous one, up to max. IPs are forgotten once they have been
+// quiet for max.
+type authLockout struct {
+	threshold int
+	base      time.Duration
+	max       time.Duration
+	audit     *auditLogger
+	proxies   []*net.IPNet // Trusted to set X-Forwarded-For
+	mu        sync.Mutex
+	clients   map[string]*lockoutState
+}
+
+type lockoutState struct {
+	failures    int
+	lockouts    int
+	lockedUntil time.Time
+	lastSeen    time.Time
+}
+
+// Returns nil, which never locks anyone out, when threshold is 0
+func newAuthLockout(threshold int, base, max time.Duration, audit *auditLogger, proxies []*net.IPNet) *authLockout {
+	if threshold <= 0 || base <= 0 {
+		return nil
+	}
+	if max < base {
+		max = base
+	}
+	return &authLockout{threshold: threshold, base: base, max: max, audit: audit, proxies: proxies, clients: make(map[string]*lockoutState)}
+}
+
+// Check answers 429 Too Many Requests and returns false while the request's
+// client is locked out
+func (l *authLockout) Check(w http.ResponseWriter, r *http.Request) bool {
+	if l == nil {
+		return true
+	}
+	ip := forwardedClientIP(r, l.proxies)
+	now := time.Now()
+
+	l.mu.Lock()
+	l.prune(now)
+	var retryAfter time.Duration
+	if state, ok := l.clients[ip]; ok && now.Before(state.lockedUntil) {
+		retryAfter = state.lockedUntil.Sub(now)
+	}
+	l.mu.Unlock()
+
+	if retryAfter == 0 {
+		return true
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+	http.Error(w, "Too many failed authentication attempts, try again later", http.StatusTooManyRequests)
+	return false
+}
+
+// Fail records a failed authentication, locking the client out once it
+// reaches the threshold
+func (l *authLockout) Fail(r *http.Request) {
+	if l == nil {
+		return
+	}
+	ip := forwardedClientIP(r, l.proxies)
+	now := time.Now()
+
+	l.mu.Lock()
+	state, ok := l.clients[ip]
+	if !ok {
+		state = &lockoutState{}
+		l.clients[ip] = state
+	}
+	state.lastSeen = now
+	state.failures++
+	if state.failures < l.threshold {
+		l.mu.Unlock()
+		return
+	}
+	duration := l.base << min(state.lockouts, 30)
+	if duration <= 0 || duration > l.max {
+		duration = l.max
+	}
+	state.failures = 0
+	state.lockouts++
+	state.lockedUntil = now.Add(duration)
+	l.mu.Unlock()
+
+	loggerFrom(r.Context()).Warn("Locking out client after failed authentication attempts", "client_ip", ip, "duration", duration.String(), "attempts", l.threshold)
+	l.audit.Record(nil, auditLockout, ip+" "+r.URL.Path, fmt.Sprintf("locked out for %v", duration))
+}
+
+// Succeed clears the client's failed attempts
+func (l *authLockout) Succeed(r *http.Request) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	delete(l.clients, forwardedClientIP(r, l.proxies))
+	l.mu.Unlock()
+}
+
+// Forget clients that have been quiet for the longest lockout. Must be called
+// with l.mu held.
+func (l *authLockout) prune(now time.Time) {
+	for ip, state := range l.clients {
+		if now.After(state.lockedUntil) && now.Sub(state.lastSeen) > l.max {
+			delete(l.clients, ip)
+		}
+	}
+}
+
+// IP address of the connection a request arrived on. Forwarding headers are
+// ignored since any client can set them.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
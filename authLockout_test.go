@@ -0,0 +1,155 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Send a request to the handler from the client address with the token
+func authStatus(handler http.HandlerFunc, remoteAddr, token string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/update", nil)
+	r.RemoteAddr = remoteAddr
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	handler(rec, r)
+	return rec
+}
+
+func newLockoutHandler(t *testing.T, lockout *authLockout) http.HandlerFunc {
+	t.Helper()
+	config := Config{APIKeys: []apiKey{{Label: "default", Token: "right", Scopes: map[string]bool{scopeAll: true}}}}
+	return authenticateWithLockout(config, lockout, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func TestAuthLockoutThreshold(t *testing.T) {
+	auditPath := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := newAuditLogger(auditPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := newLockoutHandler(t, newAuthLockout(3, time.Minute, time.Hour, audit, nil))
+
+	for i := 1; i <= 3; i++ {
+		if rec := authStatus(handler, "192.0.2.1:5000", "wrong"); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: got %d, want 401", i, rec.Code)
+		}
+	}
+	// Locked out, even with the right token
+	rec := authStatus(handler, "192.0.2.1:5000", "right")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("got %d after reaching the threshold, want 429", rec.Code)
+	}
+	if retryAfter := rec.Header().Get("Retry-After"); retryAfter != "60" && retryAfter != "61" {
+		t.Errorf("Retry-After %q, want about a minute", retryAfter)
+	}
+
+	logged, err := os.ReadFile(auditPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(logged), auditLockout) || !strings.Contains(string(logged), "192.0.2.1") {
+		t.Errorf("lockout not audited: %s", logged)
+	}
+}
+
+// Clients are told apart by the IP of RemoteAddr; other ports of the same
+// IP share its lockout
+func TestAuthLockoutPerClient(t *testing.T) {
+	handler := newLockoutHandler(t, newAuthLockout(2, time.Minute, time.Hour, nil, nil))
+	authStatus(handler, "192.0.2.1:5000", "wrong")
+	authStatus(handler, "192.0.2.1:5001", "wrong")
+
+	if rec := authStatus(handler, "192.0.2.1:6000", "right"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("same IP on another port got %d, want 429", rec.Code)
+	}
+	if rec := authStatus(handler, "198.51.100.7:5000", "right"); rec.Code != http.StatusNoContent {
+		t.Errorf("other client got %d, want 204", rec.Code)
+	}
+	if rec := authStatus(handler, "[2001:db8::1]:5000", "wrong"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("first failure of an IPv6 client got %d, want 401", rec.Code)
+	}
+}
+
+// Behind a trusted proxy, clients are told apart by X-Forwarded-For
+func TestAuthLockoutBehindProxy(t *testing.T) {
+	proxies, err := parseTrustedProxies([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := newLockoutHandler(t, newAuthLockout(2, time.Minute, time.Hour, nil, proxies))
+	status := func(forwardedFor, token string) int {
+		r := httptest.NewRequest(http.MethodPost, "/update", nil)
+		r.RemoteAddr = "10.0.0.2:5000"
+		r.Header.Set("X-Forwarded-For", forwardedFor)
+		r.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		handler(rec, r)
+		return rec.Code
+	}
+
+	status("192.0.2.1", "wrong")
+	status("192.0.2.1", "wrong")
+	if code := status("192.0.2.1", "right"); code != http.StatusTooManyRequests {
+		t.Errorf("locked out client got %d, want 429", code)
+	}
+	// Another client behind the same proxy is not locked out
+	if code := status("198.51.100.7", "right"); code != http.StatusNoContent {
+		t.Errorf("other client behind the proxy got %d, want 204", code)
+	}
+	// Nor is a client spoofing the header past the proxy
+	if code := status("192.0.2.1, 198.51.100.7", "right"); code != http.StatusNoContent {
+		t.Errorf("client with a spoofed hop got %d, want 204", code)
+	}
+}
+
+func TestAuthLockoutReset(t *testing.T) {
+	const base = 100 * time.Millisecond
+	lockout := newAuthLockout(2, base, time.Second, nil, nil)
+	handler := newLockoutHandler(t, lockout)
+
+	// A success clears earlier failures
+	authStatus(handler, "192.0.2.1:5000", "wrong")
+	authStatus(handler, "192.0.2.1:5000", "right")
+	if rec := authStatus(handler, "192.0.2.1:5000", "wrong"); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("failure count survived a success: got %d", rec.Code)
+	}
+
+	// The lockout ends after base, and a repeat lockout lasts twice as long
+	authStatus(handler, "192.0.2.1:5000", "wrong")
+	if rec := authStatus(handler, "192.0.2.1:5000", "right"); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("got %d, want 429", rec.Code)
+	}
+	time.Sleep(base + base/2)
+	authStatus(handler, "192.0.2.1:5000", "wrong")
+	authStatus(handler, "192.0.2.1:5000", "wrong")
+	time.Sleep(base + base/2)
+	if rec := authStatus(handler, "192.0.2.1:5000", "right"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("second lockout didn't double: got %d", rec.Code)
+	}
+	time.Sleep(base)
+	if rec := authStatus(handler, "192.0.2.1:5000", "right"); rec.Code != http.StatusNoContent {
+		t.Errorf("got %d after the second lockout ended, want 204", rec.Code)
+	}
+}
+
+func TestAuthLockoutDisabled(t *testing.T) {
+	if newAuthLockout(0, time.Minute, time.Hour, nil, nil) != nil {
+		t.Fatal("threshold 0 created a lockout")
+	}
+	handler := newLockoutHandler(t, nil)
+	for range 10 {
+		authStatus(handler, "192.0.2.1:5000", "wrong")
+	}
+	if rec := authStatus(handler, "192.0.2.1:5000", "right"); rec.Code != http.StatusNoContent {
+		t.Errorf("got %d without a lockout, want 204", rec.Code)
+	}
+}
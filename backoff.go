@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// backoffPolicy describes how often and how long to wait between retries
+type backoffPolicy struct {
+	MaxAttempts int
+	Base        time.Duration
+	Cap         time.Duration
+}
+
+// Delay returns a full-jitter backoff for the given (zero-based) retry, i.e. a
+// random duration in [0, min(cap, base*2^attempt)), so receivers aren't hit in
+// lockstep when many builds finish together
+func (p backoffPolicy) Delay(attempt int) time.Duration {
+	ceiling := p.Base
+	for i := 0; i < attempt && ceiling < p.Cap; i++ {
+		ceiling *= 2
+	}
+	if p.Cap > 0 && ceiling > p.Cap {
+		ceiling = p.Cap
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(ceiling)))
+}
+
+// Run fn until it succeeds, the attempts are used up or ctx is cancelled.
+// When every attempt fails a dead-letter entry is logged for the build.
+func (p backoffPolicy) Run(ctx context.Context, buildID, what string, fn func() error) error {
+	attempts := p.MaxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	logger := loggerFrom(ctx).With("build_id", buildID)
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		if attempt == attempts {
+			break
+		}
+
+		delay := p.Delay(attempt - 1)
+		logger.Warn(what+" failed, retrying", "attempt", attempt, "attempts", attempts, "retry_in", delay.Round(time.Millisecond).String(), "error", err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			logger.Error("DEAD LETTER: "+what+" abandoned", "attempts", attempt, "error", err)
+			return ctx.Err()
+		}
+	}
+
+	logger.Error("DEAD LETTER: "+what+" failed", "attempts", attempts, "error", err)
+	return fmt.Errorf("%s failed after %d attempts: %v", what, attempts, err)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Header carrying the signature of a callback's body, "sha256=" followed by
+// the hex-encoded HMAC-SHA256 of the body with CALLBACK_SECRET
+const callbackSignatureHeader = "X-Signature"
+
+// buildCallback is the JSON body POSTed to a build's callback_url once it finished
+type buildCallback struct {
+	BuildID  string  `json:"build_id"`
+	Status   string  `json:"status"`
+	Platform string  `json:"platform"`
+	Duration float64 `json:"duration_seconds"`
+	// ArtifactURL is absolute when PUBLIC_BASE_URL is set
+	ArtifactURL string `json:"artifact_url,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// callbackSender delivers build callbacks in the background, retrying with
+// the callback backoff policy. A callback that can't be delivered is logged
+// as a dead letter and doesn't affect the build.
+type callbackSender struct {
+	client  *http.Client
+	retry   backoffPolicy
+	secret  []byte
+	baseURL string
+}
+
+// Returns nil when CALLBACK_SECRET isn't set
+func newCallbackSender(config Config) *callbackSender {
+	if config.CallbackSecret == "" {
+		return nil
+	}
+	return &callbackSender{
+		client:  &http.Client{Timeout: 30 * time.Second},
+		retry:   config.CallbackRetry,
+		secret:  []byte(config.CallbackSecret),
+		baseURL: strings.TrimSuffix(config.PublicBaseURL, "/"),
+	}
+}
+
+// Check that a callback URL is an absolute http(s) URL
+func validateCallbackURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%q is not an http(s) URL", redactURLCredentials(rawURL))
+	}
+	return nil
+}
+
+// Sign the callback body with the shared secret
+func (s *callbackSender) sign(body []byte) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Send POSTs the outcome of a finished build to callbackURL
+func (s *callbackSender) Send(callbackURL string, record BuildRecord) {
+	if s == nil || record.FinishedAt == nil {
+		return
+	}
+	callback := buildCallback{
+		BuildID:  record.ID,
+		Status:   record.Status,
+		Platform: record.Platform,
+		Duration: record.FinishedAt.Sub(record.CreatedAt).Seconds(),
+		Error:    record.Error,
+	}
+	if record.ArtifactURL != "" {
+		callback.ArtifactURL = s.baseURL + record.ArtifactURL
+	}
+	body, err := json.Marshal(callback)
+	if err != nil {
+		slog.Error("Failed to encode build callback", "build_id", record.ID, "error", err)
+		return
+	}
+	signature := s.sign(body)
+
+	go s.retry.Run(context.Background(), record.ID, "Build callback", func() error {
+		req, err := http.NewRequest(http.MethodPost, callbackURL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(callbackSignatureHeader, signature)
+		resp, err := s.client.Do(req)
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			// Leave out the URL, it may embed a token
+			return urlErr.Err
+		} else if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return fmt.Errorf("callback responded with %s", resp.Status)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+
+	"github.com/joho/godotenv"
+)
+
+var envKeyPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Validate the keys of the env map of a build request
+func validateEnvMap(env map[string]string) error {
+	for key := range env {
+		if !envKeyPattern.MatchString(key) {
+			return fmt.Errorf("invalid environment variable name %q", key)
+		}
+	}
+	return nil
+}
+
+// Convert an env map to KEY=value pairs for exec.Cmd in a stable order
+func envPairs(env map[string]string) []string {
+	pairs := make([]string, 0, len(env))
+	for key, value := range env {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return pairs
+}
+
+// Load the default .env values configured for every build
+func loadDefaultDotenv(path string) (map[string]string, error) {
+	if path == "" {
+		return map[string]string{}, nil
+	}
+	values, err := godotenv.Read(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", path, err)
+	}
+	return values, nil
+}
+
+// Build the .env file for a build. Values committed in the project's own .env
+// are overridden by the configured defaults, which are in turn overridden by
+// the request's dotenv contents. Values are never included in errors.
+func mergeDotenv(packagePath string, defaults map[string]string, requested string) (string, error) {
+	merged := make(map[string]string)
+
+	if existing, err := godotenv.Read(filepath.Join(packagePath, ".env")); err == nil {
+		for key, value := range existing {
+			merged[key] = value
+		}
+	} else if !os.IsNotExist(err) {
+		return "", fmt.Errorf("project .env is not valid dotenv")
+	}
+
+	for key, value := range defaults {
+		merged[key] = value
+	}
+
+	values, err := godotenv.Unmarshal(requested)
+	if err != nil {
+		return "", fmt.Errorf("dotenv is not valid dotenv syntax")
+	}
+	for key, value := range values {
+		merged[key] = value
+	}
+
+	return godotenv.Marshal(merged)
+}
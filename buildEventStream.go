@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Report whether the client asked for the build's progress as server-sent events
+func wantsEventStream(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+// sseResponse answers a build request with server-sent events: the events
+// of the build's event stream as they happen ("log", "stage" and "build"),
+// then "done" with the build result, including its artifact_url, or "error"
+// with the HTTP status and message the build would otherwise have returned.
+// It stands in for the ResponseWriter once streaming started, and the build
+// writes its result as with Prefer: return=minimal.
+type sseResponse struct {
+	mu          sync.Mutex
+	w           http.ResponseWriter
+	header      http.Header // Headers of the result, not sent
+	status      int
+	result      bytes.Buffer
+	unsubscribe func()
+	forwarded   chan struct{}
+	closed      bool
+}
+
+// Send the response headers and start forwarding the build's events
+func newSSEResponse(w http.ResponseWriter, events *eventHub, buildID string) (*sseResponse, error) {
+	history, stream, unsubscribe, err := events.Subscribe(buildID)
+	if err != nil {
+		return nil, err
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	s := &sseResponse{w: w, header: make(http.Header), status: http.StatusOK, unsubscribe: unsubscribe, forwarded: make(chan struct{})}
+	go func() {
+		defer close(s.forwarded)
+		for _, event := range history {
+			s.send(event.Type, event)
+		}
+		for event := range stream {
+			s.send(event.Type, event)
+		}
+	}()
+	return s, nil
+}
+
+func (s *sseResponse) Header() http.Header {
+	return s.header
+}
+
+func (s *sseResponse) WriteHeader(status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = status
+}
+
+// Write collects the result, sent as the final event on Close
+func (s *sseResponse) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.result.Write(p)
+}
+
+// Flush is a no-op, events are flushed as they are sent
+func (s *sseResponse) Flush() {}
+
+// Close stops forwarding events and sends the result as "done", or as
+// "error" for error statuses
+func (s *sseResponse) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.mu.Unlock()
+
+	// Events published before the build finished are still delivered
+	s.unsubscribe()
+	<-s.forwarded
+
+	result := bytes.TrimSpace(s.result.Bytes())
+	if s.status >= http.StatusBadRequest || !json.Valid(result) {
+		return s.send("error", struct {
+			Status int    `json:"status"`
+			Error  string `json:"error"`
+		}{s.status, string(result)})
+	}
+	return s.send("done", json.RawMessage(result))
+}
+
+func (s *sseResponse) send(event string, data any) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		log.Println("Failed to encode build event:", err)
+		return err
+	}
+	if _, err := fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", event, encoded); err != nil {
+		return err
+	}
+	if f, ok := s.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Open an event stream response for a new build
+func newTestSSEResponse(t *testing.T, buildID string) (*sseResponse, *eventHub, *httptest.ResponseRecorder) {
+	t.Helper()
+	hub := newEventHub(0, nil)
+	hub.Open(BuildRecord{ID: buildID, Status: statusQueued})
+	rec := httptest.NewRecorder()
+	resp, err := newSSEResponse(rec, hub, buildID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, hub, rec
+}
+
+// The handler closes the stream on its error paths and again when it
+// returns; the second close must neither panic nor send a second result
+func TestSSEResponseCloseAfterError(t *testing.T) {
+	resp, hub, rec := newTestSSEResponse(t, "b1")
+	hub.Log("b1", "", "Installing dependencies")
+	http.Error(resp, "Failed to build the app", http.StatusInternalServerError)
+	hub.Close("b1", statusFailed, "Failed to build the app")
+	if err := resp.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := resp.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	body := rec.Body.String()
+	if n := strings.Count(body, "event: error\n"); n != 1 || strings.Contains(body, "event: done\n") {
+		t.Errorf("want exactly one error event, got:\n%s", body)
+	}
+	if !strings.Contains(body, "Installing dependencies") || !strings.Contains(body, `"status":500`) {
+		t.Errorf("log line or status missing:\n%s", body)
+	}
+}
+
+func TestSSEResponseCloseAfterSuccess(t *testing.T) {
+	resp, hub, rec := newTestSSEResponse(t, "b2")
+	resp.Header().Set("Content-Type", "application/json")
+	if _, err := resp.Write([]byte(`{"artifact_url":"/artifacts/b2/app.apk"}`)); err != nil {
+		t.Fatal(err)
+	}
+	hub.Close("b2", statusSucceeded, "")
+	for range 3 {
+		if err := resp.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	body := rec.Body.String()
+	if n := strings.Count(body, "event: done\n"); n != 1 || strings.Contains(body, "event: error\n") {
+		t.Errorf("want exactly one done event, got:\n%s", body)
+	}
+	if !strings.HasSuffix(body, "data: {\"artifact_url\":\"/artifacts/b2/app.apk\"}\n\n") {
+		t.Errorf("result isn't the final event:\n%s", body)
+	}
+}
+
+// Closing before the build's stream ends stops forwarding, and the
+// forwarding goroutine has exited once Close returns
+func TestSSEResponseCloseBeforeBuildEnds(t *testing.T) {
+	resp, hub, rec := newTestSSEResponse(t, "b3")
+	http.Error(resp, "Invalid platform", http.StatusBadRequest)
+	if err := resp.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-resp.forwarded:
+	default:
+		t.Fatal("events still forwarded after Close")
+	}
+	sent := rec.Body.Len()
+	hub.Log("b3", "", "late line")
+	resp.Close()
+	if rec.Body.Len() != sent {
+		t.Errorf("wrote after Close:\n%s", rec.Body.String())
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Pipeline stages reported in the event stream, and the build states that start them
+var buildStages = map[string]string{
+	statusCloning:    "clone",
+	statusInstalling: "install",
+	statusBuilding:   "build",
+	statusUploading:  "upload",
+}
+
+// Stage transitions
+const (
+	stageStarted   = "started"
+	stageCompleted = "completed"
+	stageFailed    = "failed"
+)
+
+// Limits on what is kept for clients that connect late
+const (
+	maxStreamEvents = 5000
+	streamRetention = 10 * time.Minute
+)
+
+// Events a subscriber may fall behind by before it is disconnected
+const subscriberBuffer = 256
+
+var (
+	errStreamNotFound     = errors.New("build events not found")
+	errTooManySubscribers = errors.New("too many subscribers")
+)
+
+// buildEvent is a single line of a build's event stream: a line of build
+// output, a stage transition, or the build being queued or finishing
+type buildEvent struct {
+	Type     string    `json:"type"` // "log", "stage" or "build"
+	Time     time.Time `json:"time"`
+	Line     string    `json:"line,omitempty"`
+	Platform string    `json:"platform,omitempty"` // Of log lines of platform "all" builds
+	Stage    string    `json:"stage,omitempty"`
+	Status   string    `json:"status,omitempty"` // Of the stage, or the state of the build
+	Duration float64   `json:"duration_seconds,omitempty"`
+	Error    string    `json:"error,omitempty"` // Of failed builds
+}
+
+// eventStream holds the events of one build and fans them out to subscribers
+type eventStream struct {
+	build        brokerEvent // The build, for events published to the broker
+	history      []buildEvent
+	subscribers  map[chan buildEvent]struct{}
+	stage        string
+	stageStarted time.Time
+	closed       bool
+}
+
+// eventHub keeps the event streams of recent builds. Publishing never blocks
+// the build: subscribers that fall behind are disconnected. Events other than
+// log lines are also published to the message broker, if configured.
+type eventHub struct {
+	mu             sync.Mutex
+	streams        map[string]*eventStream
+	maxSubscribers int // Per build, unlimited when 0
+	queue          *eventQueue
+}
+
+func newEventHub(maxSubscribers int, queue *eventQueue) *eventHub {
+	return &eventHub{streams: make(map[string]*eventStream), maxSubscribers: maxSubscribers, queue: queue}
+}
+
+// Open starts the event stream of a build
+func (h *eventHub) Open(record BuildRecord) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	stream := &eventStream{
+		build:       brokerEvent{BuildID: record.ID, Repo: record.Repo, Branch: record.Branch, Platform: record.Platform},
+		subscribers: make(map[chan buildEvent]struct{}),
+	}
+	h.streams[record.ID] = stream
+	h.publish(stream, buildEvent{Type: "build", Time: time.Now(), Status: record.Status})
+}
+
+// Stage completes the current stage of a build and starts the one belonging
+// to its new state, if any
+func (h *eventHub) Stage(buildID, status string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	stream, ok := h.streams[buildID]
+	if !ok || stream.closed {
+		return
+	}
+	next, ok := buildStages[status]
+	if !ok || next == stream.stage {
+		return
+	}
+	h.endStage(stream, stageCompleted)
+	stream.stage, stream.stageStarted = next, time.Now()
+	h.publish(stream, buildEvent{Type: "stage", Time: stream.stageStarted, Stage: next, Status: stageStarted})
+}
+
+// Close ends the current stage as completed or failed, reports the final
+// state of the build and disconnects the subscribers. The stream stays
+// available for late clients for a while.
+func (h *eventHub) Close(buildID, status, errText string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	stream, ok := h.streams[buildID]
+	if !ok || stream.closed {
+		return
+	}
+	if status == statusSucceeded {
+		h.endStage(stream, stageCompleted)
+	} else {
+		h.endStage(stream, stageFailed)
+	}
+	h.publish(stream, buildEvent{Type: "build", Time: time.Now(), Status: status, Error: errText})
+	stream.closed = true
+	for ch := range stream.subscribers {
+		close(ch)
+	}
+	stream.subscribers = nil
+
+	time.AfterFunc(streamRetention, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if h.streams[buildID] == stream {
+			delete(h.streams, buildID)
+		}
+	})
+}
+
+// Log publishes a line of build output
+func (h *eventHub) Log(buildID, platform, line string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if stream, ok := h.streams[buildID]; ok && !stream.closed {
+		h.publish(stream, buildEvent{Type: "log", Time: time.Now(), Line: line, Platform: platform})
+	}
+}
+
+// Subscribe returns the events published so far and a channel receiving the
+// following ones, closed when the build finishes or the subscriber falls
+// behind. The returned function unsubscribes.
+func (h *eventHub) Subscribe(buildID string) ([]buildEvent, <-chan buildEvent, func(), error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	stream, ok := h.streams[buildID]
+	if !ok {
+		return nil, nil, nil, errStreamNotFound
+	}
+	if !stream.closed && h.maxSubscribers > 0 && len(stream.subscribers) >= h.maxSubscribers {
+		return nil, nil, nil, errTooManySubscribers
+	}
+	history := append([]buildEvent(nil), stream.history...)
+	ch := make(chan buildEvent, subscriberBuffer)
+	if stream.closed {
+		close(ch)
+		return history, ch, func() {}, nil
+	}
+	stream.subscribers[ch] = struct{}{}
+	unsubscribe := func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if _, ok := stream.subscribers[ch]; ok {
+			delete(stream.subscribers, ch)
+			close(ch)
+		}
+	}
+	return history, ch, unsubscribe, nil
+}
+
+// End the current stage with the given status. Must be called with h.mu held.
+func (h *eventHub) endStage(stream *eventStream, status string) {
+	if stream.stage == "" {
+		return
+	}
+	now := time.Now()
+	h.publish(stream, buildEvent{Type: "stage", Time: now, Stage: stream.stage, Status: status, Duration: now.Sub(stream.stageStarted).Seconds()})
+	stream.stage = ""
+}
+
+// Must be called with h.mu held
+func (h *eventHub) publish(stream *eventStream, event buildEvent) {
+	if len(stream.history) < maxStreamEvents {
+		stream.history = append(stream.history, event)
+	}
+	for ch := range stream.subscribers {
+		select {
+		case ch <- event:
+		default:
+			// Disconnect rather than let the subscriber miss events silently
+			delete(stream.subscribers, ch)
+			close(ch)
+		}
+	}
+	if event.Type != "log" {
+		message := stream.build
+		message.buildEvent = event
+		h.queue.Send(message)
+	}
+}
+
+// logEventWriter splits build output into lines published to the event stream
+type logEventWriter struct {
+	hub      *eventHub
+	buildID  string
+	platform string // Set for the platforms of platform "all" builds
+	partial  []byte
+}
+
+func (w *logEventWriter) Write(p []byte) (int, error) {
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		w.hub.Log(w.buildID, w.platform, strings.TrimRight(string(w.partial[:i]), "\r"))
+		w.partial = w.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+// Build events handler streaming the stage transitions and output of a build
+// as newline-delimited JSON, or as server-sent events when requested
+func buildEventsHandler(svc *buildService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		history, events, unsubscribe, err := svc.events.Subscribe(r.PathValue("id"))
+		if errors.Is(err, errTooManySubscribers) {
+			http.Error(w, "Too many clients are following this build", http.StatusTooManyRequests)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Build events not found", http.StatusNotFound)
+			return
+		}
+		defer unsubscribe()
+
+		sse := strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+		if sse {
+			w.Header().Set("Content-Type", "text/event-stream")
+		} else {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+		}
+		w.Header().Set("Cache-Control", "no-cache")
+		flusher, _ := w.(http.Flusher)
+
+		// Follow a single platform of a platform "all" build
+		platform := r.URL.Query().Get("platform")
+		send := func(event buildEvent) bool {
+			if platform != "" && event.Type == "log" && event.Platform != platform {
+				return true
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				return false
+			}
+			if sse {
+				_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+			} else {
+				_, err = fmt.Fprintf(w, "%s\n", data)
+			}
+			return err == nil
+		}
+
+		for _, event := range history {
+			if !send(event) {
+				return
+			}
+		}
+		for {
+			if flusher != nil {
+				flusher.Flush()
+			}
+			select {
+			case event, ok := <-events:
+				if !ok {
+					return
+				}
+				if !send(event) {
+					return
+				}
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+}
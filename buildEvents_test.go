@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// drain receives the events buffered for a subscriber without blocking and
+// reports whether the channel was closed
+func drain(events <-chan buildEvent) ([]buildEvent, bool) {
+	var received []buildEvent
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return received, true
+			}
+			received = append(received, event)
+		default:
+			return received, false
+		}
+	}
+}
+
+func TestEventHubSubscriberCap(t *testing.T) {
+	hub := newEventHub(2, nil)
+	hub.Open(BuildRecord{ID: "b1", Status: statusQueued})
+
+	_, _, unsubscribe, err := hub.Subscribe("b1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := hub.Subscribe("b1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := hub.Subscribe("b1"); !errors.Is(err, errTooManySubscribers) {
+		t.Fatalf("third subscriber error = %v, want errTooManySubscribers", err)
+	}
+
+	// Leaving frees the slot
+	unsubscribe()
+	if _, _, _, err := hub.Subscribe("b1"); err != nil {
+		t.Fatalf("subscribe after unsubscribe: %v", err)
+	}
+
+	// Finished builds only replay their history, so they aren't capped
+	hub.Close("b1", statusSucceeded, "")
+	for range 3 {
+		history, events, _, err := hub.Subscribe("b1")
+		if err != nil {
+			t.Fatalf("subscribe to a finished build: %v", err)
+		}
+		if len(history) == 0 {
+			t.Fatal("no history for a finished build")
+		}
+		if _, closed := drain(events); !closed {
+			t.Fatal("the channel of a finished build is open")
+		}
+	}
+
+	if _, _, _, err := hub.Subscribe("missing"); !errors.Is(err, errStreamNotFound) {
+		t.Fatalf("unknown build error = %v, want errStreamNotFound", err)
+	}
+}
+
+func TestEventHubDropsSlowSubscriber(t *testing.T) {
+	hub := newEventHub(0, nil)
+	hub.Open(BuildRecord{ID: "b1", Status: statusQueued})
+	_, fast, _, err := hub.Subscribe("b1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The slow subscriber never reads
+	_, slow, _, err := hub.Subscribe("b1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const batch, batches = subscriberBuffer / 2, 4
+	published := make(chan struct{})
+	var fastEvents []buildEvent
+	go func() {
+		defer close(published)
+		for b := range batches {
+			for i := range batch {
+				hub.Log("b1", "", fmt.Sprintf("line %d", b*batch+i))
+			}
+			received, _ := drain(fast)
+			fastEvents = append(fastEvents, received...)
+		}
+	}()
+	select {
+	case <-published:
+	case <-time.After(5 * time.Second):
+		t.Fatal("publishing blocked on the slow subscriber")
+	}
+
+	if len(fastEvents) != batch*batches {
+		t.Errorf("fast subscriber got %d events, want %d", len(fastEvents), batch*batches)
+	}
+	slowEvents, closed := drain(slow)
+	if !closed {
+		t.Fatal("the slow subscriber is still connected")
+	}
+	if len(slowEvents) != subscriberBuffer {
+		t.Errorf("slow subscriber got %d events before being dropped, want %d", len(slowEvents), subscriberBuffer)
+	}
+
+	// The fast subscriber stays connected
+	hub.Log("b1", "", "after")
+	if received, closed := drain(fast); closed || len(received) != 1 {
+		t.Errorf("fast subscriber after the drop: %d events, closed %v", len(received), closed)
+	}
+}
+
+func TestBuildEventsHandlerRejectsExcessSubscribers(t *testing.T) {
+	hub := newEventHub(1, nil)
+	hub.Open(BuildRecord{ID: "b1", Status: statusQueued})
+	if _, _, _, err := hub.Subscribe("b1"); err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /build/events/{id}", buildEventsHandler(&buildService{events: hub}))
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/build/events/b1", nil))
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want 429", w.Code)
+	}
+}
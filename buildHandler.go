@@ -1,40 +1,155 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/joho/godotenv"
 )
 
+// Service version, overridden at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
 type Config struct {
-	ServerPort         string
-	LogDirectory       string
-	LogFile            string
-	BuildTimeout       time.Duration
-	TempDirPrefix      string
-	UpdateScriptPath   string
-	AllowedPlatforms   []string
-	DefaultCloneBranch string
+	ServerPort            string
+	LogDirectory          string
+	LogFile               string
+	BuildTimeout          time.Duration
+	TempDirPrefix         string
+	UpdateScriptPath      string
+	AllowedPlatforms      []string
+	DefaultCloneBranch    string
+	CloneFilter           string
+	RepoThrottleLimit     int
+	RepoThrottleWindow    time.Duration
+	PlatformAliases       bool
+	EASVersionCheck       bool
+	EASToolchain          string
+	Base64MaxSize         int64
+	CleanupConcurrency    int
+	SSHKeyPath            string
+	APIKeys               []apiKey `secret:"true"`
+	MaxConcurrent         int
+	MaxQueued             int
+	PriorityAging         time.Duration
+	ArtifactDir           string
+	ArtifactRetention     time.Duration
+	FailureBundles        bool
+	FailureBundlePaths    map[string][]string
+	TLSCertFile           string
+	TLSKeyFile            string
+	TLSMinVersion         string
+	TLSCipherSuites       []string
+	FirebaseSecretsDir    string
+	MaxBuildRecords       int
+	BuildRecordTTL        time.Duration
+	DefaultDotenvFile     string
+	APIKeyWeights         map[string]int
+	VerifyRemoteRef       bool
+	RefCacheTTL           time.Duration
+	CollectOutputs        bool
+	CallbackRetry         backoffPolicy
+	FrozenLockfile        bool
+	SigningSecretsDir     string
+	DownloadBufferSize    int64
+	TCPKeepAlive          time.Duration
+	CacheDir              string
+	IsolatedNpmCache      bool
+	GitConfig             string `secret:"true"` // May carry auth headers
+	GitConfigCommands     bool
+	WarmPoolRepos         []string
+	WarmPoolSize          int
+	InstallFlags          []string
+	AuditLogFile          string
+	AuditHashChain        bool
+	HTTPProxy             string
+	HTTPSProxy            string
+	NoProxy               string
+	DrainTimeout          time.Duration
+	InterruptTimeout      time.Duration
+	InterruptCancels      bool
+	NpmAuditLevel         string
+	NpmAuditMode          string
+	InlineLogMax          int64
+	MinArtifactSize       map[string]int64
+	CloneTimeout          time.Duration
+	CloneStallTimeout     time.Duration
+	MaxCloneSize          int64
+	SigningKeyFile        string
+	CloneRemoteHead       bool
+	SymlinkPolicy         string
+	TrustedRepos          []string
+	BuildUID              int
+	BuildGID              int
+	ResultCacheTTL        time.Duration
+	ResultCacheSize       int
+	RequestTimeout        time.Duration
+	RequestTimeoutCancels bool
+	MaxRequestSize        int64
+	RequestBodyTimeout    time.Duration
+	FailureAlertThreshold int
+	FailureAlertWebhook   string `secret:"true"` // Webhook URLs often embed a token
+	PostBuildSteps        []string
+	AuthLockoutThreshold  int
+	AuthLockoutBase       time.Duration
+	AuthLockoutMax        time.Duration
+	PublicBaseURL         string
+	InstallLinkSecret     string `secret:"true"`
+	BuildStallTimeout     time.Duration
+	MaxConcurrentPlatform map[string]int
+	GitVersion            bool
+	UpdateLockFile        string
+	CABundleFile          string
+	IdleShutdown          time.Duration
+	OutputFormats         map[string]outputFormat
+	LogConfig             bool
+	MaxEventSubscribers   int
+	CloneWorktrees        bool
+	BuildPresetsFile      string
+	OOMRetry              bool
+	OOMRetryEnv           []string
+	TrustNodeModules      bool
+	EventQueueURL         string `secret:"true"` // May embed the broker's password
+	EventQueueStream      string
+	DefaultEASProfile     string
+	CallbackSecret        string `secret:"true"`
+	RateLimitPerMinute    int
+	RateLimitBurst        int
+	RateLimitKey          string
+	TrustedProxies        []string
+	MetricsToken          string `secret:"true"`
+	AllowNoAuth           bool
+	MinFreeDisk           int64
+	LogFormat             string
+	AllowedEASProfiles    []string
 }
 
 // Load configuration from environment variables
 func loadConfig() Config {
 	// Load .env file
+	snapshotProcessEnv()
 	err := godotenv.Load()
 	if err != nil {
 		log.Println("Error loading .env file, using default configuration")
@@ -44,177 +159,1875 @@ func loadConfig() Config {
 		ServerPort:         getEnv("SERVER_PORT", "8080"),
 		LogDirectory:       getEnv("LOG_DIRECTORY", "/home/server/expo-build-service/logs"),
 		LogFile:            getEnv("LOG_FILE", "server.log"),
-		BuildTimeout:       parseDuration(getEnv("BUILD_TIMEOUT", "60m")),
+		BuildTimeout:       parseDuration(getEnv("BUILD_TIMEOUT", "60m"), 60*time.Minute),
 		TempDirPrefix:      getEnv("TEMP_DIR_PREFIX", "build-"),
 		UpdateScriptPath:   getEnv("UPDATE_SCRIPT_PATH", "/home/server/expo-build-service/update_server.sh"),
-		AllowedPlatforms:   strings.Split(getEnv("ALLOWED_PLATFORMS", "android,ios"), ","),
+		AllowedPlatforms:   splitList(strings.ToLower(getEnv("ALLOWED_PLATFORMS", "android,ios"))),
 		DefaultCloneBranch: getEnv("DEFAULT_CLONE_BRANCH", "main"),
+		CloneFilter:        getEnv("CLONE_FILTER", ""),
+		RepoThrottleLimit:  parseInt(getEnv("REPO_THROTTLE_LIMIT", "0"), 0),
+		RepoThrottleWindow: parseDuration(getEnv("REPO_THROTTLE_WINDOW", "1m"), time.Minute),
+		PlatformAliases:    parseBool(getEnv("PLATFORM_ALIASES", "false"), false),
+		EASVersionCheck:    parseBool(getEnv("EAS_VERSION_CHECK", "true"), true),
+		EASToolchain:       getEnv("EAS_TOOLCHAIN", easToolchainGlobal),
+		Base64MaxSize:      parseSize(getEnv("BASE64_MAX_SIZE", "10MB"), 10<<20),
+		CleanupConcurrency: parseInt(getEnv("CLEANUP_CONCURRENCY", "2"), 2),
+		SSHKeyPath:         getEnv("SSH_KEY_PATH", ""),
+		APIKeys:            append([]apiKey{{Label: "default", Token: os.Getenv("AUTH_TOKEN"), Scopes: map[string]bool{scopeAll: true}}}, parseAPIKeys(getEnv("API_KEYS", ""))...),
+		MaxConcurrent:      parseInt(getEnv("MAX_CONCURRENT_BUILDS", "1"), 1),
+		MaxQueued:          parseInt(getEnv("MAX_QUEUED_BUILDS", "0"), 0),
+		PriorityAging:      parseDuration(getEnv("PRIORITY_AGING", "5m"), 5*time.Minute),
+		ArtifactDir:        getEnv("ARTIFACT_DIR", "/home/server/expo-build-service/artifacts"),
+		ArtifactRetention:  parseDuration(getEnv("ARTIFACT_RETENTION", "72h"), 72*time.Hour),
+		FailureBundles:     parseBool(getEnv("FAILURE_BUNDLES", "false"), false),
+		FailureBundlePaths: map[string][]string{
+			"android": splitList(getEnv("FAILURE_BUNDLE_PATHS_ANDROID", "android/app/build/reports,android/app/build/outputs/logs,android/build/reports")),
+			"ios":     splitList(getEnv("FAILURE_BUNDLE_PATHS_IOS", "ios/build/reports,ios/logs,ios/*.log")),
+		},
+		TLSCertFile:        getEnv("TLS_CERT_FILE", ""),
+		TLSKeyFile:         getEnv("TLS_KEY_FILE", ""),
+		TLSMinVersion:      getEnv("TLS_MIN_VERSION", "1.2"),
+		TLSCipherSuites:    splitList(getEnv("TLS_CIPHER_SUITES", "")),
+		FirebaseSecretsDir: getEnv("FIREBASE_SECRETS_DIR", ""),
+		MaxBuildRecords:    parseInt(getEnv("MAX_BUILD_RECORDS", "1000"), 1000),
+		BuildRecordTTL:     parseDuration(getEnv("BUILD_RECORD_TTL", "0"), 0),
+		DefaultDotenvFile:  getEnv("DEFAULT_DOTENV_FILE", ""),
+		APIKeyWeights:      parseKeyWeights(getEnv("API_KEY_WEIGHTS", "")),
+		VerifyRemoteRef:    parseBool(getEnv("VERIFY_REMOTE_REF", "false"), false),
+		RefCacheTTL:        parseDuration(getEnv("REF_CACHE_TTL", "30s"), 30*time.Second),
+		CollectOutputs:     parseBool(getEnv("COLLECT_OUTPUTS", "false"), false),
+		CallbackRetry: backoffPolicy{
+			MaxAttempts: parseInt(getEnv("CALLBACK_MAX_ATTEMPTS", "5"), 5),
+			Base:        parseDuration(getEnv("CALLBACK_BACKOFF_BASE", "1s"), time.Second),
+			Cap:         parseDuration(getEnv("CALLBACK_BACKOFF_CAP", "1m"), time.Minute),
+		},
+		FrozenLockfile:     parseBool(getEnv("FROZEN_LOCKFILE", "false"), false),
+		SigningSecretsDir:  getEnv("SIGNING_SECRETS_DIR", ""),
+		DownloadBufferSize: parseSize(getEnv("DOWNLOAD_BUFFER_SIZE", "256KB"), 256<<10),
+		TCPKeepAlive:       parseDuration(getEnv("TCP_KEEPALIVE", "30s"), 30*time.Second),
+		CacheDir:           getEnv("CACHE_DIR", ""),
+		IsolatedNpmCache:   parseBool(getEnv("ISOLATED_NPM_CACHE", strconv.FormatBool(getEnv("CACHE_DIR", "") == "")), getEnv("CACHE_DIR", "") == ""),
+		GitConfig:          getEnv("GIT_CONFIG_OVERRIDES", ""),
+		GitConfigCommands:  parseBool(getEnv("GIT_CONFIG_ALLOW_COMMANDS", "false"), false),
+		WarmPoolRepos:      splitList(getEnv("WARM_POOL_REPOS", "")),
+		WarmPoolSize:       parseInt(getEnv("WARM_POOL_SIZE", "1"), 1),
+		InstallFlags:       splitList(getEnv("INSTALL_FLAGS", "")),
+		AuditLogFile:       getEnv("AUDIT_LOG_FILE", ""),
+		AuditHashChain:     parseBool(getEnv("AUDIT_HASH_CHAIN", "false"), false),
+		HTTPProxy:          getEnv("HTTP_PROXY", ""),
+		HTTPSProxy:         getEnv("HTTPS_PROXY", ""),
+		NoProxy:            getEnv("NO_PROXY", ""),
+		DrainTimeout:       parseDuration(getEnv("SHUTDOWN_GRACE", getEnv("SHUTDOWN_DRAIN_TIMEOUT", getEnv("BUILD_TIMEOUT", "60m"))), 60*time.Minute),
+		InterruptTimeout:   parseDuration(getEnv("SHUTDOWN_INTERRUPT_TIMEOUT", "5s"), 5*time.Second),
+		InterruptCancels:   parseBool(getEnv("SHUTDOWN_INTERRUPT_CANCEL", "true"), true),
+		NpmAuditLevel:      getEnv("NPM_AUDIT_LEVEL", ""),
+		NpmAuditMode:       getEnv("NPM_AUDIT_MODE", auditModeFail),
+		InlineLogMax:       parseSize(getEnv("INLINE_LOG_MAX", "64KB"), 64<<10),
+		MinArtifactSize: map[string]int64{
+			"android": parseSize(getEnv("MIN_ARTIFACT_SIZE_ANDROID", "1KB"), 1<<10),
+			"ios":     parseSize(getEnv("MIN_ARTIFACT_SIZE_IOS", "1KB"), 1<<10),
+		},
+		CloneTimeout:          parseDuration(getEnv("CLONE_TIMEOUT", "30m"), 30*time.Minute),
+		CloneStallTimeout:     parseDuration(getEnv("CLONE_STALL_TIMEOUT", "2m"), 2*time.Minute),
+		MaxCloneSize:          parseSize(getEnv("MAX_CLONE_SIZE", "0"), 0),
+		SigningKeyFile:        getEnv("ARTIFACT_SIGNING_KEY", ""),
+		CloneRemoteHead:       parseBool(getEnv("CLONE_REMOTE_HEAD", "false"), false),
+		SymlinkPolicy:         getEnv("SYMLINK_POLICY", symlinkPolicyReject),
+		TrustedRepos:          splitList(getEnv("TRUSTED_REPOS", "")),
+		BuildUID:              parseInt(getEnv("BUILD_UID", "-1"), -1),
+		BuildGID:              parseInt(getEnv("BUILD_GID", "-1"), -1),
+		ResultCacheTTL:        parseDuration(getEnv("RESULT_CACHE_TTL", "24h"), 24*time.Hour),
+		ResultCacheSize:       parseInt(getEnv("RESULT_CACHE_SIZE", "500"), 500),
+		RequestTimeout:        parseDuration(getEnv("REQUEST_TIMEOUT", "0"), 0),
+		RequestTimeoutCancels: parseBool(getEnv("REQUEST_TIMEOUT_CANCELS", "false"), false),
+		MaxRequestSize:        parseSize(getEnv("MAX_REQUEST_SIZE", "1MB"), 1<<20),
+		RequestBodyTimeout:    parseDuration(getEnv("REQUEST_BODY_TIMEOUT", "30s"), 30*time.Second),
+		FailureAlertThreshold: parseInt(getEnv("FAILURE_ALERT_THRESHOLD", "3"), 3),
+		FailureAlertWebhook:   getEnv("FAILURE_ALERT_WEBHOOK", ""),
+		PostBuildSteps:        splitList(getEnv("POST_BUILD_STEPS", "")),
+		AuthLockoutThreshold:  parseInt(getEnv("AUTH_LOCKOUT_THRESHOLD", "5"), 5),
+		AuthLockoutBase:       parseDuration(getEnv("AUTH_LOCKOUT_DURATION", "1m"), time.Minute),
+		AuthLockoutMax:        parseDuration(getEnv("AUTH_LOCKOUT_MAX_DURATION", "1h"), time.Hour),
+		PublicBaseURL:         getEnv("PUBLIC_BASE_URL", ""),
+		InstallLinkSecret:     getEnv("INSTALL_LINK_SECRET", ""),
+		BuildStallTimeout:     parseDuration(getEnv("BUILD_STALL_TIMEOUT", "15m"), 15*time.Minute),
+		GitVersion:            parseBool(getEnv("GIT_VERSION", "false"), false),
+		UpdateLockFile:        getEnv("UPDATE_LOCK_FILE", "/home/server/expo-build-service/update.lock"),
+		CABundleFile:          getEnv("CA_BUNDLE_FILE", ""),
+		IdleShutdown:          parseDuration(getEnv("IDLE_SHUTDOWN", "0"), 0),
+		OutputFormats:         parseOutputFormats(getEnv("OUTPUT_FORMATS", "")),
+		LogConfig:             parseBool(getEnv("LOG_CONFIG", "true"), true),
+		MaxEventSubscribers:   parseInt(getEnv("MAX_EVENT_SUBSCRIBERS", "0"), 0),
+		CloneWorktrees:        parseBool(getEnv("CLONE_WORKTREES", "false"), false),
+		BuildPresetsFile:      getEnv("BUILD_PRESETS_FILE", ""),
+		OOMRetry:              parseBool(getEnv("OOM_RETRY", "false"), false),
+		OOMRetryEnv:           splitList(getEnv("OOM_RETRY_ENV", "GRADLE_OPTS=-Dorg.gradle.workers.max=1 -Dorg.gradle.parallel=false,METRO_MAX_WORKERS=1")),
+		TrustNodeModules:      parseBool(getEnv("TRUST_NODE_MODULES", "false"), false),
+		EventQueueURL:         getEnv("EVENT_QUEUE_URL", ""),
+		EventQueueStream:      getEnv("EVENT_QUEUE_STREAM", "expo-build-events"),
+		DefaultEASProfile:     getEnv("DEFAULT_EAS_PROFILE", defaultBuildProfile),
+		AllowedEASProfiles:    splitList(getEnv("ALLOWED_EAS_PROFILES", "")),
+		CallbackSecret:        getEnv("CALLBACK_SECRET", ""),
+		RateLimitPerMinute:    parseInt(getEnv("RATE_LIMIT_PER_MINUTE", "0"), 0),
+		RateLimitBurst:        parseInt(getEnv("RATE_LIMIT_BURST", "0"), 0),
+		RateLimitKey:          getEnv("RATE_LIMIT_KEY", rateLimitByIP),
+		TrustedProxies:        splitList(getEnv("TRUSTED_PROXIES", "")),
+		MetricsToken:          getEnv("METRICS_TOKEN", ""),
+		AllowNoAuth:           parseBool(getEnv("ALLOW_NO_AUTH", "false"), false),
+		MinFreeDisk:           parseSize(getEnv("MIN_FREE_DISK", "0"), 0),
+		LogFormat:             getEnv("LOG_FORMAT", logFormatJSON),
+		MaxConcurrentPlatform: map[string]int{
+			"android": parseInt(getEnv("MAX_CONCURRENT_ANDROID", "0"), 0),
+			"ios":     parseInt(getEnv("MAX_CONCURRENT_IOS", "0"), 0),
+		},
 	}
 }
 
 // Helper function to get environment variable with a default value
 func getEnv(key, defaultValue string) string {
 	value := os.Getenv(key)
+	recordConfigSource(key, value != "")
 	if value == "" {
 		return defaultValue
 	}
 	return value
 }
 
+// Helper function to split a comma-separated list, dropping empty items
+func splitList(listStr string) []string {
+	var items []string
+	for _, item := range strings.Split(listStr, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 // Helper function to parse duration safely
-func parseDuration(durationStr string) time.Duration {
+func parseDuration(durationStr string, defaultValue time.Duration) time.Duration {
 	duration, err := time.ParseDuration(durationStr)
 	if err != nil {
-		log.Printf("Invalid duration %s, using default 60 minutes", durationStr)
-		return 60 * time.Minute
+		log.Printf("Invalid duration %s, using default %s", durationStr, defaultValue)
+		return defaultValue
 	}
 	return duration
 }
 
-// BuildRequest defines the expected JSON payload for build requests
+// Helper function to parse an integer safely
+func parseInt(intStr string, defaultValue int) int {
+	value, err := strconv.Atoi(intStr)
+	if err != nil {
+		log.Printf("Invalid integer %s, using default %d", intStr, defaultValue)
+		return defaultValue
+	}
+	return value
+}
+
+// Helper function to parse a byte size such as "512KB", "10MB" or "2GB"
+func parseSize(sizeStr string, defaultValue int64) int64 {
+	units := []struct {
+		suffix     string
+		multiplier int64
+	}{
+		{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1},
+	}
+
+	str := strings.ToUpper(strings.TrimSpace(sizeStr))
+	multiplier := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(str, unit.suffix) {
+			str = strings.TrimSpace(strings.TrimSuffix(str, unit.suffix))
+			multiplier = unit.multiplier
+			break
+		}
+	}
+
+	value, err := strconv.ParseInt(str, 10, 64)
+	if err != nil || value < 0 {
+		log.Printf("Invalid size %s, using default %d bytes", sizeStr, defaultValue)
+		return defaultValue
+	}
+	return value * multiplier
+}
+
+// Helper function to parse a boolean safely
+func parseBool(boolStr string, defaultValue bool) bool {
+	value, err := strconv.ParseBool(boolStr)
+	if err != nil {
+		log.Printf("Invalid boolean %s, using default %t", boolStr, defaultValue)
+		return defaultValue
+	}
+	return value
+}
+
+// Common alternative names clients use for a platform
+var platformAliases = map[string]string{
+	"apk": "android",
+	"ipa": "ios",
+}
+
+// Normalize a platform value by trimming and lowercasing it,
+// optionally resolving common aliases
+func normalizePlatform(platform string, allowAliases bool) string {
+	platform = strings.ToLower(strings.TrimSpace(platform))
+	if alias, ok := platformAliases[platform]; ok && allowAliases {
+		return alias
+	}
+	return platform
+}
+
+// BuildRequest defines the expected JSON payload for build requests.
+// Fields holding credentials must be tagged `secret:"true"` so they are
+// redacted before the request is stored on the build record.
 type BuildRequest struct {
-	RepoURL      string `json:"repo_url"`
+	RepoURL string `json:"repo_url"`
+	// Branch or tag to build, overrides DEFAULT_CLONE_BRANCH
+	Branch string `json:"branch"`
+	// GitToken authenticates HTTPS clones of private repositories
+	GitToken     string `json:"git_token" secret:"true"`
 	Platform     string `json:"platform"`
 	PackagePath  string `json:"package_path"`
 	UpdateServer bool   `json:"update_server"`
+	CloneFilter  string `json:"clone_filter"`
+	// CloneProtocol rewrites the repository URL to "https" or "ssh" before cloning
+	CloneProtocol string `json:"clone_protocol"`
+	// Priority is "low", "normal" (default) or "high"
+	Priority string `json:"priority"`
+	// ClearCache rebuilds without the EAS/gradle/metro caches
+	ClearCache bool `json:"clear_cache"`
+	// CollectOutputs keeps every file EAS produces, e.g. ProGuard mapping files
+	CollectOutputs bool `json:"collect_outputs"`
+	// FrozenLockfile fails the build if installing would modify the lockfile, overrides FROZEN_LOCKFILE
+	FrozenLockfile *bool `json:"frozen_lockfile,omitempty"`
+	// PackageManager forces npm, yarn, pnpm or bun instead of detecting it from the lockfile
+	PackageManager string `json:"package_manager"`
+	// TrustNodeModules skips the install when node_modules is committed, overrides TRUST_NODE_MODULES
+	TrustNodeModules *bool `json:"trust_node_modules,omitempty"`
+	// Env holds environment variables for the install and build commands
+	Env map[string]string `json:"env" secret:"true"`
+	// Dotenv is written to the package directory as .env for the build
+	Dotenv string `json:"dotenv" secret:"true"`
+	// Firebase config files, base64-encoded, or the name of a directory in
+	// FIREBASE_SECRETS_DIR holding them
+	GoogleServicesJSON     string `json:"google_services_json" secret:"true"`
+	GoogleServiceInfoPlist string `json:"google_service_info_plist" secret:"true"`
+	FirebaseSecret         string `json:"firebase_secret"`
+	// Signing credentials for store builds, or the name of a directory in
+	// SIGNING_SECRETS_DIR holding them
+	Signing       *SigningCredentials `json:"signing,omitempty"`
+	SigningSecret string              `json:"signing_secret"`
+	// GitConfig holds `git -c` overrides for the clone, limited to an allowlist of keys
+	GitConfig map[string]string `json:"git_config" secret:"true"`
+	// InstallFlags are extra npm install flags from an allowlist, overriding INSTALL_FLAGS
+	InstallFlags []string `json:"install_flags"`
+	// NpmAuditLevel enables an npm audit after install for vulnerabilities at
+	// or above this severity, overriding NPM_AUDIT_LEVEL; "" disables it
+	NpmAuditLevel *string `json:"npm_audit_level,omitempty"`
+	// NpmAuditMode is "fail" or "warn", overriding NPM_AUDIT_MODE
+	NpmAuditMode string `json:"npm_audit_mode"`
+	// InlineLogKB embeds up to this many KB of the end of the build log in
+	// the metadata response, capped at INLINE_LOG_MAX
+	InlineLogKB int `json:"inline_log_kb"`
+	// Profile is the EAS build profile, "production" by default
+	Profile string `json:"profile"`
+	// Environment selects a preset of BUILD_PRESETS_FILE providing defaults
+	// for the profile and env
+	Environment string `json:"environment"`
+	// ReuseResult answers the request with the artifact of an earlier build
+	// of the same commit and inputs when one is cached
+	ReuseResult bool `json:"reuse_result"`
+	// CallbackURL receives a signed POST with the outcome once the build finished
+	CallbackURL string `json:"callback_url" secret:"true"`
+	// InstallLink publishes an install page and QR code for testers
+	InstallLink bool `json:"install_link"`
+	// Async answers with the build ID right away and builds in the background
+	Async bool `json:"async"`
+	// NoWait rejects the build instead of queueing it when all slots are busy
+	NoWait bool `json:"no_wait"`
+	// GitVersion derives the app version and build number from git, also
+	// when GIT_VERSION is off
+	GitVersion bool `json:"git_version"`
+	// EASVersion selects the EAS CLI: "global", "auto" or an eas-cli
+	// version run through npx, overriding EAS_TOOLCHAIN
+	EASVersion string `json:"eas_version"`
+	// ResponseFormat is "binary" (default) to stream the artifact or
+	// "base64" to return it inside a JSON document
+	ResponseFormat string `json:"response_format"`
+}
+
+// BuildResult is returned instead of the artifact when the client asks for a minimal response
+type BuildResult struct {
+	BuildID     string `json:"build_id"`
+	Status      string `json:"status"`
+	Platform    string `json:"platform"`
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	SHA256      string `json:"sha256"`
+	// Signature is the Ed25519 signature of SHA256 when signing is enabled
+	Signature   string `json:"signature,omitempty"`
+	ArtifactURL string `json:"artifact_url"`
+	// Log holds the end of the build log when the request set inline_log_kb
+	Log          string `json:"log,omitempty"`
+	LogTruncated bool   `json:"log_truncated,omitempty"`
+	LogURL       string `json:"log_url,omitempty"`
+	// CacheHit reports that the artifact was reused from an earlier build
+	CacheHit bool `json:"cache_hit"`
+	// Install holds the install links requested with install_link
+	Install *installLinks `json:"install,omitempty"`
+}
+
+// Report whether the client asked for build metadata instead of the artifact.
+// The ?return= query parameter takes precedence over the Prefer header.
+func wantsMinimalResponse(r *http.Request) bool {
+	if value := r.URL.Query().Get("return"); value != "" {
+		return value == "minimal"
+	}
+	for _, header := range r.Header.Values("Prefer") {
+		for _, pref := range strings.Split(header, ",") {
+			if strings.EqualFold(strings.TrimSpace(pref), "return=minimal") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Base64ArtifactResponse is returned instead of a binary stream in base64 mode
+type Base64ArtifactResponse struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	SHA256      string `json:"sha256"`
+	Signature   string `json:"signature,omitempty"`
+	Data        string `json:"data"`
+}
+
+// buildService holds the state shared by the build endpoints
+type buildService struct {
+	config         Config
+	dotenvDefaults map[string]string
+	presets        map[string]buildPreset
+	throttle       *repoThrottle
+	eas            *easInfo
+	cleanup        *cleanupQueue
+	queue          *buildQueue
+	registry       *buildRegistry
+	events         *eventHub
+	refs           *refChecker
+	caches         *cacheManager
+	gitConfig      []string // Validated GIT_CONFIG_OVERRIDES
+	pool           *warmPool
+	audit          *auditLogger
+	signer         *artifactSigner
+	user           *buildUser // Runs npm and EAS, nil to use the service user
+	results        *resultCache
+	failures       *failureTracker
+	installs       *installLinker  // Nil without PUBLIC_BASE_URL
+	callbacks      *callbackSender // Nil without CALLBACK_SECRET
+	downloads      *downloadTracker
+	platforms      *platformLimiter
+	ca             *caBundle    // Nil without CA_BUNDLE_FILE
+	mirrors        *mirrorStore // Nil without CLONE_WORKTREES
+	// Artifacts the client stopped receiving before the end
+	partialDeliveries atomic.Int64
 }
 
 // Modify handlers and main function to use config
-func buildHandler(config Config) http.HandlerFunc {
+func buildHandler(svc *buildService) http.HandlerFunc {
+	config, throttle, eas, cleanup := svc.config, svc.throttle, svc.eas, svc.cleanup
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx, cancel := context.WithTimeout(r.Context(), config.BuildTimeout)
 		defer cancel()
 
+		// Everything logged for the build carries the request ID, set by
+		// withRequestID, and, once known, the build's ID, platform and
+		// repository
+		logger := loggerFrom(r.Context())
+
+		// Refuse to start a build that would run out of disk halfway
+		if config.MinFreeDisk > 0 {
+			if free, err := freeDiskSpace(os.TempDir()); err != nil {
+				logger.Error("Failed to check free disk space", "error", err)
+			} else {
+				logger.Info("Free disk space for builds", "free_bytes", free, "min_bytes", config.MinFreeDisk)
+				if free < config.MinFreeDisk {
+					w.Header().Set("X-Error-Code", "disk_full")
+					http.Error(w, fmt.Sprintf("Not enough free disk space on the build server: %d bytes free, %d bytes required", free, config.MinFreeDisk), http.StatusInsufficientStorage)
+					return
+				}
+			}
+		}
+
 		var req BuildRequest
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			log.Println("Invalid request payload:", err)
-			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		if err := decodeRequestBody(w, r, config, &req); err != nil {
+			logger.Warn("Rejected build request body", "error", err)
+			status := http.StatusBadRequest
+			var bodyErr *requestBodyError
+			if errors.As(err, &bodyErr) {
+				status = bodyErr.status
+			}
+			http.Error(w, err.Error(), status)
 			return
 		}
 
+		req.Platform = normalizePlatform(req.Platform, config.PlatformAliases)
+		w.Header().Set("X-Build-Platform", req.Platform)
+
 		// Validate input
-		if req.RepoURL == "" || req.Platform == "" || req.PackagePath == "" {
-			log.Println("Missing required parameters")
+		if req.RepoURL == "" || req.Platform == "" {
+			logger.Warn("Missing required parameters")
 			http.Error(w, "Missing required parameters", http.StatusBadRequest)
 			return
 		}
+		logger = logger.With("platform", req.Platform, "repo", redactURLCredentials(req.RepoURL))
+		if err := validateRepoURL(req.RepoURL); err != nil {
+			logger.Warn("Invalid repository URL", "error", err)
+			http.Error(w, fmt.Sprintf("Invalid repo_url: %v", err), http.StatusBadRequest)
+			return
+		}
+		requested := []string{req.Platform}
+		if req.Platform == platformAll {
+			requested = allPlatforms
+		}
+		for _, platform := range requested {
+			if !slices.Contains(config.AllowedPlatforms, platform) {
+				logger.Warn("Platform not allowed")
+				http.Error(w, fmt.Sprintf("Platform %s is not allowed, allowed platforms: %s", req.Platform, strings.Join(config.AllowedPlatforms, ", ")), http.StatusBadRequest)
+				return
+			}
+		}
+
+		switch req.ResponseFormat {
+		case "", "binary", "base64", "multipart":
+		default:
+			logger.Warn("Invalid response format", "response_format", req.ResponseFormat)
+			http.Error(w, "Invalid response_format, expected \"binary\", \"base64\" or \"multipart\"", http.StatusBadRequest)
+			return
+		}
+
+		if req.Platform == platformAll {
+			if err := validateMultiPlatformRequest(req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		if req.InstallLink && svc.installs == nil {
+			http.Error(w, "install_link requires PUBLIC_BASE_URL to be configured", http.StatusBadRequest)
+			return
+		}
+		if req.CallbackURL != "" {
+			if svc.callbacks == nil {
+				http.Error(w, "callback_url requires CALLBACK_SECRET to be configured", http.StatusBadRequest)
+				return
+			}
+			if err := validateCallbackURL(req.CallbackURL); err != nil {
+				http.Error(w, fmt.Sprintf("Invalid callback_url: %v", err), http.StatusBadRequest)
+				return
+			}
+		}
+
+		priority, err := parsePriority(req.Priority)
+		if err != nil {
+			logger.Warn("Invalid priority", "error", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if priority == priorityHigh && !apiKeyFromContext(r.Context()).HasScope(scopeHighPriority) {
+			logger.Warn("High priority requested by a key without the high_priority scope")
+			svc.audit.Record(apiKeyFromContext(r.Context()), auditBuild, redactURLCredentials(req.RepoURL), "denied: missing high_priority scope")
+			http.Error(w, "This API key may not request high priority builds", http.StatusForbidden)
+			return
+		}
+
+		// Use the per-request clone filter, falling back to the configured one
+		cloneFilter := req.CloneFilter
+		if cloneFilter == "" {
+			cloneFilter = config.CloneFilter
+		}
+		if cloneFilter != "" && !isValidCloneFilter(cloneFilter) {
+			logger.Warn("Invalid clone filter", "filter", cloneFilter)
+			http.Error(w, "Invalid clone filter", http.StatusBadRequest)
+			return
+		}
+		if req.Branch != "" && !isValidBranchName(req.Branch) {
+			logger.Warn("Invalid branch", "branch", req.Branch)
+			http.Error(w, "Invalid branch name", http.StatusBadRequest)
+			return
+		}
+
+		// Expand the selected preset below the request's own parameters
+		if req.Environment != "" {
+			preset, ok := svc.presets[req.Environment]
+			if !ok {
+				logger.Warn("Unknown environment", "environment", req.Environment)
+				http.Error(w, fmt.Sprintf("Unknown environment %q, available: %s", req.Environment, presetNames(svc.presets)), http.StatusBadRequest)
+				return
+			}
+			preset.apply(&req)
+		}
+
+		if err := validateEnvMap(req.Env); err != nil {
+			logger.Warn("Invalid env", "error", err)
+			http.Error(w, fmt.Sprintf("Invalid env: %v", err), http.StatusBadRequest)
+			return
+		}
+		// Proxy and CA settings come first so the request can still override them
+		buildEnv := append(append(proxyEnv(config), svc.ca.env()...), envPairs(req.Env)...)
+
+		// Request install flags replace the configured defaults
+		installFlags := config.InstallFlags
+		if req.InstallFlags != nil {
+			installFlags = req.InstallFlags
+		}
+		if err := validateInstallFlags(installFlags); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid install_flags: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := validatePackageManager(req.PackageManager); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid package_manager: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		auditLevel, auditMode := config.NpmAuditLevel, config.NpmAuditMode
+		if req.NpmAuditLevel != nil {
+			auditLevel = *req.NpmAuditLevel
+		}
+		if req.NpmAuditMode != "" {
+			auditMode = req.NpmAuditMode
+		}
+		if err := validateAuditSettings(auditLevel, auditMode); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid npm audit settings: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		profile := req.Profile
+		if profile == "" {
+			profile = config.DefaultEASProfile
+		}
+		if !isValidProfileName(profile) {
+			http.Error(w, "Invalid profile", http.StatusBadRequest)
+			return
+		}
+		if err := checkProfileAllowed(config.AllowedEASProfiles, profile); err != nil {
+			logger.Warn("Rejected build profile", "error", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		easVersion := config.EASToolchain
+		if req.EASVersion != "" {
+			easVersion = req.EASVersion
+		}
+		if err := validateEASVersionSpec(easVersion); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Load and validate Firebase config files before doing any work
+		googleServices, serviceInfo, err := loadFirebaseFiles(config, req)
+		if err != nil {
+			logger.Warn("Invalid Firebase config", "error", err)
+			http.Error(w, fmt.Sprintf("Invalid Firebase config: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		signing, err := loadSigningCredentials(config, req)
+		if err != nil {
+			logger.Warn("Invalid signing credentials", "error", err)
+			http.Error(w, fmt.Sprintf("Invalid signing credentials: %v", err), http.StatusUnprocessableEntity)
+			return
+		}
+
+		// Rewrite the repository URL to the requested transport
+		repoURL, err := rewriteRepoURL(req.RepoURL, req.CloneProtocol)
+		if err != nil {
+			logger.Warn("Invalid clone protocol", "error", err)
+			http.Error(w, fmt.Sprintf("Invalid clone_protocol: %v", err), http.StatusBadRequest)
+			return
+		}
+		if req.CloneProtocol == cloneProtocolSSH && config.SSHKeyPath == "" {
+			logger.Warn("SSH clone requested but no SSH key is configured")
+			http.Error(w, "SSH cloning requires SSH_KEY_PATH to be configured on the server", http.StatusBadRequest)
+			return
+		}
+
+		// Server overrides come first so the request's take precedence
+		if len(req.GitConfig) > maxRequestGitConfig {
+			http.Error(w, fmt.Sprintf("Too many git_config overrides, at most %d are allowed", maxRequestGitConfig), http.StatusBadRequest)
+			return
+		}
+		requestGitConfig, err := validateGitConfig(req.GitConfig, false)
+		if err != nil {
+			logger.Warn("Invalid git config override", "error", err)
+			http.Error(w, fmt.Sprintf("Invalid git_config: %v", err), http.StatusBadRequest)
+			return
+		}
+		gitConfig := append(append([]string{}, svc.gitConfig...), requestGitConfig...)
+
+		cloneOpts := cloneOptions{
+			Branch:       config.DefaultCloneBranch,
+			Filter:       cloneFilter,
+			SSHKeyPath:   config.SSHKeyPath,
+			GitConfig:    gitConfig,
+			Env:          append(proxyEnv(config), svc.ca.env()...),
+			Timeout:      config.CloneTimeout,
+			StallTimeout: config.CloneStallTimeout,
+			MaxSize:      config.MaxCloneSize,
+		}
+
+		// Authenticate private repositories with the token, for every git
+		// command talking to the remote
+		if req.GitToken != "" {
+			if isSSHRepoURL(repoURL) {
+				http.Error(w, "git_token requires an HTTPS repository URL", http.StatusBadRequest)
+				return
+			}
+			tokenEnv, removeAskpass, err := gitTokenEnvironment(req.GitToken)
+			if err != nil {
+				logger.Error("Failed to prepare git credentials", "error", err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			defer removeAskpass()
+			cloneOpts.Env = append(cloneOpts.Env, tokenEnv...)
+		}
+
+		// Follow the remote's HEAD for repositories whose default branch isn't main
+		if req.Branch != "" {
+			cloneOpts.Branch = req.Branch
+		} else if config.CloneRemoteHead {
+			branch, err := svc.refs.DefaultBranch(ctx, repoURL, cloneOpts)
+			if err != nil {
+				logger.Error("Failed to resolve the remote default branch", "error", err)
+				http.Error(w, "Failed to resolve the repository's default branch", http.StatusBadGateway)
+				return
+			}
+			logger.Info("Resolved default branch", "branch", branch)
+			cloneOpts.Branch = branch
+		}
+
+		// Fail fast when the branch doesn't exist, without paying for a clone
+		if config.VerifyRemoteRef {
+			if err := svc.refs.Verify(ctx, repoURL, cloneOpts.Branch, cloneOpts); err != nil {
+				if errors.Is(err, errRefNotFound) {
+					logger.Warn("Branch not found", "branch", cloneOpts.Branch)
+					http.Error(w, fmt.Sprintf("Branch %s not found in repository", cloneOpts.Branch), http.StatusBadRequest)
+					return
+				}
+				logger.Error("Failed to verify remote branch", "error", err)
+				http.Error(w, "Failed to verify remote branch", http.StatusBadGateway)
+				return
+			}
+		}
+
+		// Reject the build if this repository has been built too often
+		// recently. Only valid requests count, so malformed ones can't use up
+		// the quota.
+		if allowed, retryAfter := throttle.Allow(req.RepoURL); !allowed {
+			logger.Info("Throttled build", "throttled_total", throttle.Throttled())
+			w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+			http.Error(w, "Too many builds for this repository, try again later", http.StatusTooManyRequests)
+			return
+		}
 
 		// Rest of the existing buildHandler logic,
 		// passing config where needed
 		// ... (keep the existing implementation, just modify to use config)
 		// Proceed with the build logic
 		buildID := generateTimestampID()
+		noteBuildID(w, buildID)
+		logger = logger.With("build_id", buildID)
+		ctx = withLogger(ctx, logger)
+		sanitized := sanitizeBuildRequest(req)
+		svc.registry.Add(BuildRecord{
+			ID:           buildID,
+			Status:       statusQueued,
+			Platform:     req.Platform,
+			Priority:     priority.String(),
+			Repo:         sanitized.RepoURL,
+			Branch:       cloneOpts.Branch,
+			InstallFlags: installFlags,
+			Request:      &sanitized,
+			RequestID:    requestIDFromContext(r.Context()),
+			CreatedAt:    time.Now(),
+		})
+		svc.audit.Record(apiKeyFromContext(r.Context()), auditBuild, buildID+" "+sanitized.RepoURL, "accepted")
+
+		// DELETE /build/{id} cancels the build through its context
+		ctx, cancelBuild := context.WithCancelCause(ctx)
+		defer cancelBuild(nil)
+		svc.registry.SetCancel(buildID, cancelBuild)
+		defer svc.registry.SetCancel(buildID, nil)
+		if req.Async {
+			acceptAsync(w)
+		}
+		defer func() {
+			if record, ok := svc.registry.Get(buildID); ok {
+				svc.failures.Observe(record)
+				observeBuild(record)
+				if req.CallbackURL != "" {
+					svc.callbacks.Send(req.CallbackURL, record)
+				}
+			}
+		}()
+
+		// Skip the build when the same commit was already built with the same inputs
+		reuseResult := req.ReuseResult && svc.results.Enabled()
+		if reuseResult {
+			commit, err := lsRemoteCommit(ctx, repoURL, cloneOpts.Branch, cloneOpts)
+			if err != nil {
+				logger.Warn("Failed to resolve the commit to build, skipping the result cache", "error", err)
+			} else if entry, ok := svc.results.Get(resultCacheKey(commit, req.Platform, profile, req, svc.dotenvDefaults)); ok {
+				serveCachedResult(w, r.WithContext(ctx), svc, buildID, req.Platform, req.ResponseFormat, entry)
+				return
+			}
+		}
+
+		// Wait for a free build slot, or give up right away with no_wait
+		var release func()
+		if req.NoWait {
+			var ok bool
+			if release, ok = svc.queue.TryAcquire(); !ok {
+				reason := "All build slots are busy"
+				logger.Warn("Rejected build", "reason", reason)
+				svc.registry.Finish(buildID, statusFailed, reason)
+				writeQueueRejection(ctx, w, svc.queue.Info(), reason, http.StatusTooManyRequests)
+				return
+			}
+		} else if release, err = svc.queue.Acquire(ctx, priority, apiKeyFromContext(r.Context()).Name()); err != nil {
+			reason := "Timed out waiting for a build slot"
+			if errors.Is(err, errQueueFull) {
+				reason = "Build queue is full"
+			}
+			logger.Warn("Rejected build", "reason", reason, "error", err)
+			svc.registry.Finish(buildID, statusFailed, reason)
+			writeQueueRejection(ctx, w, svc.queue.Info(), reason, http.StatusServiceUnavailable)
+			return
+		}
+		defer release()
 
 		// Create a temporary directory for this build
-		tempDir, err := os.MkdirTemp("", "build-"+buildID)
+		tempDir, err := createBuildTempDir(config.TempDirPrefix, buildID)
+		if err != nil {
+			logger.Error("Failed to create temporary directory", "error", err)
+			svc.registry.Finish(buildID, statusFailed, "Failed to create temporary directory")
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		defer cleanup.Remove(ctx, tempDir) // Clean up after build
+
+		// Collect the output of git, the install and EAS in the build's own log
+		var buildLog io.Writer
+		logURL := ""
+		if file, err := createBuildLog(config, buildID); err != nil {
+			logger.Error("Failed to create build log", "error", err)
+		} else {
+			defer file.Close()
+			buildLog = file
+			cloneOpts.Log = file
+			logURL = fmt.Sprintf("/build/log/%s", buildID)
+			svc.registry.Update(buildID, func(record *BuildRecord) {
+				record.LogURL = logURL
+			})
+		}
+
+		clonePath := filepath.Join(tempDir, "repo")
+
+		// Reuse a prepared workspace for hot repositories. It's recycled after
+		// everything else registered below has been cleaned up.
+		svc.registry.SetStatus(buildID, statusCloning)
+		cloned := false
+		if ws := svc.pool.Take(req.RepoURL); ws != nil {
+			defer svc.pool.Recycle(ws)
+			if err := svc.pool.Update(ctx, ws, repoURL, cloneOpts); err != nil {
+				logger.Warn("Failed to update warm workspace, cloning instead", "error", err)
+			} else {
+				logger.Info("Using warm workspace", "workspace", ws.name)
+				clonePath, cloned = ws.path, true
+			}
+		}
+
+		// Check the repository out from its mirror, sharing the object store
+		if !cloned && svc.mirrors != nil {
+			remove, err := svc.mirrors.Checkout(ctx, repoURL, clonePath, cloneOpts)
+			if err != nil {
+				logger.Warn("Failed to check out a worktree, cloning instead", "error", err)
+				os.RemoveAll(clonePath)
+			} else {
+				defer remove()
+				cloned = true
+			}
+		}
+
+		// Clone the repository
+		if !cloned {
+			if err := cloneOrUpdateRepo(ctx, repoURL, clonePath, cloneOpts); err != nil {
+				logger.Error("Failed to clone the repository", "error", err)
+				reason, status := "Failed to clone the repository", http.StatusInternalServerError
+				buildStatus := statusFailed
+				switch {
+				case errors.Is(err, errCloneStalled):
+					reason, status = fmt.Sprintf("Failed to clone the repository: no progress for %v", cloneOpts.StallTimeout), http.StatusGatewayTimeout
+				case errors.Is(err, errCloneTimeout):
+					reason, status = fmt.Sprintf("Failed to clone the repository: exceeded clone timeout of %v", cloneOpts.Timeout), http.StatusGatewayTimeout
+				case errors.Is(err, errRepoTooLarge):
+					reason, status = fmt.Sprintf("Failed to clone the repository: exceeds maximum clone size of %d bytes", cloneOpts.MaxSize), http.StatusRequestEntityTooLarge
+					buildStatus = statusRepoTooLarge
+				default:
+					if failure, ok := classifyCloneError(err); ok {
+						reason, status = failure.Message, failure.Status
+						if failure.Code == "ref_not_found" {
+							reason = fmt.Sprintf("Branch %s not found in repository", cloneOpts.Branch)
+						}
+						w.Header().Set("X-Error-Code", failure.Code)
+						svc.registry.Update(buildID, func(record *BuildRecord) {
+							record.ErrorCode = failure.Code
+						})
+					}
+				}
+				// Keep git's own output for diagnosis, without the URL's credentials
+				detail := strings.ReplaceAll(err.Error(), repoURL, redactURLCredentials(repoURL))
+				if req.GitToken != "" {
+					detail = strings.ReplaceAll(detail, req.GitToken, redactedValue)
+				}
+				svc.registry.Update(buildID, func(record *BuildRecord) {
+					record.ErrorDetail = detail
+				})
+				svc.registry.Finish(buildID, buildStatus, reason)
+				http.Error(w, reason, status)
+				return
+			}
+		}
+
+		// Key the result by the commit actually cloned, before package path
+		// detection changes the request
+		resultKey, commit := "", ""
+		if reuseResult || len(config.PostBuildSteps) > 0 {
+			if output, err := runGit(ctx, clonePath, repoURL, cloneOpts, "rev-parse", "HEAD"); err != nil {
+				logger.Error("Failed to resolve the cloned commit", "error", err)
+			} else {
+				commit = strings.TrimSpace(output)
+			}
+		}
+		if reuseResult && commit != "" {
+			resultKey = resultCacheKey(commit, req.Platform, profile, req, svc.dotenvDefaults)
+		}
+
+		// Version the app from the repository's tags and commit count
+		var version *gitVersion
+		if config.GitVersion || req.GitVersion {
+			v, err := computeGitVersion(ctx, clonePath, repoURL, cloneOpts)
+			if err != nil {
+				logger.Error("Failed to compute the version from git", "error", err)
+				svc.registry.Finish(buildID, statusFailed, "Failed to compute the version from git")
+				http.Error(w, "Failed to compute the version from git", http.StatusInternalServerError)
+				return
+			}
+			logger.Info("Building version", "version", v.Version, "build_number", v.BuildNumber, "describe", v.Describe)
+			version = &v
+			svc.registry.Update(buildID, func(record *BuildRecord) {
+				record.Version = version
+			})
+			buildEnv = append(buildEnv, v.env()...)
+		}
+
+		// Don't let install or build scripts follow links out of the clone
+		symlinkPolicy := config.SymlinkPolicy
+		if isTrustedRepo(config, req.RepoURL) {
+			symlinkPolicy = symlinkPolicyOff
+		}
+		if err := checkCloneSymlinks(clonePath, symlinkPolicy); err != nil {
+			logger.Warn("Rejecting repository", "error", err)
+			var linkErr *symlinkError
+			if !errors.As(err, &linkErr) {
+				svc.registry.Finish(buildID, statusFailed, "Failed to scan the repository for symlinks")
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			svc.registry.Finish(buildID, statusSuspiciousSymlink, err.Error())
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+
+		// Fill in what the request leaves out from the repository's own config
+		repoCfg, err := loadRepoConfig(clonePath)
+		if err != nil {
+			logger.Error("Failed to load repository config", "error", err)
+			status := http.StatusInternalServerError
+			var cfgErr *repoConfigError
+			if errors.As(err, &cfgErr) {
+				status = http.StatusUnprocessableEntity
+			}
+			svc.registry.Finish(buildID, statusFailed, err.Error())
+			http.Error(w, err.Error(), status)
+			return
+		}
+		if req.Profile == "" && repoCfg.Profile != "" {
+			if err := checkProfileAllowed(config.AllowedEASProfiles, repoCfg.Profile); err != nil {
+				reason := fmt.Sprintf("Invalid %s: %v", repoConfigFile, err)
+				logger.Error(reason)
+				svc.registry.Finish(buildID, statusFailed, reason)
+				http.Error(w, reason, http.StatusUnprocessableEntity)
+				return
+			}
+			profile = repoCfg.Profile
+		}
+		repoCfg.mergeInto(&req)
+		if missing := repoCfg.missingEnv(req, svc.dotenvDefaults); len(missing) > 0 {
+			reason := fmt.Sprintf("Missing environment variables required by %s: %s", repoConfigFile, strings.Join(missing, ", "))
+			logger.Error(reason)
+			svc.registry.Finish(buildID, statusFailed, reason)
+			http.Error(w, reason, http.StatusUnprocessableEntity)
+			return
+		}
+
+		// Run npm install in the package directory
+		svc.registry.SetStatus(buildID, statusInstalling)
+		// Find the app when no exact package path was given
+		if isPackagePathPattern(req.PackagePath) {
+			detected, err := detectPackagePath(clonePath, req.PackagePath)
+			if err != nil {
+				logger.Error("Failed to detect package path", "error", err)
+				svc.registry.Finish(buildID, statusFailed, err.Error())
+				http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+				return
+			}
+			if detected != "" {
+				logger.Info("Detected Expo app", "path", detected)
+			}
+			req.PackagePath = detected
+		}
+		svc.registry.Update(buildID, func(record *BuildRecord) {
+			record.PackagePath = req.PackagePath
+		})
+		packagePath := filepath.Join(clonePath, req.PackagePath)
+
+		// Catch profiles that don't define the platform before paying for the install
+		platforms := []string{req.Platform}
+		if req.Platform == platformAll {
+			platforms = allPlatforms
+		}
+		for _, platform := range platforms {
+			if err := checkProfilePlatform(packagePath, profile, platform); err != nil && !errors.Is(err, errNoEASConfig) {
+				var profileErr *profileError
+				if errors.As(err, &profileErr) {
+					logger.Warn("Platform not buildable with profile", "error", err)
+					svc.registry.Finish(buildID, statusFailed, profileErr.Error())
+					http.Error(w, profileErr.Error(), http.StatusUnprocessableEntity)
+					return
+				}
+				logger.Error("Failed to check build profile", "error", err)
+			}
+		}
+
+		// Give the build a private package manager cache, removed with the temp
+		// dir, or share one between builds of the same repository. Request env
+		// comes last so it can still override the location.
+		if config.IsolatedNpmCache {
+			buildEnv = append(packageCacheEnv(filepath.Join(tempDir, "npm-cache")), buildEnv...)
+		} else if svc.caches.Enabled() {
+			cacheDir, releaseCache, err := svc.caches.Acquire(cacheNpm, cacheKeyForRepo(req.RepoURL))
+			if err != nil {
+				logger.Error("Failed to prepare dependency cache", "error", err)
+			} else {
+				defer releaseCache()
+				buildEnv = append(packageCacheEnv(cacheDir), buildEnv...)
+				if err := svc.user.grant(cacheDir); err != nil {
+					logger.Error("Failed to prepare dependency cache", "error", err)
+				}
+			}
+		}
+
+		// Let the build user write to the build directory, with its home
+		// there instead of the service user's
+		if svc.user != nil {
+			buildEnv = append([]string{"HOME=" + tempDir}, buildEnv...)
+			if err := svc.user.grant(tempDir, clonePath); err != nil {
+				logger.Error("Failed to prepare build directory", "error", err)
+				svc.registry.Finish(buildID, statusFailed, "Failed to prepare build directory")
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+		}
+		frozen := config.FrozenLockfile
+		if req.FrozenLockfile != nil {
+			frozen = *req.FrozenLockfile
+		}
+		install := runInstall
+		if frozen {
+			install = runFrozenInstall
+		}
+		// Vendored dependencies are used as committed, installing could change them
+		if skipInstall(ctx, config, req, packagePath, repoURL, cloneOpts) {
+			logger.Info("Using committed node_modules, skipping install")
+			svc.registry.Update(buildID, func(record *BuildRecord) {
+				record.InstallSkipped = true
+			})
+			install = func(context.Context, string, string, []string, []string, *buildUser, io.Writer) error { return nil }
+		}
+		// The request's or repository's package manager, else the lockfile decides
+		manager := req.PackageManager
+		if manager == "" {
+			manager = detectPackageManager(packagePath)
+		}
+		svc.registry.Update(buildID, func(record *BuildRecord) {
+			record.PackageManager = manager
+		})
+		if err := install(ctx, packagePath, manager, buildEnv, installFlags, svc.user, buildLog); err != nil {
+			var drift *lockfileDriftError
+			if errors.As(err, &drift) {
+				logger.Warn("Lockfile drift detected", "error", err)
+				svc.registry.Finish(buildID, statusLockfileDrift, drift.Error())
+				http.Error(w, drift.Error(), http.StatusConflict)
+				return
+			}
+			logger.Error("Failed to install npm dependencies", "error", err)
+			svc.registry.Finish(buildID, statusFailed, "Failed to install npm dependencies")
+			http.Error(w, "Failed to install npm dependencies", http.StatusInternalServerError)
+			return
+		}
+
+		// Check the installed dependencies for known vulnerabilities
+		if auditLevel != "" {
+			findings, err := runNpmAudit(ctx, packagePath, buildEnv, auditLevel, svc.user)
+			switch {
+			case err != nil && auditMode == auditModeFail:
+				logger.Warn("npm audit failed", "error", err)
+				svc.registry.Finish(buildID, statusAuditFailed, err.Error())
+				http.Error(w, fmt.Sprintf("Dependency audit failed: %v", err), http.StatusUnprocessableEntity)
+				return
+			case err != nil:
+				logger.Warn("npm audit failed, continuing", "error", err)
+			case len(findings) > 0:
+				svc.registry.Update(buildID, func(record *BuildRecord) {
+					record.Vulnerabilities = findings
+				})
+				summary := summarizeFindings(findings, auditLevel)
+				if auditMode == auditModeFail {
+					logger.Error("Dependency audit failed", "summary", summary)
+					svc.registry.Finish(buildID, statusAuditFailed, summary)
+					http.Error(w, "Dependency audit failed: "+summary, http.StatusUnprocessableEntity)
+					return
+				}
+				logger.Warn("Dependency audit warning", "summary", summary)
+			}
+		}
+
+		// Define the output file based on the platform and build ID
+		var outputFile, outputFilename string
+		switch req.Platform {
+		case "android":
+			outputFilename = artifactFilename(buildID, ".apk", version)
+			outputFile = outputFilename
+		case "ios":
+			outputFilename = artifactFilename(buildID, ".ipa", version)
+			outputFile = outputFilename
+		case platformAll:
+			// Every platform names its own output
+		default:
+			logger.Warn("Unsupported platform")
+			svc.registry.Finish(buildID, statusFailed, "Unsupported platform")
+			http.Error(w, "Unsupported platform", http.StatusBadRequest)
+			return
+		}
+
+		// Point EAS at a dedicated output directory to capture every file it produces
+		collectOutputs := config.CollectOutputs || req.CollectOutputs
+		outputDir := filepath.Join(tempDir, "outputs")
+		if collectOutputs {
+			if err := os.MkdirAll(outputDir, 0755); err != nil {
+				logger.Error("Failed to create output directory", "error", err)
+				svc.registry.Finish(buildID, statusFailed, "Failed to create output directory")
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			outputFile = filepath.Join(outputDir, outputFilename)
+		}
+
+		// Async builds keep their artifact for the artifact endpoint
+		minimal := wantsMinimalResponse(r) || req.Async
+
+		// Only multipart and event stream responses carry the build's output,
+		// framed apart from the artifact
+		var multipartResp *multipartResponse
+		switch {
+		case !req.Async && wantsEventStream(r):
+			// Report progress as server-sent events, ending with the result
+			sseResp, err := newSSEResponse(w, svc.events, buildID)
+			if err != nil {
+				logger.Error("Failed to start event stream response", "error", err)
+				svc.registry.Finish(buildID, statusFailed, "Failed to start event stream response")
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			defer sseResp.Close()
+			w = sseResp
+			minimal = true
+		case minimal || req.ResponseFormat == "base64" || req.Platform == platformAll:
+		case req.ResponseFormat == "multipart":
+			// Stream the EAS output as the first part and report everything
+			// from here on through the parts that follow
+			multipartResp, err = newMultipartResponse(w)
+			if err != nil {
+				logger.Error("Failed to start multipart response", "error", err)
+				svc.registry.Finish(buildID, statusFailed, "Failed to start multipart response")
+				return
+			}
+			defer multipartResp.Close()
+			w = multipartResp
+		}
+
+		// Write the .env file expected by the project for the duration of the build
+		if req.Dotenv != "" || len(svc.dotenvDefaults) > 0 {
+			dotenv, err := mergeDotenv(packagePath, svc.dotenvDefaults, req.Dotenv)
+			if err != nil {
+				logger.Warn("Invalid dotenv", "error", err)
+				svc.registry.Finish(buildID, statusFailed, "Invalid dotenv")
+				http.Error(w, fmt.Sprintf("Invalid dotenv: %v", err), http.StatusBadRequest)
+				return
+			}
+			remove, err := injectFile(ctx, packagePath, ".env", []byte(dotenv+"\n"))
+			if err != nil {
+				logger.Error("Failed to write .env", "error", err)
+				svc.registry.Finish(buildID, statusFailed, "Failed to write .env")
+				http.Error(w, "Failed to write .env", http.StatusInternalServerError)
+				return
+			}
+			defer remove()
+		}
+
+		// Drop the Firebase config files into the project for the duration of the build
+		androidFirebasePath, iosFirebasePath := firebaseFilePaths(packagePath)
+		for _, file := range []struct {
+			path     string
+			contents []byte
+		}{{androidFirebasePath, googleServices}, {iosFirebasePath, serviceInfo}} {
+			if file.contents == nil {
+				continue
+			}
+			remove, err := injectFile(ctx, packagePath, file.path, file.contents)
+			if err != nil {
+				logger.Error("Failed to inject Firebase config", "error", err)
+				svc.registry.Finish(buildID, statusFailed, "Failed to inject Firebase config")
+				http.Error(w, fmt.Sprintf("Failed to inject Firebase config: %v", err), http.StatusBadRequest)
+				return
+			}
+			defer remove()
+		}
+
+		// Write the computed version into the project for the duration of the build
+		if version != nil {
+			remove, err := patchAppVersion(ctx, packagePath, *version)
+			if err != nil {
+				logger.Error("Failed to apply the version", "error", err)
+				svc.registry.Finish(buildID, statusFailed, "Failed to apply the version")
+				http.Error(w, fmt.Sprintf("Failed to apply the version: %v", err), http.StatusUnprocessableEntity)
+				return
+			}
+			defer remove()
+		}
+
+		// Provide the signing credentials as local EAS credentials and scrub them after the build
+		if signing != nil {
+			remove, err := injectSigningCredentials(ctx, packagePath, req.Platform, profile, signing)
+			if err != nil {
+				logger.Error("Failed to inject signing credentials", "error", err)
+				svc.registry.Finish(buildID, statusFailed, fmt.Sprintf("Failed to inject signing credentials: %v", err))
+				http.Error(w, fmt.Sprintf("Failed to inject signing credentials: %v", err), http.StatusUnprocessableEntity)
+				return
+			}
+			defer remove()
+		}
+
+		// Keep EAS's working directory inside the build directory so its reports
+		// survive a failed build and can be bundled
+		buildOpts := buildOptions{ClearCache: req.ClearCache, Env: buildEnv, Profile: profile, User: svc.user, StallTimeout: config.BuildStallTimeout, Platforms: config.AllowedPlatforms}
+
+		// Files written since the install belong to the service user
+		if err := svc.user.grant(tempDir, clonePath); err != nil {
+			logger.Error("Failed to prepare build directory", "error", err)
+			svc.registry.Finish(buildID, statusFailed, "Failed to prepare build directory")
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		// Run the EAS CLI the build asked for, reporting which version it is
+		toolchain, err := resolveEASToolchain(ctx, packagePath, easVersion, buildEnv, eas, svc.user)
+		if err != nil {
+			logger.Error("Failed to resolve EAS CLI", "error", err)
+			reason := fmt.Sprintf("Failed to resolve EAS CLI: %v", err)
+			svc.registry.Finish(buildID, statusFailed, reason)
+			http.Error(w, reason, http.StatusUnprocessableEntity)
+			return
+		}
+		buildOpts.Command = toolchain.Command
+		if toolchain.Info != nil {
+			svc.registry.Update(buildID, func(record *BuildRecord) {
+				record.EASVersion = toolchain.Info.Version.String()
+			})
+		}
+
+		// Build every platform from this clone and install side by side
+		if req.Platform == platformAll {
+			multi := &multiPlatformBuild{
+				svc:         svc,
+				buildID:     buildID,
+				repo:        sanitized.RepoURL,
+				packagePath: packagePath,
+				tempDir:     tempDir,
+				profile:     profile,
+				commit:      commit,
+				prebuild:    repoCfg.Prebuild,
+				eas:         toolchain.Info,
+				version:     version,
+				opts:        buildOpts,
+			}
+			multi.log = buildLog
+			svc.registry.Update(buildID, func(record *BuildRecord) {
+				record.CacheCleared = req.ClearCache
+			})
+			svc.registry.SetStatus(buildID, statusBuilding)
+			results := multi.runAll(ctx)
+			status, reason := multiPlatformStatus(results)
+			svc.registry.Update(buildID, func(record *BuildRecord) {
+				record.Platforms = results
+				if status != statusFailed {
+					record.ArtifactURL = "/artifacts/" + buildID
+				}
+			})
+			if !claimResponse(w) {
+				minimal = true
+			}
+			svc.registry.Finish(buildID, status, reason)
+			writeMultiPlatformResult(ctx, w, buildID, results, minimal, logURL)
+			return
+		}
+
+		// Keep the EAS output so it can be fetched or embedded in the result
+		logWriters := []io.Writer{&logEventWriter{hub: svc.events, buildID: buildID}}
+		if multipartResp != nil {
+			logWriters = append(logWriters, multipartResp)
+		}
+		if buildLog != nil {
+			logWriters = append(logWriters, buildLog)
+		}
+		buildOpts.Log = io.MultiWriter(logWriters...)
+		easWorkDir := filepath.Join(tempDir, "eas-work")
+		if config.FailureBundles {
+			buildOpts.Env = append(buildOpts.Env, "EAS_LOCAL_BUILD_WORKINGDIR="+easWorkDir, "EAS_LOCAL_BUILD_SKIP_CLEANUP=1")
+		}
+		if collectOutputs {
+			buildOpts.Env = append(buildOpts.Env, "EAS_LOCAL_BUILD_ARTIFACTS_DIR="+outputDir)
+		}
+
+		// Build the app
+		svc.registry.Update(buildID, func(record *BuildRecord) {
+			record.CacheCleared = req.ClearCache
+		})
+		svc.registry.SetStatus(buildID, statusBuilding)
+		if repoCfg.Prebuild {
+			if err := runPrebuild(ctx, packagePath, req.Platform, buildOpts.Env, svc.user); err != nil {
+				logger.Error("Failed to prebuild the app", "error", err)
+				svc.registry.Finish(buildID, statusFailed, "Failed to prebuild the app")
+				http.Error(w, "Failed to prebuild the app", http.StatusInternalServerError)
+				return
+			}
+		}
+		releasePlatform, err := svc.platforms.Acquire(ctx, req.Platform)
+		if err != nil {
+			reason := fmt.Sprintf("Timed out waiting for a %s build slot", req.Platform)
+			logger.Error(reason)
+			svc.registry.Finish(buildID, statusFailed, reason)
+			http.Error(w, reason, http.StatusServiceUnavailable)
+			return
+		}
+		err = buildAppRetryingOOM(ctx, svc, buildID, toolchain.Info, packagePath, req.Platform, outputFile, buildOpts)
+		releasePlatform()
+		if err != nil {
+			logger.Error("Failed to build the app", "error", err)
+			if config.FailureBundles {
+				roots := map[string]string{
+					"repo": packagePath,
+					"eas":  filepath.Join(easWorkDir, "build", req.PackagePath),
+				}
+				bundlePath := failureBundlePath(config, buildID)
+				if err := writeFailureBundle(ctx, bundlePath, roots, config.FailureBundlePaths[req.Platform], err.Error()); err != nil {
+					logger.Error("Failed to write failure bundle", "error", err)
+				} else {
+					svc.registry.Update(buildID, func(record *BuildRecord) {
+						record.FailureBundleURL = "/build/failure/" + buildID
+					})
+				}
+			}
+			if errors.Is(err, errBuildStalled) {
+				reason := fmt.Sprintf("Failed to build the app: no output for %v, EAS is likely waiting for interactive input", buildOpts.StallTimeout)
+				svc.registry.Finish(buildID, statusInteractivePrompt, reason)
+				http.Error(w, reason, http.StatusGatewayTimeout)
+				return
+			}
+			svc.registry.Finish(buildID, statusFailed, "Failed to build the app")
+			http.Error(w, "Failed to build the app", http.StatusInternalServerError)
+			return
+		}
+
+		svc.registry.SetStatus(buildID, statusUploading)
+		builtFilePath := resolveOutputPath(packagePath, outputFile)
+
+		// Serve the primary artifact and keep the rest for separate download
+		if collectOutputs {
+			primary, extras, err := collectBuildOutputs(outputDir, req.Platform, outputFilename)
+			if err != nil {
+				logger.Error("Failed to collect build outputs", "error", err)
+				svc.registry.Finish(buildID, statusFailed, "Failed to collect build outputs")
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			builtFilePath = primary
+			urls, err := retainExtraArtifacts(config, buildID, outputDir, extras)
+			if err != nil {
+				logger.Error("Failed to retain extra build outputs", "error", err)
+			}
+			svc.registry.Update(buildID, func(record *BuildRecord) {
+				record.ExtraArtifacts = urls
+			})
+		}
+
+		// Let the configured steps re-sign, align or otherwise process the artifact
+		if len(config.PostBuildSteps) > 0 {
+			sideDir := filepath.Join(tempDir, "side-artifacts")
+			meta := postBuildMeta{
+				BuildID:  buildID,
+				Repo:     redactURLCredentials(req.RepoURL),
+				Commit:   commit,
+				Platform: req.Platform,
+				Profile:  profile,
+			}
+			transformed, err := runPostBuildSteps(ctx, config.PostBuildSteps, tempDir, builtFilePath, sideDir, meta, buildOpts.Log, svc.user)
+			if err != nil {
+				logger.Error("Failed to run post-build steps", "error", err)
+				svc.registry.Finish(buildID, statusFailed, err.Error())
+				http.Error(w, "Post-build step failed", http.StatusInternalServerError)
+				return
+			}
+			builtFilePath = transformed
+			if side, err := os.ReadDir(sideDir); err == nil && len(side) > 0 {
+				var files []string
+				for _, entry := range side {
+					if entry.Type().IsRegular() {
+						files = append(files, filepath.Join(sideDir, entry.Name()))
+					}
+				}
+				urls, err := retainExtraArtifacts(config, buildID, sideDir, files)
+				if err != nil {
+					logger.Error("Failed to retain side artifacts", "error", err)
+				}
+				svc.registry.Update(buildID, func(record *BuildRecord) {
+					record.ExtraArtifacts = append(record.ExtraArtifacts, urls...)
+				})
+			}
+		}
+
+		// EAS can exit cleanly after writing an empty or cut-off file
+		if err := checkArtifactSize(builtFilePath, config.MinArtifactSize[req.Platform]); err != nil {
+			logger.Warn("Rejecting build artifact", "error", err)
+			svc.registry.Finish(buildID, statusEmptyArtifact, err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Name the artifact after what was built, which with collect_outputs
+		// can be another format than requested
+		outputFilename = artifactFilename(buildID, artifactExt(builtFilePath), version)
+		contentType, downloadName := downloadAs(config.OutputFormats, outputFilename)
+
+		// Keep the artifact so it can be downloaded again from /artifacts/{id},
+		// also when the request timed out and nobody is waiting for it any more.
+		// The response is served from the kept copy, which the janitor leaves
+		// alone until it has been sent.
+		defer svc.downloads.Begin(buildID)()
+		result, artifactPath, err := retainBuildArtifact(svc, buildID, builtFilePath, outputFilename)
+		if err != nil {
+			logger.Error("Failed to retain artifact", "error", err)
+			svc.registry.Finish(buildID, statusFailed, "Failed to retain artifact")
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if !claimResponse(w) {
+			minimal = true
+		}
+		if minimal {
+			if req.InstallLink {
+				result.Install = publishInstallLinks(ctx, svc, buildID, req.Platform, packagePath, outputFilename)
+			}
+			svc.registry.Finish(buildID, statusSucceeded, "")
+			if resultKey != "" {
+				svc.results.Put(resultKey, newResultCacheEntry(config, result, contentType))
+			}
+
+			result.Status = statusSucceeded
+			result.Signature = svc.signer.Sign(result.SHA256)
+			setChecksumHeader(w, svc.signer, result.SHA256)
+			result.Platform = req.Platform
+			result.ContentType = contentType
+			if req.InlineLogKB > 0 && logURL != "" {
+				limit := min(int64(req.InlineLogKB)<<10, config.InlineLogMax)
+				if result.Log, result.LogTruncated, err = readLogTail(buildLogPath(config, buildID), limit); err != nil {
+					logger.Error("Failed to read build log", "error", err)
+				}
+				result.LogURL = logURL
+			}
+			w.Header().Set("Preference-Applied", "return=minimal")
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(result); err != nil {
+				logger.Error("Failed to write build result", "error", err)
+			}
+			return
+		}
+
+		if resultKey != "" {
+			svc.results.Put(resultKey, newResultCacheEntry(config, result, contentType))
+		}
+		if req.InstallLink {
+			if links := publishInstallLinks(ctx, svc, buildID, req.Platform, packagePath, outputFilename); links != nil {
+				w.Header().Set("X-Install-URL", links.PageURL)
+			}
+		}
+
+		svc.registry.Finish(buildID, statusSucceeded, "")
+
+		// Serve the built app
+		if multipartResp != nil {
+			if err := multipartResp.WriteArtifact(artifactPath, downloadName, contentType, svc.signer); err != nil {
+				logger.Error("Failed to send artifact part", "error", err)
+				http.Error(w, "Failed to send the artifact", http.StatusInternalServerError)
+			}
+			return
+		}
+		if req.ResponseFormat == "base64" {
+			writeBase64Artifact(ctx, w, artifactPath, downloadName, contentType, config.Base64MaxSize, svc.signer)
+			return
+		}
+
+		// Stream the file to the client
+		delivery := sendArtifact(ctx, w, artifactPath, outputFilename, downloadName, contentType, config.DownloadBufferSize, svc.signer)
+		if delivery == nil {
+			return
+		}
+		if delivery.Outcome == deliveryPartial {
+			svc.partialDeliveries.Add(1)
+		}
+		svc.registry.Update(buildID, func(record *BuildRecord) {
+			record.Delivery = delivery
+		})
+	}
+}
+
+// Send the artifact at path as the whole response body. Nothing else may
+// have been written to the response: build output only goes to the build log
+// and the event stream, so the body is exactly the artifact. Returns how much
+// of it reached the client, or nil when it couldn't be read and an error was
+// sent instead.
+func sendArtifact(ctx context.Context, w http.ResponseWriter, path, filename, downloadName, contentType string, bufferSize int64, signer *artifactSigner) *artifactDelivery {
+	logger := loggerFrom(ctx)
+	file, err := os.Open(path)
+	if err != nil {
+		logger.Error("Failed to open built file", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return nil
+	}
+	defer file.Close()
+
+	// Take the length from the open file so the header matches what is sent
+	info, err := file.Stat()
+	if err != nil {
+		logger.Error("Failed to stat built file", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return nil
+	}
+	size := info.Size()
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", downloadName))
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	checksum, err := setChecksumHeaders(w, signer, file)
+	if err != nil {
+		logger.Error("Failed to hash artifact", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return nil
+	}
+
+	// Hash what is sent as well, to catch the file changing after its
+	// checksum went out in the headers
+	sendStarted := time.Now()
+	sent := sha256.New()
+	buf := make([]byte, copyBufferSize(bufferSize, size))
+	written, err := io.CopyBuffer(w, io.TeeReader(io.LimitReader(file, size), sent), buf)
+	if err != nil {
+		logger.Error("Failed to send file to client", "error", err)
+	}
+	delivery := &artifactDelivery{Outcome: deliveryDelivered, Bytes: written, Size: size}
+	if written != size || err != nil {
+		logger.Warn("Artifact only partly sent", "file", filename, "sent_bytes", written, "bytes", size)
+		delivery.Outcome = deliveryPartial
+		if err != nil {
+			delivery.Error = err.Error()
+		}
+	} else if hex.EncodeToString(sent.Sum(nil)) != checksum {
+		logger.Warn("Artifact changed while it was sent, the client's checksum won't match", "file", filename)
+		delivery.Error = "artifact changed while it was sent"
+	}
+	elapsed := time.Since(sendStarted)
+	logger.Info("Sent artifact", "file", filename, "bytes", written, "duration", elapsed.Round(time.Millisecond).String(), "mb_per_second", float64(written)/(1<<20)/max(elapsed.Seconds(), 0.001))
+	return delivery
+}
+
+// Reject a build with the given status and the queue state, so clients can
+// back off for the suggested Retry-After instead of polling blindly
+func writeQueueRejection(ctx context.Context, w http.ResponseWriter, info queueInfo, reason string, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(max(info.RetryAfterSecs, 1)))
+	w.WriteHeader(status)
+	response := struct {
+		Error string `json:"error"`
+		queueInfo
+	}{reason, info}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		loggerFrom(ctx).Error("Failed to write queue rejection", "error", err)
+	}
+}
+
+// Build status handler returning the record of a single build
+func buildStatusHandler(svc *buildService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		record, ok := svc.registry.Get(r.PathValue("id"))
+		if !ok {
+			http.Error(w, "Build not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(record); err != nil {
+			loggerFrom(r.Context()).Error("Failed to write build status", "build_id", record.ID, "error", err)
+		}
+	}
+}
+
+// Cancel handler stopping a queued or running build. The build's processes
+// are killed and it finishes with status cancelled shortly after.
+func cancelBuildHandler(svc *buildService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		buildID := r.PathValue("id")
+		record, ok := svc.registry.Get(buildID)
+		if !ok {
+			http.Error(w, "Build not found", http.StatusNotFound)
+			return
+		}
+		if record.Finished() || !svc.registry.Cancel(buildID) {
+			http.Error(w, fmt.Sprintf("Build already finished with status %s", record.Status), http.StatusConflict)
+			return
+		}
+		logger := loggerFrom(r.Context()).With("build_id", buildID)
+		logger.Info("Cancelling build")
+		svc.audit.Record(apiKeyFromContext(r.Context()), auditCancel, buildID, "cancelled")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		response := struct {
+			BuildID   string `json:"build_id"`
+			Status    string `json:"status"`
+			StatusURL string `json:"status_url"`
+		}{buildID, "cancelling", "/build/status/" + buildID}
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			logger.Error("Failed to write cancel response", "error", err)
+		}
+	}
+}
+
+// Maximum and default page sizes of the build listing
+const (
+	defaultBuildListLimit = 50
+	maxBuildListLimit     = 500
+)
+
+// Build list handler returning builds filtered by repo, branch, platform,
+// status and creation time, newest first with cursor pagination
+func buildListHandler(svc *buildService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		filter := buildFilter{
+			Repo:     query.Get("repo"),
+			Branch:   query.Get("branch"),
+			Platform: query.Get("platform"),
+			Status:   query.Get("status"),
+		}
+		if filter.Platform != "" {
+			filter.Platform = normalizePlatform(filter.Platform, svc.config.PlatformAliases)
+		}
+		if since := query.Get("since"); since != "" {
+			t, err := time.Parse(time.RFC3339, since)
+			if err != nil {
+				http.Error(w, "Invalid since, expected an RFC 3339 timestamp", http.StatusBadRequest)
+				return
+			}
+			filter.Since = t
+		}
+
+		limit := defaultBuildListLimit
+		if limitStr := query.Get("limit"); limitStr != "" {
+			n, err := strconv.Atoi(limitStr)
+			if err != nil || n < 1 {
+				http.Error(w, "Invalid limit", http.StatusBadRequest)
+				return
+			}
+			limit = min(n, maxBuildListLimit)
+		}
+
+		builds, next, err := svc.registry.List(filter, query.Get("cursor"), limit)
+		if err != nil {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		response := struct {
+			Builds     []BuildRecord `json:"builds"`
+			NextCursor string        `json:"next_cursor,omitempty"`
+		}{builds, next}
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			loggerFrom(r.Context()).Error("Failed to write build list", "error", err)
+		}
+	}
+}
+
+// Artifact handler serving the retained artifact of a build
+func artifactHandler(svc *buildService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		record, ok := svc.registry.Get(r.PathValue("id"))
+		if !ok || record.ArtifactURL == "" {
+			http.Error(w, "Artifact not found", http.StatusNotFound)
+			return
+		}
+		defer svc.downloads.Begin(record.ID)()
+		path, err := findArtifact(svc.config, record.ID, r.URL.Query().Get("platform"))
+		if err != nil {
+			http.Error(w, "Artifact not found", http.StatusNotFound)
+			return
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			http.Error(w, "Artifact not found", http.StatusNotFound)
+			return
+		}
+		defer file.Close()
+		info, err := file.Stat()
 		if err != nil {
-			log.Println("Failed to create temporary directory:", err)
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 			return
 		}
-		defer func(path string) {
-			err := os.RemoveAll(path)
-			if err != nil {
-				log.Printf("Failed to clean up temporary directory %s: %v", path, err)
-			}
-		}(tempDir) // Clean up after build
-
-		clonePath := filepath.Join(tempDir, "repo")
-
-		// Clone the repository
-		if err := cloneOrUpdateRepo(ctx, req.RepoURL, clonePath); err != nil {
-			log.Println("Failed to clone the repository:", err)
-			http.Error(w, "Failed to clone the repository", http.StatusInternalServerError)
+		if _, err := setChecksumHeaders(w, svc.signer, file); err != nil {
+			loggerFrom(r.Context()).Error("Failed to hash artifact", "build_id", record.ID, "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 			return
 		}
+		setFileETag(w, info)
+		contentType, filename := downloadAs(svc.config.OutputFormats, filepath.Base(path))
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filename))
+		http.ServeContent(w, r, filepath.Base(path), info.ModTime(), file)
+	}
+}
 
-		// Run npm install in the package directory
-		packagePath := filepath.Join(clonePath, req.PackagePath)
-		if err := runNpmInstall(ctx, packagePath); err != nil {
-			log.Println("Failed to install npm dependencies:", err)
-			http.Error(w, "Failed to install npm dependencies", http.StatusInternalServerError)
+// Extra artifact handler serving additional files produced by a build
+func extraArtifactHandler(svc *buildService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		buildID, name := r.PathValue("id"), r.PathValue("name")
+		if strings.ContainsAny(buildID+name, `/\`) || buildID == ".." || name == ".." {
+			http.Error(w, "Invalid artifact name", http.StatusBadRequest)
+			return
+		}
+		defer svc.downloads.Begin(buildID)()
+		path := filepath.Join(extraArtifactDir(svc.config, buildID), name)
+		info, err := os.Stat(path)
+		if err != nil {
+			http.Error(w, "Artifact not found", http.StatusNotFound)
 			return
 		}
+		setFileETag(w, info)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", name))
+		http.ServeFile(w, r, path)
+	}
+}
 
-		// Define the output file based on the platform and build ID
-		var outputFile, contentType, outputFilename string
-		switch req.Platform {
-		case "android":
-			outputFilename = fmt.Sprintf("app-%s.apk", buildID)
-			outputFile = outputFilename
-			contentType = "application/vnd.android.package-archive"
-		case "ios":
-			outputFilename = fmt.Sprintf("app-%s.ipa", buildID)
-			outputFile = outputFilename
-			contentType = "application/octet-stream"
-		default:
-			log.Println("Unsupported platform:", req.Platform)
-			http.Error(w, "Unsupported platform", http.StatusBadRequest)
+// Failure bundle handler serving the debugging zip of a failed build
+func failureBundleHandler(svc *buildService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		buildID := r.PathValue("id")
+		if strings.ContainsAny(buildID, `/\`) || buildID == ".." {
+			http.Error(w, "Invalid build ID", http.StatusBadRequest)
 			return
 		}
+		bundlePath := failureBundlePath(svc.config, buildID)
+		info, err := os.Stat(bundlePath)
+		if err != nil {
+			http.Error(w, "Failure bundle not found", http.StatusNotFound)
+			return
+		}
+		setFileETag(w, info)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filepath.Base(bundlePath)))
+		w.Header().Set("Content-Type", "application/zip")
+		http.ServeFile(w, r, bundlePath)
+	}
+}
 
-		// Tail the log file
-		done := make(chan struct{})
-		go tailLogFile(w, "/home/server/expo-build-service/logs/server.log", done)
+// Stats handler reporting the current load of the build queue
+func statsHandler(svc *buildService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stats := map[string]any{
+			"running":       svc.queue.Running(),
+			"queued":        svc.queue.Waiting(),
+			"queued_by_key": svc.queue.WaitingByKey(),
+			// Build responses whose artifact didn't reach the client in full
+			"partial_deliveries": svc.partialDeliveries.Load(),
+			// Repositories whose latest builds all failed, with the length of the streak
+			"consecutive_failures": svc.failures.Counts(),
+		}
+		if svc.caches.Enabled() {
+			stats["cache_size_bytes"] = svc.caches.TotalSize()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(stats); err != nil {
+			loggerFrom(r.Context()).Error("Failed to write stats", "error", err)
+		}
+	}
+}
 
-		// Build the app
-		if err := buildApp(ctx, packagePath, req.Platform, outputFile); err != nil {
-			log.Println("Failed to build the app:", err)
-			http.Error(w, "Failed to build the app", http.StatusInternalServerError)
-			close(done)
+// Cache list handler reporting every cache entry with its size and last use
+func cacheListHandler(svc *buildService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !svc.caches.Enabled() {
+			http.Error(w, "Caching is not enabled", http.StatusNotFound)
 			return
 		}
+		caches, total := svc.caches.List()
+		response := map[string]any{"caches": caches, "total_size_bytes": total}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			loggerFrom(r.Context()).Error("Failed to write cache list", "error", err)
+		}
+	}
+}
 
-		// Serve the built app
-		builtFilePath := filepath.Join(packagePath, outputFile)
-		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", outputFilename))
-		w.Header().Set("Content-Type", contentType)
-		w.Header().Set("Content-Length", fmt.Sprintf("%d", fileSize(builtFilePath)))
-
-		// Stream the file to the client
-		file, err := os.Open(builtFilePath)
-		if err != nil {
-			log.Println("Failed to open built file:", err)
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			close(done)
+// Cache eviction handler removing a single entry, or all idle entries of a
+// cache when no key is given
+func cacheEvictHandler(svc *buildService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := apiKeyFromContext(r.Context())
+		action, target := auditCacheClear, r.PathValue("cache")
+		if r.PathValue("key") != "" {
+			action, target = auditCacheEvict, target+"/"+r.PathValue("key")
+		}
+		if !key.HasScope(scopeCacheAdmin) {
+			svc.audit.Record(key, action, target, "denied: missing cache_admin scope")
+			http.Error(w, "Evicting caches requires the cache_admin scope", http.StatusForbidden)
 			return
 		}
-		defer func(file *os.File) {
-			err := file.Close()
-			if err != nil {
 
+		cache, entry := r.PathValue("cache"), r.PathValue("key")
+		logger := loggerFrom(r.Context()).With("cache", cache)
+		response := map[string]any{"cache": cache}
+		if entry != "" {
+			err := svc.caches.Evict(cache, entry)
+			if err != nil {
+				svc.audit.Record(key, action, target, "failed: "+err.Error())
+			} else {
+				svc.audit.Record(key, action, target, "evicted")
 			}
-		}(file)
-
-		if _, err := io.Copy(w, file); err != nil {
-			log.Println("Failed to send file to client:", err)
+			switch {
+			case errors.Is(err, errCacheNotFound):
+				http.Error(w, "Cache entry not found", http.StatusNotFound)
+				return
+			case errors.Is(err, errCacheInUse):
+				http.Error(w, "Cache entry is in use by a running build", http.StatusConflict)
+				return
+			case err != nil:
+				logger.Error("Failed to evict cache entry", "entry", entry, "error", err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			logger.Info("Evicted cache entry", "entry", entry)
+			response["evicted"] = []string{entry}
+		} else {
+			evicted, skipped, err := svc.caches.Clear(cache)
+			if err != nil {
+				svc.audit.Record(key, action, target, "failed: "+err.Error())
+			} else {
+				svc.audit.Record(key, action, target, fmt.Sprintf("%d evicted, %d skipped in use", len(evicted), len(skipped)))
+			}
+			if errors.Is(err, errCacheNotFound) {
+				http.Error(w, "Cache not found", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				logger.Error("Failed to clear cache", "error", err)
+			}
+			logger.Info("Cleared cache", "evicted", len(evicted), "in_use", len(skipped))
+			response["evicted"], response["skipped_in_use"] = evicted, skipped
 		}
 
-		// Stop tailing the log file
-		close(done)
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			logger.Error("Failed to write cache eviction result", "error", err)
+		}
 	}
 }
 
-func updateHandler(config Config) http.HandlerFunc {
+func updateHandler(config Config, audit *auditLogger, lockout *authLockout) http.HandlerFunc {
+	// The update endpoint has its own token rather than an API key
+	updateKey := &apiKey{Label: "update"}
 	return func(w http.ResponseWriter, r *http.Request) {
+		logger := loggerFrom(r.Context())
+
 		// Authenticate the request
-		token := r.Header.Get("Authorization")
-		expectedToken := os.Getenv("UPDATE_AUTH_TOKEN")
-		if token != "Bearer "+expectedToken {
-			log.Println("Unauthorized access attempt")
+		if !lockout.Check(w, r) {
+			return
+		}
+		if !bearerTokenMatches(r, os.Getenv("UPDATE_AUTH_TOKEN")) {
+			logger.Warn("Unauthorized update attempt", "client_ip", clientIP(r))
+			audit.Record(nil, auditUpdate, config.UpdateScriptPath, "denied: invalid token")
+			lockout.Fail(r)
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
+		lockout.Succeed(r)
+
+		// Only one update may run at a time
+		unlock, err := lockUpdate(config.UpdateLockFile)
+		if errors.Is(err, errUpdateRunning) {
+			logger.Warn("Update rejected: another update is running")
+			audit.Record(updateKey, auditUpdate, config.UpdateScriptPath, "rejected: already running")
+			http.Error(w, "An update is already running", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			logger.Error("Failed to lock update", "error", err)
+			audit.Record(updateKey, auditUpdate, config.UpdateScriptPath, "failed: "+err.Error())
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		audit.Record(updateKey, auditUpdate, config.UpdateScriptPath, "started")
 
 		// Rest of the existing updateHandler logic
 		// Use config.UpdateScriptPath instead of hardcoded path
 		go func() {
+			// Released however the script exits
+			defer unlock()
 			cmd := exec.Command(config.UpdateScriptPath)
 			output, err := cmd.CombinedOutput()
 			if err != nil {
-				log.Printf("Update failed: %v\nOutput: %s", err, string(output))
+				logger.Error("Update failed", "error", err, "output", string(output))
 			} else {
-				log.Println("Update completed successfully.")
+				logger.Info("Update completed successfully")
 			}
 		}()
 
@@ -223,41 +2036,216 @@ func updateHandler(config Config) http.HandlerFunc {
 }
 
 func main() {
-	// Load configuration
+	// Load configuration, refusing to start with a dangerous or broken one
 	config := loadConfig()
+	if err := config.Validate(); err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
 
 	// Initialize logging with config
 	initLogging(config)
+	if config.LogConfig {
+		logEffectiveConfig(config)
+	}
+	if !config.hasAuthToken() {
+		log.Println("WARNING: ALLOW_NO_AUTH is set and no AUTH_TOKEN or API_KEYS are configured, the API is open to anyone")
+	}
 
+	// Request contexts derive from baseCtx so shutdown can cancel running builds
+	baseCtx, cancelBuilds := context.WithCancel(context.Background())
+	defer cancelBuilds()
 	srv := &http.Server{
-		Addr: "0.0.0.0:" + config.ServerPort,
+		Addr:        "0.0.0.0:" + config.ServerPort,
+		BaseContext: func(net.Listener) context.Context { return baseCtx },
+	}
+
+	// Serve over TLS when a certificate is configured
+	useTLS := config.TLSCertFile != "" && config.TLSKeyFile != ""
+	if useTLS {
+		tlsConfig, err := buildTLSConfig(config)
+		if err != nil {
+			log.Fatalf("Invalid TLS configuration: %v", err)
+		}
+		srv.TLSConfig = tlsConfig
+	}
+
+	gitConfig, err := parseGitConfig(config.GitConfig, config.GitConfigCommands)
+	if err != nil {
+		log.Fatalf("Invalid GIT_CONFIG_OVERRIDES: %v", err)
+	}
+	user, err := newBuildUser(config.BuildUID, config.BuildGID)
+	if err != nil {
+		log.Fatalf("Invalid BUILD_UID or BUILD_GID: %v", err)
+	}
+	signer, err := loadArtifactSigner(config.SigningKeyFile)
+	if err != nil {
+		log.Fatalf("Invalid ARTIFACT_SIGNING_KEY: %v", err)
+	}
+	audit, err := newAuditLogger(config.AuditLogFile, config.AuditHashChain)
+	if err != nil {
+		log.Fatalf("Failed to open audit log: %v", err)
 	}
 
 	// Register handlers with config
-	http.HandleFunc("/build", authenticate(buildHandler(config)))
-	http.HandleFunc("/update", updateHandler(config))
-	http.HandleFunc("/health", healthHandler)
+	// Detect the EAS CLI so build flags match what the installed version supports
+	var eas *easInfo
+	if config.EASVersionCheck {
+		var err error
+		eas, err = detectEASVersion(context.Background())
+		if err != nil {
+			log.Fatalf("Incompatible EAS CLI: %v", err)
+		}
+		log.Printf("Detected EAS CLI %s", eas.Version)
+		if eas.Version[0] > maxTestedEASMajor {
+			log.Printf("EAS CLI %s is newer than the latest tested major version %d", eas.Version, maxTestedEASMajor)
+		}
+	}
+
+	dotenvDefaults, err := loadDefaultDotenv(config.DefaultDotenvFile)
+	if err != nil {
+		log.Fatalf("Invalid DEFAULT_DOTENV_FILE: %v", err)
+	}
+	presets, err := loadBuildPresets(config.BuildPresetsFile)
+	if err != nil {
+		log.Fatalf("Invalid BUILD_PRESETS_FILE: %v", err)
+	}
+	installs, err := newInstallLinker(config)
+	if err != nil {
+		log.Fatalf("Invalid PUBLIC_BASE_URL: %v", err)
+	}
+	caBundle, err := loadCABundle(config.CABundleFile)
+	if err != nil {
+		log.Fatalf("Invalid CA_BUNDLE_FILE: %v", err)
+	}
+	defer caBundle.Close()
+	caBundle.trustForHTTP()
+
+	var publisher eventPublisher
+	if config.EventQueueURL != "" {
+		if publisher, err = newEventPublisher(config.EventQueueURL, config.EventQueueStream); err != nil {
+			log.Fatalf("Invalid EVENT_QUEUE_URL: %v", err)
+		}
+	}
+	eventQueue := newEventQueue(publisher)
+	events := newEventHub(config.MaxEventSubscribers, eventQueue)
+	svc := &buildService{
+		config:         config,
+		dotenvDefaults: dotenvDefaults,
+		presets:        presets,
+		throttle:       newRepoThrottle(config.RepoThrottleLimit, config.RepoThrottleWindow),
+		eas:            eas,
+		cleanup:        newCleanupQueue(config.CleanupConcurrency),
+		queue:          newBuildQueue(config.MaxConcurrent, config.MaxQueued, config.PriorityAging, config.APIKeyWeights),
+		registry:       newBuildRegistry(config.MaxBuildRecords, config.BuildRecordTTL, events),
+		events:         events,
+		refs:           newRefChecker(config.RefCacheTTL),
+		caches:         newCacheManager(config.CacheDir),
+		gitConfig:      gitConfig,
+		audit:          audit,
+		signer:         signer,
+		user:           user,
+		results:        newResultCache(config.ResultCacheTTL, config.ResultCacheSize),
+		failures:       newFailureTracker(config.FailureAlertThreshold, webhookFailureAlert(config)),
+		installs:       installs,
+		callbacks:      newCallbackSender(config),
+		downloads:      newDownloadTracker(),
+		platforms:      newPlatformLimiter(config.MaxConcurrentPlatform),
+		ca:             caBundle,
+	}
+	svc.mirrors = newMirrorStore(svc.caches, config.CloneWorktrees, svc.user)
+	svc.pool = newWarmPool(svc.caches, config.WarmPoolRepos, config.WarmPoolSize, cloneOptions{
+		Branch:     config.DefaultCloneBranch,
+		SSHKeyPath: config.SSHKeyPath,
+		GitConfig:  gitConfig,
+		Env:        append(proxyEnv(config), caBundle.env()...),
+
+		Timeout:      config.CloneTimeout,
+		StallTimeout: config.CloneStallTimeout,
+		MaxSize:      config.MaxCloneSize,
+	})
+
+	proxies, err := parseTrustedProxies(config.TrustedProxies)
+	if err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
+	lockout := newAuthLockout(config.AuthLockoutThreshold, config.AuthLockoutBase, config.AuthLockoutMax, svc.audit, proxies)
+	limiter := newRateLimiter(config.RateLimitPerMinute, config.RateLimitBurst, config.RateLimitKey, proxies)
+	drain := &buildDrain{}
+	build := authenticateWithLockout(config, lockout, limiter.Limit(withBackgroundBuilds(config, baseCtx, drain.Track(buildHandler(svc)))))
+	registerRoutes(http.DefaultServeMux, svc, lockout, build)
+	startArtifactJanitor(config, svc.downloads)
+
+	idle := newIdleMonitor(config.IdleShutdown, svc.queue)
+	srv.Handler = idle.Wrap(withRequestID(http.DefaultServeMux))
+
+	// Listen with TCP keepalive so idle connections of long downloads over the WAN stay up
+	listenConfig := net.ListenConfig{KeepAlive: config.TCPKeepAlive}
+	listener, err := listenConfig.Listen(context.Background(), "tcp", srv.Addr)
+	if err != nil {
+		log.Fatalf("Failed to listen on %s: %v", srv.Addr, err)
+	}
 
 	// Start the server
 	go func() {
-		log.Printf("Server started at :%s", config.ServerPort)
-		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("Server started at :%s (TLS: %t)", config.ServerPort, useTLS)
+		var err error
+		if useTLS {
+			err = srv.ServeTLS(listener, config.TLSCertFile, config.TLSKeyFile)
+		} else {
+			err = srv.Serve(listener)
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
 			log.Fatalf("Server failed: %v", err)
 		}
 	}()
 
-	// Graceful shutdown logic remains the same
+	// SIGTERM (e.g. from Kubernetes) drains running builds, while SIGINT
+	// (Ctrl-C) exits quickly and optionally cancels them
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
-	<-quit
-	log.Println("Shutting down server...")
+	var sig os.Signal
+	select {
+	case sig = <-quit:
+	case <-idle.Idle():
+		log.Printf("No builds or requests for %v, shutting down", config.IdleShutdown)
+	}
+
+	timeout := config.DrainTimeout
+	if sig == os.Interrupt {
+		timeout = config.InterruptTimeout
+		if config.InterruptCancels {
+			log.Printf("Received %v, cancelling running builds and shutting down within %v", sig, timeout)
+			cancelBuilds()
+		} else {
+			log.Printf("Received %v, shutting down within %v", sig, timeout)
+		}
+	} else if sig != nil {
+		log.Printf("Received %v, draining running builds for up to %v", sig, timeout)
+	}
+
+	// Keep serving status and artifact requests while the builds finish, but
+	// answer new builds with 503. Builds still running at the deadline are
+	// cancelled, killing their processes, and given a moment to exit.
+	deadline := time.Now().Add(timeout)
+	if !drain.Drain(deadline) {
+		log.Printf("Builds still running after %v, cancelling them", timeout)
+		cancelBuilds()
+		if !drain.Drain(time.Now().Add(buildReapTimeout)) {
+			log.Printf("Builds still running %v after cancelling them, exiting anyway", buildReapTimeout)
+		}
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
 	defer cancel()
 	if err := srv.Shutdown(ctx); err != nil {
-		log.Fatalf("Server forced to shutdown: %v", err)
+		log.Printf("Requests still running after %v, closing them: %v", timeout, err)
+		srv.Close()
 	}
 
+	// Let pending temporary directory deletions finish
+	svc.cleanup.Wait()
+	eventQueue.Close()
+
 	log.Println("Server exiting")
 }
 
@@ -274,63 +2262,229 @@ func initLogging(config Config) {
 		}
 	}
 
+	// Log to the console instead of the file during local development
+	if config.LogFormat == logFormatConsole {
+		slog.SetDefault(slog.New(newLogHandler(config.LogFormat, os.Stderr)))
+		return
+	}
+
 	// Open log file in append mode, create if not exists
 	file, err := os.OpenFile(logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		log.Fatalf("Failed to open log file %s: %v", logFile, err)
 	}
 
-	// Set log output to the file
-	log.SetOutput(file)
+	// Log JSON lines to the file, package log included
+	slog.SetDefault(slog.New(newLogHandler(config.LogFormat, file)))
+}
+
+// Register the endpoints of the service. Method patterns make the mux answer
+// other methods with 405 and an Allow header, and GET patterns also serve HEAD.
+// build is the fully wrapped POST /build handler.
+func registerRoutes(mux *http.ServeMux, svc *buildService, lockout *authLockout, build http.HandlerFunc) {
+	config := svc.config
+	mux.HandleFunc("POST /build", build)
+	mux.HandleFunc("GET /build/status/{id}", authenticate(config, buildStatusHandler(svc)))
+	mux.HandleFunc("DELETE /build/{id}", authenticate(config, cancelBuildHandler(svc)))
+	mux.HandleFunc("GET /builds", authenticate(config, buildListHandler(svc)))
+	mux.HandleFunc("GET /build/log/{id}", authenticate(config, buildLogHandler(svc)))
+	mux.HandleFunc("GET /build/events/{id}", authenticate(config, buildEventsHandler(svc)))
+	mux.HandleFunc("GET /build/failure/{id}", authenticate(config, failureBundleHandler(svc)))
+	mux.HandleFunc("GET /artifacts/{id}", authenticate(config, artifactHandler(svc)))
+	mux.HandleFunc("GET /artifacts/{id}/extras/{name}", authenticate(config, extraArtifactHandler(svc)))
+	mux.HandleFunc("GET /stats", authenticate(config, statsHandler(svc)))
+	mux.HandleFunc("GET /caches", authenticate(config, cacheListHandler(svc)))
+	mux.HandleFunc("DELETE /caches/{cache}", authenticate(config, cacheEvictHandler(svc)))
+	mux.HandleFunc("DELETE /caches/{cache}/{key}", authenticate(config, cacheEvictHandler(svc)))
+	mux.HandleFunc("POST /update", updateHandler(config, svc.audit, lockout))
 
-	// Set log flags to include date and time
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	// Install links carry their own token instead of an API key
+	if svc.installs != nil {
+		mux.HandleFunc("GET /install/{id}/{token}", installPageHandler(svc.installs))
+		mux.HandleFunc("GET /install/{id}/{token}/qr.png", installQRCodeHandler(svc.installs))
+		mux.HandleFunc("GET /install/{id}/{token}/artifact", installArtifactHandler(svc.installs, svc.downloads))
+		mux.HandleFunc("GET /install/{id}/{token}/manifest.plist", installManifestHandler(svc.installs))
+	}
+	mux.HandleFunc("GET /health", healthHandler)
+	mux.HandleFunc("GET /metrics", metricsHandler(config, svc.queue))
+	mux.HandleFunc("GET /.well-known/artifact-signing-key", signingKeyHandler(svc.signer))
+	mux.HandleFunc("GET /version", versionHandler(svc.eas))
 }
 
 // Health check handler
 func healthHandler(w http.ResponseWriter, _ *http.Request) {
+	writeBody(w, "text/plain; charset=utf-8", []byte("Server is up and running.\n"))
+}
+
+// Version handler reporting the service and detected EAS CLI versions
+func versionHandler(eas *easInfo) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp := map[string]string{"version": version}
+		if eas != nil {
+			resp["eas_version"] = eas.Version.String()
+			resp["eas_version_raw"] = eas.Raw
+		}
+		body, err := json.Marshal(resp)
+		if err != nil {
+			loggerFrom(r.Context()).Error("Failed to encode version response", "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		writeBody(w, "application/json", append(body, '\n'))
+	}
+}
+
+// Write a complete response body with its length, so HEAD requests, which
+// discard the body, get the same headers as GET
+func writeBody(w http.ResponseWriter, contentType string, body []byte) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
 	w.WriteHeader(http.StatusOK)
-	_, err := fmt.Fprintln(w, "Server is up and running.")
-	if err != nil {
-		return
+	w.Write(body)
+}
+
+// Prepare a response whose length isn't known until it has been written, such
+// as an archive built while it's sent. Any Content-Length is dropped so the
+// body is sent chunked instead of cut off at a wrong length. The returned
+// function pushes what has been written so far to the client.
+func startStreaming(w http.ResponseWriter) func() error {
+	w.Header().Del("Content-Length")
+	rc := http.NewResponseController(w)
+	return func() error {
+		if err := rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			return err
+		}
+		return nil
 	}
 }
 
 // Authentication middleware
-func authenticate(next http.HandlerFunc) http.HandlerFunc {
+func authenticate(config Config, next http.HandlerFunc) http.HandlerFunc {
+	return authenticateWithLockout(config, nil, next)
+}
+
+// Report whether the request's Authorization header is "Bearer <token>",
+// in constant time so the comparison doesn't reveal how much of a guess was
+// right. An empty token never matches.
+func bearerTokenMatches(r *http.Request, token string) bool {
+	if token == "" {
+		return false
+	}
+	received := []byte(r.Header.Get("Authorization"))
+	return subtle.ConstantTimeCompare(received, []byte("Bearer "+token)) == 1
+}
+
+// Authenticate like authenticate, locking out clients that keep failing
+func authenticateWithLockout(config Config, lockout *authLockout, next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		token := r.Header.Get("Authorization")
-		expectedToken := os.Getenv("AUTH_TOKEN")
-		// Log the tokens for debugging
-		log.Printf("Received token: %s", token)
-		log.Printf("Expected token: Bearer %s", expectedToken)
-		if token != "Bearer "+expectedToken {
-			log.Println("Unauthorized access attempt")
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		if !lockout.Check(w, r) {
+			return
+		}
+		for i := range config.APIKeys {
+			key := &config.APIKeys[i]
+			if bearerTokenMatches(r, key.Token) {
+				lockout.Succeed(r)
+				next(w, r.WithContext(withAPIKey(r.Context(), key)))
+				return
+			}
+		}
+		// Without any token, ALLOW_NO_AUTH lets everyone act as AUTH_TOKEN
+		if config.AllowNoAuth && !config.hasAuthToken() {
+			next(w, r.WithContext(withAPIKey(r.Context(), &config.APIKeys[0])))
 			return
 		}
-		next(w, r)
+		loggerFrom(r.Context()).Warn("Unauthorized access attempt", "client_ip", clientIP(r))
+		lockout.Fail(r)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 	}
 }
 
-func buildApp(ctx context.Context, packagePath, platform, outputFile string) error {
+// buildOptions tunes how EAS is invoked
+type buildOptions struct {
+	Env        []string  // Extra environment variables for the EAS process
+	ClearCache bool      // Build without cached dependencies
+	Profile    string    // EAS build profile, EAS's default when empty
+	Log        io.Writer // Receives the EAS output as it is produced
+	Command    []string  // EAS CLI command, "eas" when empty
+	Platforms  []string  // Platforms that may be built, from ALLOWED_PLATFORMS
+	User       *buildUser
+	// StallTimeout fails the build with errBuildStalled when EAS writes no
+	// output for this long, disabled when 0
+	StallTimeout time.Duration
+}
+
+// Environment keeping expo and EAS from prompting for input. Nobody could
+// answer, so the build would only hang.
+var nonInteractiveEnv = []string{"CI=1"}
+
+func buildApp(ctx context.Context, eas *easInfo, packagePath, platform, outputFile string, opts buildOptions) error {
+	defer observeStage(stageBuild, time.Now())
 	// Validate the platform
-	validPlatforms := map[string]bool{"android": true, "ios": true}
-	if !validPlatforms[platform] {
+	if !slices.Contains(opts.Platforms, platform) {
 		return fmt.Errorf("unsupported platform: %s", platform)
 	}
 
 	// Build the app using EAS CLI
-	buildCmd := exec.CommandContext(ctx, "eas", "build", "--platform", platform, "--local", "--output", outputFile)
+	args := []string{"build", "--platform", platform, "--local", "--non-interactive"}
+	if opts.Profile != "" {
+		args = append(args, "--profile", opts.Profile)
+	}
+	if eas.Supports("--output") {
+		args = append(args, "--output", outputFile)
+	}
+	if opts.ClearCache {
+		if eas.Supports("--clear-cache") {
+			args = append(args, "--clear-cache")
+		} else {
+			// Older EAS versions can't clear caches themselves, drop the bundler caches instead
+			loggerFrom(ctx).Info("EAS CLI does not support --clear-cache, removing node_modules/.cache instead")
+			if err := os.RemoveAll(filepath.Join(packagePath, "node_modules", ".cache")); err != nil {
+				return fmt.Errorf("error clearing cache: %v", err)
+			}
+		}
+	}
+	command := opts.Command
+	if len(command) == 0 {
+		command = []string{"eas"}
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	buildCmd := exec.CommandContext(ctx, command[0], append(command[1:], args...)...)
+	killProcessGroupOnCancel(buildCmd)
 	buildCmd.Dir = packagePath
-	buildCmd.Env = os.Environ() // Inherit the environment
+	buildCmd.Env = append(append(os.Environ(), nonInteractiveEnv...), opts.Env...) // Inherit the environment
+	opts.User.apply(buildCmd)
+
+	var output bytes.Buffer
+	var stdout io.Writer = &output
+	if opts.Log != nil {
+		stdout = io.MultiWriter(&output, opts.Log)
+	}
+	progress := newProgressWriter(stdout)
+	buildCmd.Stdout = progress
+	buildCmd.Stderr = progress
+	if opts.StallTimeout > 0 {
+		go watchProgress(ctx, progress, opts.StallTimeout, cancel, errBuildStalled)
+	}
+
+	startedAt := time.Now()
+	if err := buildCmd.Run(); err != nil {
+		if cause := context.Cause(ctx); errors.Is(cause, errBuildStalled) {
+			return fmt.Errorf("%w for %v, output: %s", cause, opts.StallTimeout, output.String())
+		}
+		return fmt.Errorf("error building app: %v, output: %s", err, output.String())
+	}
 
-	if output, err := buildCmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("error building app: %v, output: %s", err, string(output))
+	// Older EAS versions name the artifact themselves, so move the newest one into place
+	builtFilePath := filepath.Join(packagePath, filepath.Base(outputFile))
+	if !eas.Supports("--output") {
+		if err := moveNewestArtifact(packagePath, filepath.Ext(outputFile), startedAt, builtFilePath); err != nil {
+			return err
+		}
 	}
 
 	// Check if the built file exists
-	builtFilePath := filepath.Join(packagePath, outputFile)
+	builtFilePath = resolveOutputPath(packagePath, outputFile)
 	if _, err := os.Stat(builtFilePath); os.IsNotExist(err) {
 		return fmt.Errorf("built app file not found at %s", builtFilePath)
 	}
@@ -338,101 +2492,295 @@ func buildApp(ctx context.Context, packagePath, platform, outputFile string) err
 	return nil
 }
 
-func fileSize(filePath string) int64 {
-	info, err := os.Stat(filePath)
+// Resolve the --output value the same way EAS does, relative to the package directory
+func resolveOutputPath(packagePath, outputFile string) string {
+	if filepath.IsAbs(outputFile) {
+		return outputFile
+	}
+	return filepath.Join(packagePath, outputFile)
+}
+
+// Find the newest file with the given extension produced since startedAt and rename it to dest
+func moveNewestArtifact(dir, ext string, startedAt time.Time, dest string) error {
+	entries, err := os.ReadDir(dir)
 	if err != nil {
-		log.Println("Failed to get file size:", err)
-		return 0
+		return fmt.Errorf("error reading build directory: %v", err)
+	}
+
+	var newest string
+	var newestTime time.Time
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ext {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || info.ModTime().Before(startedAt) {
+			continue
+		}
+		if newest == "" || info.ModTime().After(newestTime) {
+			newest, newestTime = entry.Name(), info.ModTime()
+		}
+	}
+	if newest == "" {
+		return fmt.Errorf("no %s artifact produced in %s", ext, dir)
 	}
-	return info.Size()
+
+	return os.Rename(filepath.Join(dir, newest), dest)
 }
 
-// Tail the log file and send updates to the client
-func tailLogFile(w http.ResponseWriter, logFilePath string, done chan struct{}) {
-	cmd := exec.Command("tail", "-f", logFilePath)
-	stdout, err := cmd.StdoutPipe()
+// Write a small artifact as a base64-encoded JSON document
+func writeBase64Artifact(ctx context.Context, w http.ResponseWriter, path, filename, contentType string, maxSize int64, signer *artifactSigner) {
+	logger := loggerFrom(ctx)
+	info, err := os.Stat(path)
 	if err != nil {
-		log.Println("Failed to get stdout pipe:", err)
+		logger.Error("Failed to stat built file", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if size := info.Size(); size > maxSize {
+		logger.Warn("Artifact exceeds the base64 limit", "file", filename, "bytes", size, "max_bytes", maxSize)
+		http.Error(w, fmt.Sprintf("Artifact is %d bytes, which exceeds the base64 response limit of %d bytes; use the binary response format", size, maxSize), http.StatusUnprocessableEntity)
 		return
 	}
 
-	if err := cmd.Start(); err != nil {
-		log.Println("Failed to start tail command:", err)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		logger.Error("Failed to read built file", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 
-	reader := bufio.NewReader(stdout)
-	for {
-		select {
-		case <-done:
-			err := cmd.Process.Kill()
-			if err != nil {
-				return
-			}
-			return
-		default:
-			line, err := reader.ReadString('\n')
-			if err != nil {
-				time.Sleep(100 * time.Millisecond)
-				continue
-			}
-			if _, err := w.Write([]byte(line)); err != nil {
-				log.Println("Failed to send log message:", err)
-				return
-			}
-			if f, ok := w.(http.Flusher); ok {
-				f.Flush()
-			}
-		}
+	sum := sha256.Sum256(data)
+	resp := Base64ArtifactResponse{
+		Filename:    filename,
+		ContentType: contentType,
+		Size:        int64(len(data)),
+		SHA256:      hex.EncodeToString(sum[:]),
+		Data:        base64.StdEncoding.EncodeToString(data),
+	}
+	resp.Signature = signer.Sign(resp.SHA256)
+	setChecksumHeader(w, signer, resp.SHA256)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		logger.Error("Failed to send base64 artifact to client", "error", err)
+	}
+}
+
+// Size the download copy buffer, never larger than the file itself so small
+// artifacts don't allocate the full buffer
+func copyBufferSize(configured, fileSize int64) int64 {
+	size := min(configured, fileSize)
+	if size < 32<<10 {
+		size = 32 << 10 // io.Copy's default
 	}
+	return size
+}
+
+// Environment pointing the npm and yarn caches into cacheDir
+func packageCacheEnv(cacheDir string) []string {
+	return []string{"npm_config_cache=" + cacheDir, "YARN_CACHE_FOLDER=" + filepath.Join(cacheDir, "yarn")}
 }
 
-// Run npm install in the specified package directory
-func runNpmInstall(ctx context.Context, packagePath string) error {
-	installCmd := exec.CommandContext(ctx, "npm", "install")
+// Run npm install in the specified package directory, copying the output to
+// buildLog if any
+func runNpmInstall(ctx context.Context, packagePath string, env, flags []string, user *buildUser, buildLog io.Writer) error {
+	installCmd := exec.CommandContext(ctx, "npm", append([]string{"install"}, flags...)...)
+	killProcessGroupOnCancel(installCmd)
 	installCmd.Dir = packagePath
-	installCmd.Env = os.Environ() // Inherit the environment
+	installCmd.Env = append(os.Environ(), env...) // Inherit the environment
+	user.apply(installCmd)
 
-	if output, err := installCmd.CombinedOutput(); err != nil {
+	if output, err := combinedOutput(installCmd, buildLog); err != nil {
 		return fmt.Errorf("error running npm install: %v, output: %s", err, string(output))
 	}
 
 	return nil
 }
 
+// cloneOptions tunes how a repository is cloned
+type cloneOptions struct {
+	Branch     string    // Branch or tag to check out
+	Filter     string    // Partial clone filter, e.g. blob:none
+	SSHKeyPath string    // Private key used for SSH transports
+	GitConfig  []string  // key=value pairs passed with -c
+	Env        []string  // Extra environment, e.g. proxy settings
+	Log        io.Writer // Receives git's output as it is produced, if set
+
+	Timeout      time.Duration // Overall cap on the clone, none when zero
+	StallTimeout time.Duration // Abort when git reports no progress for this long
+	MaxSize      int64         // Abort when the clone grows past this many bytes, no limit when zero
+}
+
 // Clone or update the repository
-func cloneOrUpdateRepo(ctx context.Context, repoURL, clonePath string) error {
+func cloneOrUpdateRepo(ctx context.Context, repoURL, clonePath string, opts cloneOptions) error {
+	defer observeStage(stageClone, time.Now())
 	if strings.ContainsAny(repoURL, ";&") {
 		return fmt.Errorf("invalid repoURL parameter")
 	}
+	if err := validateRepoURL(repoURL); err != nil {
+		return err
+	}
 
 	// Create the parent directory if it doesn't exist
 	if err := os.MkdirAll(filepath.Dir(clonePath), 0755); err != nil {
 		return fmt.Errorf("error creating parent directory: %v", err)
 	}
 
-	// Perform a shallow clone of the main branch
-	cloneCmd := exec.CommandContext(ctx, "git", "clone", "--depth", "1", "--single-branch", "--branch", "main", repoURL, clonePath)
+	start := time.Now()
+	filter := opts.Filter
+	output, err := runGitClone(ctx, repoURL, clonePath, opts)
+	if err != nil && filter != "" && strings.Contains(output, "filter") {
+		// Some servers reject partial clone outright; retry as a plain shallow clone
+		loggerFrom(ctx).Warn("Partial clone failed, falling back to shallow clone", "filter", filter)
+		if err := os.RemoveAll(clonePath); err != nil {
+			return fmt.Errorf("error cleaning up failed clone: %v", err)
+		}
+		filter, opts.Filter = "", ""
+		output, err = runGitClone(ctx, repoURL, clonePath, opts)
+	}
+	if err != nil {
+		return fmt.Errorf("error cloning repository: %w, output: %s", err, output)
+	}
+
+	if filter != "" && strings.Contains(output, "filtering not recognized by server") {
+		loggerFrom(ctx).Warn("Server does not support the clone filter, a regular shallow clone was performed", "filter", filter)
+		filter = ""
+	}
 
-	// Set the GIT_TERMINAL_PROMPT environment variable to prevent interactive prompts
-	cloneCmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	// Log the size of the object store as an approximation of the data transferred
+	transferred := dirSize(filepath.Join(clonePath, ".git"))
+	loggerFrom(ctx).Info("Cloned repository", "duration", time.Since(start).Round(time.Millisecond).String(), "transferred_bytes", transferred, "filter", filter)
+
+	return nil
+}
+
+// Run a shallow clone of the main branch, optionally with a partial clone filter.
+// The clone is aborted when git stops reporting progress for StallTimeout, or
+// when it takes longer than Timeout overall, even if still progressing.
+func runGitClone(ctx context.Context, repoURL, clonePath string, opts cloneOptions) (string, error) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	if opts.Timeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeoutCause(ctx, opts.Timeout, errCloneTimeout)
+		defer cancelTimeout()
+	}
+
+	args := gitArgs(opts, "clone", "--progress", "--depth", "1", "--single-branch", "--branch", opts.Branch)
+	if opts.Filter != "" {
+		args = append(args, "--filter="+opts.Filter)
+	}
+	args = append(args, "--", repoURL, clonePath)
+	cloneCmd := exec.CommandContext(ctx, "git", args...)
+	killProcessGroupOnCancel(cloneCmd)
+	cloneCmd.Env = gitEnv(repoURL, opts)
 
-	// Use a buffer to capture output
+	// Use a buffer to capture output, watching it for progress
 	var output bytes.Buffer
-	cloneCmd.Stdout = &output
-	cloneCmd.Stderr = &output
+	var outputWriter io.Writer = &output
+	if opts.Log != nil {
+		outputWriter = io.MultiWriter(&output, opts.Log)
+	}
+	progress := newProgressWriter(outputWriter)
+	cloneCmd.Stdout = progress
+	cloneCmd.Stderr = progress
+	if opts.StallTimeout > 0 {
+		go watchProgress(ctx, progress, opts.StallTimeout, cancel, errCloneStalled)
+	}
+	if opts.MaxSize > 0 {
+		go watchCloneSize(ctx, clonePath, opts.MaxSize, cancel)
+	}
 
-	// Run the command
+	// Run the command, checking the size once more since the checkout may
+	// have finished between two polls
 	err := cloneCmd.Run()
-	if err != nil {
-		return fmt.Errorf("error cloning repository: %v, output: %s", err, output.String())
+	if err == nil && opts.MaxSize > 0 && dirSize(clonePath) > opts.MaxSize {
+		cancel(errRepoTooLarge)
+		err = errRepoTooLarge
+	}
+	if cause := context.Cause(ctx); errors.Is(cause, errCloneStalled) {
+		err = fmt.Errorf("%w for %v", cause, opts.StallTimeout)
+	} else if errors.Is(cause, errCloneTimeout) {
+		err = fmt.Errorf("%w of %v", cause, opts.Timeout)
+	} else if errors.Is(cause, errRepoTooLarge) {
+		err = fmt.Errorf("%w of %d bytes", cause, opts.MaxSize)
 	}
+	return output.String(), err
+}
 
-	return nil
+// Environment for git commands talking to the remote
+func gitEnv(repoURL string, opts cloneOptions) []string {
+	// Set the GIT_TERMINAL_PROMPT environment variable to prevent interactive prompts
+	env := append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	env = append(env, opts.Env...)
+	if opts.SSHKeyPath != "" && isSSHRepoURL(repoURL) {
+		env = append(env, "GIT_SSH_COMMAND="+gitSSHCommand(opts.SSHKeyPath))
+	}
+	return env
+}
+
+// Branch names are passed to git, so reject anything that could be taken as
+// an option or isn't a valid ref name
+func isValidBranchName(branch string) bool {
+	if branch == "" || strings.HasPrefix(branch, "-") || strings.HasPrefix(branch, "/") ||
+		strings.HasSuffix(branch, "/") || strings.HasSuffix(branch, ".") || strings.HasSuffix(branch, ".lock") ||
+		strings.Contains(branch, "..") || strings.Contains(branch, "//") || strings.Contains(branch, "@{") {
+		return false
+	}
+	for _, c := range branch {
+		if c <= ' ' || c == 0x7f || strings.ContainsRune(";&~^:?*[\\", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// Check that a clone filter is one of the forms supported by git
+// (blob:none, blob:limit=<n>[kmg], tree:<depth>)
+func isValidCloneFilter(filter string) bool {
+	switch {
+	case filter == "blob:none":
+		return true
+	case strings.HasPrefix(filter, "blob:limit="):
+		limit := strings.TrimRight(strings.TrimPrefix(filter, "blob:limit="), "kmgKMG")
+		return limit != "" && isDigits(limit)
+	case strings.HasPrefix(filter, "tree:"):
+		depth := strings.TrimPrefix(filter, "tree:")
+		return depth != "" && isDigits(depth)
+	}
+	return false
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Calculate the total size of all regular files under a directory
+func dirSize(path string) int64 {
+	var size int64
+	_ = filepath.WalkDir(path, func(_ string, d os.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return size
 }
 
-// Generate a timestamp-based ID for builds
+// Generate a timestamp-based ID for builds. The random suffix keeps builds
+// started in the same minute apart, in this process or an earlier one.
 func generateTimestampID() string {
 	timestamp := time.Now().Format("20060102-1504") // YearMonthDay-HourMinute
-	return timestamp
+	return timestamp + "-" + randomHex(6)
 }
@@ -0,0 +1,531 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Build output produced while the artifact is downloaded goes to the build
+// log and the event stream, never into the download
+func TestArtifactDownloadIsExactlyTheFile(t *testing.T) {
+	dir := t.TempDir()
+	artifact := make([]byte, 3<<20+17)
+	rand.New(rand.NewSource(1)).Read(artifact)
+	path := filepath.Join(dir, "app.apk")
+	if err := os.WriteFile(path, artifact, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	logFile, err := os.Create(filepath.Join(dir, "build.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logFile.Close()
+
+	const buildID = "20260101-1200-0123456789ab"
+	hub := newEventHub(0, nil)
+	hub.Open(BuildRecord{ID: buildID, Platform: "android", Status: statusUploading})
+	buildLog := io.MultiWriter(&logEventWriter{hub: hub, buildID: buildID}, logFile)
+
+	handled := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(handled)
+		stop, started := make(chan struct{}), make(chan struct{})
+		var producer sync.WaitGroup
+		producer.Add(1)
+		go func() {
+			defer producer.Done()
+			for i := 0; ; i++ {
+				if i == 1 {
+					close(started)
+				}
+				select {
+				case <-stop:
+					return
+				default:
+					fmt.Fprintf(buildLog, "[%d] Compressing assets\n", i)
+				}
+			}
+		}()
+		<-started
+		// Small buffer, so the download takes many writes between log lines
+		delivery := sendArtifact(r.Context(), w, path, "app.apk", "app.apk", "application/vnd.android.package-archive", 4<<10, nil)
+		close(stop)
+		producer.Wait()
+		if delivery == nil || delivery.Outcome != deliveryDelivered || delivery.Bytes != int64(len(artifact)) {
+			t.Errorf("delivery %+v", delivery)
+		}
+	}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(body, artifact) {
+		t.Fatalf("downloaded %d bytes that differ from the %d byte artifact", len(body), len(artifact))
+	}
+	if resp.Header.Get("Content-Length") != strconv.Itoa(len(artifact)) {
+		t.Errorf("Content-Length %q", resp.Header.Get("Content-Length"))
+	}
+	sum := sha256.Sum256(artifact)
+	if resp.Header.Get(headerChecksumSHA256) != hex.EncodeToString(sum[:]) {
+		t.Errorf("checksum header %q", resp.Header.Get(headerChecksumSHA256))
+	}
+	<-handled
+	if info, err := logFile.Stat(); err != nil || info.Size() == 0 {
+		t.Error("the log producer wrote nothing during the download")
+	}
+}
+
+func TestSendArtifactMissingFile(t *testing.T) {
+	rec := httptest.NewRecorder()
+	if delivery := sendArtifact(context.Background(), rec, filepath.Join(t.TempDir(), "missing.apk"), "missing.apk", "missing.apk", "application/octet-stream", 0, nil); delivery != nil {
+		t.Errorf("delivery %+v for a missing file", delivery)
+	}
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("got %d, want 500", rec.Code)
+	}
+}
+
+func TestNormalizePlatform(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		aliases bool
+		want    string
+	}{
+		{"android", false, "android"},
+		{"Android", false, "android"},
+		{" ios ", false, "ios"},
+		{"iOS", false, "ios"},
+		{"\tALL\n", false, "all"},
+		{"apk", true, "android"},
+		{" IPA ", true, "ios"},
+		{"apk", false, "apk"},
+		{"web", true, "web"},
+	} {
+		if got := normalizePlatform(tc.in, tc.aliases); got != tc.want {
+			t.Errorf("normalizePlatform(%q, %v) = %q, want %q", tc.in, tc.aliases, got, tc.want)
+		}
+	}
+}
+
+// The build handler validates and reports the normalized platform
+func TestBuildHandlerNormalizesPlatform(t *testing.T) {
+	for _, tc := range []struct {
+		platform, want, wantBody string
+		aliases                  bool
+	}{
+		{" Android ", "android", "Invalid response_format", false},
+		{"APK", "android", "Invalid response_format", true},
+		{"apk", "apk", "Platform apk is not allowed", false},
+		{"iOS", "ios", "Platform ios is not allowed", false},
+	} {
+		t.Run(tc.platform, func(t *testing.T) {
+			svc := &buildService{config: Config{BuildTimeout: time.Minute, AllowedPlatforms: []string{"android"}, PlatformAliases: tc.aliases}}
+			// An invalid response_format stops allowed platforms before any build work
+			body := fmt.Sprintf(`{"repo_url":"https://github.com/owner/app.git","platform":%q,"response_format":"xml"}`, tc.platform)
+			rec := httptest.NewRecorder()
+			buildHandler(svc)(rec, httptest.NewRequest(http.MethodPost, "/build", strings.NewReader(body)))
+
+			if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), tc.wantBody) {
+				t.Errorf("got %d %q, want 400 containing %q", rec.Code, rec.Body.String(), tc.wantBody)
+			}
+			if got := rec.Header().Get("X-Build-Platform"); got != tc.want {
+				t.Errorf("X-Build-Platform %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+// A build rejected by a saturated queue learns the queue state and when to retry
+func TestQueueRejectionUnderSaturation(t *testing.T) {
+	q := newBuildQueue(1, 1, 0, nil)
+	release, err := q.Acquire(context.Background(), priorityNormal, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go q.Acquire(ctx, priorityNormal, "a")
+	for q.Waiting() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	q.mu.Lock()
+	q.durations = []time.Duration{90 * time.Second, 150 * time.Second}
+	q.mu.Unlock()
+
+	if _, err := q.Acquire(context.Background(), priorityNormal, "b"); err != errQueueFull {
+		t.Fatalf("got %v, want errQueueFull", err)
+	}
+	rec := httptest.NewRecorder()
+	writeQueueRejection(context.Background(), rec, q.Info(), "Build queue is full", http.StatusServiceUnavailable)
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("got %d, want 503", rec.Code)
+	}
+	// Two minutes on average, for the running build and the queued one
+	if got := rec.Header().Get("Retry-After"); got != "240" {
+		t.Errorf("Retry-After %q, want 240", got)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type %q", got)
+	}
+	var body struct {
+		Error string `json:"error"`
+		queueInfo
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	want := queueInfo{Running: 1, Queued: 1, MaxConcurrent: 1, MaxQueued: 1, AverageBuild: 120, RetryAfterSecs: 240}
+	if body.Error != "Build queue is full" || body.queueInfo != want {
+		t.Errorf("body %+v, want %+v", body, want)
+	}
+}
+
+// Retry-After is at least a second, also before any estimate exists
+func TestQueueRejectionMinimumRetryAfter(t *testing.T) {
+	rec := httptest.NewRecorder()
+	writeQueueRejection(context.Background(), rec, queueInfo{}, "All build slots are busy", http.StatusTooManyRequests)
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "1" {
+		t.Errorf("got %d with Retry-After %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+}
+
+// Concurrent installs with isolated caches each see only their own cache
+func TestConcurrentInstallsUseIsolatedCaches(t *testing.T) {
+	bin := t.TempDir()
+	// Stands in for npm: adds the build's package to the cache and lists it
+	fakeNpm := "#!/bin/sh\nmkdir -p \"$npm_config_cache/_cacache\" \"$YARN_CACHE_FOLDER\"\n" +
+		"echo \"$BUILD\" > \"$npm_config_cache/_cacache/$BUILD\"\nsleep 0.05\nls \"$npm_config_cache/_cacache\"\n"
+	if err := os.WriteFile(filepath.Join(bin, "npm"), []byte(fakeNpm), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	const builds = 8
+	tempDirs := make([]string, builds)
+	outputs := make([]bytes.Buffer, builds)
+	var wg sync.WaitGroup
+	for i := range builds {
+		tempDirs[i] = t.TempDir()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			env := append(packageCacheEnv(filepath.Join(tempDirs[i], "npm-cache")), fmt.Sprintf("BUILD=build-%d", i))
+			if err := runNpmInstall(context.Background(), tempDirs[i], env, nil, nil, &outputs[i]); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i := range builds {
+		want := fmt.Sprintf("build-%d", i)
+		if got := strings.TrimSpace(outputs[i].String()); got != want {
+			t.Errorf("install %d saw cache entries %q, want only %q", i, got, want)
+		}
+		if _, err := os.Stat(filepath.Join(tempDirs[i], "npm-cache", "yarn")); err != nil {
+			t.Errorf("yarn cache not inside the build's cache: %v", err)
+		}
+	}
+}
+
+// Create a git repository with the files committed on main, returning its
+// file:// URL
+func newTestRepo(t *testing.T, files map[string][]byte) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), content, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, args := range [][]string{
+		{"init", "-q", "-b", "main"},
+		{"add", "."},
+		{"-c", "user.name=Test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "Initial commit"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		if output, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v: %s", args, err, output)
+		}
+	}
+	return "file://" + dir
+}
+
+func TestRunGitCloneMaxSize(t *testing.T) {
+	large := make([]byte, 2<<20)
+	rand.New(rand.NewSource(1)).Read(large) // Incompressible, so git can't store it smaller
+	repoURL := newTestRepo(t, map[string][]byte{"app.json": []byte(expoAppJSON), "assets.bin": large})
+
+	t.Run("over the limit", func(t *testing.T) {
+		_, err := runGitClone(context.Background(), repoURL, filepath.Join(t.TempDir(), "clone"), cloneOptions{Branch: "main", MaxSize: 1 << 20})
+		if !errors.Is(err, errRepoTooLarge) || !strings.Contains(err.Error(), "of 1048576 bytes") {
+			t.Errorf("got %v, want errRepoTooLarge naming the limit", err)
+		}
+	})
+	t.Run("within the limit", func(t *testing.T) {
+		clonePath := filepath.Join(t.TempDir(), "clone")
+		if output, err := runGitClone(context.Background(), repoURL, clonePath, cloneOptions{Branch: "main", MaxSize: 16 << 20}); err != nil {
+			t.Fatalf("%v: %s", err, output)
+		}
+		if _, err := os.Stat(filepath.Join(clonePath, "assets.bin")); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+// newRouteTestServer serves the routes of a service holding one finished
+// build with a retained artifact. build stands in for POST /build.
+func newRouteTestServer(t *testing.T, build http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	config := Config{
+		ArtifactDir: t.TempDir(),
+		APIKeys:     []apiKey{{Label: "test", Token: "secret"}},
+	}
+	dir := buildArtifactDir(config, "b1")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "app-b1.apk"), []byte("apk bytes"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	svc := &buildService{
+		config:    config,
+		registry:  newBuildRegistry(0, 0, newEventHub(0, nil)),
+		queue:     newBuildQueue(1, 1, 0, nil),
+		downloads: newDownloadTracker(),
+	}
+	svc.registry.Add(BuildRecord{ID: "b1", Status: statusQueued})
+	svc.registry.Update("b1", func(record *BuildRecord) { record.ArtifactURL = "/artifacts/b1" })
+	svc.registry.Finish("b1", statusSucceeded, "")
+
+	mux := http.NewServeMux()
+	registerRoutes(mux, svc, nil, build)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func routeRequest(t *testing.T, server *httptest.Server, method, path string) (*http.Response, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(method, server.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, body
+}
+
+func TestHeadMatchesGetWithoutBody(t *testing.T) {
+	server := newRouteTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("%s /build ran the build handler", r.Method)
+	})
+
+	for _, path := range []string{"/health", "/version", "/artifacts/b1"} {
+		t.Run(path, func(t *testing.T) {
+			get, getBody := routeRequest(t, server, http.MethodGet, path)
+			head, headBody := routeRequest(t, server, http.MethodHead, path)
+			if get.StatusCode != http.StatusOK || head.StatusCode != http.StatusOK {
+				t.Fatalf("GET %d, HEAD %d, want 200 for both", get.StatusCode, head.StatusCode)
+			}
+			if len(getBody) == 0 {
+				t.Fatal("GET returned an empty body")
+			}
+			if len(headBody) != 0 {
+				t.Errorf("HEAD body = %q, want none", headBody)
+			}
+			if want := strconv.Itoa(len(getBody)); get.Header.Get("Content-Length") != want || head.Header.Get("Content-Length") != want {
+				t.Errorf("Content-Length GET %q, HEAD %q, want %s", get.Header.Get("Content-Length"), head.Header.Get("Content-Length"), want)
+			}
+			for _, name := range []string{"Content-Type", "ETag", "Content-Disposition", "X-Checksum-Sha256"} {
+				if get.Header.Get(name) != head.Header.Get(name) {
+					t.Errorf("%s GET %q, HEAD %q", name, get.Header.Get(name), head.Header.Get(name))
+				}
+			}
+		})
+	}
+
+	resp, body := routeRequest(t, server, http.MethodGet, "/artifacts/b1")
+	if string(body) != "apk bytes" || resp.Header.Get("ETag") == "" {
+		t.Errorf("artifact body %q, ETag %q, want the file with an ETag", body, resp.Header.Get("ETag"))
+	}
+}
+
+func TestHeadOnBuildIsRejected(t *testing.T) {
+	server := newRouteTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("%s /build ran the build handler", r.Method)
+	})
+
+	resp, _ := routeRequest(t, server, http.MethodHead, "/build")
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("HEAD /build status = %d, want 405", resp.StatusCode)
+	}
+	if allow := resp.Header.Get("Allow"); allow != http.MethodPost {
+		t.Errorf("Allow = %q, want POST", allow)
+	}
+}
+
+func TestUnsupportedMethodsGet405(t *testing.T) {
+	server := newRouteTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("%s /build ran the build handler", r.Method)
+	})
+
+	tests := []struct {
+		method, path, allow string
+	}{
+		{http.MethodGet, "/build", "POST"},
+		{http.MethodPut, "/build", "POST"},
+		{http.MethodGet, "/update", "POST"},
+		{http.MethodDelete, "/update", "POST"},
+		{http.MethodPost, "/health", "GET, HEAD"},
+		{http.MethodPost, "/version", "GET, HEAD"},
+		{http.MethodPost, "/builds", "GET, HEAD"},
+		{http.MethodPut, "/artifacts/b1", "GET, HEAD"},
+		{http.MethodPost, "/build/status/b1", "GET, HEAD"},
+		{http.MethodPost, "/caches", "GET, HEAD"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			resp, _ := routeRequest(t, server, tt.method, tt.path)
+			if resp.StatusCode != http.StatusMethodNotAllowed {
+				t.Fatalf("status = %d, want 405", resp.StatusCode)
+			}
+			if allow := resp.Header.Get("Allow"); allow != tt.allow {
+				t.Errorf("Allow = %q, want %q", allow, tt.allow)
+			}
+		})
+	}
+}
+
+// shortWriter accepts limit bytes of the body and then fails like a client
+// that went away
+type shortWriter struct {
+	*httptest.ResponseRecorder
+	limit int
+}
+
+func (w *shortWriter) Write(p []byte) (int, error) {
+	if w.Body.Len()+len(p) <= w.limit {
+		return w.ResponseRecorder.Write(p)
+	}
+	n, _ := w.ResponseRecorder.Write(p[:w.limit-w.Body.Len()])
+	return n, errors.New("connection reset by peer")
+}
+
+// disconnectedWriter sends the headers and holds the body back until the
+// client is gone, so the body can't fit in socket buffers before it leaves
+type disconnectedWriter struct {
+	http.ResponseWriter
+	gone   <-chan struct{}
+	waited bool
+}
+
+func (w *disconnectedWriter) Write(p []byte) (int, error) {
+	if !w.waited {
+		w.waited = true
+		http.NewResponseController(w.ResponseWriter).Flush()
+		<-w.gone
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func TestSendArtifactDeliveryOutcome(t *testing.T) {
+	data := make([]byte, 256<<10)
+	rand.New(rand.NewSource(1)).Read(data)
+	path := filepath.Join(t.TempDir(), "app-b1.apk")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	send := func(w http.ResponseWriter) *artifactDelivery {
+		return sendArtifact(context.Background(), w, path, "app-b1.apk", "app-b1.apk", "application/vnd.android.package-archive", 16<<10, nil)
+	}
+
+	t.Run("delivered", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		delivery := send(rec)
+		want := artifactDelivery{Outcome: deliveryDelivered, Bytes: int64(len(data)), Size: int64(len(data))}
+		if delivery == nil || *delivery != want {
+			t.Fatalf("delivery = %+v, want %+v", delivery, want)
+		}
+		if !bytes.Equal(rec.Body.Bytes(), data) {
+			t.Error("body differs from the artifact")
+		}
+	})
+
+	t.Run("short read", func(t *testing.T) {
+		w := &shortWriter{ResponseRecorder: httptest.NewRecorder(), limit: 100 << 10}
+		delivery := send(w)
+		if delivery == nil || delivery.Outcome != deliveryPartial {
+			t.Fatalf("delivery = %+v, want partial", delivery)
+		}
+		if delivery.Bytes != 100<<10 || delivery.Size != int64(len(data)) {
+			t.Errorf("delivered %d of %d bytes, want %d of %d", delivery.Bytes, delivery.Size, 100<<10, len(data))
+		}
+		if !strings.Contains(delivery.Error, "connection reset") {
+			t.Errorf("error = %q, want the write error", delivery.Error)
+		}
+	})
+
+	t.Run("client disconnects", func(t *testing.T) {
+		deliveries := make(chan *artifactDelivery, 1)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			deliveries <- send(&disconnectedWriter{ResponseWriter: w, gone: r.Context().Done()})
+		}))
+		defer server.Close()
+
+		resp, err := http.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Closing an unread body drops the connection
+		resp.Body.Close()
+
+		select {
+		case delivery := <-deliveries:
+			if delivery == nil || delivery.Outcome != deliveryPartial || delivery.Bytes >= delivery.Size {
+				t.Errorf("delivery = %+v, want partial", delivery)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("the handler never finished sending")
+		}
+	})
+}
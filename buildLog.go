@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+)
+
+// Path of the output log of a build, kept alongside its retained artifacts
+func buildLogPath(config Config, buildID string) string {
+	return filepath.Join(buildArtifactDir(config, buildID), "build.log")
+}
+
+// Create the output log of a build
+func createBuildLog(config Config, buildID string) (*os.File, error) {
+	path := buildLogPath(config, buildID)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("error creating build log directory: %v", err)
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error creating build log: %v", err)
+	}
+	return file, nil
+}
+
+// Read at most maxBytes from the end of a log and report whether it was cut
+func readLogTail(path string, maxBytes int64) (string, bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", false, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return "", false, err
+	}
+	truncated := info.Size() > maxBytes
+	if truncated {
+		if _, err := file.Seek(-maxBytes, io.SeekEnd); err != nil {
+			return "", false, err
+		}
+	}
+	tail, err := io.ReadAll(io.LimitReader(file, maxBytes))
+	return string(tail), truncated, err
+}
+
+// Build log handler serving the full output log of a build
+func buildLogHandler(svc *buildService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		record, ok := svc.registry.Get(r.PathValue("id"))
+		if !ok || record.LogURL == "" {
+			http.Error(w, "Build log not found", http.StatusNotFound)
+			return
+		}
+		path := buildLogPath(svc.config, record.ID)
+		if platform := r.URL.Query().Get("platform"); platform != "" {
+			// Only platform "all" builds keep a log per platform
+			if !slices.Contains(allPlatforms, platform) {
+				http.Error(w, "Build log not found", http.StatusNotFound)
+				return
+			}
+			path = platformLogPath(svc.config, record.ID, platform)
+		}
+		if _, err := os.Stat(path); err != nil {
+			http.Error(w, "Build log not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		http.ServeFile(w, r, path)
+	}
+}
+
+// Run a command and return its combined output, copying it to buildLog as it
+// is produced if set
+func combinedOutput(cmd *exec.Cmd, buildLog io.Writer) ([]byte, error) {
+	if buildLog == nil {
+		return cmd.CombinedOutput()
+	}
+	var output bytes.Buffer
+	w := io.MultiWriter(&output, buildLog)
+	cmd.Stdout, cmd.Stderr = w, w
+	err := cmd.Run()
+	return output.Bytes(), err
+}
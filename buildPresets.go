@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var presetNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// buildPreset is a named set of build parameters, such as for staging or
+// production, selected with the request's environment field. Parameters set in
+// the request take precedence.
+type buildPreset struct {
+	Profile string            `yaml:"profile"`
+	Env     map[string]string `yaml:"env"`
+	// NpmRegistry is the npm registry to install dependencies from
+	NpmRegistry string `yaml:"npm_registry"`
+}
+
+// Load the presets file, a YAML mapping of preset names to their parameters
+func loadBuildPresets(path string) (map[string]buildPreset, error) {
+	presets := map[string]buildPreset{}
+	if path == "" {
+		return presets, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", path, err)
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&presets); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("error parsing %s: %v", path, err)
+	}
+	for name, preset := range presets {
+		if err := preset.validate(name); err != nil {
+			return nil, fmt.Errorf("preset %q: %v", name, err)
+		}
+	}
+	return presets, nil
+}
+
+func (p buildPreset) validate(name string) error {
+	if !presetNamePattern.MatchString(name) {
+		return fmt.Errorf("name may only contain letters, digits, '-' and '_'")
+	}
+	if p.Profile != "" && !isValidProfileName(p.Profile) {
+		return fmt.Errorf("invalid profile %q", p.Profile)
+	}
+	if err := validateEnvMap(p.Env); err != nil {
+		return err
+	}
+	if p.NpmRegistry != "" {
+		parsed, err := url.Parse(p.NpmRegistry)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("npm_registry %s is not an http(s) URL", redactURLCredentials(p.NpmRegistry))
+		}
+	}
+	return nil
+}
+
+// Fill in the parameters the request leaves unset. Variables in the
+// request's env override the preset's one by one.
+func (p buildPreset) apply(req *BuildRequest) {
+	if req.Profile == "" {
+		req.Profile = p.Profile
+	}
+	env := maps.Clone(p.Env)
+	if env == nil {
+		env = map[string]string{}
+	}
+	if p.NpmRegistry != "" {
+		env["npm_config_registry"] = p.NpmRegistry
+	}
+	maps.Copy(env, req.Env)
+	req.Env = env
+}
+
+// Names of the configured presets, for error messages
+func presetNames(presets map[string]buildPreset) string {
+	if len(presets) == 0 {
+		return "none configured"
+	}
+	names := make([]string, 0, len(presets))
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
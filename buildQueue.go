@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// buildPriority orders builds waiting for a free slot
+type buildPriority int
+
+const (
+	priorityLow buildPriority = iota
+	priorityNormal
+	priorityHigh
+)
+
+func (p buildPriority) String() string {
+	switch p {
+	case priorityLow:
+		return "low"
+	case priorityHigh:
+		return "high"
+	}
+	return "normal"
+}
+
+// Parse a priority name, defaulting to normal when empty
+func parsePriority(s string) (buildPriority, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "normal":
+		return priorityNormal, nil
+	case "low":
+		return priorityLow, nil
+	case "high":
+		return priorityHigh, nil
+	}
+	return priorityNormal, fmt.Errorf("unknown priority %q, expected low, normal or high", s)
+}
+
+// errQueueFull is returned by Acquire when MAX_QUEUED_BUILDS builds are already waiting
+var errQueueFull = errors.New("build queue is full")
+
+// Number of recent build durations averaged for retry estimates, and the
+// estimate used before any build has finished
+const (
+	durationSamples      = 20
+	defaultBuildEstimate = time.Minute
+)
+
+// buildQueue limits the number of concurrently running builds and hands out
+// free slots to waiting builds by priority. Waiting builds gain one priority
+// level per aging interval so low-priority builds aren't starved. Among builds
+// of equal priority, slots are shared between API keys by weighted round-robin
+// so a single client can't monopolize the workers.
+type buildQueue struct {
+	mu         sync.Mutex
+	slots      int
+	maxWaiting int
+	running    int
+	waiting    []*queuedBuild
+	aging      time.Duration
+	weights    map[string]int
+	credit     map[string]int  // Smooth weighted round-robin state per key
+	durations  []time.Duration // Recent slot hold times, oldest first
+}
+
+// queueInfo is a snapshot of the queue returned to rejected clients
+type queueInfo struct {
+	Running        int     `json:"running"`
+	Queued         int     `json:"queued"`
+	MaxConcurrent  int     `json:"max_concurrent"`
+	MaxQueued      int     `json:"max_queued"`
+	AverageBuild   float64 `json:"average_build_seconds"`
+	RetryAfterSecs int     `json:"retry_after_seconds"`
+}
+
+type queuedBuild struct {
+	priority buildPriority
+	key      string
+	enqueued time.Time
+	ready    chan struct{}
+}
+
+// newBuildQueue creates a queue allowing up to slots concurrent builds and
+// maxWaiting waiting builds, where zero or less means unlimited. Keys without
+// a weight get weight 1.
+func newBuildQueue(slots, maxWaiting int, aging time.Duration, weights map[string]int) *buildQueue {
+	return &buildQueue{slots: slots, maxWaiting: maxWaiting, aging: aging, weights: weights, credit: make(map[string]int)}
+}
+
+// Acquire blocks until a build slot is available for the API key or ctx is done.
+// The returned function must be called to release the slot.
+func (q *buildQueue) Acquire(ctx context.Context, priority buildPriority, key string) (func(), error) {
+	q.mu.Lock()
+	if q.slots <= 0 || (q.running < q.slots && len(q.waiting) == 0) {
+		q.running++
+		q.mu.Unlock()
+		return q.releaseFunc(), nil
+	}
+	if q.maxWaiting > 0 && len(q.waiting) >= q.maxWaiting {
+		q.mu.Unlock()
+		return nil, errQueueFull
+	}
+
+	waiter := &queuedBuild{priority: priority, key: key, enqueued: time.Now(), ready: make(chan struct{})}
+	q.waiting = append(q.waiting, waiter)
+	q.mu.Unlock()
+
+	select {
+	case <-waiter.ready:
+		return q.releaseFunc(), nil
+	case <-ctx.Done():
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		select {
+		case <-waiter.ready:
+			// The slot was handed over while giving up, pass it on
+			q.running--
+			q.dispatch()
+		default:
+			q.remove(waiter)
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// TryAcquire takes a build slot only if one is free right away, without
+// queueing. The returned function must be called to release the slot.
+func (q *buildQueue) TryAcquire() (func(), bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.slots > 0 && (q.running >= q.slots || len(q.waiting) > 0) {
+		return nil, false
+	}
+	q.running++
+	return q.releaseFunc(), true
+}
+
+// Running returns the number of builds holding a slot
+func (q *buildQueue) Running() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.running
+}
+
+// Waiting returns the number of builds waiting for a slot
+func (q *buildQueue) Waiting() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.waiting)
+}
+
+// WaitingByKey returns the number of waiting builds per API key
+func (q *buildQueue) WaitingByKey() map[string]int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	depth := make(map[string]int)
+	for _, waiter := range q.waiting {
+		depth[waiter.key]++
+	}
+	return depth
+}
+
+// Info returns the queue state with a suggested retry delay: the rolling
+// average build time for every round of slots the queued builds need first
+func (q *buildQueue) Info() queueInfo {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	average := defaultBuildEstimate
+	if len(q.durations) > 0 {
+		var total time.Duration
+		for _, d := range q.durations {
+			total += d
+		}
+		average = total / time.Duration(len(q.durations))
+	}
+	rounds := 1
+	if q.slots > 0 {
+		rounds += len(q.waiting) / q.slots
+	}
+
+	return queueInfo{
+		Running:        q.running,
+		Queued:         len(q.waiting),
+		MaxConcurrent:  q.slots,
+		MaxQueued:      q.maxWaiting,
+		AverageBuild:   average.Seconds(),
+		RetryAfterSecs: int((average * time.Duration(rounds)).Round(time.Second) / time.Second),
+	}
+}
+
+func (q *buildQueue) releaseFunc() func() {
+	var once sync.Once
+	acquired := time.Now()
+	return func() {
+		once.Do(func() {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			q.running--
+			q.durations = append(q.durations, time.Since(acquired))
+			if len(q.durations) > durationSamples {
+				q.durations = q.durations[1:]
+			}
+			q.dispatch()
+		})
+	}
+}
+
+// Hand free slots to the waiting builds with the highest effective priority,
+// choosing between API keys by weighted round-robin. Must be called with q.mu held.
+func (q *buildQueue) dispatch() {
+	for len(q.waiting) > 0 && (q.slots <= 0 || q.running < q.slots) {
+		best := q.next(time.Now())
+		waiter := q.waiting[best]
+		q.waiting = append(q.waiting[:best], q.waiting[best+1:]...)
+		q.running++
+		close(waiter.ready)
+	}
+}
+
+// Pick the index of the next waiting build to run
+func (q *buildQueue) next(now time.Time) int {
+	top := priorityLow
+	for _, waiter := range q.waiting {
+		top = max(top, q.effectivePriority(waiter, now))
+	}
+
+	// Oldest waiting build of the top priority for each key
+	oldest := make(map[string]int)
+	for i, waiter := range q.waiting {
+		if q.effectivePriority(waiter, now) != top {
+			continue
+		}
+		if _, ok := oldest[waiter.key]; !ok {
+			oldest[waiter.key] = i
+		}
+	}
+
+	// Smooth weighted round-robin between the keys with eligible builds
+	for key := range q.credit {
+		if _, ok := oldest[key]; !ok {
+			delete(q.credit, key)
+		}
+	}
+	total := 0
+	chosen := ""
+	for key := range oldest {
+		weight := q.weight(key)
+		total += weight
+		q.credit[key] += weight
+		if chosen == "" || q.credit[key] > q.credit[chosen] || (q.credit[key] == q.credit[chosen] && oldest[key] < oldest[chosen]) {
+			chosen = key
+		}
+	}
+	q.credit[chosen] -= total
+
+	return oldest[chosen]
+}
+
+func (q *buildQueue) weight(key string) int {
+	if weight, ok := q.weights[key]; ok && weight > 0 {
+		return weight
+	}
+	return 1
+}
+
+// The priority of a waiting build raised by the time it has spent in the queue
+func (q *buildQueue) effectivePriority(waiter *queuedBuild, now time.Time) buildPriority {
+	priority := waiter.priority
+	if q.aging > 0 {
+		priority += buildPriority(now.Sub(waiter.enqueued) / q.aging)
+	}
+	return min(priority, priorityHigh)
+}
+
+func (q *buildQueue) remove(waiter *queuedBuild) {
+	for i, w := range q.waiting {
+		if w == waiter {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			return
+		}
+	}
+}
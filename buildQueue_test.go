@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Queue the builds, one per key in the order given, all enqueued at now
+func queueBuilds(q *buildQueue, now time.Time, priority buildPriority, keys ...string) {
+	for _, key := range keys {
+		q.waiting = append(q.waiting, &queuedBuild{priority: priority, key: key, enqueued: now, ready: make(chan struct{})})
+	}
+}
+
+// Dispatch every waiting build through next and return their keys in order
+func dispatchOrder(q *buildQueue, now time.Time) string {
+	var order []string
+	for len(q.waiting) > 0 {
+		i := q.next(now)
+		order = append(order, q.waiting[i].key)
+		q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+	}
+	return strings.Join(order, " ")
+}
+
+func TestBuildQueueWeightedRoundRobin(t *testing.T) {
+	now := time.Now()
+	q := newBuildQueue(1, 0, 0, map[string]int{"release": 3})
+	queueBuilds(q, now, priorityNormal, "release", "preview", "release", "preview", "release", "preview", "release", "preview")
+
+	// release gets three slots for every one of preview while both wait,
+	// ties going to the build waiting longest
+	if got, want := dispatchOrder(q, now), "release preview release release release preview preview preview"; got != want {
+		t.Errorf("dispatched %s, want %s", got, want)
+	}
+}
+
+func TestBuildQueueEqualWeightsAlternate(t *testing.T) {
+	now := time.Now()
+	q := newBuildQueue(1, 0, 0, nil)
+	queueBuilds(q, now, priorityNormal, "a", "a", "a", "b", "b", "b")
+	if got, want := dispatchOrder(q, now), "a b a b a b"; got != want {
+		t.Errorf("dispatched %s, want %s", got, want)
+	}
+}
+
+func TestBuildQueuePriorityAndAging(t *testing.T) {
+	now := time.Now()
+	q := newBuildQueue(1, 0, 10*time.Minute, map[string]int{"heavy": 100})
+	queueBuilds(q, now, priorityNormal, "heavy", "heavy")
+	queueBuilds(q, now, priorityHigh, "urgent")
+	// Waiting for two aging intervals lifts a low priority build to high
+	q.waiting = append(q.waiting, &queuedBuild{priority: priorityLow, key: "old", enqueued: now.Add(-21 * time.Minute), ready: make(chan struct{})})
+
+	if got, want := dispatchOrder(q, now), "urgent old heavy heavy"; got != want {
+		t.Errorf("dispatched %s, want %s", got, want)
+	}
+}
+
+func TestBuildQueueInfo(t *testing.T) {
+	now := time.Now()
+	q := newBuildQueue(2, 10, 0, nil)
+	q.running = 2
+
+	// Before any build finished, every round of slots is estimated at a minute
+	queueBuilds(q, now, priorityNormal, "a", "b", "c", "d", "e")
+	info := q.Info()
+	if info.Running != 2 || info.Queued != 5 || info.MaxConcurrent != 2 || info.MaxQueued != 10 {
+		t.Errorf("info %+v", info)
+	}
+	// Five waiting builds need two more rounds of two slots before a new one runs
+	if info.RetryAfterSecs != 3*60 {
+		t.Errorf("Retry-After %d, want %d", info.RetryAfterSecs, 3*60)
+	}
+
+	q.durations = []time.Duration{2 * time.Minute, 4 * time.Minute}
+	info = q.Info()
+	if info.AverageBuild != 180 || info.RetryAfterSecs != 3*180 {
+		t.Errorf("average %v, Retry-After %d, want 180 and %d", info.AverageBuild, info.RetryAfterSecs, 3*180)
+	}
+}
+
+// Released slots go to waiting builds in dispatch order
+func TestBuildQueueAcquireRelease(t *testing.T) {
+	q := newBuildQueue(1, 1, 0, nil)
+	release, err := q.Acquire(context.Background(), priorityNormal, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := q.TryAcquire(); ok {
+		t.Fatal("TryAcquire took a slot while all were taken")
+	}
+
+	acquired := make(chan func())
+	go func() {
+		next, err := q.Acquire(context.Background(), priorityNormal, "b")
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- next
+	}()
+	for q.Waiting() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := q.Acquire(context.Background(), priorityNormal, "c"); err != errQueueFull {
+		t.Errorf("got %v with the queue full, want errQueueFull", err)
+	}
+
+	release()
+	release() // Releasing twice frees a single slot
+	next := <-acquired
+	if q.Running() != 1 || q.Waiting() != 0 {
+		t.Errorf("running %d, waiting %d after handing over the slot", q.Running(), q.Waiting())
+	}
+	next()
+	if q.Running() != 0 {
+		t.Errorf("running %d after releasing every slot", q.Running())
+	}
+}
+
+// A key flooding the queue doesn't keep another key's builds waiting behind
+// all of its own
+func TestBuildQueueFairUnderContention(t *testing.T) {
+	q := newBuildQueue(1, 0, 0, nil)
+	release, err := q.Acquire(context.Background(), priorityNormal, "flood")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type slot struct {
+		key     string
+		release func()
+	}
+	acquired := make(chan slot)
+	enqueue := func(key string) {
+		waiting := q.Waiting()
+		go func() {
+			release, err := q.Acquire(context.Background(), priorityNormal, key)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			acquired <- slot{key, release}
+		}()
+		for q.Waiting() == waiting {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	for range 4 {
+		enqueue("flood")
+	}
+	enqueue("team")
+	enqueue("team")
+
+	if depth := q.WaitingByKey(); depth["flood"] != 4 || depth["team"] != 2 {
+		t.Errorf("queue depth by key %v", depth)
+	}
+
+	var order []string
+	for range 6 {
+		release()
+		next := <-acquired
+		order = append(order, next.key)
+		release = next.release
+	}
+	release()
+	if got, want := strings.Join(order, " "), "flood team flood team flood flood"; got != want {
+		t.Errorf("dispatched %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Build lifecycle states
+const (
+	statusQueued     = "queued"
+	statusCloning    = "cloning"
+	statusInstalling = "installing"
+	statusBuilding   = "building"
+	statusUploading  = "uploading"
+	statusSucceeded  = "succeeded"
+	statusFailed     = "failed"
+	// The lockfile didn't match package.json during a frozen install
+	statusLockfileDrift = "lockfile_drift"
+	// npm audit found vulnerabilities at or above the configured severity
+	statusAuditFailed = "audit_failed"
+	// The build produced an artifact below the platform's minimum size
+	statusEmptyArtifact = "empty_artifact"
+	// The clone contained symlinks pointing outside of it
+	statusSuspiciousSymlink = "suspicious_symlink"
+	// The clone grew past MAX_CLONE_SIZE
+	statusRepoTooLarge = "repo_too_large"
+	// EAS produced no output for BUILD_STALL_TIMEOUT, likely stuck at a prompt
+	statusInteractivePrompt = "interactive_prompt"
+	// Some platforms of a platform "all" build failed
+	statusPartiallySucceeded = "partially_succeeded"
+	// The build was cancelled with DELETE /build/{id}
+	statusCancelled = "cancelled"
+)
+
+// Cause of the context of a cancelled build
+var errBuildCancelled = errors.New("build cancelled")
+
+// BuildRecord describes a build and is returned by the status endpoint
+type BuildRecord struct {
+	ID       string `json:"build_id"`
+	Status   string `json:"status"`
+	Platform string `json:"platform"`
+	Priority string `json:"priority"`
+	Repo     string `json:"repo"`
+	Branch   string `json:"branch"`
+	// InstallFlags are the npm install flags applied to the build
+	InstallFlags []string `json:"install_flags,omitempty"`
+	// PackagePath is the app directory that was built, after auto-detection
+	PackagePath string `json:"package_path"`
+	Error       string `json:"error,omitempty"`
+	// ErrorCode identifies recognized causes of failure, e.g. auth_required
+	ErrorCode string `json:"error_code,omitempty"`
+	// ErrorDetail is the raw output of the failed step
+	ErrorDetail string `json:"error_detail,omitempty"`
+	// Version is the app version computed from git with git_version
+	Version *gitVersion `json:"version,omitempty"`
+	// EASVersion is the version of the EAS CLI that ran the build
+	EASVersion string `json:"eas_version,omitempty"`
+	// ReducedParallelismRetry reports that the build ran out of memory and
+	// was retried with OOM_RETRY_ENV
+	ReducedParallelismRetry bool `json:"reduced_parallelism_retry,omitempty"`
+	// PackageManager installed the build's dependencies
+	PackageManager string `json:"package_manager,omitempty"`
+	// InstallSkipped reports that the committed node_modules were used as is
+	InstallSkipped bool `json:"install_skipped,omitempty"`
+	// CacheHit reports that the artifact of an earlier identical build was reused
+	CacheHit bool `json:"cache_hit"`
+	// CacheCleared reports whether the build ran without caches
+	CacheCleared bool `json:"cache_cleared"`
+	// Vulnerabilities lists what npm audit found at or above the threshold
+	Vulnerabilities []auditFinding `json:"vulnerabilities,omitempty"`
+	// LogURL points at the full EAS output of the build
+	LogURL string `json:"log_url,omitempty"`
+	// ArtifactURL points at the retained artifact of a successful build
+	ArtifactURL string `json:"artifact_url,omitempty"`
+	// ExtraArtifacts lists download URLs of additional build outputs
+	ExtraArtifacts []string `json:"extra_artifacts,omitempty"`
+	// Platforms reports each platform of a platform "all" build
+	Platforms []platformResult `json:"platforms,omitempty"`
+	// Install holds the tester install links of the build
+	Install *installLinks `json:"install,omitempty"`
+	// Delivery reports whether the artifact streamed in the build response
+	// reached the client in full
+	Delivery *artifactDelivery `json:"delivery,omitempty"`
+	// FailureBundleURL points at the debugging zip of a failed build
+	FailureBundleURL string `json:"failure_bundle_url,omitempty"`
+	// Request is the build request with secrets redacted
+	Request *BuildRequest `json:"request,omitempty"`
+	// RequestID is the X-Request-ID of the request that started the build
+	RequestID  string     `json:"request_id,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// Outcomes of streaming the artifact in the build response
+const (
+	deliveryDelivered = "delivered"
+	deliveryPartial   = "partial"
+)
+
+// artifactDelivery is how much of the artifact was written to the client
+type artifactDelivery struct {
+	Outcome string `json:"outcome"`
+	Bytes   int64  `json:"bytes"`
+	Size    int64  `json:"size"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Finished reports whether the build reached a final state
+func (r *BuildRecord) Finished() bool {
+	return r.FinishedAt != nil
+}
+
+// buildRegistry keeps track of builds in memory. Once more than maxRecords
+// are stored, the least recently used finished builds are evicted; queued
+// and running builds are never evicted. State changes are reported to the
+// build's event stream as stage transitions.
+type buildRegistry struct {
+	mu         sync.Mutex
+	maxRecords int
+	ttl        time.Duration // How long finished builds are kept, until evicted by maxRecords when 0
+	records    map[string]*list.Element
+	lru        *list.List // Most recently used at the front
+	events     *eventHub
+	cancels    map[string]context.CancelCauseFunc // Of builds that haven't finished
+	cancelled  map[string]bool                    // Builds cancelled but not finished yet
+}
+
+func newBuildRegistry(maxRecords int, ttl time.Duration, events *eventHub) *buildRegistry {
+	return &buildRegistry{
+		maxRecords: maxRecords,
+		ttl:        ttl,
+		records:    make(map[string]*list.Element),
+		lru:        list.New(),
+		events:     events,
+		cancels:    make(map[string]context.CancelCauseFunc),
+		cancelled:  make(map[string]bool),
+	}
+}
+
+// Add registers a new build
+func (r *buildRegistry) Add(record BuildRecord) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if elem, ok := r.records[record.ID]; ok {
+		r.lru.Remove(elem)
+	}
+	r.records[record.ID] = r.lru.PushFront(&record)
+	r.evict()
+	r.events.Open(record)
+}
+
+// Get returns a copy of the build record
+func (r *buildRegistry) Get(id string) (BuildRecord, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	elem, ok := r.records[id]
+	if !ok {
+		return BuildRecord{}, false
+	}
+	if record := elem.Value.(*BuildRecord); r.expired(record) {
+		r.lru.Remove(elem)
+		delete(r.records, id)
+		return BuildRecord{}, false
+	}
+	r.lru.MoveToFront(elem)
+	return *elem.Value.(*BuildRecord), true
+}
+
+// Update applies fn to the build record while holding the lock
+func (r *buildRegistry) Update(id string, fn func(*BuildRecord)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if elem, ok := r.records[id]; ok {
+		r.lru.MoveToFront(elem)
+		fn(elem.Value.(*BuildRecord))
+	}
+}
+
+// SetStatus moves a build to a new state, recording when it started running
+func (r *buildRegistry) SetStatus(id, status string) {
+	r.Update(id, func(record *BuildRecord) {
+		if record.StartedAt == nil && status != statusQueued {
+			now := time.Now()
+			record.StartedAt = &now
+		}
+		record.Status = status
+	})
+	r.events.Stage(id, status)
+}
+
+// SetCancel registers the function cancelling a running build's context, or
+// forgets it when cancel is nil
+func (r *buildRegistry) SetCancel(id string, cancel context.CancelCauseFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if cancel == nil {
+		delete(r.cancels, id)
+		delete(r.cancelled, id)
+		return
+	}
+	r.cancels[id] = cancel
+}
+
+// Cancel cancels a build that hasn't finished yet, which then finishes as
+// cancelled however it ends. Returns false when the build isn't running.
+func (r *buildRegistry) Cancel(id string) bool {
+	r.mu.Lock()
+	cancel, ok := r.cancels[id]
+	if ok {
+		r.cancelled[id] = true
+	}
+	r.mu.Unlock()
+	if !ok {
+		return false
+	}
+	cancel(errBuildCancelled)
+	return true
+}
+
+// Finish marks a build as succeeded or failed with the given error text. A
+// cancelled build is marked as cancelled instead.
+func (r *buildRegistry) Finish(id, status, errText string) {
+	r.mu.Lock()
+	if r.cancelled[id] {
+		status, errText = statusCancelled, "Build cancelled"
+	}
+	delete(r.cancels, id)
+	delete(r.cancelled, id)
+	r.mu.Unlock()
+
+	r.Update(id, func(record *BuildRecord) {
+		now := time.Now()
+		record.Status = status
+		record.Error = errText
+		record.FinishedAt = &now
+	})
+	r.events.Close(id, status, errText)
+}
+
+// buildFilter selects builds in List; empty fields match everything
+type buildFilter struct {
+	Repo     string
+	Branch   string
+	Platform string
+	Status   string
+	Since    time.Time
+}
+
+// Matches reports whether the record passes the filter
+func (f buildFilter) Matches(record *BuildRecord) bool {
+	switch {
+	case f.Repo != "" && repoListKey(f.Repo) != repoListKey(record.Repo):
+		return false
+	case f.Branch != "" && f.Branch != record.Branch:
+		return false
+	case f.Platform != "" && f.Platform != record.Platform:
+		return false
+	case f.Status != "" && f.Status != record.Status:
+		return false
+	case !f.Since.IsZero() && record.CreatedAt.Before(f.Since):
+		return false
+	}
+	return true
+}
+
+// Compare repo URLs without credentials, case, trailing slash or .git suffix
+func repoListKey(repoURL string) string {
+	if parsed, err := url.Parse(repoURL); err == nil && parsed.User != nil {
+		parsed.User = nil
+		repoURL = parsed.String()
+	}
+	return normalizeRepoKey(repoURL)
+}
+
+// errInvalidCursor is returned by List for cursors it didn't issue
+var errInvalidCursor = errors.New("invalid cursor")
+
+// List returns up to limit builds matching filter, newest first, starting
+// after cursor. The returned cursor is empty when there are no more pages.
+func (r *buildRegistry) List(filter buildFilter, cursor string, limit int) ([]BuildRecord, string, error) {
+	var afterTime time.Time
+	var afterID string
+	if cursor != "" {
+		var err error
+		if afterTime, afterID, err = decodeListCursor(cursor); err != nil {
+			return nil, "", err
+		}
+	}
+
+	r.mu.Lock()
+	r.evict()
+	matched := make([]BuildRecord, 0)
+	for _, elem := range r.records {
+		if record := elem.Value.(*BuildRecord); filter.Matches(record) {
+			matched = append(matched, *record)
+		}
+	}
+	r.mu.Unlock()
+
+	// Newest first, breaking ties on the ID so the order is stable across pages
+	sort.Slice(matched, func(i, j int) bool {
+		if !matched[i].CreatedAt.Equal(matched[j].CreatedAt) {
+			return matched[i].CreatedAt.After(matched[j].CreatedAt)
+		}
+		return matched[i].ID > matched[j].ID
+	})
+
+	start := 0
+	if cursor != "" {
+		start = sort.Search(len(matched), func(i int) bool {
+			record := matched[i]
+			return record.CreatedAt.Before(afterTime) || (record.CreatedAt.Equal(afterTime) && record.ID < afterID)
+		})
+	}
+	page := matched[start:]
+	if len(page) <= limit {
+		return page, "", nil
+	}
+	page = page[:limit]
+	last := page[len(page)-1]
+	return page, encodeListCursor(last.CreatedAt, last.ID), nil
+}
+
+func encodeListCursor(createdAt time.Time, id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d_%s", createdAt.UnixNano(), id)))
+}
+
+func decodeListCursor(cursor string) (time.Time, string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, "", errInvalidCursor
+	}
+	nanos, id, ok := strings.Cut(string(raw), "_")
+	if !ok {
+		return time.Time{}, "", errInvalidCursor
+	}
+	n, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return time.Time{}, "", errInvalidCursor
+	}
+	return time.Unix(0, n), id, nil
+}
+
+// Report whether a build finished longer than the TTL ago. Must be called
+// with r.mu held.
+func (r *buildRegistry) expired(record *BuildRecord) bool {
+	return r.ttl > 0 && record.FinishedAt != nil && time.Since(*record.FinishedAt) > r.ttl
+}
+
+// Evict builds past their TTL, then least recently used finished builds
+// until the registry fits its cap. Must be called with r.mu held.
+func (r *buildRegistry) evict() {
+	if r.ttl > 0 {
+		for id, elem := range r.records {
+			if r.expired(elem.Value.(*BuildRecord)) {
+				r.lru.Remove(elem)
+				delete(r.records, id)
+			}
+		}
+	}
+	if r.maxRecords <= 0 {
+		return
+	}
+	for elem := r.lru.Back(); elem != nil && len(r.records) > r.maxRecords; {
+		prev := elem.Prev()
+		if record := elem.Value.(*BuildRecord); record.Finished() {
+			r.lru.Remove(elem)
+			delete(r.records, record.ID)
+		}
+		elem = prev
+	}
+}
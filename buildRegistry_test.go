@@ -0,0 +1,104 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Add a build and move it to status, finishing it unless it's still queued
+// or building
+func addBuild(r *buildRegistry, id, status string) {
+	r.Add(BuildRecord{ID: id, Status: statusQueued})
+	switch status {
+	case statusQueued:
+	case statusBuilding:
+		r.SetStatus(id, statusBuilding)
+	default:
+		r.Finish(id, status, "")
+	}
+}
+
+func TestBuildRegistryEvictsLeastRecentlyUsedFinished(t *testing.T) {
+	registry := newBuildRegistry(3, 0, newEventHub(0, nil))
+	addBuild(registry, "old", statusSucceeded)
+	addBuild(registry, "used", statusFailed)
+	addBuild(registry, "newer", statusSucceeded)
+	// Looking at a build makes it the most recently used
+	if _, ok := registry.Get("used"); !ok {
+		t.Fatal("build missing before the cap was reached")
+	}
+	addBuild(registry, "new", statusSucceeded)
+
+	for id, want := range map[string]bool{"old": false, "used": true, "newer": true, "new": true} {
+		if _, ok := registry.Get(id); ok != want {
+			t.Errorf("build %q kept = %v, want %v", id, ok, want)
+		}
+	}
+}
+
+func TestBuildRegistryNeverEvictsUnfinished(t *testing.T) {
+	registry := newBuildRegistry(2, 0, newEventHub(0, nil))
+	addBuild(registry, "queued", statusQueued)
+	addBuild(registry, "building", statusBuilding)
+	addBuild(registry, "done", statusSucceeded)
+	addBuild(registry, "running", statusBuilding)
+
+	// Over the cap with only unfinished builds left, they're all kept
+	for _, id := range []string{"queued", "building", "running"} {
+		if _, ok := registry.Get(id); !ok {
+			t.Errorf("unfinished build %q evicted", id)
+		}
+	}
+	if _, ok := registry.Get("done"); ok {
+		t.Error("finished build kept over the cap")
+	}
+
+	// Once they finish they can go
+	registry.Finish("queued", statusSucceeded, "")
+	addBuild(registry, "last", statusSucceeded)
+	if _, ok := registry.Get("queued"); ok {
+		t.Error("build finished first kept over the cap")
+	}
+}
+
+func TestBuildRegistryExpiresFinishedBuilds(t *testing.T) {
+	registry := newBuildRegistry(0, time.Hour, newEventHub(0, nil))
+	addBuild(registry, "expired", statusSucceeded)
+	addBuild(registry, "recent", statusSucceeded)
+	addBuild(registry, "running", statusBuilding)
+	registry.Update("expired", func(record *BuildRecord) {
+		finished := time.Now().Add(-2 * time.Hour)
+		record.FinishedAt = &finished
+	})
+	registry.Update("running", func(record *BuildRecord) {
+		started := time.Now().Add(-2 * time.Hour)
+		record.StartedAt = &started
+	})
+
+	// Expiry comes first, before any cap applies
+	addBuild(registry, "new", statusQueued)
+	registry.mu.Lock()
+	_, stored := registry.records["expired"]
+	registry.mu.Unlock()
+	if stored {
+		t.Error("build past its TTL still stored after eviction")
+	}
+	for _, id := range []string{"recent", "running", "new"} {
+		if _, ok := registry.Get(id); !ok {
+			t.Errorf("build %q expired", id)
+		}
+	}
+}
+
+// Get doesn't return a build past its TTL even before the next eviction
+func TestBuildRegistryGetExpired(t *testing.T) {
+	registry := newBuildRegistry(0, time.Hour, newEventHub(0, nil))
+	addBuild(registry, "expired", statusSucceeded)
+	registry.Update("expired", func(record *BuildRecord) {
+		finished := time.Now().Add(-2 * time.Hour)
+		record.FinishedAt = &finished
+	})
+	if _, ok := registry.Get("expired"); ok {
+		t.Error("Get returned a build past its TTL")
+	}
+}
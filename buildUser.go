@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+)
+
+// buildUser is the unprivileged account npm and EAS run as, keeping build
+// scripts from untrusted repositories away from the service's own files.
+// A nil buildUser runs everything as the service user.
+type buildUser struct {
+	uid, gid uint32
+}
+
+// Create the build user from BUILD_UID and BUILD_GID. The gid defaults to
+// the uid, and a negative uid disables privilege dropping.
+func newBuildUser(uid, gid int) (*buildUser, error) {
+	if uid < 0 {
+		return nil, nil
+	}
+	if uid == 0 {
+		return nil, fmt.Errorf("BUILD_UID must not be root")
+	}
+	if gid < 0 {
+		gid = uid
+	}
+	if os.Geteuid() != 0 {
+		return nil, fmt.Errorf("the service must run as root to switch to uid %d", uid)
+	}
+	return &buildUser{uid: uint32(uid), gid: uint32(gid)}, nil
+}
+
+// Run cmd as the build user without supplementary groups
+func (u *buildUser) apply(cmd *exec.Cmd) {
+	if u == nil {
+		return
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Credential = &syscall.Credential{Uid: u.uid, Gid: u.gid, Groups: []uint32{}}
+}
+
+// Hand the given directories and everything in them to the build user
+func (u *buildUser) grant(paths ...string) error {
+	if u == nil {
+		return nil
+	}
+	for _, root := range paths {
+		err := filepath.WalkDir(root, func(path string, _ fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			return os.Lchown(path, int(u.uid), int(u.gid))
+		})
+		if err != nil {
+			return fmt.Errorf("error handing %s to the build user: %v", root, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+)
+
+// System trust stores of common distributions, as in crypto/x509
+var systemCAFiles = []string{
+	"/etc/ssl/certs/ca-certificates.crt",
+	"/etc/pki/tls/certs/ca-bundle.crt",
+	"/etc/ssl/ca-bundle.pem",
+	"/etc/pki/tls/cacert.pem",
+	"/etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem",
+	"/etc/ssl/cert.pem",
+}
+
+// caBundle holds additional CA certificates trusted for outbound HTTPS on top
+// of the system trust store
+type caBundle struct {
+	path     string         // The configured bundle
+	combined string         // System trust store followed by the bundle
+	pool     *x509.CertPool // System roots and the bundle
+}
+
+// Load the CA bundle at path. Returns nil when path is empty. git and npm
+// replace their trust store with the file they are given, so they get a copy
+// of the system store with the bundle appended.
+func loadCABundle(path string) (*caBundle, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading CA bundle: %v", err)
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	count := 0
+	for rest := data; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing certificate %d of %s: %v", count+1, path, err)
+		}
+		pool.AddCert(cert)
+		count++
+	}
+	if count == 0 {
+		return nil, fmt.Errorf("%s contains no PEM certificates", path)
+	}
+
+	var system []byte
+	for _, file := range systemCAFiles {
+		if system, err = os.ReadFile(file); err == nil {
+			break
+		}
+	}
+	if len(system) == 0 {
+		slog.Warn("No system CA certificates found, git and npm only trust the CA bundle")
+	}
+	file, err := os.CreateTemp("", "expo-build-service-ca-*.pem")
+	if err != nil {
+		return nil, fmt.Errorf("error creating combined CA bundle: %v", err)
+	}
+	defer file.Close()
+	// Read by builds running as BUILD_UID
+	if err := file.Chmod(0644); err != nil {
+		os.Remove(file.Name())
+		return nil, fmt.Errorf("error creating combined CA bundle: %v", err)
+	}
+	if len(system) > 0 && system[len(system)-1] != '\n' {
+		system = append(system, '\n')
+	}
+	if _, err := file.Write(append(system, data...)); err != nil {
+		os.Remove(file.Name())
+		return nil, fmt.Errorf("error writing combined CA bundle: %v", err)
+	}
+
+	slog.Info("Trusting additional CA certificates", "count", count, "path", path)
+	return &caBundle{path: path, combined: file.Name(), pool: pool}, nil
+}
+
+// Environment making git, npm and Node (and so EAS) trust the bundle
+func (b *caBundle) env() []string {
+	if b == nil {
+		return nil
+	}
+	return []string{
+		"GIT_SSL_CAINFO=" + b.combined,
+		"npm_config_cafile=" + b.combined,
+		"NODE_EXTRA_CA_CERTS=" + b.path,
+	}
+}
+
+// Trust the bundle for the service's own requests, such as webhooks
+func (b *caBundle) trustForHTTP() {
+	if b == nil {
+		return
+	}
+	if transport, ok := http.DefaultTransport.(*http.Transport); ok {
+		transport.TLSClientConfig = &tls.Config{RootCAs: b.pool}
+	}
+}
+
+// Remove the combined bundle
+func (b *caBundle) Close() {
+	if b != nil {
+		os.Remove(b.combined)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Caches maintained below CACHE_DIR, each holding one entry per repository
+const cacheNpm = "npm"
+
+var knownCaches = []string{cacheNpm, cacheWorkspaces, cacheMirrors}
+
+var (
+	errCacheNotFound = errors.New("cache entry not found")
+	errCacheInUse    = errors.New("cache entry is in use by a running build")
+)
+
+var unsafeCacheKeyChars = regexp.MustCompile(`[^a-z0-9._-]+`)
+
+// cacheManager hands out per-repository cache directories to builds and lets
+// operators inspect and evict them. Entries used by a running build are never
+// evicted.
+type cacheManager struct {
+	root  string
+	mu    sync.Mutex
+	inUse map[string]int // Entry path -> number of builds using it
+}
+
+// cacheEntry describes a single cache directory
+type cacheEntry struct {
+	Key      string    `json:"key"`
+	Size     int64     `json:"size_bytes"`
+	LastUsed time.Time `json:"last_used"`
+	InUse    bool      `json:"in_use"`
+}
+
+// cacheInfo describes a cache and its entries
+type cacheInfo struct {
+	Name    string       `json:"name"`
+	Size    int64        `json:"size_bytes"`
+	Entries []cacheEntry `json:"entries"`
+}
+
+func newCacheManager(root string) *cacheManager {
+	return &cacheManager{root: root, inUse: make(map[string]int)}
+}
+
+// Enabled reports whether CACHE_DIR is configured
+func (c *cacheManager) Enabled() bool {
+	return c.root != ""
+}
+
+// Acquire returns the directory of a cache entry, creating it if needed, and
+// marks it as used until release is called
+func (c *cacheManager) Acquire(cache, key string) (string, func(), error) {
+	path, err := c.entryPath(cache, key)
+	if err != nil {
+		return "", nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return "", nil, fmt.Errorf("error creating cache directory: %v", err)
+	}
+	now := time.Now()
+	_ = os.Chtimes(path, now, now)
+	c.inUse[path]++
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			if c.inUse[path]--; c.inUse[path] <= 0 {
+				delete(c.inUse, path)
+			}
+		})
+	}
+	return path, release, nil
+}
+
+// List returns every cache with its entries and the total size of all caches
+func (c *cacheManager) List() ([]cacheInfo, int64) {
+	var caches []cacheInfo
+	var total int64
+	for _, name := range knownCaches {
+		info := cacheInfo{Name: name, Entries: []cacheEntry{}}
+		dirEntries, _ := os.ReadDir(filepath.Join(c.root, name))
+		for _, dirEntry := range dirEntries {
+			if !dirEntry.IsDir() {
+				continue
+			}
+			path := filepath.Join(c.root, name, dirEntry.Name())
+			entry := cacheEntry{Key: dirEntry.Name(), Size: dirSize(path)}
+			if fi, err := dirEntry.Info(); err == nil {
+				entry.LastUsed = fi.ModTime()
+			}
+			c.mu.Lock()
+			entry.InUse = c.inUse[path] > 0
+			c.mu.Unlock()
+			info.Entries = append(info.Entries, entry)
+			info.Size += entry.Size
+		}
+		// Most recently used first
+		sort.Slice(info.Entries, func(i, j int) bool {
+			return info.Entries[i].LastUsed.After(info.Entries[j].LastUsed)
+		})
+		caches = append(caches, info)
+		total += info.Size
+	}
+	return caches, total
+}
+
+// TotalSize returns the combined size of all caches in bytes
+func (c *cacheManager) TotalSize() int64 {
+	if !c.Enabled() {
+		return 0
+	}
+	return dirSize(c.root)
+}
+
+// Evict deletes a single cache entry unless a build is using it
+func (c *cacheManager) Evict(cache, key string) error {
+	path, err := c.entryPath(cache, key)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := os.Stat(path); err != nil {
+		return errCacheNotFound
+	}
+	if c.inUse[path] > 0 {
+		return errCacheInUse
+	}
+	if err := os.RemoveAll(path); err != nil {
+		return fmt.Errorf("error removing cache entry: %v", err)
+	}
+	return nil
+}
+
+// Clear evicts every entry of a cache that isn't in use and returns the keys
+// that were removed and those skipped because a build is using them
+func (c *cacheManager) Clear(cache string) (evicted, skipped []string, err error) {
+	if !isKnownCache(cache) {
+		return nil, nil, errCacheNotFound
+	}
+	dirEntries, _ := os.ReadDir(filepath.Join(c.root, cache))
+	for _, dirEntry := range dirEntries {
+		if !dirEntry.IsDir() {
+			continue
+		}
+		switch err := c.Evict(cache, dirEntry.Name()); {
+		case errors.Is(err, errCacheInUse):
+			skipped = append(skipped, dirEntry.Name())
+		case err != nil && !errors.Is(err, errCacheNotFound):
+			return evicted, skipped, err
+		case err == nil:
+			evicted = append(evicted, dirEntry.Name())
+		}
+	}
+	return evicted, skipped, nil
+}
+
+// Resolve and validate the directory of a cache entry
+func (c *cacheManager) entryPath(cache, key string) (string, error) {
+	if !c.Enabled() || !isKnownCache(cache) {
+		return "", errCacheNotFound
+	}
+	if key == "" || strings.ContainsAny(key, `/\`) || strings.HasPrefix(key, ".") {
+		return "", errCacheNotFound
+	}
+	return filepath.Join(c.root, cache, key), nil
+}
+
+func isKnownCache(cache string) bool {
+	for _, name := range knownCaches {
+		if name == cache {
+			return true
+		}
+	}
+	return false
+}
+
+// Derive a readable cache key from a repository URL,
+// e.g. github.com-org-repo for https://user@github.com/org/repo.git
+func cacheKeyForRepo(repoURL string) string {
+	key := repoListKey(repoURL)
+	if _, rest, ok := strings.Cut(key, "://"); ok {
+		key = rest
+	}
+	return strings.Trim(unsafeCacheKeyChars.ReplaceAllString(key, "-"), "-.")
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+)
+
+// cleanupQueue removes build directories in the background while bounding
+// how many deletions run at once, so large node_modules trees being removed
+// together don't saturate disk I/O for running builds.
+type cleanupQueue struct {
+	slots chan struct{}
+	wg    sync.WaitGroup
+}
+
+func newCleanupQueue(concurrency int) *cleanupQueue {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &cleanupQueue{slots: make(chan struct{}, concurrency)}
+}
+
+// Remove schedules the path for deletion and returns immediately. The outcome
+// is logged with the logger of ctx.
+func (q *cleanupQueue) Remove(ctx context.Context, path string) {
+	logger := loggerFrom(ctx)
+	q.wg.Add(1)
+	go func() {
+		defer q.wg.Done()
+
+		queuedAt := time.Now()
+		q.slots <- struct{}{}
+		defer func() { <-q.slots }()
+
+		start := time.Now()
+		cleanupWaits.Observe(start.Sub(queuedAt).Seconds())
+		err := os.RemoveAll(path)
+		cleanupDurations.Observe(time.Since(start).Seconds())
+		if err != nil {
+			logger.Error("Failed to clean up temporary directory", "path", path, "error", err)
+			return
+		}
+		logger.Info("Cleaned up temporary directory", "path", path, "duration", time.Since(start).Round(time.Millisecond).String(), "waited", start.Sub(queuedAt).Round(time.Millisecond).String())
+	}()
+}
+
+// Wait blocks until all scheduled deletions have finished
+func (q *cleanupQueue) Wait() {
+	q.wg.Wait()
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCleanupQueueRemovesAll(t *testing.T) {
+	queue := newCleanupQueue(2)
+	var dirs []string
+	for i := 0; i < 10; i++ {
+		dir := filepath.Join(t.TempDir(), "build")
+		if err := os.MkdirAll(filepath.Join(dir, "node_modules", "pkg"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		dirs = append(dirs, dir)
+		queue.Remove(context.Background(), dir)
+	}
+	queue.Wait()
+	for _, dir := range dirs {
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			t.Errorf("%s still exists after Wait", dir)
+		}
+	}
+	if len(queue.slots) != 0 {
+		t.Errorf("%d cleanup slots still held", len(queue.slots))
+	}
+}
+
+func TestCleanupQueueMinimumConcurrency(t *testing.T) {
+	if got := cap(newCleanupQueue(0).slots); got != 1 {
+		t.Errorf("concurrency 0 gave %d slots, want 1", got)
+	}
+}
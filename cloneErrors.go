@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// cloneFailure is a recognized cause of a failed clone
+type cloneFailure struct {
+	Code    string
+	Status  int
+	Message string
+}
+
+// Causes of failed clones, recognized by git's output. The first match wins,
+// so specific causes come before the generic "unable to access".
+var cloneFailures = []struct {
+	failure    cloneFailure
+	signatures []string
+}{
+	{cloneFailure{"disk_full", http.StatusInsufficientStorage, "Failed to clone the repository: no space left on the build server"},
+		[]string{"no space left on device"}},
+	{cloneFailure{"ref_not_found", http.StatusBadRequest, "Failed to clone the repository: the branch was not found"},
+		[]string{"remote branch", "couldn't find remote ref"}},
+	{cloneFailure{"repo_not_found", http.StatusNotFound, "Failed to clone the repository: repository not found"},
+		[]string{"repository not found", "does not appear to be a git repository", "returned error: 404"}},
+	{cloneFailure{"access_denied", http.StatusForbidden, "Failed to clone the repository: access denied"},
+		[]string{"returned error: 403", "access denied", "permission to"}},
+	{cloneFailure{"auth_required", http.StatusUnauthorized, "Failed to clone the repository: authentication required or failed"},
+		[]string{"authentication failed", "could not read username", "could not read password", "terminal prompts disabled", "permission denied (publickey", "returned error: 401", "invalid username or password"}},
+	{cloneFailure{"host_unreachable", http.StatusBadGateway, "Failed to clone the repository: the git host could not be reached"},
+		[]string{"could not resolve host", "connection refused", "connection timed out", "network is unreachable", "failed to connect", "connection reset", "ssl certificate problem", "ssl_connect", "gnutls_handshake", "unable to access"}},
+}
+
+// Classify a failed clone by git's output. Returns false when the cause isn't
+// recognized.
+func classifyCloneError(err error) (cloneFailure, bool) {
+	output := strings.ToLower(err.Error())
+	for _, c := range cloneFailures {
+		for _, signature := range c.signatures {
+			if strings.Contains(output, signature) {
+				return c.failure, true
+			}
+		}
+	}
+	return cloneFailure{}, false
+}
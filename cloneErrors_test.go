@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+func TestClassifyCloneError(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		code   string
+		status int
+	}{
+		{"github repo not found", "remote: Repository not found.\nfatal: repository 'https://github.com/owner/missing.git/' not found", "repo_not_found", http.StatusNotFound},
+		{"ssh repo not found", "ERROR: Repository not found.\nfatal: Could not read from remote repository.", "repo_not_found", http.StatusNotFound},
+		{"local path", "fatal: '/srv/missing' does not appear to be a git repository", "repo_not_found", http.StatusNotFound},
+		{"http 404", "fatal: unable to access 'https://git.example.com/app.git/': The requested URL returned error: 404", "repo_not_found", http.StatusNotFound},
+		{"http 403", "fatal: unable to access 'https://github.com/owner/app.git/': The requested URL returned error: 403", "access_denied", http.StatusForbidden},
+		{"push permission", "remote: Permission to owner/app.git denied to someone.", "access_denied", http.StatusForbidden},
+		{"no credentials", "fatal: could not read Username for 'https://github.com': terminal prompts disabled", "auth_required", http.StatusUnauthorized},
+		{"bad credentials", "remote: Invalid username or password.\nfatal: Authentication failed for 'https://github.com/owner/app.git/'", "auth_required", http.StatusUnauthorized},
+		{"ssh key", "git@github.com: Permission denied (publickey).\nfatal: Could not read from remote repository.", "auth_required", http.StatusUnauthorized},
+		{"dns", "fatal: unable to access 'https://git.example.com/app.git/': Could not resolve host: git.example.com", "host_unreachable", http.StatusBadGateway},
+		{"refused", "ssh: connect to host git.example.com port 22: Connection refused", "host_unreachable", http.StatusBadGateway},
+		{"tls", "fatal: unable to access 'https://git.example.com/app.git/': SSL certificate problem: self-signed certificate", "host_unreachable", http.StatusBadGateway},
+		{"missing branch", "warning: Could not find remote branch release/9 to clone.\nfatal: Remote branch release/9 not found in upstream origin", "ref_not_found", http.StatusBadRequest},
+		{"missing ref on fetch", "fatal: couldn't find remote ref refs/heads/release/9", "ref_not_found", http.StatusBadRequest},
+		{"disk full", "error: unable to write file app.json: No space left on device\nfatal: unable to checkout working tree", "disk_full", http.StatusInsufficientStorage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := errors.New("error cloning repository: exit status 128, output: " + tt.output)
+			failure, ok := classifyCloneError(err)
+			if !ok {
+				t.Fatal("not recognized")
+			}
+			if failure.Code != tt.code || failure.Status != tt.status {
+				t.Errorf("got %s %d, want %s %d", failure.Code, failure.Status, tt.code, tt.status)
+			}
+			if failure.Message == "" {
+				t.Error("no message")
+			}
+		})
+	}
+
+	if failure, ok := classifyCloneError(errors.New("error cloning repository: exit status 128, output: fatal: index-pack failed")); ok {
+		t.Errorf("unknown failure classified as %s", failure.Code)
+	}
+}
+
+// The output of real git failures is recognized, not just the samples above
+func TestClassifyGitCloneFailures(t *testing.T) {
+	repoURL := newTestRepo(t, map[string][]byte{"app.json": []byte(expoAppJSON)})
+	tests := []struct {
+		name, repoURL, branch, code string
+	}{
+		{"missing repository", "file://" + filepath.Join(t.TempDir(), "missing"), "main", "repo_not_found"},
+		{"missing branch", repoURL, "release/9", "ref_not_found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output, err := runGitClone(context.Background(), tt.repoURL, filepath.Join(t.TempDir(), "clone"), cloneOptions{Branch: tt.branch})
+			if err == nil {
+				t.Fatal("the clone succeeded")
+			}
+			// Wrapped like cloneOrUpdateRepo, which refuses file:// URLs
+			err = fmt.Errorf("error cloning repository: %w, output: %s", err, output)
+			failure, ok := classifyCloneError(err)
+			if !ok || failure.Code != tt.code {
+				t.Errorf("classified %v as %q, want %s", err, failure.Code, tt.code)
+			}
+		})
+	}
+}
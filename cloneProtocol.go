@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Supported transports for cloning repositories
+const (
+	cloneProtocolHTTPS = "https"
+	cloneProtocolSSH   = "ssh"
+)
+
+// Rewrite a repository URL to use the requested transport. An empty protocol
+// leaves the URL untouched.
+func rewriteRepoURL(repoURL, protocol string) (string, error) {
+	switch protocol {
+	case "":
+		return repoURL, nil
+	case cloneProtocolHTTPS, cloneProtocolSSH:
+	default:
+		return "", fmt.Errorf("unsupported clone protocol %q, expected %q or %q", protocol, cloneProtocolHTTPS, cloneProtocolSSH)
+	}
+
+	host, path, err := splitRepoURL(repoURL)
+	if err != nil {
+		return "", err
+	}
+
+	if protocol == cloneProtocolSSH {
+		return fmt.Sprintf("git@%s:%s", host, path), nil
+	}
+	return fmt.Sprintf("https://%s/%s", host, path), nil
+}
+
+// Split an HTTPS or SSH repository URL into its host and repository path
+func splitRepoURL(repoURL string) (host, path string, err error) {
+	// scp-like syntax: git@github.com:owner/repo.git
+	if !strings.Contains(repoURL, "://") {
+		userHost, repoPath, ok := strings.Cut(repoURL, ":")
+		if !ok || repoPath == "" {
+			return "", "", fmt.Errorf("unrecognized repository URL")
+		}
+		_, host, found := strings.Cut(userHost, "@")
+		if !found {
+			host = userHost
+		}
+		return host, strings.TrimPrefix(repoPath, "/"), nil
+	}
+
+	parsed, err := url.Parse(repoURL)
+	if err != nil {
+		return "", "", fmt.Errorf("unrecognized repository URL")
+	}
+	switch parsed.Scheme {
+	case "https", "http", "ssh":
+	default:
+		return "", "", fmt.Errorf("unsupported repository URL scheme %q", parsed.Scheme)
+	}
+	path = strings.TrimPrefix(parsed.Path, "/")
+	if parsed.Hostname() == "" || path == "" {
+		return "", "", fmt.Errorf("unrecognized repository URL")
+	}
+	return parsed.Hostname(), path, nil
+}
+
+// Check that a repository URL is an https://, ssh:// or scp-like
+// (git@host:path) URL. Repository URLs are passed to git, which would take
+// one starting with "-" as an option and run local paths and other
+// transports, so nothing else is accepted.
+func validateRepoURL(repoURL string) error {
+	if strings.HasPrefix(repoURL, "-") {
+		return fmt.Errorf("repository URL must not start with \"-\"")
+	}
+	for _, c := range repoURL {
+		if c <= ' ' || c == 0x7f {
+			return fmt.Errorf("repository URL must not contain spaces or control characters")
+		}
+	}
+	if strings.Contains(repoURL, "://") {
+		parsed, err := url.Parse(repoURL)
+		if err != nil {
+			return fmt.Errorf("unrecognized repository URL")
+		}
+		if parsed.Scheme != "https" && parsed.Scheme != "ssh" {
+			return fmt.Errorf("unsupported repository URL scheme %q, expected https or ssh", parsed.Scheme)
+		}
+		if parsed.Hostname() == "" || strings.HasPrefix(parsed.Hostname(), "-") {
+			return fmt.Errorf("invalid repository URL host")
+		}
+		return nil
+	}
+	// git only reads host:path as scp-like when no slash comes before the
+	// colon, otherwise it is a local path
+	userHost, path, ok := strings.Cut(repoURL, ":")
+	_, host, found := strings.Cut(userHost, "@")
+	if !found {
+		host = userHost
+	}
+	if !ok || path == "" || host == "" || strings.HasPrefix(host, "-") || strings.Contains(userHost, "/") {
+		return fmt.Errorf("unrecognized repository URL, expected https://, ssh:// or user@host:path")
+	}
+	return nil
+}
+
+// Report whether a repository URL will be cloned over SSH
+func isSSHRepoURL(repoURL string) bool {
+	if strings.HasPrefix(repoURL, "ssh://") {
+		return true
+	}
+	return !strings.Contains(repoURL, "://") && strings.Contains(repoURL, "@")
+}
+
+// Build the GIT_SSH_COMMAND value that authenticates with the configured key
+func gitSSHCommand(keyPath string) string {
+	quoted := "'" + strings.ReplaceAll(keyPath, "'", `'\''`) + "'"
+	return "ssh -i " + quoted + " -o IdentitiesOnly=yes -o BatchMode=yes -o StrictHostKeyChecking=accept-new"
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// Reasons a clone is aborted, reported to the client
+var (
+	errCloneStalled = errors.New("clone stalled: no progress from git")
+	errCloneTimeout = errors.New("clone exceeded the overall clone timeout")
+	errRepoTooLarge = errors.New("repository exceeds the maximum clone size")
+)
+
+// EAS stopped writing output, which usually means it waits for input
+var errBuildStalled = errors.New("build stalled: no output from EAS, it is likely waiting for an interactive prompt")
+
+// progressWriter forwards a process's output and remembers when it last
+// wrote. git does so continuously with --progress while data is transferred.
+type progressWriter struct {
+	w    io.Writer
+	last atomic.Int64 // Unix nanoseconds of the last write
+}
+
+func newProgressWriter(w io.Writer) *progressWriter {
+	p := &progressWriter{w: w}
+	p.last.Store(time.Now().UnixNano())
+	return p
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	p.last.Store(time.Now().UnixNano())
+	return p.w.Write(b)
+}
+
+// Idle returns how long ago the process last wrote
+func (p *progressWriter) Idle() time.Duration {
+	return time.Since(time.Unix(0, p.last.Load()))
+}
+
+// Cancel with cause once the process behind progress has been silent for
+// longer than window. Returns when ctx is done.
+func watchProgress(ctx context.Context, progress *progressWriter, window time.Duration, cancel context.CancelCauseFunc, cause error) {
+	ticker := time.NewTicker(max(min(window/4, 5*time.Second), time.Millisecond))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if progress.Idle() > window {
+				cancel(cause)
+				return
+			}
+		}
+	}
+}
+
+// Cancel the clone with errRepoTooLarge once the clone directory grows past
+// maxSize bytes. Returns when ctx is done.
+func watchCloneSize(ctx context.Context, clonePath string, maxSize int64, cancel context.CancelCauseFunc) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if dirSize(clonePath) > maxSize {
+				cancel(errRepoTooLarge)
+				return
+			}
+		}
+	}
+}
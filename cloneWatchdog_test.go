@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// The watchdog cancels a clone as soon as its directory outgrows the limit
+func TestWatchCloneSize(t *testing.T) {
+	clonePath := t.TempDir()
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		watchCloneSize(ctx, clonePath, 64<<10, cancel)
+	}()
+
+	// Growing up to the limit is fine
+	if err := os.WriteFile(filepath.Join(clonePath, "small"), make([]byte, 32<<10), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if err := context.Cause(ctx); err != nil {
+		t.Fatalf("cancelled below the limit: %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(clonePath, "large"), make([]byte, 64<<10), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("clone not cancelled after outgrowing the limit")
+	}
+	if err := context.Cause(ctx); !errors.Is(err, errRepoTooLarge) {
+		t.Errorf("cancelled with %v, want errRepoTooLarge", err)
+	}
+}
+
+// A clone that stops reporting progress is cancelled with the given cause
+func TestWatchProgress(t *testing.T) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	progress := newProgressWriter(io.Discard)
+	go watchProgress(ctx, progress, 100*time.Millisecond, cancel, errCloneStalled)
+
+	// Regular output keeps the clone alive
+	for range 6 {
+		progress.Write([]byte("Receiving objects\n"))
+		time.Sleep(40 * time.Millisecond)
+	}
+	if err := context.Cause(ctx); err != nil {
+		t.Fatalf("cancelled while progressing: %v", err)
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("stalled clone not cancelled")
+	}
+	if err := context.Cause(ctx); !errors.Is(err, errCloneStalled) {
+		t.Errorf("cancelled with %v, want errCloneStalled", err)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Report whether the install is skipped because the app's node_modules is
+// committed and trusted. The request's trust_node_modules overrides
+// TRUST_NODE_MODULES.
+func skipInstall(ctx context.Context, config Config, req BuildRequest, packagePath, repoURL string, opts cloneOptions) bool {
+	trust := config.TrustNodeModules
+	if req.TrustNodeModules != nil {
+		trust = *req.TrustNodeModules
+	}
+	return trust && hasCommittedNodeModules(ctx, packagePath, repoURL, opts)
+}
+
+// Report whether the app has its node_modules committed to the repository,
+// with packages in it. Directories left by an earlier install, e.g. in a warm
+// workspace, aren't tracked by git and don't count.
+func hasCommittedNodeModules(ctx context.Context, packagePath, repoURL string, opts cloneOptions) bool {
+	entries, err := os.ReadDir(filepath.Join(packagePath, "node_modules"))
+	if err != nil {
+		return false
+	}
+	populated := false
+	for _, entry := range entries {
+		// .bin and npm's .package-lock.json aren't packages
+		if !strings.HasPrefix(entry.Name(), ".") {
+			populated = true
+			break
+		}
+	}
+	if !populated {
+		return false
+	}
+	output, err := runGit(ctx, packagePath, repoURL, opts, "ls-tree", "HEAD", "node_modules")
+	return err == nil && strings.TrimSpace(output) != ""
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Clone a test repository with the given files, returning the clone's path
+func cloneTestRepo(t *testing.T, files map[string][]byte) (string, string) {
+	t.Helper()
+	repoURL := newTestRepo(t, files)
+	clonePath := filepath.Join(t.TempDir(), "clone")
+	if output, err := runGitClone(context.Background(), repoURL, clonePath, cloneOptions{Branch: "main"}); err != nil {
+		t.Fatalf("%v: %s", err, output)
+	}
+	return repoURL, clonePath
+}
+
+func TestSkipInstallWithCommittedNodeModules(t *testing.T) {
+	repoURL, clonePath := cloneTestRepo(t, map[string][]byte{
+		"package.json":                    []byte(`{"dependencies":{"react":"18.2.0"}}`),
+		"node_modules/react/package.json": []byte(`{"name":"react","version":"18.2.0"}`),
+	})
+	yes, no := true, false
+
+	tests := []struct {
+		name   string
+		config bool
+		req    *bool
+		want   bool
+	}{
+		{"trusted by config", true, nil, true},
+		{"default", false, nil, false},
+		{"trusted by request", false, &yes, true},
+		{"request overrides config", true, &no, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := skipInstall(context.Background(), Config{TrustNodeModules: tt.config}, BuildRequest{TrustNodeModules: tt.req}, clonePath, repoURL, cloneOptions{})
+			if got != tt.want {
+				t.Errorf("skipInstall = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHasCommittedNodeModules(t *testing.T) {
+	t.Run("committed in a monorepo app", func(t *testing.T) {
+		repoURL, clonePath := cloneTestRepo(t, map[string][]byte{
+			"apps/mobile/package.json":                   []byte(`{}`),
+			"apps/mobile/node_modules/expo/package.json": []byte(`{"name":"expo"}`),
+		})
+		if !hasCommittedNodeModules(context.Background(), filepath.Join(clonePath, "apps", "mobile"), repoURL, cloneOptions{}) {
+			t.Error("committed node_modules not detected")
+		}
+	})
+
+	t.Run("left by an earlier install", func(t *testing.T) {
+		repoURL, clonePath := cloneTestRepo(t, map[string][]byte{"package.json": []byte(`{}`)})
+		// A warm workspace keeps the untracked modules of the last build
+		if err := os.MkdirAll(filepath.Join(clonePath, "node_modules", "react"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if hasCommittedNodeModules(context.Background(), clonePath, repoURL, cloneOptions{}) {
+			t.Error("untracked node_modules counted as committed")
+		}
+	})
+
+	t.Run("only metadata committed", func(t *testing.T) {
+		repoURL, clonePath := cloneTestRepo(t, map[string][]byte{
+			"package.json":                    []byte(`{}`),
+			"node_modules/.package-lock.json": []byte(`{}`),
+		})
+		if hasCommittedNodeModules(context.Background(), clonePath, repoURL, cloneOptions{}) {
+			t.Error("node_modules without packages counted as populated")
+		}
+	})
+
+	t.Run("none", func(t *testing.T) {
+		repoURL, clonePath := cloneTestRepo(t, map[string][]byte{"package.json": []byte(`{}`)})
+		if hasCommittedNodeModules(context.Background(), clonePath, repoURL, cloneOptions{}) {
+			t.Error("node_modules detected without one")
+		}
+	})
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"log"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Where the configuration variables read with getEnv came from
+var configSources = struct {
+	sync.Mutex
+	processEnv map[string]bool // Variables set before .env was loaded
+	byKey      map[string]string
+}{byKey: make(map[string]string)}
+
+// Remember which variables the process environment sets, so the ones added
+// by godotenv can be told apart. Must be called before the .env file is loaded.
+func snapshotProcessEnv() {
+	configSources.Lock()
+	defer configSources.Unlock()
+	configSources.processEnv = make(map[string]bool)
+	for _, entry := range os.Environ() {
+		key, _, _ := strings.Cut(entry, "=")
+		configSources.processEnv[key] = true
+	}
+}
+
+// Record where the value of a configuration variable came from
+func recordConfigSource(key string, set bool) {
+	source := "default"
+	configSources.Lock()
+	defer configSources.Unlock()
+	if set {
+		source = "environment"
+		if configSources.processEnv != nil && !configSources.processEnv[key] {
+			source = ".env"
+		}
+	}
+	configSources.byKey[key] = source
+}
+
+// Log the effective configuration and where it came from. Fields tagged
+// `secret:"true"` are only reported as set, and credentials in proxy URLs are
+// removed.
+func logEffectiveConfig(config Config) {
+	config.HTTPProxy = redactURLCredentials(config.HTTPProxy)
+	config.HTTPSProxy = redactURLCredentials(config.HTTPSProxy)
+
+	v := reflect.ValueOf(config)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := v.Field(i)
+		var value any = field.Interface()
+		if t.Field(i).Tag.Get("secret") == "true" && !field.IsZero() {
+			value = redactedValue
+		}
+		log.Printf("Config %s: %v", t.Field(i).Name, value)
+	}
+
+	configSources.Lock()
+	bySource := make(map[string][]string)
+	for key, source := range configSources.byKey {
+		bySource[source] = append(bySource[source], key)
+	}
+	configSources.Unlock()
+	for _, source := range []string{"environment", ".env", "default"} {
+		keys := bySource[source]
+		slices.Sort(keys)
+		if len(keys) > 0 {
+			log.Printf("Config from %s: %s", source, strings.Join(keys, ", "))
+		}
+	}
+}
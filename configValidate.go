@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"syscall"
+)
+
+// Validate checks the configuration for settings the service can't run
+// with, or shouldn't: every problem found is reported, not just the first.
+// Settings that are parsed into something else, like TLS certificates or the
+// signing key, are checked where they are loaded.
+func (c Config) Validate() error {
+	var errs []error
+	check := func(name string, err error) {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", name, err))
+		}
+	}
+
+	if !c.hasAuthToken() && !c.AllowNoAuth {
+		errs = append(errs, errors.New("AUTH_TOKEN: empty and no API_KEYS are set; set ALLOW_NO_AUTH=true to run without authentication"))
+	}
+	if os.Getenv("UPDATE_AUTH_TOKEN") != "" {
+		check("UPDATE_SCRIPT_PATH", checkExecutable(c.UpdateScriptPath))
+	}
+	check("LOG_DIRECTORY", checkWritableDir(c.LogDirectory))
+	check("LOG_FORMAT", validateLogFormat(c.LogFormat))
+
+	check("INSTALL_FLAGS", validateInstallFlags(c.InstallFlags))
+	check("proxy configuration", checkProxyConfig(c))
+	check("NPM_AUDIT_LEVEL or NPM_AUDIT_MODE", validateAuditSettings(c.NpmAuditLevel, c.NpmAuditMode))
+	check("EAS_TOOLCHAIN", validateEASVersionSpec(c.EASToolchain))
+	check("SYMLINK_POLICY", validateSymlinkPolicy(c.SymlinkPolicy))
+	check("OOM_RETRY_ENV", validateOOMRetryEnv(c.OOMRetryEnv))
+	for _, platform := range c.AllowedPlatforms {
+		if !slices.Contains(allPlatforms, platform) {
+			check("ALLOWED_PLATFORMS", fmt.Errorf("unknown platform %q, expected android or ios", platform))
+		}
+	}
+	if !isValidBranchName(c.DefaultCloneBranch) {
+		check("DEFAULT_CLONE_BRANCH", fmt.Errorf("%q is not a valid branch name", c.DefaultCloneBranch))
+	}
+	for _, profile := range c.AllowedEASProfiles {
+		if !isValidProfileName(profile) {
+			check("ALLOWED_EAS_PROFILES", fmt.Errorf("%q is not a valid profile name", profile))
+		}
+	}
+	if !isValidProfileName(c.DefaultEASProfile) {
+		check("DEFAULT_EAS_PROFILE", fmt.Errorf("%q is not a valid profile name", c.DefaultEASProfile))
+	} else {
+		check("DEFAULT_EAS_PROFILE", checkProfileAllowed(c.AllowedEASProfiles, c.DefaultEASProfile))
+	}
+	check("POST_BUILD_STEPS", validatePostBuildSteps(c.PostBuildSteps))
+	check("RATE_LIMIT_KEY", validateRateLimitKey(c.RateLimitKey))
+	_, err := parseTrustedProxies(c.TrustedProxies)
+	check("TRUSTED_PROXIES", err)
+
+	return errors.Join(errs...)
+}
+
+// Report whether any API key, AUTH_TOKEN included, has a token
+func (c Config) hasAuthToken() bool {
+	for _, key := range c.APIKeys {
+		if key.Token != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Check that path is an executable file
+func checkExecutable(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() || info.Mode().Perm()&0111 == 0 {
+		return fmt.Errorf("%s is not an executable file", path)
+	}
+	return nil
+}
+
+// Check that dir, or the closest existing directory it would be created in,
+// is writable
+func checkWritableDir(dir string) error {
+	for path := dir; ; path = filepath.Dir(path) {
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) && filepath.Dir(path) != path {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", path)
+		}
+		// 0x2 is W_OK, which package syscall doesn't define
+		if err := syscall.Access(path, 0x2); err != nil {
+			return fmt.Errorf("%s is not writable: %v", path, err)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,13 @@
+package main
+
+import "syscall"
+
+// Bytes available to the service on the filesystem holding dir
+func freeDiskSpace(dir string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	// Bavail leaves out the blocks reserved for root
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Default of DEFAULT_EAS_PROFILE, the profile used when none is given
+const defaultBuildProfile = "production"
+
+// Platforms EAS can build, used to detect per-platform profile sections
+var easPlatforms = []string{"android", "ios"}
+
+// errNoEASConfig is returned when the project has no eas.json
+var errNoEASConfig = errors.New("eas.json not found")
+
+// profileError reports a build profile that can't build the requested platform
+type profileError struct {
+	msg string
+}
+
+func (e *profileError) Error() string {
+	return e.msg
+}
+
+// Check that the build profile in eas.json can build the platform. A profile
+// without android or ios sections (following "extends") builds every platform;
+// otherwise only the platforms it has sections for are buildable.
+func checkProfilePlatform(packagePath, profile, platform string) error {
+	data, err := os.ReadFile(filepath.Join(packagePath, "eas.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return errNoEASConfig
+	}
+	if err != nil {
+		return fmt.Errorf("error reading eas.json: %v", err)
+	}
+
+	var easConfig struct {
+		Build map[string]map[string]json.RawMessage `json:"build"`
+	}
+	if err := json.Unmarshal(data, &easConfig); err != nil {
+		return &profileError{msg: fmt.Sprintf("eas.json is not valid: %v", err)}
+	}
+
+	supported := map[string]bool{}
+	seen := map[string]bool{}
+	for name := profile; name != ""; {
+		if seen[name] {
+			return &profileError{msg: fmt.Sprintf("build profile %q has a circular \"extends\"", profile)}
+		}
+		seen[name] = true
+
+		section, ok := easConfig.Build[name]
+		if !ok {
+			if name == profile {
+				return &profileError{msg: fmt.Sprintf("build profile %q is not defined in eas.json (available: %v)", profile, sortedKeys(easConfig.Build))}
+			}
+			return &profileError{msg: fmt.Sprintf("build profile %q extends undefined profile %q", profile, name)}
+		}
+		for _, p := range easPlatforms {
+			if _, ok := section[p]; ok {
+				supported[p] = true
+			}
+		}
+
+		name = ""
+		if raw, ok := section["extends"]; ok {
+			_ = json.Unmarshal(raw, &name)
+		}
+	}
+
+	if len(supported) == 0 || supported[platform] {
+		return nil
+	}
+	return &profileError{msg: fmt.Sprintf("platform %s is not configured in build profile %q, it supports: %v", platform, profile, sortedKeys(supported))}
+}
+
+// Check the build profile against ALLOWED_EAS_PROFILES, which allows any
+// profile when empty
+func checkProfileAllowed(allowed []string, profile string) error {
+	if len(allowed) == 0 || slices.Contains(allowed, profile) {
+		return nil
+	}
+	return fmt.Errorf("build profile %q is not allowed, allowed profiles: %s", profile, strings.Join(allowed, ", "))
+}
+
+// Profile names are passed to the EAS CLI, so keep them to a safe character set
+func isValidProfileName(name string) bool {
+	for i, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '_', c == '.':
+		case c == '-' && i > 0:
+		default:
+			return false
+		}
+	}
+	return name != ""
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Write eas.json into a new project directory
+func writeEASConfig(t *testing.T, config string) string {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "eas.json"), []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+const testEASConfig = `{
+	"cli": {"version": ">= 5.0.0"},
+	"build": {
+		"base": {"node": "20.11.0"},
+		"android-only": {"android": {"buildType": "apk"}},
+		"ios-only": {"ios": {"simulator": true}},
+		"both": {"android": {}, "ios": {}},
+		"everything": {"extends": "base"},
+		"android-store": {"extends": "android-only", "distribution": "store"},
+		"loop-a": {"extends": "loop-b"},
+		"loop-b": {"extends": "loop-a"},
+		"broken": {"extends": "missing"}
+	}
+}`
+
+func TestCheckProfilePlatform(t *testing.T) {
+	dir := writeEASConfig(t, testEASConfig)
+	for _, tc := range []struct {
+		profile, platform string
+		wantErr           string // Empty when buildable
+	}{
+		{"android-only", "android", ""},
+		{"android-only", "ios", `platform ios is not configured in build profile "android-only", it supports: [android]`},
+		{"ios-only", "ios", ""},
+		{"ios-only", "android", `platform android is not configured in build profile "ios-only", it supports: [ios]`},
+		{"both", "android", ""},
+		{"both", "ios", ""},
+		{"everything", "ios", ""},
+		{"android-store", "android", ""},
+		{"android-store", "ios", "it supports: [android]"},
+		{"preview", "android", `build profile "preview" is not defined in eas.json`},
+		{"loop-a", "android", "circular"},
+		{"broken", "android", `extends undefined profile "missing"`},
+	} {
+		t.Run(tc.profile+"/"+tc.platform, func(t *testing.T) {
+			err := checkProfilePlatform(dir, tc.profile, tc.platform)
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			// Profile errors are answered with 422
+			var profileErr *profileError
+			if !errors.As(err, &profileErr) || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("got %v, want a profile error containing %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckProfilePlatformWithoutConfig(t *testing.T) {
+	if err := checkProfilePlatform(t.TempDir(), "production", "android"); !errors.Is(err, errNoEASConfig) {
+		t.Errorf("got %v, want errNoEASConfig", err)
+	}
+	var profileErr *profileError
+	if err := checkProfilePlatform(writeEASConfig(t, "{not json"), "production", "android"); !errors.As(err, &profileErr) {
+		t.Errorf("got %v for invalid eas.json, want a profile error", err)
+	}
+}
+
+func TestIsValidProfileName(t *testing.T) {
+	for name, want := range map[string]bool{
+		"production":    true,
+		"preview_v2.1":  true,
+		"store-release": true,
+		"":              false,
+		"-profile":      false,
+		"a b":           false,
+		"prod;rm":       false,
+	} {
+		if got := isValidProfileName(name); got != want {
+			t.Errorf("isValidProfileName(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
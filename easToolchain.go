@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// Ways of choosing the EAS CLI a build runs with
+const (
+	easToolchainGlobal = "global" // The CLI installed on the host
+	easToolchainAuto   = "auto"   // The version the repository depends on, if any
+)
+
+// Versions, ranges and dist-tags accepted for npx eas-cli@<version>
+var easVersionSpecPattern = regexp.MustCompile(`^[0-9A-Za-z.^~*<>=|-]{1,64}$`)
+
+// easToolchain is the EAS CLI command used for a build and its detected version
+type easToolchain struct {
+	Command []string
+	Info    *easInfo
+}
+
+// Check a requested EAS version: global, auto or a version for npx
+func validateEASVersionSpec(spec string) error {
+	if spec == "" || spec == easToolchainGlobal || spec == easToolchainAuto {
+		return nil
+	}
+	if !easVersionSpecPattern.MatchString(spec) {
+		return fmt.Errorf("invalid EAS version %q, expected global, auto or an eas-cli version", spec)
+	}
+	return nil
+}
+
+// Pick the EAS CLI for a build. A version runs that eas-cli through npx; auto
+// uses the repository's own eas-cli from node_modules, or its declared
+// version through npx, and falls back to the host CLI when it declares none.
+func resolveEASToolchain(ctx context.Context, packagePath, spec string, env []string, global *easInfo, user *buildUser) (*easToolchain, error) {
+	if spec == "" || spec == easToolchainGlobal {
+		return &easToolchain{Command: []string{"eas"}, Info: global}, nil
+	}
+
+	var command []string
+	if spec == easToolchainAuto {
+		local := filepath.Join(packagePath, "node_modules", ".bin", "eas")
+		declared, err := declaredEASVersion(packagePath)
+		switch {
+		case err != nil:
+			return nil, err
+		case declared == "":
+			return &easToolchain{Command: []string{"eas"}, Info: global}, nil
+		case fileExists(local):
+			command = []string{local}
+		default:
+			command = []string{"npx", "--yes", "eas-cli@" + declared}
+		}
+	} else {
+		command = []string{"npx", "--yes", "eas-cli@" + spec}
+	}
+
+	info, err := detectEASVersionWith(ctx, packagePath, env, command, user)
+	if err != nil {
+		return nil, err
+	}
+	return &easToolchain{Command: command, Info: info}, nil
+}
+
+// Read the eas-cli version the project depends on from package.json
+func declaredEASVersion(packagePath string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(packagePath, "package.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("error reading package.json: %v", err)
+	}
+
+	var pkg struct {
+		Dependencies    map[string]string `json:"dependencies"`
+		DevDependencies map[string]string `json:"devDependencies"`
+	}
+	if err := json.Unmarshal(data, &pkg); err != nil {
+		return "", fmt.Errorf("error parsing package.json: %v", err)
+	}
+	for _, deps := range []map[string]string{pkg.DevDependencies, pkg.Dependencies} {
+		if version, ok := deps["eas-cli"]; ok {
+			if !easVersionSpecPattern.MatchString(version) {
+				return "", fmt.Errorf("unsupported eas-cli version %q in package.json", version)
+			}
+			return version, nil
+		}
+	}
+	return "", nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
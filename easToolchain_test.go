@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Put a fake npx on PATH that reports the eas-cli version it was asked for,
+// and the arguments it got
+func installFakeNpx(t *testing.T) {
+	t.Helper()
+	bin := t.TempDir()
+	script := "#!/bin/sh\nfor arg; do case \"$arg\" in eas-cli@*) version=${arg#eas-cli@};; esac; done\n" +
+		"echo \"eas-cli/${version:-0.0.0} linux-x64 node-v20.11.1 args: $*\"\n"
+	if err := os.WriteFile(filepath.Join(bin, "npx"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func writePackageJSON(t *testing.T, content string) string {
+	t.Helper()
+	dir := t.TempDir()
+	if content != "" {
+		if err := os.WriteFile(filepath.Join(dir, "package.json"), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestResolveEASToolchainNpx(t *testing.T) {
+	installFakeNpx(t)
+	global := &easInfo{Version: semver{12, 0, 0}, Raw: "eas-cli/12.0.0"}
+
+	for _, tc := range []struct {
+		name, packageJSON, spec string
+		wantCommand             []string
+		wantVersion             semver
+	}{
+		{"pinned version", "", "16.3.1", []string{"npx", "--yes", "eas-cli@16.3.1"}, semver{16, 3, 1}},
+		{"declared devDependency", `{"devDependencies": {"eas-cli": "15.0.2"}}`, easToolchainAuto, []string{"npx", "--yes", "eas-cli@15.0.2"}, semver{15, 0, 2}},
+		{"declared dependency", `{"dependencies": {"eas-cli": "14.7.0"}}`, easToolchainAuto, []string{"npx", "--yes", "eas-cli@14.7.0"}, semver{14, 7, 0}},
+		{"auto without a declaration", `{"dependencies": {"expo": "~51.0.0"}}`, easToolchainAuto, []string{"eas"}, semver{12, 0, 0}},
+		{"global", "", easToolchainGlobal, []string{"eas"}, semver{12, 0, 0}},
+		{"default", "", "", []string{"eas"}, semver{12, 0, 0}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := writePackageJSON(t, tc.packageJSON)
+			toolchain, err := resolveEASToolchain(context.Background(), dir, tc.spec, nil, global, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(toolchain.Command, tc.wantCommand) {
+				t.Errorf("command %q, want %q", toolchain.Command, tc.wantCommand)
+			}
+			if toolchain.Info.Version != tc.wantVersion {
+				t.Errorf("version %v, want %v", toolchain.Info.Version, tc.wantVersion)
+			}
+			// npx is asked for the version of the pinned CLI
+			if tc.wantCommand[0] == "npx" && !strings.HasSuffix(toolchain.Info.Raw, "--yes eas-cli@"+tc.wantVersion.String()+" --version") {
+				t.Errorf("npx ran as %q", toolchain.Info.Raw)
+			}
+		})
+	}
+}
+
+// A repository's installed eas-cli is used before fetching it through npx
+func TestResolveEASToolchainLocalBinary(t *testing.T) {
+	dir := writePackageJSON(t, `{"devDependencies": {"eas-cli": "^16.0.0"}}`)
+	local := filepath.Join(dir, "node_modules", ".bin", "eas")
+	if err := os.MkdirAll(filepath.Dir(local), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(local, []byte("#!/bin/sh\necho eas-cli/16.1.0 linux-x64 node-v20.11.1\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	toolchain, err := resolveEASToolchain(context.Background(), dir, easToolchainAuto, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(toolchain.Command, []string{local}) || toolchain.Info.Version != (semver{16, 1, 0}) {
+		t.Errorf("got %q at %v", toolchain.Command, toolchain.Info.Version)
+	}
+}
+
+func TestEASVersionSpecs(t *testing.T) {
+	installFakeNpx(t)
+	for spec, valid := range map[string]bool{"": true, "global": true, "auto": true, "16.3.1": true, "^16.0.0": true, ">=15 <17": false, "latest": true, "16.3.1;rm": false, "$(id)": false} {
+		if err := validateEASVersionSpec(spec); (err == nil) != valid {
+			t.Errorf("validateEASVersionSpec(%q) = %v", spec, err)
+		}
+	}
+
+	// Versions from package.json are passed to npx too, so they're held to the same rules
+	dir := writePackageJSON(t, `{"devDependencies": {"eas-cli": "file:../evil"}}`)
+	if _, err := resolveEASToolchain(context.Background(), dir, easToolchainAuto, nil, nil, nil); err == nil || !strings.Contains(err.Error(), "unsupported eas-cli version") {
+		t.Errorf("got %v for a file: dependency", err)
+	}
+	// Too old for local builds
+	if _, err := resolveEASToolchain(context.Background(), t.TempDir(), "0.30.0", nil, nil, nil); err == nil || !strings.Contains(err.Error(), "too old") {
+		t.Errorf("got %v for eas-cli 0.30.0", err)
+	}
+}
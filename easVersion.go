@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// semver is a parsed major.minor.patch version
+type semver [3]int
+
+func (v semver) String() string {
+	return fmt.Sprintf("%d.%d.%d", v[0], v[1], v[2])
+}
+
+func (v semver) less(other semver) bool {
+	for i := range v {
+		if v[i] != other[i] {
+			return v[i] < other[i]
+		}
+	}
+	return false
+}
+
+// Minimum EAS CLI version able to run local builds at all
+var minEASVersion = semver{0, 34, 0}
+
+// Newest EAS CLI major version this service has been tested against
+const maxTestedEASMajor = 16
+
+// easFlagMatrix lists optional EAS flags and the first CLI version supporting them.
+// Flags missing from the detected version are dropped and handled by fallbacks.
+var easFlagMatrix = map[string]semver{
+	"--output":      {0, 48, 0},
+	"--clear-cache": {0, 40, 0},
+}
+
+var easVersionPattern = regexp.MustCompile(`eas-cli/(\d+)\.(\d+)\.(\d+)`)
+
+// easInfo describes the EAS CLI installed on the host
+type easInfo struct {
+	Version semver
+	Raw     string
+}
+
+// Supports reports whether the detected EAS CLI understands the given flag
+func (e *easInfo) Supports(flag string) bool {
+	if e == nil {
+		// The version is unknown, assume a current CLI
+		return true
+	}
+	minVersion, ok := easFlagMatrix[flag]
+	if !ok {
+		return true
+	}
+	return !e.Version.less(minVersion)
+}
+
+// Detect the installed EAS CLI version and check it can be used for local builds
+func detectEASVersion(ctx context.Context) (*easInfo, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	return detectEASVersionWith(ctx, "", nil, []string{"eas"}, nil)
+}
+
+// Detect the version of the EAS CLI run by command, which may be npx
+// fetching it first, and check it can be used for local builds
+func detectEASVersionWith(ctx context.Context, dir string, env, command []string, user *buildUser) (*easInfo, error) {
+	cmd := exec.CommandContext(ctx, command[0], append(command[1:], "--version")...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+	user.apply(cmd)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("error running %s --version (is eas-cli installed?): %v, output: %s", strings.Join(command, " "), err, string(output))
+	}
+
+	raw := strings.TrimSpace(string(output))
+	version, err := parseEASVersion(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	if version.less(minEASVersion) {
+		return nil, fmt.Errorf("eas-cli %s is too old, local builds require at least %s", version, minEASVersion)
+	}
+
+	return &easInfo{Version: version, Raw: raw}, nil
+}
+
+// Parse the output of `eas --version`, e.g. "eas-cli/16.3.1 linux-x64 node-v20.11.1"
+func parseEASVersion(output string) (semver, error) {
+	match := easVersionPattern.FindStringSubmatch(output)
+	if match == nil {
+		return semver{}, fmt.Errorf("unrecognized eas --version output: %q", output)
+	}
+
+	var version semver
+	for i := range version {
+		version[i], _ = strconv.Atoi(match[i+1])
+	}
+	return version, nil
+}
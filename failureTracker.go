@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// failureAlert is posted to FAILURE_ALERT_WEBHOOK when a repository's builds
+// keep failing
+type failureAlert struct {
+	Repo                string    `json:"repo"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	BuildID             string    `json:"build_id"`
+	Status              string    `json:"status"`
+	Error               string    `json:"error"`
+	Time                time.Time `json:"time"`
+}
+
+// failureTracker counts consecutive failed builds per repository. A success
+// resets the count. Crossing the threshold raises one alert per streak.
+type failureTracker struct {
+	mu        sync.Mutex
+	threshold int
+	counts    map[string]int
+	alert     func(failureAlert)
+}
+
+func newFailureTracker(threshold int, alert func(failureAlert)) *failureTracker {
+	return &failureTracker{threshold: threshold, counts: make(map[string]int), alert: alert}
+}
+
+// Observe records the outcome of a finished build. Builds that never started,
+// e.g. rejected by a full queue, don't count.
+func (t *failureTracker) Observe(record BuildRecord) {
+	// Cancelled builds say nothing about the repository
+	if !record.Finished() || record.StartedAt == nil || record.Status == statusCancelled {
+		return
+	}
+	key := normalizeRepoKey(record.Repo)
+
+	t.mu.Lock()
+	if record.Status == statusSucceeded {
+		delete(t.counts, key)
+		t.mu.Unlock()
+		return
+	}
+	t.counts[key]++
+	count := t.counts[key]
+	t.mu.Unlock()
+
+	if t.threshold > 0 && count == t.threshold && t.alert != nil {
+		slog.Warn("Repository failed several builds in a row", "repo", record.Repo, "build_id", record.ID, "count", count)
+		t.alert(failureAlert{
+			Repo:                record.Repo,
+			ConsecutiveFailures: count,
+			BuildID:             record.ID,
+			Status:              record.Status,
+			Error:               record.Error,
+			Time:                time.Now(),
+		})
+	}
+}
+
+// Counts returns the consecutive failures of every repository currently failing
+func (t *failureTracker) Counts() map[string]int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	counts := make(map[string]int, len(t.counts))
+	for key, count := range t.counts {
+		counts[key] = count
+	}
+	return counts
+}
+
+// Post failure alerts to the webhook in the background, retrying with the
+// callback backoff policy
+func webhookFailureAlert(config Config) func(failureAlert) {
+	if config.FailureAlertWebhook == "" {
+		return nil
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	return func(alert failureAlert) {
+		body, err := json.Marshal(alert)
+		if err != nil {
+			slog.Error("Failed to encode failure alert", "build_id", alert.BuildID, "error", err)
+			return
+		}
+		go config.CallbackRetry.Run(context.Background(), alert.BuildID, "Failure alert", func() error {
+			resp, err := client.Post(config.FailureAlertWebhook, "application/json", bytes.NewReader(body))
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				return fmt.Errorf("webhook responded with %s", resp.Status)
+			}
+			return nil
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// finishedRecord returns a build of repo that started and ended with status
+func finishedRecord(id, repo, status string) BuildRecord {
+	now := time.Now()
+	return BuildRecord{ID: id, Repo: repo, Status: status, StartedAt: &now, FinishedAt: &now}
+}
+
+func TestFailureTrackerFailuresAndRecovery(t *testing.T) {
+	const repo = "https://example.com/org/app.git"
+	var alerts []failureAlert
+	tracker := newFailureTracker(3, func(alert failureAlert) { alerts = append(alerts, alert) })
+
+	tracker.Observe(finishedRecord("b1", repo, statusFailed))
+	tracker.Observe(finishedRecord("b2", repo, statusLockfileDrift))
+	if got := tracker.Counts()[normalizeRepoKey(repo)]; got != 2 {
+		t.Fatalf("count after 2 failures = %d, want 2", got)
+	}
+	if len(alerts) != 0 {
+		t.Fatalf("alerted below the threshold: %+v", alerts)
+	}
+
+	// The same repository spelled differently shares the streak
+	tracker.Observe(finishedRecord("b3", "https://EXAMPLE.com/org/app/", statusFailed))
+	if len(alerts) != 1 {
+		t.Fatalf("alerts at the threshold = %d, want 1", len(alerts))
+	}
+	if alerts[0].ConsecutiveFailures != 3 || alerts[0].BuildID != "b3" || alerts[0].Status != statusFailed {
+		t.Errorf("alert = %+v, want 3 failures ending with b3", alerts[0])
+	}
+
+	// One alert per streak
+	tracker.Observe(finishedRecord("b4", repo, statusFailed))
+	if len(alerts) != 1 {
+		t.Fatalf("alerts past the threshold = %d, want 1", len(alerts))
+	}
+	if got := tracker.Counts()[normalizeRepoKey(repo)]; got != 4 {
+		t.Fatalf("count after 4 failures = %d, want 4", got)
+	}
+
+	tracker.Observe(finishedRecord("b5", repo, statusSucceeded))
+	if _, ok := tracker.Counts()[normalizeRepoKey(repo)]; ok {
+		t.Fatalf("counts after a success = %v, want the repository cleared", tracker.Counts())
+	}
+
+	// A new streak alerts again
+	for _, id := range []string{"c1", "c2", "c3"} {
+		tracker.Observe(finishedRecord(id, repo, statusFailed))
+	}
+	if len(alerts) != 2 || alerts[1].BuildID != "c3" {
+		t.Fatalf("alerts after a second streak = %+v, want a second alert for c3", alerts)
+	}
+}
+
+func TestFailureTrackerIgnoresUnstartedAndCancelled(t *testing.T) {
+	const repo = "https://example.com/org/app"
+	tracker := newFailureTracker(1, nil)
+
+	cancelled := finishedRecord("b1", repo, statusCancelled)
+	tracker.Observe(cancelled)
+
+	rejected := finishedRecord("b2", repo, statusFailed)
+	rejected.StartedAt = nil
+	tracker.Observe(rejected)
+
+	running := finishedRecord("b3", repo, statusFailed)
+	running.FinishedAt = nil
+	tracker.Observe(running)
+
+	if counts := tracker.Counts(); len(counts) != 0 {
+		t.Fatalf("counts = %v, want none", counts)
+	}
+
+	// A cancellation doesn't end a streak either
+	tracker.Observe(finishedRecord("b4", repo, statusFailed))
+	tracker.Observe(cancelled)
+	tracker.Observe(finishedRecord("b5", repo, statusFailed))
+	if got := tracker.Counts()[repo]; got != 2 {
+		t.Fatalf("count = %d, want 2", got)
+	}
+}
+
+func TestFailureTrackerKeepsReposApart(t *testing.T) {
+	tracker := newFailureTracker(2, nil)
+	tracker.Observe(finishedRecord("b1", "https://example.com/a", statusFailed))
+	tracker.Observe(finishedRecord("b2", "https://example.com/b", statusFailed))
+	tracker.Observe(finishedRecord("b3", "https://example.com/b", statusSucceeded))
+
+	counts := tracker.Counts()
+	if counts["https://example.com/a"] != 1 || len(counts) != 1 {
+		t.Fatalf("counts = %v, want only a with 1 failure", counts)
+	}
+}
+
+func TestWebhookFailureAlert(t *testing.T) {
+	if webhookFailureAlert(Config{}) != nil {
+		t.Fatal("alert func without FAILURE_ALERT_WEBHOOK, want nil")
+	}
+
+	received := make(chan failureAlert, 1)
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		var alert failureAlert
+		if err := json.NewDecoder(r.Body).Decode(&alert); err != nil {
+			t.Errorf("decode alert: %v", err)
+		}
+		received <- alert
+	}))
+	defer server.Close()
+
+	alert := webhookFailureAlert(Config{
+		FailureAlertWebhook: server.URL,
+		CallbackRetry:       backoffPolicy{MaxAttempts: 2, Base: time.Millisecond, Cap: time.Millisecond},
+	})
+	alert(failureAlert{Repo: "https://example.com/app", ConsecutiveFailures: 3, BuildID: "b3", Status: statusFailed})
+
+	select {
+	case got := <-received:
+		if got.Repo != "https://example.com/app" || got.ConsecutiveFailures != 3 || got.BuildID != "b3" {
+			t.Errorf("posted alert = %+v", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the webhook never received the alert")
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Maximum number of git config overrides a single request may pass
+const maxRequestGitConfig = 16
+
+// Git config keys that may be overridden at clone time. Matching is
+// case-insensitive; "*" stands for a subsection such as the base URL of
+// url.<base>.insteadOf.
+var allowedGitConfigKeys = []string{
+	"http.postbuffer",
+	"http.lowspeedlimit",
+	"http.lowspeedtime",
+	"http.version",
+	"http.extraheader",
+	"http.*.extraheader",
+	"core.compression",
+	"protocol.version",
+	"url.*.insteadof",
+}
+
+// Keys that make git run a command. They are only accepted from the server
+// configuration, and only when GIT_CONFIG_ALLOW_COMMANDS is enabled.
+var commandGitConfigKeys = []string{
+	"core.sshcommand",
+	"core.gitproxy",
+	"credential.helper",
+}
+
+// Parse server-wide overrides in the form "key=value,key2=value2"
+func parseGitConfig(spec string, allowCommands bool) ([]string, error) {
+	overrides := map[string]string{}
+	for _, entry := range splitList(spec) {
+		key, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("git config override %q is not in the form key=value", entry)
+		}
+		overrides[strings.TrimSpace(key)] = value
+	}
+	return validateGitConfig(overrides, allowCommands)
+}
+
+// Validate git config overrides against the allowlist and return them as
+// key=value pairs for `git -c`, sorted for reproducible command lines
+func validateGitConfig(overrides map[string]string, allowCommands bool) ([]string, error) {
+	pairs := make([]string, 0, len(overrides))
+	for key, value := range overrides {
+		if !isAllowedGitConfigKey(key, allowCommands) {
+			return nil, fmt.Errorf("git config key %q is not allowed", key)
+		}
+		if strings.ContainsAny(value, "\n\r\x00") {
+			return nil, fmt.Errorf("git config value for %q contains invalid characters", key)
+		}
+		// Rewriting URLs to the ext:: or fd:: transports would run arbitrary commands
+		if strings.HasSuffix(strings.ToLower(key), ".insteadof") && (strings.Contains(key, "::") || strings.Contains(value, "::")) {
+			return nil, fmt.Errorf("git config %q may not use the ext:: or fd:: transports", key)
+		}
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return pairs, nil
+}
+
+// Check a key against the allowlist, comparing section and name
+// case-insensitively and accepting any subsection where "*" is given
+func isAllowedGitConfigKey(key string, allowCommands bool) bool {
+	parts := strings.Split(key, ".")
+	if len(parts) < 2 {
+		return false
+	}
+	section, name := strings.ToLower(parts[0]), strings.ToLower(parts[len(parts)-1])
+	normalized := section + "." + name
+	if len(parts) > 2 {
+		normalized = section + ".*." + name
+	}
+
+	allowed := allowedGitConfigKeys
+	if allowCommands {
+		allowed = append(allowed[:len(allowed):len(allowed)], commandGitConfigKeys...)
+	}
+	for _, candidate := range allowed {
+		if candidate == normalized {
+			return true
+		}
+	}
+	return false
+}
+
+// Prefix git arguments with the -c overrides of the clone options
+func gitArgs(opts cloneOptions, args ...string) []string {
+	full := make([]string, 0, 2*len(opts.GitConfig)+len(args))
+	for _, pair := range opts.GitConfig {
+		full = append(full, "-c", pair)
+	}
+	return append(full, args...)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// Username sent with git_token. GitHub requires this one for app and
+// fine-grained tokens; GitLab and others accept any username with a token.
+const gitTokenUsername = "x-access-token"
+
+// Environment variable handing the token to the askpass script
+const gitTokenEnv = "EXPO_BUILD_GIT_TOKEN"
+
+// The askpass script answers git's username and password prompts. It holds
+// no secret itself: the token only lives in the environment of the git
+// processes, never in the URL, the command line or a file.
+const gitAskpassScript = `#!/bin/sh
+case "$1" in
+Username*) echo "` + gitTokenUsername + `" ;;
+*) echo "$` + gitTokenEnv + `" ;;
+esac
+`
+
+// Prepare git to authenticate HTTPS remotes with token. Returns the
+// environment to add to git commands and a function removing the askpass
+// script, to be called however the build ends.
+func gitTokenEnvironment(token string) ([]string, func(), error) {
+	file, err := os.CreateTemp("", "git-askpass-*.sh")
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating askpass script: %v", err)
+	}
+	remove := func() { os.Remove(file.Name()) }
+	_, err = file.WriteString(gitAskpassScript)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(file.Name(), 0700)
+	}
+	if err != nil {
+		remove()
+		return nil, nil, fmt.Errorf("error writing askpass script: %v", err)
+	}
+	env := []string{
+		"GIT_ASKPASS=" + file.Name(),
+		gitTokenEnv + "=" + token,
+		// Use the token rather than a credential helper of the service user
+		"GIT_CONFIG_COUNT=1",
+		"GIT_CONFIG_KEY_0=credential.helper",
+		"GIT_CONFIG_VALUE_0=",
+	}
+	return env, remove, nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// gitVersion is an app version derived from the repository's history
+type gitVersion struct {
+	// Version is the latest tag reachable from HEAD without a leading "v",
+	// 0.0.0 when there is none
+	Version string `json:"version"`
+	// BuildNumber is the number of commits up to HEAD
+	BuildNumber int `json:"build_number"`
+	// Describe is the output of git describe, e.g. v1.4.0-3-g1a2b3c4
+	Describe string `json:"describe"`
+}
+
+// Compute the version of the cloned commit. Tags and commit counts need the
+// full history, so a shallow clone is deepened first.
+func computeGitVersion(ctx context.Context, clonePath, repoURL string, opts cloneOptions) (gitVersion, error) {
+	shallow, err := runGit(ctx, clonePath, repoURL, opts, "rev-parse", "--is-shallow-repository")
+	if err != nil {
+		return gitVersion{}, fmt.Errorf("error running git rev-parse: %v, output: %s", err, shallow)
+	}
+	if strings.TrimSpace(shallow) == "true" {
+		if output, err := runGit(ctx, clonePath, repoURL, opts, gitArgs(opts, "fetch", "--unshallow", "--tags", "origin")...); err != nil {
+			return gitVersion{}, fmt.Errorf("error fetching the full history: %v, output: %s", err, output)
+		}
+	}
+
+	count, err := runGit(ctx, clonePath, repoURL, opts, "rev-list", "--count", "HEAD")
+	if err != nil {
+		return gitVersion{}, fmt.Errorf("error counting commits: %v, output: %s", err, count)
+	}
+	v := gitVersion{Version: "0.0.0"}
+	if v.BuildNumber, err = strconv.Atoi(strings.TrimSpace(count)); err != nil {
+		return gitVersion{}, fmt.Errorf("unexpected commit count %q", count)
+	}
+	describe, err := runGit(ctx, clonePath, repoURL, opts, "describe", "--tags", "--always")
+	if err != nil {
+		return gitVersion{}, fmt.Errorf("error running git describe: %v, output: %s", err, describe)
+	}
+	v.Describe = strings.TrimSpace(describe)
+	// Without tags the output has no tag part to take the version from
+	if tag, err := runGit(ctx, clonePath, repoURL, opts, "describe", "--tags", "--abbrev=0"); err == nil {
+		v.Version = strings.TrimPrefix(strings.TrimSpace(tag), "v")
+	}
+	return v, nil
+}
+
+// Environment for app.config.js and build scripts to pick up the version
+func (v gitVersion) env() []string {
+	return []string{"APP_VERSION=" + v.Version, "APP_BUILD_NUMBER=" + strconv.Itoa(v.BuildNumber)}
+}
+
+// Part of the artifact filename identifying the version
+func (v gitVersion) filenameTag() string {
+	return strings.Map(func(r rune) rune {
+		if r == '.' || r == '-' || r == '_' || ('0' <= r && r <= '9') || ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') {
+			return r
+		}
+		return '_'
+	}, fmt.Sprintf("%s-%d", v.Version, v.BuildNumber))
+}
+
+// Matches of the version settings in native Android and iOS projects
+var (
+	gradleVersionCode  = regexp.MustCompile(`(versionCode\s+)\d+`)
+	gradleVersionName  = regexp.MustCompile(`(versionName\s+)"[^"]*"`)
+	plistShortVersion  = regexp.MustCompile(`(<key>CFBundleShortVersionString</key>\s*<string>)[^<]*(</string>)`)
+	plistBundleVersion = regexp.MustCompile(`(<key>CFBundleVersion</key>\s*<string>)[^<]*(</string>)`)
+)
+
+// Write the version into app.json and, for projects with native directories,
+// into build.gradle and Info.plist. The returned function restores the files.
+func patchAppVersion(ctx context.Context, packagePath string, v gitVersion) (func(), error) {
+	var restores []func()
+	restore := func() {
+		for i := len(restores) - 1; i >= 0; i-- {
+			restores[i]()
+		}
+	}
+	patch := func(relPath string, edit func([]byte) ([]byte, error)) error {
+		data, err := os.ReadFile(filepath.Join(packagePath, relPath))
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading %s: %v", relPath, err)
+		}
+		patched, err := edit(data)
+		if err != nil {
+			return fmt.Errorf("error patching %s: %v", relPath, err)
+		}
+		remove, err := injectFile(ctx, packagePath, relPath, patched)
+		if err != nil {
+			return err
+		}
+		restores = append(restores, remove)
+		return nil
+	}
+
+	build := strconv.Itoa(v.BuildNumber)
+	version := strings.ReplaceAll(v.Version, "$", "$$") // Literal in replacement templates
+	err := patch("app.json", func(data []byte) ([]byte, error) {
+		var appJSON map[string]any
+		if err := json.Unmarshal(data, &appJSON); err != nil {
+			return nil, err
+		}
+		expo, ok := appJSON["expo"].(map[string]any)
+		if !ok {
+			return data, nil
+		}
+		expo["version"] = v.Version
+		for platform, key := range map[string]string{"android": "versionCode", "ios": "buildNumber"} {
+			settings, ok := expo[platform].(map[string]any)
+			if !ok {
+				settings = map[string]any{}
+				expo[platform] = settings
+			}
+			if platform == "android" {
+				settings[key] = v.BuildNumber
+			} else {
+				settings[key] = build
+			}
+		}
+		var buf bytes.Buffer
+		encoder := json.NewEncoder(&buf)
+		encoder.SetEscapeHTML(false)
+		encoder.SetIndent("", "  ")
+		err := encoder.Encode(appJSON)
+		return buf.Bytes(), err
+	})
+	if err == nil {
+		err = patch(filepath.Join("android", "app", "build.gradle"), func(data []byte) ([]byte, error) {
+			data = gradleVersionCode.ReplaceAll(data, []byte("${1}"+build))
+			return gradleVersionName.ReplaceAll(data, []byte(`${1}"`+version+`"`)), nil
+		})
+	}
+	if err == nil {
+		plists, _ := filepath.Glob(filepath.Join(packagePath, "ios", "*", "Info.plist"))
+		for _, plist := range plists {
+			rel, _ := filepath.Rel(packagePath, plist)
+			if err = patch(rel, func(data []byte) ([]byte, error) {
+				data = plistShortVersion.ReplaceAll(data, []byte("${1}"+version+"${2}"))
+				return plistBundleVersion.ReplaceAll(data, []byte("${1}"+build+"${2}")), nil
+			}); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		restore()
+		return nil, err
+	}
+	return restore, nil
+}
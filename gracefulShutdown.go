@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// How long shutdown waits for cancelled builds to stop their processes
+const buildReapTimeout = 30 * time.Second
+
+// buildDrain tracks the builds in flight, async ones included, so shutdown
+// can wait for them while no longer accepting new ones
+type buildDrain struct {
+	mu       sync.Mutex
+	draining bool
+	builds   sync.WaitGroup
+}
+
+// Track wraps the build handler, counting the build until it ends and
+// answering 503 Service Unavailable once the service is shutting down
+func (d *buildDrain) Track(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Add under the lock so no build slips in after Wait started
+		d.mu.Lock()
+		if d.draining {
+			d.mu.Unlock()
+			w.Header().Set("Connection", "close")
+			http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		d.builds.Add(1)
+		d.mu.Unlock()
+		defer d.builds.Done()
+		next(w, r)
+	}
+}
+
+// Drain stops accepting builds and waits until the running ones ended or the
+// deadline passed. Reports whether they all ended.
+func (d *buildDrain) Drain(deadline time.Time) bool {
+	d.mu.Lock()
+	d.draining = true
+	d.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.builds.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
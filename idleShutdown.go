@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// idleMonitor reports when the service has gone without requests and builds
+// for a while, so an on-demand deployment can be scaled to zero
+type idleMonitor struct {
+	timeout time.Duration
+	queue   *buildQueue
+	mu      sync.Mutex
+	active  int // Requests being served
+	last    time.Time
+}
+
+// Returns nil, which is never idle, when timeout is 0
+func newIdleMonitor(timeout time.Duration, queue *buildQueue) *idleMonitor {
+	if timeout <= 0 {
+		return nil
+	}
+	return &idleMonitor{timeout: timeout, queue: queue, last: time.Now()}
+}
+
+// Wrap counts the requests served by next as activity. Health checks don't
+// count, or the orchestrator's probes would keep the service up.
+func (m *idleMonitor) Wrap(next http.Handler) http.Handler {
+	if m == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		m.mu.Lock()
+		m.active++
+		m.last = time.Now()
+		m.mu.Unlock()
+		defer func() {
+			m.mu.Lock()
+			m.active--
+			m.last = time.Now()
+			m.mu.Unlock()
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Idle returns a channel closed once no request has been served and no build
+// has run or waited for the timeout. The channel of a nil monitor is never
+// closed.
+func (m *idleMonitor) Idle() <-chan struct{} {
+	if m == nil {
+		return nil
+	}
+	idle := make(chan struct{})
+	go func() {
+		for {
+			m.mu.Lock()
+			// Builds can outlive the request that started them
+			if m.active > 0 || m.queue.Running() > 0 || m.queue.Waiting() > 0 {
+				m.last = time.Now()
+			}
+			idleFor := time.Since(m.last)
+			m.mu.Unlock()
+			if idleFor >= m.timeout {
+				close(idle)
+				return
+			}
+			time.Sleep(m.timeout - idleFor)
+		}
+	}()
+	return idle
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Default locations of the Firebase config files relative to the package directory
+const (
+	defaultGoogleServicesFile = "google-services.json"
+	defaultGoogleServiceInfo  = "GoogleService-Info.plist"
+)
+
+// Write secret contents to a file inside root and return a function that
+// removes it again, restoring any file that was there before
+func injectFile(ctx context.Context, root, relPath string, contents []byte) (func(), error) {
+	target := filepath.Join(root, relPath)
+	if rel, err := filepath.Rel(root, target); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, fmt.Errorf("path %s escapes the project directory", relPath)
+	}
+	// The path may still lead out through a symlink in the project, check the
+	// deepest part of it that exists with all links resolved
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving the project directory: %v", err)
+	}
+	existing := target
+	for {
+		if _, err := os.Lstat(existing); err == nil || filepath.Dir(existing) == existing {
+			break
+		}
+		existing = filepath.Dir(existing)
+	}
+	if !resolvesWithin(realRoot, existing) {
+		return nil, fmt.Errorf("path %s escapes the project directory through a symlink", relPath)
+	}
+
+	original, err := os.ReadFile(target)
+	hadOriginal := err == nil
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return nil, fmt.Errorf("error creating directory for %s: %v", relPath, err)
+	}
+	if err := os.WriteFile(target, contents, 0600); err != nil {
+		return nil, fmt.Errorf("error writing %s: %v", relPath, err)
+	}
+
+	return func() {
+		var err error
+		if hadOriginal {
+			err = os.WriteFile(target, original, 0644)
+		} else {
+			err = os.Remove(target)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			loggerFrom(ctx).Warn("Failed to remove injected file", "file", relPath, "error", err)
+		}
+	}, nil
+}
+
+// Load the Firebase config files for a build, either from the base64 fields
+// of the request or from a named entry in the secrets directory
+func loadFirebaseFiles(config Config, req BuildRequest) (googleServices, serviceInfo []byte, err error) {
+	if req.FirebaseSecret != "" {
+		if config.FirebaseSecretsDir == "" {
+			return nil, nil, errors.New("firebase_secret requires FIREBASE_SECRETS_DIR to be configured")
+		}
+		if strings.ContainsAny(req.FirebaseSecret, `/\`) || strings.HasPrefix(req.FirebaseSecret, ".") {
+			return nil, nil, errors.New("invalid firebase_secret name")
+		}
+		dir := filepath.Join(config.FirebaseSecretsDir, req.FirebaseSecret)
+		if _, err := os.Stat(dir); err != nil {
+			return nil, nil, fmt.Errorf("unknown firebase_secret %q", req.FirebaseSecret)
+		}
+		googleServices, _ = os.ReadFile(filepath.Join(dir, defaultGoogleServicesFile))
+		serviceInfo, _ = os.ReadFile(filepath.Join(dir, defaultGoogleServiceInfo))
+	}
+
+	if req.GoogleServicesJSON != "" {
+		if googleServices, err = base64.StdEncoding.DecodeString(req.GoogleServicesJSON); err != nil {
+			return nil, nil, errors.New("google_services_json is not valid base64")
+		}
+	}
+	if req.GoogleServiceInfoPlist != "" {
+		if serviceInfo, err = base64.StdEncoding.DecodeString(req.GoogleServiceInfoPlist); err != nil {
+			return nil, nil, errors.New("google_service_info_plist is not valid base64")
+		}
+	}
+
+	if googleServices != nil {
+		var obj map[string]any
+		if err := json.Unmarshal(googleServices, &obj); err != nil {
+			return nil, nil, errors.New("google-services.json is not a valid JSON object")
+		}
+	}
+	if serviceInfo != nil && !isValidPlist(serviceInfo) {
+		return nil, nil, errors.New("GoogleService-Info.plist is not a valid property list")
+	}
+
+	return googleServices, serviceInfo, nil
+}
+
+// Check that data is a binary property list or a well-formed XML property list
+func isValidPlist(data []byte) bool {
+	if bytes.HasPrefix(data, []byte("bplist00")) {
+		return true
+	}
+
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	sawPlist := false
+	for {
+		token, err := decoder.Token()
+		if errors.Is(err, io.EOF) {
+			return sawPlist
+		}
+		if err != nil {
+			return false
+		}
+		if start, ok := token.(xml.StartElement); ok && start.Name.Local == "plist" {
+			sawPlist = true
+		}
+	}
+}
+
+// Resolve where the project expects its Firebase config files, honoring
+// expo.android.googleServicesFile and expo.ios.googleServicesFile in app.json
+func firebaseFilePaths(packagePath string) (android, ios string) {
+	android, ios = defaultGoogleServicesFile, defaultGoogleServiceInfo
+
+	data, err := os.ReadFile(filepath.Join(packagePath, "app.json"))
+	if err != nil {
+		return android, ios
+	}
+	var appJSON struct {
+		Expo struct {
+			Android struct {
+				GoogleServicesFile string `json:"googleServicesFile"`
+			} `json:"android"`
+			IOS struct {
+				GoogleServicesFile string `json:"googleServicesFile"`
+			} `json:"ios"`
+		} `json:"expo"`
+	}
+	if err := json.Unmarshal(data, &appJSON); err != nil {
+		return android, ios
+	}
+	if path := appJSON.Expo.Android.GoogleServicesFile; path != "" {
+		android = filepath.Clean(path)
+	}
+	if path := appJSON.Expo.IOS.GoogleServicesFile; path != "" {
+		ios = filepath.Clean(path)
+	}
+	return android, ios
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Secrets are never written through a symlink leading out of the project
+func TestInjectFileThroughSymlink(t *testing.T) {
+	parent := t.TempDir()
+	outside := filepath.Join(parent, "outside")
+	root := filepath.Join(parent, "clone")
+	for _, dir := range []string{outside, filepath.Join(root, "d")} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"credentials": outside,                          // Directory outside
+		".env":        filepath.Join(outside, "dotenv"), // Dangling, would create a file outside
+		"d/y":         "..",                             // The project itself
+		"x":           "d/y/../outside",                 // Lexically inside, escapes through d/y
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, relPath := range []string{"credentials/android/keystore.jks", ".env", "x/secret"} {
+		if remove, err := injectFile(context.Background(), root, relPath, []byte("secret")); err == nil {
+			remove()
+			t.Errorf("%s was written", relPath)
+		}
+	}
+	if entries, _ := os.ReadDir(outside); len(entries) != 0 {
+		t.Errorf("files written outside the project: %v", entries)
+	}
+
+	// A link staying inside the project is fine
+	remove, err := injectFile(context.Background(), root, "d/y/google-services.json", []byte("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "google-services.json")); err != nil {
+		t.Errorf("file not written through the link: %v", err)
+	}
+	remove()
+	if _, err := os.Stat(filepath.Join(root, "google-services.json")); !os.IsNotExist(err) {
+		t.Errorf("file kept after removal: %v", err)
+	}
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	texttemplate "text/template"
+
+	"github.com/skip2/go-qrcode"
+)
+
+// File in a build's artifact directory describing its install links
+const installInfoFile = "install.json"
+
+// installLinks lets testers install a build without an API key. The links
+// carry a token derived from the build ID, so they can't be guessed for
+// other builds.
+type installLinks struct {
+	// PageURL is a page with a download button and a QR code of itself
+	PageURL string `json:"page_url"`
+	// InstallURL installs the app when opened on a device: the APK itself for
+	// Android, an itms-services:// link for iOS
+	InstallURL string `json:"install_url"`
+	// QRCodeURL is a PNG QR code of PageURL
+	QRCodeURL string `json:"qr_code_url"`
+	// ManifestURL is the iOS install manifest
+	ManifestURL string `json:"manifest_url,omitempty"`
+}
+
+// installInfo is what the install endpoints need to know about a build
+type installInfo struct {
+	Platform         string `json:"platform"`
+	Title            string `json:"title"`
+	BundleIdentifier string `json:"bundle_identifier,omitempty"`
+	BundleVersion    string `json:"bundle_version,omitempty"`
+}
+
+// installLinker creates and checks install links
+type installLinker struct {
+	config  Config
+	baseURL string
+	secret  []byte
+}
+
+// Returns nil when PUBLIC_BASE_URL isn't set. Without INSTALL_LINK_SECRET a
+// random secret is used, so links stop working when the service restarts.
+func newInstallLinker(config Config) (*installLinker, error) {
+	if config.PublicBaseURL == "" {
+		return nil, nil
+	}
+	base, err := url.Parse(config.PublicBaseURL)
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+		return nil, fmt.Errorf("%q is not an http(s) URL", config.PublicBaseURL)
+	}
+	secret := []byte(config.InstallLinkSecret)
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, fmt.Errorf("error generating install link secret: %v", err)
+		}
+	}
+	return &installLinker{config: config, baseURL: strings.TrimSuffix(base.String(), "/"), secret: secret}, nil
+}
+
+func (l *installLinker) token(buildID string) string {
+	mac := hmac.New(sha256.New, l.secret)
+	mac.Write([]byte(buildID))
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+// Check the token of an install link
+func (l *installLinker) valid(buildID, token string) bool {
+	return l != nil && hmac.Equal([]byte(token), []byte(l.token(buildID)))
+}
+
+// Publish install links for the retained artifact of a build. Only APKs and
+// iOS archives whose bundle identifier is known from app.json can be installed.
+func (l *installLinker) Publish(buildID, platform, packagePath, filename string) (*installLinks, error) {
+	info := installInfo{Platform: platform, Title: filename}
+	switch {
+	case platform == "android" && strings.HasSuffix(filename, ".apk"):
+	case platform == "ios" && strings.HasSuffix(filename, ".ipa"):
+		app, err := readAppIdentity(packagePath)
+		if err != nil {
+			return nil, err
+		}
+		info.Title, info.BundleIdentifier, info.BundleVersion = app.name, app.bundleIdentifier, app.version
+	default:
+		return nil, fmt.Errorf("%s can't be installed from a link", filename)
+	}
+
+	data, err := json.Marshal(info)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding install info: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(buildArtifactDir(l.config, buildID), installInfoFile), data, 0644); err != nil {
+		return nil, fmt.Errorf("error writing install info: %v", err)
+	}
+	return l.links(buildID, info), nil
+}
+
+func (l *installLinker) links(buildID string, info installInfo) *installLinks {
+	base := fmt.Sprintf("%s/install/%s/%s", l.baseURL, buildID, l.token(buildID))
+	links := &installLinks{
+		PageURL:    base,
+		InstallURL: base + "/artifact",
+		QRCodeURL:  base + "/qr.png",
+	}
+	if info.Platform == "ios" {
+		links.ManifestURL = base + "/manifest.plist"
+		links.InstallURL = "itms-services://?action=download-manifest&url=" + url.QueryEscape(links.ManifestURL)
+	}
+	return links
+}
+
+// appIdentity is what iOS needs to know to install an app
+type appIdentity struct {
+	name             string
+	bundleIdentifier string
+	version          string
+}
+
+// Read the app's name, iOS bundle identifier and version from app.json
+func readAppIdentity(packagePath string) (appIdentity, error) {
+	data, err := os.ReadFile(filepath.Join(packagePath, "app.json"))
+	if err != nil {
+		return appIdentity{}, fmt.Errorf("error reading app.json: %v", err)
+	}
+	var appJSON struct {
+		Expo struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+			IOS     struct {
+				BundleIdentifier string `json:"bundleIdentifier"`
+				BuildNumber      string `json:"buildNumber"`
+			} `json:"ios"`
+		} `json:"expo"`
+	}
+	if err := json.Unmarshal(data, &appJSON); err != nil {
+		return appIdentity{}, fmt.Errorf("error parsing app.json: %v", err)
+	}
+	app := appIdentity{
+		name:             appJSON.Expo.Name,
+		bundleIdentifier: appJSON.Expo.IOS.BundleIdentifier,
+		version:          appJSON.Expo.Version,
+	}
+	if app.bundleIdentifier == "" {
+		return appIdentity{}, fmt.Errorf("app.json sets no expo.ios.bundleIdentifier")
+	}
+	if app.version == "" {
+		app.version = appJSON.Expo.IOS.BuildNumber
+	}
+	if app.version == "" {
+		app.version = "1.0.0"
+	}
+	if app.name == "" {
+		app.name = app.bundleIdentifier
+	}
+	return app, nil
+}
+
+// Publish install links for a build and record them with it. A build that
+// can't be installed from a link still succeeds.
+func publishInstallLinks(ctx context.Context, svc *buildService, buildID, platform, packagePath, filename string) *installLinks {
+	links, err := svc.installs.Publish(buildID, platform, packagePath, filename)
+	if err != nil {
+		loggerFrom(ctx).Warn("No install links for the build", "error", err)
+		return nil
+	}
+	svc.registry.Update(buildID, func(record *BuildRecord) {
+		record.Install = links
+	})
+	return links
+}
+
+// Look up the install info of the build an install link points at
+func (l *installLinker) resolve(w http.ResponseWriter, r *http.Request) (string, installInfo, bool) {
+	buildID := r.PathValue("id")
+	if !l.valid(buildID, r.PathValue("token")) || strings.ContainsAny(buildID, `/\`) || buildID == ".." {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return "", installInfo{}, false
+	}
+	var info installInfo
+	data, err := os.ReadFile(filepath.Join(buildArtifactDir(l.config, buildID), installInfoFile))
+	if err == nil {
+		err = json.Unmarshal(data, &info)
+	}
+	if err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return "", installInfo{}, false
+	}
+	return buildID, info, true
+}
+
+var installPage = template.Must(template.New("install").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Install {{.Title}}</title>
+</head>
+<body style="font-family: sans-serif; text-align: center; margin-top: 3em">
+<h1>{{.Title}}</h1>
+<p><a href="{{.InstallURL}}" style="font-size: 1.5em">Install</a></p>
+<p><img src="{{.QRCodeURL}}" alt="QR code of this page" width="256" height="256"></p>
+</body>
+</html>
+`))
+
+// Page with the install link and a QR code for scanning it from another screen
+func installPageHandler(linker *installLinker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		buildID, info, ok := linker.resolve(w, r)
+		if !ok {
+			return
+		}
+		links := linker.links(buildID, info)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err := installPage.Execute(w, struct {
+			Title      string
+			InstallURL template.URL
+			QRCodeURL  string
+		}{info.Title, template.URL(links.InstallURL), links.QRCodeURL})
+		if err != nil {
+			loggerFrom(r.Context()).Error("Failed to render install page", "build_id", buildID, "error", err)
+		}
+	}
+}
+
+// QR code of the install page
+func installQRCodeHandler(linker *installLinker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		buildID, info, ok := linker.resolve(w, r)
+		if !ok {
+			return
+		}
+		png, err := qrcode.Encode(linker.links(buildID, info).PageURL, qrcode.Medium, 256)
+		if err != nil {
+			loggerFrom(r.Context()).Error("Failed to generate QR code", "build_id", buildID, "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(png)
+	}
+}
+
+// The artifact itself, for the device installing it
+func installArtifactHandler(linker *installLinker, downloads *downloadTracker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		buildID, _, ok := linker.resolve(w, r)
+		if !ok {
+			return
+		}
+		defer downloads.Begin(buildID)()
+		path, err := findArtifact(linker.config, buildID, "")
+		if err != nil {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		if info, err := os.Stat(path); err == nil {
+			setFileETag(w, info)
+		}
+		contentType, filename := downloadAs(linker.config.OutputFormats, filepath.Base(path))
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filename))
+		http.ServeFile(w, r, path)
+	}
+}
+
+// The manifest is XML rather than HTML, so escape the values for XML
+var installManifest = texttemplate.Must(texttemplate.New("manifest").Funcs(texttemplate.FuncMap{
+	"xml": func(s string) string {
+		var b strings.Builder
+		_ = xml.EscapeText(&b, []byte(s))
+		return b.String()
+	},
+}).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+  <key>items</key>
+  <array>
+    <dict>
+      <key>assets</key>
+      <array>
+        <dict>
+          <key>kind</key>
+          <string>software-package</string>
+          <key>url</key>
+          <string>{{xml .ArtifactURL}}</string>
+        </dict>
+      </array>
+      <key>metadata</key>
+      <dict>
+        <key>bundle-identifier</key>
+        <string>{{xml .BundleIdentifier}}</string>
+        <key>bundle-version</key>
+        <string>{{xml .BundleVersion}}</string>
+        <key>kind</key>
+        <string>software</string>
+        <key>title</key>
+        <string>{{xml .Title}}</string>
+      </dict>
+    </dict>
+  </array>
+</dict>
+</plist>
+`))
+
+// The itms-services manifest iOS reads to install an ad-hoc build
+func installManifestHandler(linker *installLinker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		buildID, info, ok := linker.resolve(w, r)
+		if !ok {
+			return
+		}
+		if info.Platform != "ios" {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/xml")
+		err := installManifest.Execute(w, struct {
+			ArtifactURL      string
+			BundleIdentifier string
+			BundleVersion    string
+			Title            string
+		}{linker.links(buildID, info).PageURL + "/artifact", info.BundleIdentifier, info.BundleVersion, info.Title})
+		if err != nil {
+			loggerFrom(r.Context()).Error("Failed to render install manifest", "build_id", buildID, "error", err)
+		}
+	}
+}
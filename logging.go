@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"path/filepath"
+)
+
+// Formats of the server log, see LOG_FORMAT
+const (
+	logFormatJSON    = "json"    // JSON lines in LOG_FILE
+	logFormatConsole = "console" // Human-readable lines on stderr, for local development
+)
+
+// Check that LOG_FORMAT names a known format
+func validateLogFormat(format string) error {
+	switch format {
+	case logFormatJSON, logFormatConsole:
+		return nil
+	default:
+		return fmt.Errorf("%q is not one of %s or %s", format, logFormatJSON, logFormatConsole)
+	}
+}
+
+// Handler writing the server log to w in the given format. Lines logged with
+// package log go through it as well, at level INFO.
+func newLogHandler(format string, w io.Writer) slog.Handler {
+	opts := &slog.HandlerOptions{
+		AddSource: true,
+		// Report the source as file:line rather than the full path and
+		// function. Lines from package log come without one.
+		ReplaceAttr: func(_ []string, a slog.Attr) slog.Attr {
+			if source, ok := a.Value.Any().(*slog.Source); ok && a.Key == slog.SourceKey {
+				if source.File == "" {
+					return slog.Attr{}
+				}
+				a.Value = slog.StringValue(fmt.Sprintf("%s:%d", filepath.Base(source.File), source.Line))
+			}
+			return a
+		},
+	}
+	if format == logFormatConsole {
+		return slog.NewTextHandler(w, opts)
+	}
+	return slog.NewJSONHandler(w, opts)
+}
+
+type loggerKey struct{}
+
+// Attach the logger of a build to its context, so everything logged for the
+// build carries its ID, platform and repository
+func withLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// Logger of the build running with ctx, or the default logger outside builds
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Decode the JSON lines written by a log handler
+func decodeLogLines(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+	var lines []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("log line %q isn't JSON: %v", line, err)
+		}
+		lines = append(lines, entry)
+	}
+	return lines
+}
+
+func TestBuildLoggerTagsLines(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(newLogHandler(logFormatJSON, &buf)).With("build_id", "20260101-1200-abc", "platform", "android", "repo", "https://github.com/owner/repo.git")
+	ctx := withLogger(context.Background(), logger)
+
+	loggerFrom(ctx).Info("Cloned repository", "filter", "blob:none")
+	writeAccepted(ctx, httptest.NewRecorder(), "20260101-1200-abc")
+
+	lines := decodeLogLines(t, &buf)
+	if len(lines) != 2 {
+		t.Fatalf("got %d log lines, want 2", len(lines))
+	}
+	for _, line := range lines {
+		if line["build_id"] != "20260101-1200-abc" || line["platform"] != "android" || line["repo"] != "https://github.com/owner/repo.git" {
+			t.Errorf("line %v lacks the build's fields", line)
+		}
+		source, _ := line["source"].(string)
+		if !strings.HasPrefix(source, "logging_test.go:") && !strings.HasPrefix(source, "requestTimeout.go:") {
+			t.Errorf("source %q is not file:line", source)
+		}
+	}
+	if lines[0]["filter"] != "blob:none" {
+		t.Errorf("attribute missing from %v", lines[0])
+	}
+}
+
+func TestLoggerFromWithoutBuild(t *testing.T) {
+	if loggerFrom(context.Background()) != slog.Default() {
+		t.Error("loggerFrom outside a build isn't the default logger")
+	}
+}
+
+func TestConsoleLogFormat(t *testing.T) {
+	var buf bytes.Buffer
+	slog.New(newLogHandler(logFormatConsole, &buf)).Info("Server started", "port", "8080")
+	if line := buf.String(); !strings.Contains(line, `msg="Server started"`) || !strings.Contains(line, "port=8080") {
+		t.Errorf("console line %q isn't human-readable key=value", line)
+	}
+	if err := validateLogFormat("xml"); err == nil {
+		t.Error("LOG_FORMAT xml accepted")
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Build stages timed by the stage duration histogram
+const (
+	stageClone   = "clone"
+	stageInstall = "install"
+	stageBuild   = "build"
+)
+
+// Collectors updated from anywhere in the service. They are package-level
+// since the stages are timed by functions that don't know the service.
+var (
+	buildsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "expo_builds_total",
+		Help: "Finished builds by platform and outcome.",
+	}, []string{"platform", "outcome"})
+	stageDurations = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "expo_build_stage_duration_seconds",
+		Help: "Time spent in each build stage.",
+		// From a cached clone to a long native build
+		Buckets: prometheus.ExponentialBuckets(1, 2, 12),
+	}, []string{"stage"})
+	cleanupDurations = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "expo_cleanup_duration_seconds",
+		Help:    "Time spent deleting a build directory.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 12),
+	})
+	cleanupWaits = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "expo_cleanup_queue_wait_seconds",
+		Help:    "Time a build directory waited for a CLEANUP_CONCURRENCY slot.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 12),
+	})
+	buildsThrottled = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "expo_builds_throttled_total",
+		Help: "Build requests rejected by REPO_THROTTLE_LIMIT.",
+	})
+)
+
+// Record how long a stage took, as in defer observeStage(stageBuild, time.Now())
+func observeStage(stage string, start time.Time) {
+	stageDurations.WithLabelValues(stage).Observe(time.Since(start).Seconds())
+}
+
+// Count a finished build
+func observeBuild(record BuildRecord) {
+	if record.Finished() {
+		buildsTotal.WithLabelValues(record.Platform, record.Status).Inc()
+	}
+}
+
+// Serve the metrics in the Prometheus format, requiring METRICS_TOKEN as a
+// bearer token when set
+func metricsHandler(config Config, queue *buildQueue) http.HandlerFunc {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		buildsTotal,
+		stageDurations,
+		buildsThrottled,
+		cleanupDurations,
+		cleanupWaits,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "expo_builds_running",
+			Help: "Builds holding a build slot.",
+		}, func() float64 { return float64(queue.Running()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "expo_build_queue_depth",
+			Help: "Builds waiting for a build slot.",
+		}, func() float64 { return float64(queue.Waiting()) }),
+	)
+	metrics := promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+	return func(w http.ResponseWriter, r *http.Request) {
+		if config.MetricsToken != "" && !bearerTokenMatches(r, config.MetricsToken) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		metrics.ServeHTTP(w, r)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Cache holding a bare mirror of each repository built with CLONE_WORKTREES
+const cacheMirrors = "mirrors"
+
+// Lock files a git process killed mid-operation leaves in a mirror
+var staleMirrorLocks = []string{"index.lock", "shallow.lock", "packed-refs.lock", "HEAD.lock", "config.lock"}
+
+// mirrorStore checks builds out as worktrees of a bare mirror per repository
+// in CACHE_DIR, so builds share the object store instead of each cloning the
+// repository. Operations on a mirror are serialized; the worktrees themselves
+// are independent.
+type mirrorStore struct {
+	caches    *cacheManager
+	mu        sync.Mutex
+	locks     map[string]*sync.Mutex // Cache key -> lock of the mirror
+	recovered map[string]bool        // Mirrors checked for stale locks since startup
+}
+
+// Returns nil when worktrees are disabled or caching is
+func newMirrorStore(caches *cacheManager, enabled bool, user *buildUser) *mirrorStore {
+	if !enabled {
+		return nil
+	}
+	if !caches.Enabled() {
+		log.Println("CLONE_WORKTREES is set but CACHE_DIR is not, builds clone as usual")
+		return nil
+	}
+	if user != nil {
+		// git in a worktree writes to the mirror, which belongs to the service user
+		log.Println("CLONE_WORKTREES is not supported with BUILD_UID, builds clone as usual")
+		return nil
+	}
+	return &mirrorStore{caches: caches, locks: make(map[string]*sync.Mutex), recovered: make(map[string]bool)}
+}
+
+func (m *mirrorStore) lock(key string) *sync.Mutex {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.locks[key]; !ok {
+		m.locks[key] = &sync.Mutex{}
+	}
+	return m.locks[key]
+}
+
+// Checkout fetches the branch into the repository's mirror and adds a
+// worktree of it at dest. The returned function removes the worktree and
+// must be called before dest is deleted.
+func (m *mirrorStore) Checkout(ctx context.Context, repoURL, dest string, opts cloneOptions) (func(), error) {
+	if m == nil {
+		return nil, fmt.Errorf("worktrees are disabled")
+	}
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, opts.Timeout, errCloneTimeout)
+		defer cancel()
+	}
+	key := cacheKeyForRepo(repoURL)
+	mirror, release, err := m.caches.Acquire(cacheMirrors, key)
+	if err != nil {
+		return nil, err
+	}
+	lock := m.lock(key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Nothing else in this service works in the mirror while the lock is
+	// held, so lock files are left over from a crash
+	m.mu.Lock()
+	firstUse := !m.recovered[key]
+	m.recovered[key] = true
+	m.mu.Unlock()
+	if firstUse {
+		for _, name := range staleMirrorLocks {
+			if err := os.Remove(filepath.Join(mirror, name)); err == nil {
+				loggerFrom(ctx).Info("Removed stale lock from mirror", "lock", name, "mirror", key)
+			}
+		}
+	}
+
+	type step struct {
+		name string
+		args []string
+	}
+	// The URL isn't stored in the mirror, so credentials of one build never
+	// reach another. Tags are kept for git_version.
+	steps := []step{
+		{"worktree prune", []string{"worktree", "prune"}}, // Forget worktrees whose build directory is gone
+		{"fetch", gitArgs(opts, "fetch", "--force", "--tags", "--", repoURL)},
+		{"fetch", gitArgs(opts, "fetch", "--force", "--no-tags", "--", repoURL, opts.Branch)},
+		{"worktree add", []string{"worktree", "add", "--detach", "--force", dest, "FETCH_HEAD"}},
+	}
+	if _, err := os.Stat(filepath.Join(mirror, "HEAD")); err != nil {
+		steps = append([]step{{"init", []string{"init", "--bare", "--quiet"}}}, steps...)
+	}
+	for _, s := range steps {
+		if output, err := runGit(ctx, mirror, repoURL, opts, s.args...); err != nil {
+			release()
+			if cause := context.Cause(ctx); errors.Is(cause, errCloneTimeout) {
+				return nil, fmt.Errorf("%w: git %s", cause, s.name)
+			}
+			return nil, fmt.Errorf("error running git %s in mirror: %v, output: %s", s.name, err, output)
+		}
+	}
+
+	logger := loggerFrom(ctx)
+	remove := func() {
+		defer release()
+		lock.Lock()
+		defer lock.Unlock()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if output, err := runGit(ctx, mirror, repoURL, opts, "worktree", "remove", "--force", dest); err != nil {
+			logger.Warn("Failed to remove worktree", "path", dest, "error", err, "output", output)
+			os.RemoveAll(dest)
+			runGit(ctx, mirror, repoURL, opts, "worktree", "prune")
+		}
+	}
+	return remove, nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Commit a file on a new branch of the test repository at repoURL
+func addTestBranch(t *testing.T, repoURL, branch, name string, content []byte) {
+	t.Helper()
+	dir := strings.TrimPrefix(repoURL, "file://")
+	git := func(args ...string) {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		if output, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v: %s", args, err, output)
+		}
+	}
+	git("checkout", "-q", "-b", branch)
+	if err := os.WriteFile(filepath.Join(dir, name), content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	git("-c", "user.name=Test", "-c", "user.email=test@example.com", "commit", "-q", "-am", "Change "+name)
+	git("checkout", "-q", "main")
+}
+
+// List the worktrees registered in a mirror, besides the mirror itself
+func mirrorWorktrees(t *testing.T, caches *cacheManager, repoURL string) []string {
+	t.Helper()
+	mirror, release, err := caches.Acquire(cacheMirrors, cacheKeyForRepo(repoURL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	output, err := exec.Command("git", "-C", mirror, "worktree", "list", "--porcelain").CombinedOutput()
+	if err != nil {
+		t.Fatalf("git worktree list: %v: %s", err, output)
+	}
+	var worktrees []string
+	for _, line := range strings.Split(string(output), "\n") {
+		if path, ok := strings.CutPrefix(line, "worktree "); ok && path != mirror {
+			worktrees = append(worktrees, path)
+		}
+	}
+	return worktrees
+}
+
+func TestMirrorConcurrentWorktrees(t *testing.T) {
+	repoURL := newTestRepo(t, map[string][]byte{"app.json": []byte(`{"expo":{"name":"main"}}`)})
+	addTestBranch(t, repoURL, "feature", "app.json", []byte(`{"expo":{"name":"feature"}}`))
+	caches := newCacheManager(t.TempDir())
+	mirrors := newMirrorStore(caches, true, nil)
+
+	branches := []string{"main", "feature", "main", "feature"}
+	dests := make([]string, len(branches))
+	removes := make([]func(), len(branches))
+	errs := make([]error, len(branches))
+	var wg sync.WaitGroup
+	for i, branch := range branches {
+		dests[i] = filepath.Join(t.TempDir(), "clone")
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			removes[i], errs[i] = mirrors.Checkout(context.Background(), repoURL, dests[i], cloneOptions{Branch: branch})
+		}()
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("checkout %d of %s: %v", i, branches[i], err)
+		}
+	}
+
+	for i, branch := range branches {
+		content, err := os.ReadFile(filepath.Join(dests[i], "app.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := `"name":"` + branch + `"`; !strings.Contains(string(content), want) {
+			t.Errorf("worktree %d has %s, want branch %s", i, content, branch)
+		}
+	}
+	if got := mirrorWorktrees(t, caches, repoURL); len(got) != len(branches) {
+		t.Fatalf("mirror has worktrees %v, want %d", got, len(branches))
+	}
+
+	// A build changing its checkout leaves the others alone
+	if err := os.WriteFile(filepath.Join(dests[0], "app.json"), []byte("changed"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := os.ReadFile(filepath.Join(dests[2], "app.json")); !strings.Contains(string(content), `"name":"main"`) {
+		t.Errorf("the change leaked into another worktree of the branch: %s", content)
+	}
+
+	for i, remove := range removes {
+		remove()
+		if _, err := os.Stat(dests[i]); !os.IsNotExist(err) {
+			t.Errorf("worktree %d still exists after removal: %v", i, err)
+		}
+	}
+	if got := mirrorWorktrees(t, caches, repoURL); len(got) != 0 {
+		t.Errorf("mirror still has worktrees %v", got)
+	}
+}
+
+func TestMirrorRecoversAfterCrash(t *testing.T) {
+	repoURL := newTestRepo(t, map[string][]byte{"app.json": []byte(expoAppJSON)})
+	caches := newCacheManager(t.TempDir())
+
+	crashed := filepath.Join(t.TempDir(), "clone")
+	if _, err := newMirrorStore(caches, true, nil).Checkout(context.Background(), repoURL, crashed, cloneOptions{Branch: "main"}); err != nil {
+		t.Fatal(err)
+	}
+	// The service died mid-build: the worktree was never removed, its build
+	// directory was cleaned up and git left a lock behind
+	if err := os.RemoveAll(crashed); err != nil {
+		t.Fatal(err)
+	}
+	mirror, release, err := caches.Acquire(cacheMirrors, cacheKeyForRepo(repoURL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	if err := os.WriteFile(filepath.Join(mirror, "packed-refs.lock"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// After a restart
+	dest := filepath.Join(t.TempDir(), "clone")
+	remove, err := newMirrorStore(caches, true, nil).Checkout(context.Background(), repoURL, dest, cloneOptions{Branch: "main"})
+	if err != nil {
+		t.Fatalf("checkout after a crash: %v", err)
+	}
+	defer remove()
+	if _, err := os.Stat(filepath.Join(mirror, "packed-refs.lock")); !os.IsNotExist(err) {
+		t.Errorf("stale lock still present: %v", err)
+	}
+	if got := mirrorWorktrees(t, caches, repoURL); len(got) != 1 || got[0] != dest {
+		t.Errorf("mirror has worktrees %v, want only %s", got, dest)
+	}
+}
+
+func TestNewMirrorStoreDisabled(t *testing.T) {
+	if newMirrorStore(newCacheManager(t.TempDir()), false, nil) != nil {
+		t.Error("store created without CLONE_WORKTREES")
+	}
+	if newMirrorStore(newCacheManager(""), true, nil) != nil {
+		t.Error("store created without CACHE_DIR")
+	}
+	if newMirrorStore(newCacheManager(t.TempDir()), true, &buildUser{}) != nil {
+		t.Error("store created with BUILD_UID")
+	}
+	var disabled *mirrorStore
+	if _, err := disabled.Checkout(context.Background(), "file:///repo", t.TempDir(), cloneOptions{}); err == nil {
+		t.Error("checkout with worktrees disabled succeeded")
+	}
+}
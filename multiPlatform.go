@@ -0,0 +1,309 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Platform building Android and iOS from a single clone and install
+const platformAll = "all"
+
+// Platforms built for platform "all", in the order they are reported
+var allPlatforms = []string{"android", "ios"}
+
+// platformResult is the outcome of one platform of a platform "all" build
+type platformResult struct {
+	Platform    string `json:"platform"`
+	Status      string `json:"status"`
+	Error       string `json:"error,omitempty"`
+	Filename    string `json:"filename,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+	SHA256      string `json:"sha256,omitempty"`
+	ArtifactURL string `json:"artifact_url,omitempty"`
+	LogURL      string `json:"log_url,omitempty"`
+	path        string // Retained artifact
+}
+
+// platformLimiter caps how many builds of each platform run EAS at once,
+// on top of MAX_CONCURRENT_BUILDS. Platforms without a limit aren't capped.
+type platformLimiter struct {
+	slots map[string]chan struct{}
+}
+
+func newPlatformLimiter(limits map[string]int) *platformLimiter {
+	l := &platformLimiter{slots: make(map[string]chan struct{})}
+	for platform, limit := range limits {
+		if limit > 0 {
+			l.slots[platform] = make(chan struct{}, limit)
+		}
+	}
+	return l
+}
+
+// Acquire waits for a slot of the platform and returns the function releasing it
+func (l *platformLimiter) Acquire(ctx context.Context, platform string) (func(), error) {
+	slots, ok := l.slots[platform]
+	if !ok {
+		return func() {}, nil
+	}
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Path of the output log of one platform of a platform "all" build
+func platformLogPath(config Config, buildID, platform string) string {
+	return filepath.Join(buildArtifactDir(config, buildID), "build-"+platform+".log")
+}
+
+// prefixWriter writes complete lines to w, each starting with prefix, so
+// concurrent builds can share one log
+type prefixWriter struct {
+	w       io.Writer
+	prefix  string
+	partial []byte
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.partial = append(p.partial, b...)
+	for {
+		i := bytes.IndexByte(p.partial, '\n')
+		if i < 0 {
+			return len(b), nil
+		}
+		line := append([]byte(p.prefix), p.partial[:i+1]...)
+		p.partial = p.partial[i+1:]
+		if _, err := p.w.Write(line); err != nil {
+			return len(b), err
+		}
+	}
+}
+
+// multiPlatformBuild runs the EAS builds of a platform "all" request side by
+// side in the shared, installed clone
+type multiPlatformBuild struct {
+	svc         *buildService
+	buildID     string
+	repo        string // Without credentials
+	packagePath string
+	tempDir     string
+	profile     string
+	commit      string
+	prebuild    bool
+	eas         *easInfo
+	version     *gitVersion
+	opts        buildOptions // Log is replaced per platform
+	log         io.Writer    // Combined log of all platforms
+	prebuildMu  sync.Mutex   // expo prebuild updates files shared by the platforms
+}
+
+// Build every platform concurrently and report each outcome
+func (b *multiPlatformBuild) runAll(ctx context.Context) []platformResult {
+	results := make([]platformResult, len(allPlatforms))
+	var wg sync.WaitGroup
+	for i, platform := range allPlatforms {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = b.run(ctx, platform)
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// Build one platform with its own log, output file and EAS working directory
+func (b *multiPlatformBuild) run(ctx context.Context, platform string) platformResult {
+	config := b.svc.config
+	result := platformResult{Platform: platform, Status: statusFailed}
+	// The build's platform is "all", tell the platforms apart
+	logger := loggerFrom(ctx).With("target_platform", platform)
+	fail := func(status, reason string, err error) platformResult {
+		logger.Error(reason, "error", err)
+		result.Status, result.Error = status, reason
+		return result
+	}
+
+	logWriters := []io.Writer{&logEventWriter{hub: b.svc.events, buildID: b.buildID, platform: platform}}
+	if b.log != nil {
+		logWriters = append(logWriters, &prefixWriter{w: b.log, prefix: "[" + platform + "] "})
+	}
+	if file, err := os.OpenFile(platformLogPath(config, b.buildID, platform), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644); err != nil {
+		logger.Error("Failed to create build log", "error", err)
+	} else {
+		defer file.Close()
+		logWriters = append(logWriters, file)
+		result.LogURL = fmt.Sprintf("/build/log/%s?platform=%s", b.buildID, platform)
+	}
+	opts := b.opts
+	opts.Log = io.MultiWriter(logWriters...)
+	opts.Env = append(append([]string{}, opts.Env...), "EAS_LOCAL_BUILD_WORKINGDIR="+filepath.Join(b.tempDir, "eas-work-"+platform))
+
+	if b.prebuild {
+		b.prebuildMu.Lock()
+		err := runPrebuild(ctx, b.packagePath, platform, opts.Env, b.svc.user)
+		b.prebuildMu.Unlock()
+		if err != nil {
+			return fail(statusFailed, "Failed to prebuild the app", err)
+		}
+	}
+
+	release, err := b.svc.platforms.Acquire(ctx, platform)
+	if err != nil {
+		return fail(statusFailed, "Timed out waiting for a "+platform+" build slot", err)
+	}
+	filename := artifactFilename(b.buildID, primaryArtifactExtensions[platform][0], b.version)
+	err = buildAppRetryingOOM(ctx, b.svc, b.buildID, b.eas, b.packagePath, platform, filename, opts)
+	release()
+	if errors.Is(err, errBuildStalled) {
+		return fail(statusInteractivePrompt, fmt.Sprintf("Failed to build the app: no output for %v, EAS is likely waiting for interactive input", opts.StallTimeout), err)
+	}
+	if err != nil {
+		return fail(statusFailed, "Failed to build the app", err)
+	}
+	builtFilePath := resolveOutputPath(b.packagePath, filename)
+
+	if len(config.PostBuildSteps) > 0 {
+		sideDir := filepath.Join(b.tempDir, "side-artifacts-"+platform)
+		meta := postBuildMeta{BuildID: b.buildID, Repo: b.repo, Commit: b.commit, Platform: platform, Profile: b.profile}
+		transformed, err := runPostBuildSteps(ctx, config.PostBuildSteps, b.tempDir, builtFilePath, sideDir, meta, opts.Log, b.svc.user)
+		if err != nil {
+			return fail(statusFailed, err.Error(), err)
+		}
+		builtFilePath = transformed
+	}
+
+	if err := checkArtifactSize(builtFilePath, config.MinArtifactSize[platform]); err != nil {
+		return fail(statusEmptyArtifact, err.Error(), err)
+	}
+	retained, err := retainArtifact(config, b.buildID, builtFilePath, filename)
+	if err != nil {
+		return fail(statusFailed, "Failed to retain artifact", err)
+	}
+	result.Status = statusSucceeded
+	result.Filename = filename
+	result.Size = retained.Size
+	result.SHA256 = retained.SHA256
+	result.ArtifactURL = fmt.Sprintf("/artifacts/%s?platform=%s", b.buildID, platform)
+	result.path = filepath.Join(buildArtifactDir(config, b.buildID), filename)
+	return result
+}
+
+// Overall status of a platform "all" build
+func multiPlatformStatus(results []platformResult) (string, string) {
+	var failed []string
+	for _, result := range results {
+		if result.Status != statusSucceeded {
+			failed = append(failed, fmt.Sprintf("%s: %s", result.Platform, result.Error))
+		}
+	}
+	switch len(failed) {
+	case 0:
+		return statusSucceeded, ""
+	case len(results):
+		return statusFailed, strings.Join(failed, "; ")
+	default:
+		return statusPartiallySucceeded, strings.Join(failed, "; ")
+	}
+}
+
+// multiPlatformResult is the JSON result of a platform "all" build
+type multiPlatformResult struct {
+	BuildID   string           `json:"build_id"`
+	Status    string           `json:"status"`
+	Platform  string           `json:"platform"`
+	Error     string           `json:"error,omitempty"`
+	Platforms []platformResult `json:"platforms"`
+	LogURL    string           `json:"log_url,omitempty"`
+}
+
+// Answer a platform "all" build with the JSON result, or with a zip of the
+// artifacts that were built. The request only fails when no platform built.
+func writeMultiPlatformResult(ctx context.Context, w http.ResponseWriter, buildID string, results []platformResult, minimal bool, logURL string) {
+	status, reason := multiPlatformStatus(results)
+	w.Header().Set("X-Build-Status", status)
+	if status == statusFailed {
+		http.Error(w, "Failed to build the app: "+reason, http.StatusInternalServerError)
+		return
+	}
+
+	if minimal {
+		result := multiPlatformResult{BuildID: buildID, Status: status, Platform: platformAll, Error: reason, Platforms: results, LogURL: logURL}
+		w.Header().Set("Preference-Applied", "return=minimal")
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(result); err != nil {
+			loggerFrom(ctx).Error("Failed to write build result", "error", err)
+		}
+		return
+	}
+
+	// The zip is built while it's sent, so its size isn't known up front
+	flush := startStreaming(w)
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=app-%s.zip", buildID))
+	zw := zip.NewWriter(w)
+	for _, result := range results {
+		if result.Status != statusSucceeded {
+			continue
+		}
+		err := addFileToZip(zw, result.path, result.Filename)
+		if err == nil {
+			err = zw.Flush()
+		}
+		if err == nil {
+			err = flush()
+		}
+		if err != nil {
+			loggerFrom(ctx).Error("Failed to send artifacts", "error", err)
+			return
+		}
+	}
+	if err := zw.Close(); err != nil {
+		loggerFrom(ctx).Error("Failed to send artifacts", "error", err)
+	}
+}
+
+// Store a file in a zip under name. Artifacts are compressed already.
+func addFileToZip(zw *zip.Writer, path, name string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error opening artifact: %v", err)
+	}
+	defer file.Close()
+	entry, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(entry, file)
+	return err
+}
+
+// Reject options a platform "all" build can't honor
+func validateMultiPlatformRequest(req BuildRequest) error {
+	switch {
+	case req.ResponseFormat == "base64" || req.ResponseFormat == "multipart":
+		return fmt.Errorf("response_format %q is not supported with platform %q", req.ResponseFormat, platformAll)
+	case req.ReuseResult:
+		return fmt.Errorf("reuse_result is not supported with platform %q", platformAll)
+	case req.InstallLink:
+		return fmt.Errorf("install_link is not supported with platform %q", platformAll)
+	case req.CollectOutputs:
+		return fmt.Errorf("collect_outputs is not supported with platform %q", platformAll)
+	case req.Signing != nil || req.SigningSecret != "":
+		return fmt.Errorf("signing credentials are not supported with platform %q, build each platform separately", platformAll)
+	}
+	return nil
+}
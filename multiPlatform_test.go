@@ -0,0 +1,116 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writePlatformArtifacts retains an artifact of each platform with random
+// content and returns the results of a platform "all" build
+func writePlatformArtifacts(t *testing.T, sizes map[string]int) ([]platformResult, map[string][]byte) {
+	t.Helper()
+	dir := t.TempDir()
+	rng := rand.New(rand.NewSource(1))
+	var results []platformResult
+	contents := make(map[string][]byte)
+	for platform, size := range sizes {
+		filename := "app-b1." + platform
+		data := make([]byte, size)
+		rng.Read(data)
+		path := filepath.Join(dir, filename)
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		results = append(results, platformResult{Platform: platform, Status: statusSucceeded, Filename: filename, Size: int64(size), path: path})
+		contents[filename] = data
+	}
+	return results, contents
+}
+
+func TestMultiPlatformZipStreamsChunked(t *testing.T) {
+	results, contents := writePlatformArtifacts(t, map[string]int{"android": 3 << 20, "ios": 1 << 20})
+	results = append(results, platformResult{Platform: "web", Status: statusFailed, Error: "Failed to build the app"})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A length set earlier, e.g. from a single artifact, must not survive
+		w.Header().Set("Content-Length", "1024")
+		writeMultiPlatformResult(r.Context(), w, "b1", results, false, "")
+	}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	if resp.ContentLength != -1 || len(resp.TransferEncoding) == 0 || resp.TransferEncoding[0] != "chunked" {
+		t.Fatalf("Content-Length %d, Transfer-Encoding %v, want a chunked body", resp.ContentLength, resp.TransferEncoding)
+	}
+	if got := resp.Header.Get("X-Build-Status"); got != statusPartiallySucceeded {
+		t.Errorf("X-Build-Status = %q, want %q", got, statusPartiallySucceeded)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatalf("read zip: %v", err)
+	}
+	if len(archive.File) != len(contents) {
+		t.Fatalf("zip has %d entries, want %d", len(archive.File), len(contents))
+	}
+	for _, entry := range archive.File {
+		file, err := entry.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(file)
+		file.Close()
+		if err != nil {
+			t.Fatalf("read %s: %v", entry.Name, err)
+		}
+		if !bytes.Equal(data, contents[entry.Name]) {
+			t.Errorf("%s differs from the retained artifact", entry.Name)
+		}
+	}
+}
+
+func TestMultiPlatformZipFlushesPerArtifact(t *testing.T) {
+	results, _ := writePlatformArtifacts(t, map[string]int{"android": 1024})
+	w := httptest.NewRecorder()
+	writeMultiPlatformResult(context.Background(), w, "b1", results, false, "")
+	if !w.Flushed {
+		t.Error("the zip was not flushed while it was written")
+	}
+	if w.Header().Get("Content-Length") != "" {
+		t.Errorf("Content-Length = %q, want none", w.Header().Get("Content-Length"))
+	}
+}
+
+func TestMultiPlatformAllFailed(t *testing.T) {
+	results := []platformResult{
+		{Platform: "android", Status: statusFailed, Error: "gradle"},
+		{Platform: "ios", Status: statusFailed, Error: "signing"},
+	}
+	w := httptest.NewRecorder()
+	writeMultiPlatformResult(context.Background(), w, "b1", results, false, "")
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want 500", w.Code)
+	}
+	if got := w.Header().Get("X-Build-Status"); got != statusFailed {
+		t.Errorf("X-Build-Status = %q, want %q", got, statusFailed)
+	}
+}
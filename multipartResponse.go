@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// multipartResponse answers a build request with a multipart/mixed body: a
+// "log" part streaming the EAS output while the build runs, then either an
+// "artifact" part with the built file or an "error" part. It stands in for
+// the ResponseWriter once streaming started, so errors reported with
+// http.Error become the error part.
+type multipartResponse struct {
+	mu      sync.Mutex
+	w       http.ResponseWriter
+	mw      *multipart.Writer
+	part    io.Writer
+	pending http.Header // Headers for the next part
+	closed  bool
+}
+
+// Send the response headers and open the log part
+func newMultipartResponse(w http.ResponseWriter) (*multipartResponse, error) {
+	mw := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	w.WriteHeader(http.StatusOK)
+
+	m := &multipartResponse{w: w, mw: mw, pending: make(http.Header)}
+	m.pending.Set("Content-Type", "text/plain; charset=utf-8")
+	m.pending.Set("Content-Disposition", `inline; name="log"`)
+	if err := m.nextPart(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Header returns the headers of the next part
+func (m *multipartResponse) Header() http.Header {
+	return m.pending
+}
+
+// WriteHeader starts an error part for error statuses; anything else is
+// already covered by the 200 OK sent with the log part
+func (m *multipartResponse) WriteHeader(status int) {
+	if status < http.StatusBadRequest {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pending.Set("Content-Disposition", `inline; name="error"`)
+	m.pending.Set("X-Build-Status", strconv.Itoa(status))
+	m.pending.Del("Content-Length")
+	_ = m.nextPart()
+}
+
+func (m *multipartResponse) Write(p []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return 0, io.ErrClosedPipe
+	}
+	n, err := m.part.Write(p)
+	if f, ok := m.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return n, err
+}
+
+func (m *multipartResponse) Flush() {
+	if f, ok := m.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Send the artifact part and finish the response
+func (m *multipartResponse) WriteArtifact(path, filename, contentType string, signer *artifactSigner) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error opening artifact: %v", err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("error reading artifact: %v", err)
+	}
+
+	m.pending.Set("Content-Type", contentType)
+	m.pending.Set("Content-Disposition", fmt.Sprintf(`attachment; name="artifact"; filename=%q`, filename))
+	m.pending.Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	if _, err := setChecksumHeaders(m, signer, file); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.nextPart(); err != nil {
+		return err
+	}
+	if _, err := io.Copy(m.part, file); err != nil {
+		return fmt.Errorf("error sending artifact: %v", err)
+	}
+	return m.close()
+}
+
+// Close writes the final boundary
+func (m *multipartResponse) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.close()
+}
+
+// Must be called with m.mu held
+func (m *multipartResponse) close() error {
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+	return m.mw.Close()
+}
+
+// Open a part with the pending headers. Must be called with m.mu held unless
+// the response isn't shared yet.
+func (m *multipartResponse) nextPart() error {
+	header := make(textproto.MIMEHeader, len(m.pending))
+	for key, values := range m.pending {
+		header[key] = values
+	}
+	m.pending = make(http.Header)
+	part, err := m.mw.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	m.part = part
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// npm audit severities from least to most severe
+var auditSeverities = []string{"info", "low", "moderate", "high", "critical"}
+
+// What to do when npm audit finds vulnerabilities at or above the threshold
+const (
+	auditModeFail = "fail"
+	auditModeWarn = "warn"
+)
+
+// auditFinding is a vulnerable package reported by npm audit
+type auditFinding struct {
+	Package    string   `json:"package"`
+	Severity   string   `json:"severity"`
+	Range      string   `json:"range,omitempty"`
+	Advisories []string `json:"advisories,omitempty"`
+}
+
+// Rank of a severity, or -1 if unknown
+func severityRank(severity string) int {
+	for i, s := range auditSeverities {
+		if s == severity {
+			return i
+		}
+	}
+	return -1
+}
+
+// Validate an npm audit threshold ("" disables the audit) and mode
+func validateAuditSettings(level, mode string) error {
+	if level != "" && severityRank(level) < 0 {
+		return fmt.Errorf("unknown severity %q, expected one of %s", level, strings.Join(auditSeverities, ", "))
+	}
+	if mode != auditModeFail && mode != auditModeWarn {
+		return fmt.Errorf("unknown audit mode %q, expected fail or warn", mode)
+	}
+	return nil
+}
+
+// Run npm audit and return the vulnerable packages at or above level,
+// most severe first
+func runNpmAudit(ctx context.Context, packagePath string, env []string, level string, user *buildUser) ([]auditFinding, error) {
+	cmd := exec.CommandContext(ctx, "npm", "audit", "--json", "--audit-level="+level)
+	killProcessGroupOnCancel(cmd)
+	cmd.Dir = packagePath
+	cmd.Env = append(os.Environ(), env...) // Inherit the environment
+	user.apply(cmd)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	runErr := cmd.Run() // npm audit exits non-zero when it finds vulnerabilities
+
+	var report struct {
+		Vulnerabilities map[string]struct {
+			Severity string            `json:"severity"`
+			Range    string            `json:"range"`
+			Via      []json.RawMessage `json:"via"`
+		} `json:"vulnerabilities"`
+		Error *struct {
+			Code    string `json:"code"`
+			Summary string `json:"summary"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &report); err != nil {
+		return nil, fmt.Errorf("error running npm audit: %v, output: %s", runErr, stderr.String())
+	}
+	if report.Error != nil {
+		return nil, fmt.Errorf("npm audit failed: %s %s", report.Error.Code, report.Error.Summary)
+	}
+
+	threshold := severityRank(level)
+	var findings []auditFinding
+	for name, vuln := range report.Vulnerabilities {
+		if severityRank(vuln.Severity) < threshold {
+			continue
+		}
+		finding := auditFinding{Package: name, Severity: vuln.Severity, Range: vuln.Range}
+		for _, via := range vuln.Via {
+			// Entries are either advisories or names of vulnerable dependencies
+			var advisory struct {
+				Title string `json:"title"`
+				URL   string `json:"url"`
+			}
+			if json.Unmarshal(via, &advisory) == nil && advisory.Title != "" {
+				finding.Advisories = append(finding.Advisories, strings.TrimSpace(advisory.Title+" "+advisory.URL))
+			}
+		}
+		findings = append(findings, finding)
+	}
+
+	sort.Slice(findings, func(i, j int) bool {
+		if ri, rj := severityRank(findings[i].Severity), severityRank(findings[j].Severity); ri != rj {
+			return ri > rj
+		}
+		return findings[i].Package < findings[j].Package
+	})
+	return findings, nil
+}
+
+// Summarize findings for the build error, e.g. "2 vulnerable packages at or above high: a (critical), b (high)"
+func summarizeFindings(findings []auditFinding, level string) string {
+	names := make([]string, len(findings))
+	for i, finding := range findings {
+		names[i] = fmt.Sprintf("%s (%s)", finding.Package, finding.Severity)
+	}
+	return fmt.Sprintf("%d vulnerable packages at or above %s: %s", len(findings), level, strings.Join(names, ", "))
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Output of Gradle, Metro (Node) and the kernel when a build runs out of memory
+var outOfMemorySignatures = []string{
+	"java.lang.OutOfMemoryError",
+	"JavaScript heap out of memory",
+	"Gradle build daemon disappeared unexpectedly",
+	"JVM heap space is exhausted",
+	"Cannot allocate memory",
+	"signal: killed",
+}
+
+// Report whether a failed build ran out of memory
+func isOutOfMemory(err error) bool {
+	if err == nil || errors.Is(err, errBuildStalled) {
+		return false
+	}
+	msg := err.Error()
+	for _, signature := range outOfMemorySignatures {
+		if strings.Contains(msg, signature) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check that every OOM_RETRY_ENV entry is a KEY=value pair
+func validateOOMRetryEnv(env []string) error {
+	for _, entry := range env {
+		key, _, ok := strings.Cut(entry, "=")
+		if !ok || !envKeyPattern.MatchString(key) {
+			return fmt.Errorf("%q is not a KEY=value pair", entry)
+		}
+	}
+	return nil
+}
+
+// Build the app, and when OOM_RETRY is enabled and the build ran out of
+// memory, build it once more with the reduced parallelism of OOM_RETRY_ENV.
+// The retry is recorded with the build.
+func buildAppRetryingOOM(ctx context.Context, svc *buildService, buildID string, eas *easInfo, packagePath, platform, outputFile string, opts buildOptions) error {
+	err := buildApp(ctx, eas, packagePath, platform, outputFile, opts)
+	if !svc.config.OOMRetry || !isOutOfMemory(err) || ctx.Err() != nil {
+		return err
+	}
+
+	loggerFrom(ctx).Warn("Build ran out of memory, retrying with reduced parallelism", "target_platform", platform)
+	if opts.Log != nil {
+		fmt.Fprintln(opts.Log, "Out of memory, retrying with reduced parallelism")
+	}
+	svc.registry.Update(buildID, func(record *BuildRecord) {
+		record.ReducedParallelismRetry = true
+	})
+	// Later entries override earlier ones of the same variable
+	opts.Env = append(append([]string{}, opts.Env...), svc.config.OOMRetryEnv...)
+	return buildApp(ctx, eas, packagePath, platform, outputFile, opts)
+}
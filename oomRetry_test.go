@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeEAS writes a stand-in for the EAS CLI that runs out of memory on its
+// first run and builds the --output file on later runs. Every run appends its
+// METRO_MAX_WORKERS to the runs file.
+func fakeEAS(t *testing.T, oomOutput string) (command []string, runs string) {
+	t.Helper()
+	dir := t.TempDir()
+	runs = filepath.Join(dir, "runs")
+	script := filepath.Join(dir, "eas")
+	body := `#!/bin/sh
+echo "workers=$METRO_MAX_WORKERS" >> ` + runs + `
+if [ "$(wc -l < ` + runs + `)" -eq 1 ]; then
+	echo "` + oomOutput + `"
+	exit 1
+fi
+while [ $# -gt 0 ]; do
+	if [ "$1" = --output ]; then echo app > "$2"; fi
+	shift
+done
+`
+	if err := os.WriteFile(script, []byte(body), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return []string{script}, runs
+}
+
+func newOOMTestService(retry bool) *buildService {
+	svc := &buildService{
+		config: Config{
+			OOMRetry:    retry,
+			OOMRetryEnv: []string{"METRO_MAX_WORKERS=1"},
+		},
+		registry: newBuildRegistry(0, 0, newEventHub(0, nil)),
+	}
+	svc.registry.Add(BuildRecord{ID: "b1", Status: statusQueued})
+	return svc
+}
+
+func TestBuildRetriesOutOfMemoryWithReducedParallelism(t *testing.T) {
+	command, runs := fakeEAS(t, "FATAL ERROR: Reached heap limit Allocation failed - JavaScript heap out of memory")
+	svc := newOOMTestService(true)
+	var buildLog bytes.Buffer
+	opts := buildOptions{Command: command, Platforms: []string{"android"}, Env: []string{"METRO_MAX_WORKERS=4"}, Log: &buildLog}
+
+	packagePath := t.TempDir()
+	if err := buildAppRetryingOOM(context.Background(), svc, "b1", nil, packagePath, "android", "app-b1.apk", opts); err != nil {
+		t.Fatalf("build after the retry: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(packagePath, "app-b1.apk")); err != nil {
+		t.Errorf("the retry produced no artifact: %v", err)
+	}
+
+	output, err := os.ReadFile(runs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(output); got != "workers=4\nworkers=1\n" {
+		t.Errorf("runs:\n%swant the retry with METRO_MAX_WORKERS=1", got)
+	}
+	if record, _ := svc.registry.Get("b1"); !record.ReducedParallelismRetry {
+		t.Error("the retry is not recorded with the build")
+	}
+	if !strings.Contains(buildLog.String(), "retrying with reduced parallelism") {
+		t.Errorf("the build log doesn't mention the retry:\n%s", buildLog.String())
+	}
+	// The caller's environment is left alone
+	if len(opts.Env) != 1 || opts.Env[0] != "METRO_MAX_WORKERS=4" {
+		t.Errorf("opts.Env = %v after the retry", opts.Env)
+	}
+}
+
+func TestBuildOutOfMemoryWithoutRetry(t *testing.T) {
+	command, runs := fakeEAS(t, "java.lang.OutOfMemoryError: Java heap space")
+	svc := newOOMTestService(false)
+	opts := buildOptions{Command: command, Platforms: []string{"android"}}
+
+	err := buildAppRetryingOOM(context.Background(), svc, "b1", nil, t.TempDir(), "android", "app-b1.apk", opts)
+	if !isOutOfMemory(err) {
+		t.Fatalf("got %v, want the out-of-memory failure", err)
+	}
+	if output, _ := os.ReadFile(runs); strings.Count(string(output), "\n") != 1 {
+		t.Errorf("EAS ran %q, want once", output)
+	}
+	if record, _ := svc.registry.Get("b1"); record.ReducedParallelismRetry {
+		t.Error("a retry is recorded although OOM_RETRY is off")
+	}
+}
+
+func TestBuildOtherFailureIsNotRetried(t *testing.T) {
+	command, runs := fakeEAS(t, "Execution failed for task ':app:compileReleaseKotlin'")
+	svc := newOOMTestService(true)
+	opts := buildOptions{Command: command, Platforms: []string{"android"}}
+
+	if err := buildAppRetryingOOM(context.Background(), svc, "b1", nil, t.TempDir(), "android", "app-b1.apk", opts); err == nil {
+		t.Fatal("the failed build succeeded")
+	}
+	if output, _ := os.ReadFile(runs); strings.Count(string(output), "\n") != 1 {
+		t.Errorf("EAS ran %q, want once", output)
+	}
+}
+
+func TestIsOutOfMemory(t *testing.T) {
+	for _, signature := range outOfMemorySignatures {
+		if !isOutOfMemory(errors.New("error building app: exit status 1, output: ... " + signature + " ...")) {
+			t.Errorf("%q not recognized", signature)
+		}
+	}
+	if isOutOfMemory(nil) || isOutOfMemory(errors.New("error building app: exit status 1")) {
+		t.Error("a failure without a signature counts as out of memory")
+	}
+	// A stalled build killed for its silence didn't run out of memory
+	stalled := errors.Join(errBuildStalled, errors.New("signal: killed"))
+	if isOutOfMemory(stalled) {
+		t.Error("a stalled build counts as out of memory")
+	}
+}
+
+func TestValidateOOMRetryEnv(t *testing.T) {
+	if err := validateOOMRetryEnv([]string{"GRADLE_OPTS=-Dorg.gradle.workers.max=1 -Dorg.gradle.parallel=false", "METRO_MAX_WORKERS=1"}); err != nil {
+		t.Errorf("default OOM_RETRY_ENV rejected: %v", err)
+	}
+	for _, entry := range []string{"METRO_MAX_WORKERS", "BAD-NAME=1", "=1"} {
+		if err := validateOOMRetryEnv([]string{entry}); err == nil {
+			t.Errorf("%q accepted", entry)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"log"
+	"maps"
+	"strings"
+)
+
+// outputFormat is how an artifact of one format is downloaded
+type outputFormat struct {
+	ContentType string
+	// Extension replaces the artifact's own in download filenames
+	Extension string
+}
+
+// Formats by artifact extension without the leading dot
+var defaultOutputFormats = map[string]outputFormat{
+	"apk":    {ContentType: "application/vnd.android.package-archive", Extension: ".apk"},
+	"aab":    {ContentType: "application/octet-stream", Extension: ".aab"},
+	"ipa":    {ContentType: "application/octet-stream", Extension: ".ipa"},
+	"tar.gz": {ContentType: "application/gzip", Extension: ".tar.gz"}, // iOS simulator builds
+	"app":    {ContentType: "application/octet-stream", Extension: ".app"},
+	"zip":    {ContentType: "application/zip", Extension: ".zip"},
+}
+
+// Parse OUTPUT_FORMATS entries like aab=application/x-authorware-bin or
+// zip=application/zip:.web.zip over the defaults. Invalid entries are logged
+// and ignored.
+func parseOutputFormats(spec string) map[string]outputFormat {
+	formats := maps.Clone(defaultOutputFormats)
+	for _, entry := range splitList(spec) {
+		name, value, ok := strings.Cut(entry, "=")
+		name = strings.TrimPrefix(strings.TrimSpace(name), ".")
+		contentType, ext, _ := strings.Cut(strings.TrimSpace(value), ":")
+		if !ok || name == "" || !strings.Contains(contentType, "/") {
+			log.Printf("Ignoring invalid output format %q", entry)
+			continue
+		}
+		if ext == "" {
+			ext = "." + name
+		}
+		if !strings.HasPrefix(ext, ".") || strings.ContainsAny(ext, `/\`) {
+			log.Printf("Ignoring invalid extension of output format %q", entry)
+			continue
+		}
+		formats[name] = outputFormat{ContentType: contentType, Extension: ext}
+	}
+	return formats
+}
+
+// Format of the artifact at path, by its longest matching extension.
+// Unknown files are downloaded as they are.
+func lookupOutputFormat(formats map[string]outputFormat, path string) (string, outputFormat) {
+	match := ""
+	for name := range formats {
+		if strings.HasSuffix(path, "."+name) && len(name) > len(match) {
+			match = name
+		}
+	}
+	if match == "" {
+		return "", outputFormat{ContentType: "application/octet-stream"}
+	}
+	return match, formats[match]
+}
+
+// Content type and download filename of an artifact named filename
+func downloadAs(formats map[string]outputFormat, filename string) (string, string) {
+	name, format := lookupOutputFormat(formats, filename)
+	if name == "" {
+		return format.ContentType, filename
+	}
+	return format.ContentType, strings.TrimSuffix(filename, "."+name) + format.Extension
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDownloadAsDefaultFormats(t *testing.T) {
+	tests := []struct {
+		filename, contentType, download string
+	}{
+		{"app-b1.apk", "application/vnd.android.package-archive", "app-b1.apk"},
+		{"app-b1.aab", "application/octet-stream", "app-b1.aab"},
+		{"app-b1.ipa", "application/octet-stream", "app-b1.ipa"},
+		{"app-b1.tar.gz", "application/gzip", "app-b1.tar.gz"},
+		{"app-b1.app", "application/octet-stream", "app-b1.app"},
+		{"app-b1.zip", "application/zip", "app-b1.zip"},
+		// Unknown files are downloaded as they are
+		{"app-b1.bin", "application/octet-stream", "app-b1.bin"},
+		{"app-b1.gz", "application/octet-stream", "app-b1.gz"},
+	}
+	for _, tt := range tests {
+		contentType, download := downloadAs(defaultOutputFormats, tt.filename)
+		if contentType != tt.contentType || download != tt.download {
+			t.Errorf("downloadAs(%q) = %q, %q, want %q, %q", tt.filename, contentType, download, tt.contentType, tt.download)
+		}
+	}
+}
+
+func TestParseOutputFormats(t *testing.T) {
+	formats := parseOutputFormats("aab=application/x-authorware-bin, .zip=application/zip:.web.zip, gz=application/gzip, " +
+		"broken, apk=nope, ipa=application/octet-stream:ipa, app=application/octet-stream:../x")
+
+	tests := []struct {
+		filename, contentType, download string
+	}{
+		// Overridden content type, default extension
+		{"app-b1.aab", "application/x-authorware-bin", "app-b1.aab"},
+		// Overridden extension, leading dot of the name ignored
+		{"app-b1.zip", "application/zip", "app-b1.web.zip"},
+		// New format
+		{"app-b1.gz", "application/gzip", "app-b1.gz"},
+		// The longest extension wins over the new gz format
+		{"app-b1.tar.gz", "application/gzip", "app-b1.tar.gz"},
+		// Invalid entries keep the defaults
+		{"app-b1.apk", "application/vnd.android.package-archive", "app-b1.apk"},
+		{"app-b1.ipa", "application/octet-stream", "app-b1.ipa"},
+		{"app-b1.app", "application/octet-stream", "app-b1.app"},
+	}
+	for _, tt := range tests {
+		contentType, download := downloadAs(formats, tt.filename)
+		if contentType != tt.contentType || download != tt.download {
+			t.Errorf("downloadAs(%q) = %q, %q, want %q, %q", tt.filename, contentType, download, tt.contentType, tt.download)
+		}
+	}
+	if _, ok := formats["broken"]; ok {
+		t.Error("an entry without a content type was added")
+	}
+
+	// The defaults aren't modified by the overrides
+	if got := defaultOutputFormats["aab"].ContentType; got != "application/octet-stream" {
+		t.Errorf("default aab content type = %q after parsing overrides", got)
+	}
+}
+
+func TestArtifactHandlerUsesOutputFormat(t *testing.T) {
+	config := Config{
+		ArtifactDir:   t.TempDir(),
+		OutputFormats: parseOutputFormats("aab=application/x-authorware-bin:.android.aab"),
+	}
+	dir := buildArtifactDir(config, "b1")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "app-b1.aab"), []byte("aab bytes"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	svc := &buildService{config: config, registry: newBuildRegistry(0, 0, newEventHub(0, nil)), downloads: newDownloadTracker()}
+	svc.registry.Add(BuildRecord{ID: "b1", Status: statusQueued})
+	svc.registry.Update("b1", func(record *BuildRecord) { record.ArtifactURL = "/artifacts/b1" })
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /artifacts/{id}", artifactHandler(svc))
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/artifacts/b1", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", w.Code)
+	}
+	if got := w.Header().Get("Content-Type"); got != "application/x-authorware-bin" {
+		t.Errorf("Content-Type = %q, want the configured type", got)
+	}
+	if got := w.Header().Get("Content-Disposition"); got != "attachment; filename=app-b1.android.aab" {
+		t.Errorf("Content-Disposition = %q, want the configured extension", got)
+	}
+	if w.Body.String() != "aab bytes" {
+		t.Errorf("body = %q, want the artifact", w.Body.String())
+	}
+}
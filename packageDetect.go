@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// How deep below the clone to look for Expo apps when auto-detecting
+const maxPackageSearchDepth = 4
+
+// Expo config files marking an app directory, besides an app.json with an "expo" key
+var expoConfigFiles = []string{"app.config.js", "app.config.ts"}
+
+// packagePathError reports a package path that doesn't resolve to exactly one app
+type packagePathError struct {
+	msg string
+}
+
+func (e *packagePathError) Error() string {
+	return e.msg
+}
+
+// isPackagePathPattern reports whether package_path asks for auto-detection
+func isPackagePathPattern(packagePath string) bool {
+	return packagePath == "" || strings.ContainsAny(packagePath, "*?[")
+}
+
+// Resolve an empty or glob package_path to the single Expo app it matches,
+// returned relative to the clone. An empty path prefers the repository root
+// when it is an Expo app and otherwise searches the whole clone.
+func detectPackagePath(clonePath, pattern string) (string, error) {
+	if pattern == "" && isExpoApp(clonePath) {
+		return "", nil
+	}
+
+	var candidates []string
+	if pattern == "" {
+		_ = filepath.WalkDir(clonePath, func(path string, d os.DirEntry, err error) error {
+			if err != nil || !d.IsDir() {
+				return nil
+			}
+			if name := d.Name(); path != clonePath && (name == "node_modules" || strings.HasPrefix(name, ".")) {
+				return filepath.SkipDir
+			}
+			rel, _ := filepath.Rel(clonePath, path)
+			if strings.Count(rel, string(filepath.Separator)) >= maxPackageSearchDepth {
+				return filepath.SkipDir
+			}
+			if isExpoApp(path) {
+				candidates = append(candidates, rel)
+			}
+			return nil
+		})
+	} else {
+		matches, err := filepath.Glob(filepath.Join(clonePath, pattern))
+		if err != nil {
+			return "", &packagePathError{msg: fmt.Sprintf("invalid package_path pattern %q: %v", pattern, err)}
+		}
+		for _, match := range matches {
+			rel, err := filepath.Rel(clonePath, match)
+			if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				continue
+			}
+			if isExpoApp(match) {
+				candidates = append(candidates, rel)
+			}
+		}
+	}
+
+	sort.Strings(candidates)
+	switch len(candidates) {
+	case 0:
+		return "", &packagePathError{msg: "no Expo app (app.json or app.config.js/ts) found in the repository"}
+	case 1:
+		return candidates[0], nil
+	}
+	return "", &packagePathError{msg: fmt.Sprintf("multiple Expo apps found, set package_path to one of: %s", strings.Join(candidates, ", "))}
+}
+
+// Check whether a directory holds an Expo app config
+func isExpoApp(dir string) bool {
+	for _, name := range expoConfigFiles {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			return true
+		}
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "app.json"))
+	if err != nil {
+		return false
+	}
+	var appConfig map[string]json.RawMessage
+	if err := json.Unmarshal(data, &appConfig); err != nil {
+		return false
+	}
+	_, ok := appConfig["expo"]
+	return ok
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Create a clone holding the files, keyed by slash-separated paths
+func writeCloneFixture(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+const expoAppJSON = `{"expo": {"name": "app"}}`
+
+func TestDetectPackagePathSingleMatch(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		files   map[string]string
+		pattern string
+		want    string
+	}{
+		{"root app", map[string]string{"app.json": expoAppJSON, "apps/other/app.json": expoAppJSON}, "", ""},
+		{"nested app.json", map[string]string{"package.json": "{}", "apps/mobile/app.json": expoAppJSON, "apps/web/app.json": `{"name": "web"}`}, "", filepath.Join("apps", "mobile")},
+		{"app.config.ts", map[string]string{"packages/mobile/app.config.ts": "export default {}"}, "", filepath.Join("packages", "mobile")},
+		{"glob", map[string]string{"apps/mobile/app.config.js": "", "apps/admin/app.json": `{"name": "admin"}`}, "apps/*", filepath.Join("apps", "mobile")},
+		{"ignores node_modules", map[string]string{"app/app.json": expoAppJSON, "node_modules/expo-template/app.json": expoAppJSON, ".expo/app.json": expoAppJSON}, "", "app"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := detectPackagePath(writeCloneFixture(t, tc.files), tc.pattern)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDetectPackagePathErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		files   map[string]string
+		pattern string
+		wantErr string
+	}{
+		{"multiple", map[string]string{"apps/a/app.json": expoAppJSON, "apps/b/app.config.js": ""}, "", "set package_path to one of: apps/a, apps/b"},
+		{"multiple by glob", map[string]string{"apps/a/app.json": expoAppJSON, "apps/b/app.json": expoAppJSON}, "apps/*", "multiple Expo apps found"},
+		{"none", map[string]string{"README.md": "", "src/app.json": `{"name": "not expo"}`}, "", "no Expo app"},
+		{"too deep", map[string]string{"a/b/c/d/e/app.json": expoAppJSON}, "", "no Expo app"},
+		{"glob outside the clone", map[string]string{"app.json": expoAppJSON}, "../../*", "no Expo app"},
+		{"bad glob", map[string]string{"app.json": expoAppJSON}, "apps/[", "invalid package_path pattern"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := detectPackagePath(writeCloneFixture(t, tc.files), tc.pattern)
+			var pathErr *packagePathError
+			if !errors.As(err, &pathErr) || !strings.Contains(err.Error(), filepath.FromSlash(tc.wantErr)) {
+				t.Errorf("got %v, want a package path error containing %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestIsPackagePathPattern(t *testing.T) {
+	for path, want := range map[string]bool{"": true, "apps/*": true, "app?": true, "apps/[ab]": true, "apps/mobile": false, ".": false} {
+		if got := isPackagePathPattern(path); got != want {
+			t.Errorf("isPackagePathPattern(%q) = %v, want %v", path, got, want)
+		}
+	}
+}
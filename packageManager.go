@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Lockfiles identifying the package manager of a project, checked in order
+var lockfilePackageManagers = []struct {
+	lockfile string
+	manager  string
+}{
+	{"yarn.lock", "yarn"},
+	{"pnpm-lock.yaml", "pnpm"},
+	{"bun.lockb", "bun"},
+	{"bun.lock", "bun"},
+	{"package-lock.json", "npm"},
+}
+
+// Package managers a build can install with
+var packageManagers = []string{"npm", "yarn", "pnpm", "bun"}
+
+// Check a package manager name, empty meaning detect it
+func validatePackageManager(manager string) error {
+	if manager != "" && !slices.Contains(packageManagers, manager) {
+		return fmt.Errorf("%q is not one of %s", manager, strings.Join(packageManagers, ", "))
+	}
+	return nil
+}
+
+// Output fragments printed by npm, yarn and pnpm when a frozen install would
+// have to change the lockfile
+var lockfileDriftMarkers = []string{
+	"npm ci` can only install packages when your package.json and package-lock.json",
+	"can only install with an existing package-lock.json",
+	"from lock file",
+	"Invalid: lock file",
+	"Your lockfile needs to be updated",
+	"The lockfile would have been modified by this install",
+	"lockfile had changes, but lockfile is frozen",
+	"ERR_PNPM_OUTDATED_LOCKFILE",
+	"ERR_PNPM_NO_LOCKFILE",
+}
+
+// lockfileDriftError reports that the committed lockfile is out of sync with package.json
+type lockfileDriftError struct {
+	Manager string
+	Details string
+}
+
+func (e *lockfileDriftError) Error() string {
+	return fmt.Sprintf("lockfile is out of sync with package.json (%s): %s", e.Manager, e.Details)
+}
+
+// npm install flags a request may pass. Anything else is rejected so
+// requests can't inject arbitrary npm options.
+var allowedInstallFlags = map[string]bool{
+	"--legacy-peer-deps": true,
+	"--strict-peer-deps": true,
+	"--force":            true,
+	"--engine-strict":    true,
+	"--no-engine-strict": true,
+	"--ignore-scripts":   true,
+	"--prefer-offline":   true,
+	"--no-audit":         true,
+	"--no-fund":          true,
+	"--no-package-lock":  true,
+}
+
+// Check install flags against the allowlist
+func validateInstallFlags(flags []string) error {
+	for _, flag := range flags {
+		if !allowedInstallFlags[flag] {
+			return fmt.Errorf("flag %q is not allowed", flag)
+		}
+	}
+	return nil
+}
+
+// Detect the package manager from the lockfile, defaulting to npm
+func detectPackageManager(packagePath string) string {
+	for _, candidate := range lockfilePackageManagers {
+		if _, err := os.Stat(filepath.Join(packagePath, candidate.lockfile)); err == nil {
+			return candidate.manager
+		}
+	}
+	return "npm"
+}
+
+// Yarn 2+ (Berry) is configured by .yarnrc.yml and replaced --frozen-lockfile
+// with --immutable
+func isYarnBerry(packagePath string) bool {
+	_, err := os.Stat(filepath.Join(packagePath, ".yarnrc.yml"))
+	return err == nil
+}
+
+// Install dependencies with the given package manager, detected from the
+// lockfile when empty. Install flags only apply to npm. The output is copied
+// to buildLog, if any.
+func runInstall(ctx context.Context, packagePath, manager string, env, flags []string, user *buildUser, buildLog io.Writer) error {
+	defer observeStage(stageInstall, time.Now())
+	if manager == "" {
+		manager = detectPackageManager(packagePath)
+	}
+	if manager == "npm" {
+		return runNpmInstall(ctx, packagePath, env, flags, user, buildLog)
+	}
+	if len(flags) > 0 {
+		loggerFrom(ctx).Warn("Ignoring npm install flags", "flags", flags, "package_manager", manager)
+	}
+
+	installCmd := exec.CommandContext(ctx, manager, "install")
+	killProcessGroupOnCancel(installCmd)
+	installCmd.Dir = packagePath
+	installCmd.Env = append(os.Environ(), env...) // Inherit the environment
+	user.apply(installCmd)
+
+	if output, err := combinedOutput(installCmd, buildLog); err != nil {
+		return fmt.Errorf("error running %s install: %v, output: %s", manager, err, string(output))
+	}
+	return nil
+}
+
+// Install dependencies exactly as locked, failing with a lockfileDriftError if
+// the install would have to modify the lockfile. The package manager is
+// detected from the lockfile when empty.
+func runFrozenInstall(ctx context.Context, packagePath, manager string, env, flags []string, user *buildUser, buildLog io.Writer) error {
+	defer observeStage(stageInstall, time.Now())
+	if manager == "" {
+		manager = detectPackageManager(packagePath)
+	}
+	var args []string
+	switch manager {
+	case "yarn":
+		args = []string{"install", "--frozen-lockfile"}
+		if isYarnBerry(packagePath) {
+			args = []string{"install", "--immutable"}
+		}
+	case "pnpm", "bun":
+		args = []string{"install", "--frozen-lockfile"}
+	default:
+		args = append([]string{"ci"}, flags...)
+	}
+	if manager != "npm" && len(flags) > 0 {
+		loggerFrom(ctx).Warn("Ignoring npm install flags", "flags", flags, "package_manager", manager)
+	}
+
+	installCmd := exec.CommandContext(ctx, manager, args...)
+	killProcessGroupOnCancel(installCmd)
+	installCmd.Dir = packagePath
+	installCmd.Env = append(os.Environ(), env...) // Inherit the environment
+	user.apply(installCmd)
+
+	output, err := combinedOutput(installCmd, buildLog)
+	if err == nil {
+		return nil
+	}
+	if details := lockfileDriftDetails(string(output)); details != "" {
+		return &lockfileDriftError{Manager: manager, Details: details}
+	}
+	return fmt.Errorf("error running %s %s: %v, output: %s", manager, strings.Join(args, " "), err, string(output))
+}
+
+// Extract the lines describing lockfile drift from the install output
+func lockfileDriftDetails(output string) string {
+	var details []string
+	for _, line := range strings.Split(output, "\n") {
+		for _, marker := range lockfileDriftMarkers {
+			if strings.Contains(line, marker) {
+				details = append(details, strings.TrimSpace(line))
+				break
+			}
+		}
+	}
+	return strings.Join(details, "; ")
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// postBuildMeta describes the build to post-build steps
+type postBuildMeta struct {
+	BuildID  string
+	Repo     string
+	Commit   string
+	Platform string
+	Profile  string
+}
+
+// Check that every post-build step is an executable file
+func validatePostBuildSteps(steps []string) error {
+	for _, step := range steps {
+		path, err := exec.LookPath(step)
+		if err != nil {
+			return fmt.Errorf("step %q: %v", step, err)
+		}
+		if !filepath.IsAbs(path) {
+			return fmt.Errorf("step %q must be an absolute path or found in PATH", step)
+		}
+	}
+	return nil
+}
+
+// Run the post-build steps on the artifact in order and return the path of
+// the final artifact. Each step gets the artifact in EXPO_BUILD_ARTIFACT and
+// replaces it by writing the new file to EXPO_BUILD_ARTIFACT_OUT. Files it
+// writes to EXPO_BUILD_SIDE_ARTIFACTS_DIR are kept as extra artifacts. The
+// step's output goes to the build log; the first failing step fails the build.
+func runPostBuildSteps(ctx context.Context, steps []string, workDir, artifact, sideDir string, meta postBuildMeta, logw io.Writer, user *buildUser) (string, error) {
+	if err := os.MkdirAll(sideDir, 0755); err != nil {
+		return "", fmt.Errorf("error creating side artifact directory: %v", err)
+	}
+	if err := user.grant(sideDir); err != nil {
+		return "", err
+	}
+
+	for i, step := range steps {
+		out := filepath.Join(workDir, fmt.Sprintf("post-build-%d%s", i+1, artifactExt(artifact)))
+		fmt.Fprintf(logw, "Running post-build step %s\n", step)
+
+		cmd := exec.CommandContext(ctx, step)
+		killProcessGroupOnCancel(cmd)
+		cmd.Dir = workDir
+		cmd.Env = append(os.Environ(),
+			"EXPO_BUILD_ARTIFACT="+artifact,
+			"EXPO_BUILD_ARTIFACT_OUT="+out,
+			"EXPO_BUILD_SIDE_ARTIFACTS_DIR="+sideDir,
+			"EXPO_BUILD_ID="+meta.BuildID,
+			"EXPO_BUILD_REPO="+meta.Repo,
+			"EXPO_BUILD_COMMIT="+meta.Commit,
+			"EXPO_BUILD_PLATFORM="+meta.Platform,
+			"EXPO_BUILD_PROFILE="+meta.Profile,
+		)
+		cmd.Stdout = logw
+		cmd.Stderr = logw
+		user.apply(cmd)
+		if err := cmd.Run(); err != nil {
+			return "", fmt.Errorf("post-build step %s failed: %v", step, err)
+		}
+
+		if info, err := os.Stat(out); err == nil && info.Mode().IsRegular() {
+			artifact = out
+		}
+	}
+	return artifact, nil
+}
+
+// Extension of an artifact, keeping compound ones like .tar.gz whole
+func artifactExt(path string) string {
+	for _, exts := range primaryArtifactExtensions {
+		for _, ext := range exts {
+			if strings.HasSuffix(path, ext) {
+				return ext
+			}
+		}
+	}
+	return filepath.Ext(path)
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// Run the command in its own process group and kill the whole group when its
+// context is done. EAS, npm and git start children of their own, e.g. Gradle
+// or xcodebuild, which would otherwise keep running after the command itself
+// was killed.
+func killProcessGroupOnCancel(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// What requests are counted against, see RATE_LIMIT_KEY
+const (
+	rateLimitByIP     = "ip"
+	rateLimitByAPIKey = "api_key"
+)
+
+// How often idle clients are dropped from the limiter
+const rateLimitPruneInterval = time.Minute
+
+// rateLimiter limits build requests per client with a token bucket: every
+// client may send burst requests at once, refilled at perMinute per minute.
+// Clients whose bucket is full again are forgotten.
+type rateLimiter struct {
+	rate      float64 // Tokens per second
+	burst     float64
+	by        string
+	proxies   []*net.IPNet // Trusted to set X-Forwarded-For
+	mu        sync.Mutex
+	clients   map[string]*tokenBucket
+	lastPrune time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Returns nil, which allows every request, when perMinute is 0
+func newRateLimiter(perMinute, burst int, by string, proxies []*net.IPNet) *rateLimiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = perMinute
+	}
+	return &rateLimiter{
+		rate:      float64(perMinute) / 60,
+		burst:     float64(burst),
+		by:        by,
+		proxies:   proxies,
+		clients:   make(map[string]*tokenBucket),
+		lastPrune: time.Now(),
+	}
+}
+
+// Check that RATE_LIMIT_KEY names a known key
+func validateRateLimitKey(by string) error {
+	switch by {
+	case rateLimitByIP, rateLimitByAPIKey:
+		return nil
+	default:
+		return fmt.Errorf("%q is not one of %s or %s", by, rateLimitByIP, rateLimitByAPIKey)
+	}
+}
+
+// Parse TRUSTED_PROXIES, IP addresses or CIDR ranges
+func parseTrustedProxies(entries []string) ([]*net.IPNet, error) {
+	var proxies []*net.IPNet
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is not an IP address or CIDR range", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an IP address or CIDR range", entry)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+// Limit wraps a handler, answering 429 Too Many Requests with Retry-After to
+// clients over the limit
+func (l *rateLimiter) Limit(next http.HandlerFunc) http.HandlerFunc {
+	if l == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := l.key(r)
+		retryAfter := l.take(key, time.Now())
+		if retryAfter == 0 {
+			next(w, r)
+			return
+		}
+		loggerFrom(r.Context()).Warn("Rate limiting build requests", "client", key)
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		http.Error(w, "Too many build requests, try again later", http.StatusTooManyRequests)
+	}
+}
+
+// Take a token from the client's bucket. Returns how long until the next
+// token when the bucket is empty, otherwise 0.
+func (l *rateLimiter) take(key string, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastPrune) >= rateLimitPruneInterval {
+		l.prune(now)
+	}
+
+	bucket, ok := l.clients[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.clients[key] = bucket
+	}
+	bucket.tokens = min(l.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate)
+	bucket.last = now
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return 0
+	}
+	return time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+}
+
+// Forget clients whose bucket has filled up again. Must be called with l.mu
+// held.
+func (l *rateLimiter) prune(now time.Time) {
+	for key, bucket := range l.clients {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate >= l.burst {
+			delete(l.clients, key)
+		}
+	}
+	l.lastPrune = now
+}
+
+// Client a request is counted against: its API key with RATE_LIMIT_KEY
+// api_key, otherwise its IP address
+func (l *rateLimiter) key(r *http.Request) string {
+	if l.by == rateLimitByAPIKey {
+		if key := apiKeyFromContext(r.Context()); key != nil {
+			return "key " + key.Label
+		}
+	}
+	return "ip " + forwardedClientIP(r, l.proxies)
+}
+
+// IP address of the client behind the trusted proxies. X-Forwarded-For is
+// only followed from a trusted proxy, and read from the right, since the
+// entries further left were added by whoever sent the request.
+func forwardedClientIP(r *http.Request, proxies []*net.IPNet) string {
+	ip := clientIP(r)
+	if !isTrustedProxy(ip, proxies) {
+		return ip
+	}
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		ip = hop
+		if !isTrustedProxy(ip, proxies) {
+			break
+		}
+	}
+	return ip
+}
+
+func isTrustedProxy(ip string, proxies []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range proxies {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errRefNotFound is returned when the requested ref doesn't exist on the remote
+var errRefNotFound = errors.New("ref not found on remote")
+
+// refChecker verifies that refs exist on a remote with `git ls-remote`,
+// caching results briefly so bursts of builds don't hammer the remote
+type refChecker struct {
+	ttl   time.Duration
+	mu    sync.Mutex
+	cache map[string]refCacheEntry
+}
+
+type refCacheEntry struct {
+	exists  bool
+	branch  string // Resolved default branch for HEAD lookups
+	expires time.Time
+}
+
+func newRefChecker(ttl time.Duration) *refChecker {
+	return &refChecker{ttl: ttl, cache: make(map[string]refCacheEntry)}
+}
+
+// Verify returns errRefNotFound when ref is neither a branch nor a tag of the repository
+func (c *refChecker) Verify(ctx context.Context, repoURL, ref string, opts cloneOptions) error {
+	if strings.ContainsAny(repoURL, ";&") {
+		return fmt.Errorf("invalid repoURL parameter")
+	}
+	if err := validateRepoURL(repoURL); err != nil {
+		return err
+	}
+	if strings.HasPrefix(ref, "-") {
+		return fmt.Errorf("invalid ref %q", ref)
+	}
+
+	key := refCacheKey(repoURL, ref, opts)
+	c.mu.Lock()
+	entry, ok := c.cache[key]
+	c.mu.Unlock()
+	if !ok || time.Now().After(entry.expires) {
+		exists, err := lsRemote(ctx, repoURL, ref, opts)
+		if err != nil {
+			return err
+		}
+		entry = refCacheEntry{exists: exists, expires: time.Now().Add(c.ttl)}
+		c.mu.Lock()
+		c.prune()
+		c.cache[key] = entry
+		c.mu.Unlock()
+	}
+
+	if !entry.exists {
+		return errRefNotFound
+	}
+	return nil
+}
+
+// DefaultBranch returns the branch the remote's HEAD points at, e.g. master
+// for repositories that predate main
+func (c *refChecker) DefaultBranch(ctx context.Context, repoURL string, opts cloneOptions) (string, error) {
+	if strings.ContainsAny(repoURL, ";&") {
+		return "", fmt.Errorf("invalid repoURL parameter")
+	}
+	if err := validateRepoURL(repoURL); err != nil {
+		return "", err
+	}
+
+	key := refCacheKey(repoURL, "HEAD", opts)
+	c.mu.Lock()
+	entry, ok := c.cache[key]
+	c.mu.Unlock()
+	if !ok || time.Now().After(entry.expires) {
+		branch, err := lsRemoteHead(ctx, repoURL, opts)
+		if err != nil {
+			return "", err
+		}
+		entry = refCacheEntry{exists: true, branch: branch, expires: time.Now().Add(c.ttl)}
+		c.mu.Lock()
+		c.prune()
+		c.cache[key] = entry
+		c.mu.Unlock()
+	}
+	return entry.branch, nil
+}
+
+// Cache key of a lookup. The credentials it was made with are part of the key,
+// so a check that passed with one token isn't reused for requests with another
+// token or none; they are hashed rather than kept in memory.
+func refCacheKey(repoURL, ref string, opts cloneOptions) string {
+	token := ""
+	for _, entry := range opts.Env {
+		if value, ok := strings.CutPrefix(entry, gitTokenEnv+"="); ok {
+			token = value
+		}
+	}
+	hash := sha256.New()
+	for _, part := range append([]string{repoURL, ref, token}, opts.GitConfig...) {
+		hash.Write([]byte(part))
+		hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Drop expired cache entries. Must be called with c.mu held.
+func (c *refChecker) prune() {
+	now := time.Now()
+	for key, entry := range c.cache {
+		if now.After(entry.expires) {
+			delete(c.cache, key)
+		}
+	}
+}
+
+// Report whether the remote has a branch or tag named ref
+func lsRemote(ctx context.Context, repoURL, ref string, opts cloneOptions) (bool, error) {
+	cmd := exec.CommandContext(ctx, "git", gitArgs(opts, "ls-remote", "--exit-code", "--", repoURL, "refs/heads/"+ref, "refs/tags/"+ref)...)
+	cmd.Env = gitEnv(repoURL, opts)
+
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 2 {
+		// --exit-code makes git exit with 2 when no matching refs were found
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error running git ls-remote: %v, output: %s", err, output.String())
+	}
+	return true, nil
+}
+
+// Resolve the remote's HEAD symref with `git ls-remote --symref`, which
+// prints a line like "ref: refs/heads/master	HEAD"
+func lsRemoteHead(ctx context.Context, repoURL string, opts cloneOptions) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", gitArgs(opts, "ls-remote", "--symref", "--", repoURL, "HEAD")...)
+	cmd.Env = gitEnv(repoURL, opts)
+
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("error running git ls-remote: %v, output: %s", err, output.String())
+	}
+
+	for _, line := range strings.Split(output.String(), "\n") {
+		ref, name, ok := strings.Cut(strings.TrimPrefix(line, "ref: "), "\t")
+		if ok && strings.HasPrefix(line, "ref: ") && name == "HEAD" && strings.HasPrefix(ref, "refs/heads/") {
+			return strings.TrimPrefix(ref, "refs/heads/"), nil
+		}
+	}
+	return "", errors.New("remote did not report a default branch")
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRefCheckerRejectsOptionURLs(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "pwned")
+	repoURL := "--upload-pack=touch " + marker
+	checker := newRefChecker(time.Minute)
+
+	if _, err := checker.DefaultBranch(context.Background(), repoURL, cloneOptions{}); err == nil {
+		t.Error("DefaultBranch accepted a repo URL starting with -")
+	}
+	if err := checker.Verify(context.Background(), repoURL, "main", cloneOptions{}); err == nil {
+		t.Error("Verify accepted a repo URL starting with -")
+	}
+	if _, err := os.Stat(marker); err == nil {
+		t.Fatal("git ran the injected upload-pack")
+	}
+}
+
+func TestLsRemoteCommitRejectsOptionURLs(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "pwned")
+	if _, err := lsRemoteCommit(context.Background(), "--upload-pack=touch "+marker, "main", cloneOptions{}); err == nil {
+		t.Error("lsRemoteCommit accepted a repo URL starting with -")
+	}
+	if _, err := os.Stat(marker); err == nil {
+		t.Fatal("git ran the injected upload-pack")
+	}
+}
+
+func TestRefCheckerCacheIsPerCredential(t *testing.T) {
+	// Nothing listens on port 1, so any lookup that isn't cached fails
+	const repoURL = "https://127.0.0.1:1/owner/private.git"
+	tokenOpts := func(token, askpass string) cloneOptions {
+		return cloneOptions{Env: []string{"GIT_ASKPASS=" + askpass, gitTokenEnv + "=" + token}}
+	}
+	checker := newRefChecker(time.Minute)
+	// A lookup with token A found the branch
+	checker.cache[refCacheKey(repoURL, "main", tokenOpts("token-a", "/tmp/askpass-1.sh"))] = refCacheEntry{exists: true, expires: time.Now().Add(time.Minute)}
+
+	// The same token with another request's askpass script reuses it
+	if err := checker.Verify(context.Background(), repoURL, "main", tokenOpts("token-a", "/tmp/askpass-2.sh")); err != nil {
+		t.Errorf("same token: %v, want the cached result", err)
+	}
+	for name, opts := range map[string]cloneOptions{
+		"no token":      {},
+		"another token": tokenOpts("token-b", "/tmp/askpass-3.sh"),
+		"auth header":   {GitConfig: []string{"http.extraHeader=Authorization: Bearer token-c"}},
+	} {
+		if err := checker.Verify(context.Background(), repoURL, "main", opts); err == nil {
+			t.Errorf("%s: the check made with token A was reused", name)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+)
+
+// File at the repository root with the repository's own build settings
+const repoConfigFile = ".expo-build-service.yml"
+
+// repoConfig holds the build settings a repository declares for itself.
+// Request parameters take precedence over them.
+type repoConfig struct {
+	PackagePath    string   `yaml:"package_path"`
+	Profile        string   `yaml:"profile"`
+	PackageManager string   `yaml:"package_manager"`
+	Prebuild       bool     `yaml:"prebuild"`
+	RequiredEnv    []string `yaml:"required_env"`
+}
+
+// repoConfigError reports an invalid repository config file
+type repoConfigError struct {
+	msg string
+}
+
+func (e *repoConfigError) Error() string {
+	return fmt.Sprintf("invalid %s: %s", repoConfigFile, e.msg)
+}
+
+// Read and validate the repository's config file, returning an empty config
+// when there is none
+func loadRepoConfig(clonePath string) (repoConfig, error) {
+	var cfg repoConfig
+	data, err := os.ReadFile(filepath.Join(clonePath, repoConfigFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, fmt.Errorf("error reading %s: %v", repoConfigFile, err)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		return cfg, &repoConfigError{msg: err.Error()}
+	}
+	if err := cfg.validate(); err != nil {
+		return cfg, &repoConfigError{msg: err.Error()}
+	}
+	return cfg, nil
+}
+
+func (c repoConfig) validate() error {
+	if c.PackagePath != "" {
+		cleaned := filepath.Clean(c.PackagePath)
+		if filepath.IsAbs(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("package_path %q must be relative to the repository root", c.PackagePath)
+		}
+	}
+	if c.Profile != "" && !isValidProfileName(c.Profile) {
+		return fmt.Errorf("invalid profile %q", c.Profile)
+	}
+	if err := validatePackageManager(c.PackageManager); err != nil {
+		return fmt.Errorf("package_manager %v", err)
+	}
+	for _, key := range c.RequiredEnv {
+		if !envKeyPattern.MatchString(key) {
+			return fmt.Errorf("required_env entry %q is not a valid variable name", key)
+		}
+	}
+	return nil
+}
+
+// Fill in the settings the request leaves empty. Prebuild has no request
+// parameter and is read from the config directly.
+func (c repoConfig) mergeInto(req *BuildRequest) {
+	if req.PackagePath == "" {
+		req.PackagePath = c.PackagePath
+	}
+	if req.Profile == "" {
+		req.Profile = c.Profile
+	}
+	if req.PackageManager == "" {
+		req.PackageManager = c.PackageManager
+	}
+}
+
+// List the required_env variables set neither in the request's env or dotenv
+// nor in the server's default dotenv
+func (c repoConfig) missingEnv(req BuildRequest, dotenvDefaults map[string]string) []string {
+	dotenv, _ := godotenv.Unmarshal(req.Dotenv)
+	var missing []string
+	for _, key := range c.RequiredEnv {
+		_, inEnv := req.Env[key]
+		_, inDotenv := dotenv[key]
+		_, inDefaults := dotenvDefaults[key]
+		if !inEnv && !inDotenv && !inDefaults {
+			missing = append(missing, key)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// Generate the native project for the platform before EAS runs
+func runPrebuild(ctx context.Context, packagePath, platform string, env []string, user *buildUser) error {
+	cmd := exec.CommandContext(ctx, "npx", "expo", "prebuild", "--platform", platform, "--no-install")
+	killProcessGroupOnCancel(cmd)
+	cmd.Dir = packagePath
+	cmd.Env = append(append(os.Environ(), nonInteractiveEnv...), env...) // Inherit the environment
+	user.apply(cmd)
+
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("error running expo prebuild: %v, output: %s", err, string(output))
+	}
+	return nil
+}
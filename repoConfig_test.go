@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Write the repository config file into a new clone, none when content is empty
+func writeRepoConfig(t *testing.T, content string) string {
+	t.Helper()
+	dir := t.TempDir()
+	if content != "" {
+		if err := os.WriteFile(filepath.Join(dir, repoConfigFile), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestLoadRepoConfig(t *testing.T) {
+	cfg, err := loadRepoConfig(writeRepoConfig(t, `
+package_path: apps/mobile
+profile: preview
+package_manager: pnpm
+prebuild: true
+required_env: [API_URL, SENTRY_DSN]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := repoConfig{PackagePath: "apps/mobile", Profile: "preview", PackageManager: "pnpm", Prebuild: true, RequiredEnv: []string{"API_URL", "SENTRY_DSN"}}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("got %+v, want %+v", cfg, want)
+	}
+
+	for name, content := range map[string]string{"missing": "", "empty": "\n# Nothing configured yet\n"} {
+		if cfg, err := loadRepoConfig(writeRepoConfig(t, content)); err != nil || !reflect.DeepEqual(cfg, repoConfig{}) {
+			t.Errorf("%s file: got %+v, %v", name, cfg, err)
+		}
+	}
+}
+
+func TestLoadRepoConfigInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		name, content, wantErr string
+	}{
+		{"unknown field", "package_paht: apps/mobile\n", "field package_paht not found"},
+		{"malformed", "profile: [preview\n", "invalid " + repoConfigFile},
+		{"wrong type", "prebuild: sometimes\n", "invalid " + repoConfigFile},
+		{"absolute package_path", "package_path: /etc\n", "must be relative to the repository root"},
+		{"escaping package_path", "package_path: ../other\n", "must be relative to the repository root"},
+		{"profile", "profile: --local\n", `invalid profile "--local"`},
+		{"package_manager", "package_manager: deno\n", `package_manager "deno" is not one of`},
+		{"required_env", "required_env: [API-URL]\n", `required_env entry "API-URL" is not a valid variable name`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := loadRepoConfig(writeRepoConfig(t, tc.content))
+			var cfgErr *repoConfigError
+			if !errors.As(err, &cfgErr) || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("got %v, want a config error containing %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+// The request wins over the repository config, which fills in the rest
+func TestRepoConfigMergePrecedence(t *testing.T) {
+	cfg := repoConfig{PackagePath: "apps/mobile", Profile: "preview", PackageManager: "yarn"}
+
+	req := BuildRequest{Platform: "android"}
+	cfg.mergeInto(&req)
+	if req.PackagePath != "apps/mobile" || req.Profile != "preview" || req.PackageManager != "yarn" {
+		t.Errorf("empty request not filled in: %+v", req)
+	}
+
+	req = BuildRequest{PackagePath: "apps/tv", Profile: "production", PackageManager: "npm"}
+	cfg.mergeInto(&req)
+	if req.PackagePath != "apps/tv" || req.Profile != "production" || req.PackageManager != "npm" {
+		t.Errorf("request settings overridden: %+v", req)
+	}
+
+	req = BuildRequest{Profile: "production"}
+	repoConfig{}.mergeInto(&req)
+	if req.PackagePath != "" || req.Profile != "production" || req.PackageManager != "" {
+		t.Errorf("empty config changed the request: %+v", req)
+	}
+}
+
+func TestRepoConfigMissingEnv(t *testing.T) {
+	cfg := repoConfig{RequiredEnv: []string{"SENTRY_DSN", "API_URL", "FROM_DOTENV", "FROM_DEFAULTS"}}
+	req := BuildRequest{Env: map[string]string{"API_URL": "https://api.example.com"}, Dotenv: "FROM_DOTENV=1\n"}
+	missing := cfg.missingEnv(req, map[string]string{"FROM_DEFAULTS": "1"})
+	if !slices.Equal(missing, []string{"SENTRY_DSN"}) {
+		t.Errorf("missing %q, want [SENTRY_DSN]", missing)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// repoThrottle limits how many builds a single repository may start within
+// a sliding time window, protecting the server from webhook storms.
+type repoThrottle struct {
+	limit     int
+	window    time.Duration
+	mu        sync.Mutex
+	starts    map[string][]time.Time
+	throttled atomic.Int64
+}
+
+func newRepoThrottle(limit int, window time.Duration) *repoThrottle {
+	return &repoThrottle{
+		limit:  limit,
+		window: window,
+		starts: make(map[string][]time.Time),
+	}
+}
+
+// Allow records a build for the repository and reports whether it is within
+// the limit. When it isn't, the returned duration is how long until a slot frees up.
+func (t *repoThrottle) Allow(repoURL string) (bool, time.Duration) {
+	if t.limit <= 0 {
+		return true, 0
+	}
+
+	key := normalizeRepoKey(repoURL)
+	now := time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.prune(now)
+
+	starts := t.starts[key]
+	if len(starts) >= t.limit {
+		t.throttled.Add(1)
+		buildsThrottled.Inc()
+		return false, starts[0].Add(t.window).Sub(now)
+	}
+	t.starts[key] = append(starts, now)
+	return true, 0
+}
+
+// Throttled returns the total number of requests rejected by the throttle
+func (t *repoThrottle) Throttled() int64 {
+	return t.throttled.Load()
+}
+
+// Drop build starts that fell out of the window, forgetting idle repositories
+func (t *repoThrottle) prune(now time.Time) {
+	cutoff := now.Add(-t.window)
+	for key, starts := range t.starts {
+		i := 0
+		for i < len(starts) && !starts[i].After(cutoff) {
+			i++
+		}
+		if i == len(starts) {
+			delete(t.starts, key)
+		} else {
+			t.starts[key] = starts[i:]
+		}
+	}
+}
+
+// Normalize a repository URL so trivially different spellings share a key
+func normalizeRepoKey(repoURL string) string {
+	key := strings.ToLower(strings.TrimSpace(repoURL))
+	key = strings.TrimSuffix(key, "/")
+	return strings.TrimSuffix(key, ".git")
+}
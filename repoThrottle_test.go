@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRepoThrottle(t *testing.T) {
+	throttle := newRepoThrottle(2, 100*time.Millisecond)
+	for i := 0; i < 2; i++ {
+		if allowed, _ := throttle.Allow("https://github.com/Owner/Repo.git"); !allowed {
+			t.Fatalf("build %d throttled within the limit", i+1)
+		}
+	}
+	// Another spelling of the same repository shares its quota
+	allowed, retryAfter := throttle.Allow("https://github.com/owner/repo/")
+	if allowed {
+		t.Fatal("build over the limit allowed")
+	}
+	if retryAfter <= 0 || retryAfter > 100*time.Millisecond {
+		t.Errorf("retry after %v, want within the window", retryAfter)
+	}
+	if allowed, _ := throttle.Allow("https://github.com/owner/other.git"); !allowed {
+		t.Error("other repository throttled")
+	}
+	if throttle.Throttled() != 1 {
+		t.Errorf("Throttled() = %d, want 1", throttle.Throttled())
+	}
+
+	time.Sleep(120 * time.Millisecond)
+	if allowed, _ := throttle.Allow("https://github.com/owner/repo.git"); !allowed {
+		t.Error("build throttled after the window passed")
+	}
+}
+
+func TestRepoThrottleDisabled(t *testing.T) {
+	throttle := newRepoThrottle(0, time.Minute)
+	for i := 0; i < 100; i++ {
+		if allowed, _ := throttle.Allow("https://github.com/owner/repo.git"); !allowed {
+			t.Fatal("disabled throttle rejected a build")
+		}
+	}
+}
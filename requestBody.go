@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// requestBodyError reports a build request body that can't be used, with the
+// status to answer it with
+type requestBodyError struct {
+	status int
+	msg    string
+}
+
+func (e *requestBodyError) Error() string {
+	return e.msg
+}
+
+// Decode the JSON body of a build request. Bodyless requests, bodies over
+// MAX_REQUEST_SIZE and bodies that don't arrive completely within
+// REQUEST_BODY_TIMEOUT, e.g. a chunked upload a proxy cut short, are rejected
+// instead of leaving the decoder waiting.
+func decodeRequestBody(w http.ResponseWriter, r *http.Request, config Config, v any) error {
+	if r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 {
+		return &requestBodyError{status: http.StatusLengthRequired, msg: "Request body required"}
+	}
+	if config.MaxRequestSize > 0 && r.ContentLength > config.MaxRequestSize {
+		return &requestBodyError{status: http.StatusRequestEntityTooLarge, msg: "Request body too large"}
+	}
+
+	if config.RequestBodyTimeout > 0 {
+		rc := http.NewResponseController(w)
+		if err := rc.SetReadDeadline(time.Now().Add(config.RequestBodyTimeout)); err == nil {
+			// The build itself may take much longer than reading its request
+			defer rc.SetReadDeadline(time.Time{})
+		}
+	}
+
+	body := r.Body
+	if config.MaxRequestSize > 0 {
+		body = http.MaxBytesReader(w, r.Body, config.MaxRequestSize)
+	}
+	decoder := json.NewDecoder(body)
+	if err := decoder.Decode(v); err != nil {
+		return classifyBodyError(err)
+	}
+	// Only whitespace may follow the request object
+	if _, err := decoder.Token(); !errors.Is(err, io.EOF) {
+		if err == nil {
+			return &requestBodyError{status: http.StatusBadRequest, msg: "Invalid request payload: unexpected data after the JSON object"}
+		}
+		return classifyBodyError(err)
+	}
+	return nil
+}
+
+// Map a failure to read or decode the body to the status it should be answered with
+func classifyBodyError(err error) error {
+	var maxBytesErr *http.MaxBytesError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &maxBytesErr):
+		return &requestBodyError{status: http.StatusRequestEntityTooLarge, msg: "Request body too large"}
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return &requestBodyError{status: http.StatusRequestTimeout, msg: "Timed out reading the request body"}
+	case errors.Is(err, io.EOF):
+		return &requestBodyError{status: http.StatusLengthRequired, msg: "Request body required"}
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return &requestBodyError{status: http.StatusBadRequest, msg: "Invalid request payload: body ended early"}
+	}
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+		return &requestBodyError{status: http.StatusBadRequest, msg: "Invalid request payload: " + err.Error()}
+	}
+	// Anything else failed while reading, e.g. a malformed chunked encoding
+	return &requestBodyError{status: http.StatusBadRequest, msg: fmt.Sprintf("Invalid request body: %v", err)}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Status decodeRequestBody answers a request with, 200 when it decodes
+func decodeStatus(w http.ResponseWriter, r *http.Request, config Config) int {
+	var req BuildRequest
+	err := decodeRequestBody(w, r, config, &req)
+	var bodyErr *requestBodyError
+	if errors.As(err, &bodyErr) {
+		return bodyErr.status
+	}
+	if err != nil {
+		return -1
+	}
+	return http.StatusOK
+}
+
+func TestDecodeRequestBody(t *testing.T) {
+	config := Config{MaxRequestSize: 64}
+	for _, tc := range []struct {
+		name    string
+		body    io.Reader
+		length  int64 // -1 for chunked uploads without a length
+		want    int
+		wantMsg string
+	}{
+		{"valid", strings.NewReader(`{"repo_url":"https://github.com/o/r.git","platform":"android"}`), 0, http.StatusOK, ""},
+		{"trailing whitespace", strings.NewReader("{\"platform\":\"ios\"}\n\n"), 0, http.StatusOK, ""},
+		{"no body", nil, 0, http.StatusLengthRequired, "Request body required"},
+		{"empty chunked body", strings.NewReader(""), -1, http.StatusLengthRequired, "Request body required"},
+		{"declared too large", strings.NewReader(`{}`), 65, http.StatusRequestEntityTooLarge, "too large"},
+		{"chunked too large", strings.NewReader(`{"repo_url":"` + strings.Repeat("a", 100) + `"}`), -1, http.StatusRequestEntityTooLarge, "too large"},
+		{"truncated", strings.NewReader(`{"repo_url":"https://gith`), -1, http.StatusBadRequest, "body ended early"},
+		{"garbage", strings.NewReader("\x00\xff garbage"), -1, http.StatusBadRequest, "Invalid request payload"},
+		{"wrong type", strings.NewReader(`{"platform":42}`), -1, http.StatusBadRequest, "Invalid request payload"},
+		{"second object", strings.NewReader(`{}{}`), -1, http.StatusBadRequest, "unexpected data after the JSON object"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/build", tc.body)
+			if tc.length != 0 {
+				r.ContentLength = tc.length
+			}
+			var req BuildRequest
+			err := decodeRequestBody(httptest.NewRecorder(), r, config, &req)
+			if tc.want == http.StatusOK {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			var bodyErr *requestBodyError
+			if !errors.As(err, &bodyErr) {
+				t.Fatalf("got %v, want a requestBodyError", err)
+			}
+			if bodyErr.status != tc.want || !strings.Contains(bodyErr.msg, tc.wantMsg) {
+				t.Errorf("got %d %q, want %d containing %q", bodyErr.status, bodyErr.msg, tc.want, tc.wantMsg)
+			}
+		})
+	}
+}
+
+// Send a raw HTTP request to the server and return the response status
+func rawRequestStatus(t *testing.T, server *httptest.Server, request string) int {
+	t.Helper()
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, request); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("no response: %v", err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// Chunked uploads cut short or garbled by a proxy are answered instead of
+// leaving the decoder waiting for the rest
+func TestDecodeRequestBodyMalformedChunked(t *testing.T) {
+	config := Config{MaxRequestSize: 1 << 20, RequestBodyTimeout: 200 * time.Millisecond}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(decodeStatus(w, r, config))
+	}))
+	defer server.Close()
+
+	const head = "POST /build HTTP/1.1\r\nHost: test\r\nContent-Type: application/json\r\nTransfer-Encoding: chunked\r\n\r\n"
+	for _, tc := range []struct {
+		name, body string
+		want       int
+	}{
+		{"invalid chunk size", "zz\r\n{}\r\n0\r\n\r\n", http.StatusBadRequest},
+		{"never finished", "5\r\n{\"pla", http.StatusRequestTimeout},
+		{"complete", "2\r\n{}\r\n0\r\n\r\n", http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := rawRequestStatus(t, server, head+tc.body); got != tc.want {
+				t.Errorf("got %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
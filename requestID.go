@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"regexp"
+)
+
+// Header tying a build request to the client's logs and the server's
+const requestIDHeader = "X-Request-ID"
+
+// Request IDs taken from clients, short and safe to log
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:/+=-]{1,128}$`)
+
+type requestIDContextKey struct{}
+
+// Give every request an ID, logged with everything done for it and echoed in
+// X-Request-ID. A client's own X-Request-ID is kept, so a build can be
+// found from the CI job that started it. Wraps the whole mux, so auth
+// failures and lines logged after a build is detached carry the ID too.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !requestIDPattern.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		ctx := context.WithValue(r.Context(), requestIDContextKey{}, id)
+		ctx = withLogger(ctx, loggerFrom(ctx).With("request_id", id))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Return the ID of the request, empty outside withRequestID
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey{}).(string)
+	return id
+}
+
+func newRequestID() string {
+	return randomHex(8)
+}
+
+// Return n random bytes, hex encoded. Build and request IDs come from here;
+// IDs that could repeat would mix up builds, so a failing crypto/rand panics
+// instead of handing out zeros.
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("error generating random ID: %v", err))
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestWithRequestIDEchoesHeader(t *testing.T) {
+	var seen string
+	handler := withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = requestIDFromContext(r.Context())
+	}))
+
+	for _, tc := range []struct {
+		name, header string
+		kept         bool
+	}{
+		{"client ID", "ci-job/1234:5", true},
+		{"missing", "", false},
+		{"invalid characters", "id with spaces", false},
+		{"too long", string(bytes.Repeat([]byte("a"), 129)), false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/status/x", nil)
+			if tc.header != "" {
+				req.Header.Set(requestIDHeader, tc.header)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			echoed := rec.Header().Get(requestIDHeader)
+			if echoed == "" || echoed != seen {
+				t.Fatalf("echoed %q, handler saw %q", echoed, seen)
+			}
+			if (echoed == tc.header) != tc.kept {
+				t.Errorf("X-Request-ID %q became %q", tc.header, echoed)
+			}
+		})
+	}
+}
+
+// Requests rejected before reaching a handler still log their request ID
+func TestRequestIDLoggedOnAuthFailure(t *testing.T) {
+	var buf bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(newLogHandler(logFormatJSON, &buf)))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+
+	config := Config{APIKeys: []apiKey{{Label: "default", Token: "secret", Scopes: map[string]bool{scopeAll: true}}}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /build", authenticate(config, func(w http.ResponseWriter, r *http.Request) {
+		t.Error("unauthenticated request reached the build handler")
+	}))
+	req := httptest.NewRequest(http.MethodPost, "/build", nil)
+	req.Header.Set(requestIDHeader, "job-42")
+	rec := httptest.NewRecorder()
+	withRequestID(mux).ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusUnauthorized || rec.Header().Get(requestIDHeader) != "job-42" {
+		t.Fatalf("got %d with X-Request-ID %q", rec.Code, rec.Header().Get(requestIDHeader))
+	}
+	lines := decodeLogLines(t, &buf)
+	if len(lines) != 1 || lines[0]["request_id"] != "job-42" {
+		t.Errorf("auth failure logged as %v", lines)
+	}
+}
+
+// Build and request IDs generated at once, as concurrent builds do, never
+// collide
+func TestGeneratedIDsAreUnique(t *testing.T) {
+	const workers, perWorker = 16, 500
+	for name, generate := range map[string]func() string{
+		"build":   generateTimestampID,
+		"request": newRequestID,
+	} {
+		t.Run(name, func(t *testing.T) {
+			ids := make(chan string, workers*perWorker)
+			var wg sync.WaitGroup
+			for range workers {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for range perWorker {
+						ids <- generate()
+					}
+				}()
+			}
+			wg.Wait()
+			close(ids)
+
+			seen := make(map[string]bool, workers*perWorker)
+			for id := range ids {
+				if seen[id] {
+					t.Fatalf("duplicate %s ID %q", name, id)
+				}
+				seen[id] = true
+			}
+			if len(seen) != workers*perWorker {
+				t.Errorf("got %d IDs, want %d", len(seen), workers*perWorker)
+			}
+		})
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// detachableWriter lets a build outlive its HTTP request. Until the build
+// starts responding, the request can give up and detach it; from then on
+// everything the build writes is discarded.
+type detachableWriter struct {
+	mu          sync.Mutex
+	w           http.ResponseWriter
+	header      http.Header
+	started     bool // The build owns the response
+	wroteHeader bool
+	detached    bool
+	buildID     string
+	accepted    chan struct{} // Closed when an async build detaches itself
+}
+
+func newDetachableWriter(w http.ResponseWriter) *detachableWriter {
+	return &detachableWriter{w: w, header: make(http.Header), accepted: make(chan struct{})}
+}
+
+func (d *detachableWriter) Header() http.Header {
+	return d.header
+}
+
+func (d *detachableWriter) WriteHeader(status int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.detached || d.wroteHeader {
+		return
+	}
+	d.started = true
+	d.writeHeader(status)
+}
+
+func (d *detachableWriter) Write(p []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.detached {
+		return len(p), nil
+	}
+	d.started = true
+	if !d.wroteHeader {
+		d.writeHeader(http.StatusOK)
+	}
+	return d.w.Write(p)
+}
+
+func (d *detachableWriter) Flush() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if f, ok := d.w.(http.Flusher); ok && !d.detached && d.wroteHeader {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the connection
+func (d *detachableWriter) Unwrap() http.ResponseWriter {
+	return d.w
+}
+
+// Copy the build's headers to the real response. Must be called with d.mu held.
+func (d *detachableWriter) writeHeader(status int) {
+	for key, values := range d.header {
+		d.w.Header()[key] = values
+	}
+	d.wroteHeader = true
+	d.w.WriteHeader(status)
+}
+
+// Claim the response for the build, reporting false if the request already
+// gave up on it
+func (d *detachableWriter) claim() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.started = true
+	return !d.detached
+}
+
+// Detach the build from the request unless it already started responding.
+// The returned build ID is empty if the build wasn't registered yet.
+func (d *detachableWriter) detach() (string, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.started {
+		return "", false
+	}
+	d.detached = true
+	return d.buildID, true
+}
+
+// Tell the request which build it is waiting for
+func noteBuildID(w http.ResponseWriter, buildID string) {
+	w.Header().Set("X-Build-ID", buildID)
+	if d, ok := w.(*detachableWriter); ok {
+		d.mu.Lock()
+		d.buildID = buildID
+		d.mu.Unlock()
+	}
+}
+
+// Detach an async build from its request, which is answered with 202
+// Accepted. The build then runs on in the background.
+func acceptAsync(w http.ResponseWriter) {
+	if d, ok := w.(*detachableWriter); ok {
+		if _, detached := d.detach(); detached {
+			close(d.accepted)
+		}
+	}
+}
+
+// Report whether the build can still answer its request. Once it returns
+// true the request waits for the build's response.
+func claimResponse(w http.ResponseWriter) bool {
+	if d, ok := w.(*detachableWriter); ok {
+		return d.claim()
+	}
+	return true
+}
+
+// Run builds so they can outlive their request. Async builds are answered
+// with 202 Accepted once registered. Others are answered with 504 Gateway
+// Timeout after REQUEST_TIMEOUT unless the build already started responding,
+// e.g. by streaming its log. With REQUEST_TIMEOUT_CANCELS unset the build
+// keeps running and its result is kept for the status and artifact endpoints.
+// Shutdown still cancels it.
+func withBackgroundBuilds(config Config, shutdown context.Context, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithCancel(context.WithoutCancel(r.Context()))
+		stop := context.AfterFunc(shutdown, cancel)
+		dw := newDetachableWriter(w)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			defer stop()
+			defer cancel()
+			next(dw, r.WithContext(ctx))
+		}()
+
+		var timeout <-chan time.Time
+		if config.RequestTimeout > 0 {
+			timer := time.NewTimer(config.RequestTimeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case <-done:
+			return
+		case <-dw.accepted:
+			writeAccepted(r.Context(), w, dw.buildID)
+			return
+		case <-r.Context().Done():
+			// The client went away, keep building unless told otherwise.
+			// Without REQUEST_TIMEOUT the build ends with its request.
+			if config.RequestTimeout <= 0 || config.RequestTimeoutCancels {
+				cancel()
+			} else if _, detached := dw.detach(); detached {
+				return
+			}
+			<-done
+			return
+		case <-timeout:
+		}
+
+		buildID, detached := dw.detach()
+		if !detached {
+			<-done
+			return
+		}
+		logger := loggerFrom(r.Context()).With("build_id", buildID)
+		if config.RequestTimeoutCancels || buildID == "" {
+			cancel()
+			logger.Warn("Build request timed out, cancelling the build", "timeout", config.RequestTimeout.String())
+			http.Error(w, "Request timed out", http.StatusGatewayTimeout)
+			return
+		}
+
+		logger.Info("Build request timed out, continuing in the background", "timeout", config.RequestTimeout.String())
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Build-ID", buildID)
+		w.WriteHeader(http.StatusGatewayTimeout)
+		resp := map[string]string{
+			"build_id":   buildID,
+			"status":     "running",
+			"status_url": "/build/status/" + buildID,
+			"error":      "Request timed out, the build continues in the background",
+		}
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			logger.Error("Failed to write timeout response", "error", err)
+		}
+	}
+}
+
+// Answer the request of an async build with where to follow it
+func writeAccepted(ctx context.Context, w http.ResponseWriter, buildID string) {
+	logger := loggerFrom(ctx).With("build_id", buildID)
+	logger.Info("Accepted async build")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Build-ID", buildID)
+	w.Header().Set("Location", "/build/status/"+buildID)
+	w.WriteHeader(http.StatusAccepted)
+	resp := map[string]string{
+		"build_id":   buildID,
+		"status":     statusQueued,
+		"status_url": "/build/status/" + buildID,
+	}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		logger.Error("Failed to write async build response", "error", err)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Header telling clients whether the artifact came from the result cache
+const headerBuildCache = "X-Build-Cache"
+
+// resultCacheEntry points at the retained artifact of a successful build
+type resultCacheEntry struct {
+	BuildID     string
+	Path        string
+	Filename    string
+	ContentType string
+	Size        int64
+	SHA256      string
+	stored      time.Time
+}
+
+// Describe a retained artifact for the result cache
+func newResultCacheEntry(config Config, result BuildResult, contentType string) resultCacheEntry {
+	return resultCacheEntry{
+		BuildID:     result.BuildID,
+		Path:        filepath.Join(buildArtifactDir(config, result.BuildID), result.Filename),
+		Filename:    result.Filename,
+		ContentType: contentType,
+		Size:        result.Size,
+		SHA256:      result.SHA256,
+	}
+}
+
+// resultCache remembers successful builds by their inputs so an identical
+// build can be answered with the earlier artifact. Entries expire after ttl
+// or when the retained artifact is gone, and the least recently used are
+// evicted beyond maxEntries.
+type resultCache struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	maxEntries int
+	entries    map[string]*list.Element
+	lru        *list.List // Most recently used at the front
+}
+
+type resultCacheItem struct {
+	key   string
+	entry resultCacheEntry
+}
+
+func newResultCache(ttl time.Duration, maxEntries int) *resultCache {
+	return &resultCache{ttl: ttl, maxEntries: maxEntries, entries: make(map[string]*list.Element), lru: list.New()}
+}
+
+// Enabled reports whether results are cached at all
+func (c *resultCache) Enabled() bool {
+	return c.ttl > 0 && c.maxEntries > 0
+}
+
+// Get returns the cached result for key if it's still fresh and its artifact exists
+func (c *resultCache) Get(key string) (resultCacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return resultCacheEntry{}, false
+	}
+	entry := elem.Value.(*resultCacheItem).entry
+	if time.Since(entry.stored) > c.ttl || !fileExists(entry.Path) {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+		return resultCacheEntry{}, false
+	}
+	c.lru.MoveToFront(elem)
+	return entry, true
+}
+
+// Put stores the result of a build under key
+func (c *resultCache) Put(key string, entry resultCacheEntry) {
+	if !c.Enabled() {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry.stored = time.Now()
+	if elem, ok := c.entries[key]; ok {
+		c.lru.Remove(elem)
+	}
+	c.entries[key] = c.lru.PushFront(&resultCacheItem{key: key, entry: entry})
+	for c.lru.Len() > c.maxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*resultCacheItem).key)
+	}
+}
+
+// Key of a build's result: the exact commit, platform and profile plus a hash
+// of everything else in the request that can change the artifact, and the
+// server's default dotenv. Fields that only affect scheduling or the response
+// are left out.
+func resultCacheKey(commit, platform, profile string, req BuildRequest, dotenvDefaults map[string]string) string {
+	inputs := req
+	inputs.RepoURL = normalizeRepoKey(req.RepoURL)
+	// Credentials don't change what is built, with or without them in the URL
+	if parsed, err := url.Parse(inputs.RepoURL); err == nil && parsed.User != nil {
+		parsed.User = nil
+		inputs.RepoURL = parsed.String()
+	}
+	inputs.GitToken = ""
+	inputs.Priority = ""
+	inputs.ResponseFormat = ""
+	inputs.InlineLogKB = 0
+	inputs.ReuseResult = false
+	inputs.InstallLink = false
+	inputs.NpmAuditLevel = nil
+	inputs.NpmAuditMode = ""
+	inputs.Async = false
+	inputs.NoWait = false
+	inputs.CallbackURL = ""
+
+	// Every field of the request came from JSON, so encoding can't fail
+	data, _ := json.Marshal(struct {
+		Commit   string
+		Platform string
+		Profile  string
+		Request  BuildRequest
+		Defaults map[string]string
+	}{commit, platform, profile, inputs, dotenvDefaults})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Resolve the commit a branch or tag currently points at on the remote
+func lsRemoteCommit(ctx context.Context, repoURL, ref string, opts cloneOptions) (string, error) {
+	if err := validateRepoURL(repoURL); err != nil {
+		return "", err
+	}
+	output, err := runGit(ctx, "", repoURL, opts, gitArgs(opts, "ls-remote", "--", repoURL, "refs/heads/"+ref, "refs/tags/"+ref, "refs/tags/"+ref+"^{}")...)
+	if err != nil {
+		return "", fmt.Errorf("error running git ls-remote: %v, output: %s", err, output)
+	}
+
+	// Prefer the commit an annotated tag points at over the tag object
+	commit := ""
+	for _, line := range strings.Split(output, "\n") {
+		sha, name, ok := strings.Cut(line, "\t")
+		if !ok {
+			continue
+		}
+		if commit == "" || strings.HasSuffix(name, "^{}") {
+			commit = sha
+		}
+	}
+	if commit == "" {
+		return "", errRefNotFound
+	}
+	return commit, nil
+}
+
+// Answer a build request with the artifact of an identical earlier build
+func serveCachedResult(w http.ResponseWriter, r *http.Request, svc *buildService, buildID, platform, responseFormat string, entry resultCacheEntry) {
+	artifactURL := "/artifacts/" + entry.BuildID
+	svc.registry.Update(buildID, func(record *BuildRecord) {
+		record.CacheHit = true
+		record.ArtifactURL = artifactURL
+	})
+	svc.registry.Finish(buildID, statusSucceeded, "")
+	logger := loggerFrom(r.Context())
+	logger.Info("Reusing the artifact of an earlier build", "cached_build_id", entry.BuildID)
+	w.Header().Set(headerBuildCache, "hit")
+
+	if wantsMinimalResponse(r) {
+		result := BuildResult{
+			BuildID:     buildID,
+			Status:      statusSucceeded,
+			Platform:    platform,
+			Filename:    entry.Filename,
+			ContentType: entry.ContentType,
+			Size:        entry.Size,
+			SHA256:      entry.SHA256,
+			Signature:   svc.signer.Sign(entry.SHA256),
+			ArtifactURL: artifactURL,
+			CacheHit:    true,
+		}
+		setChecksumHeader(w, svc.signer, result.SHA256)
+		w.Header().Set("Preference-Applied", "return=minimal")
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(result); err != nil {
+			logger.Error("Failed to write build result", "error", err)
+		}
+		return
+	}
+
+	defer svc.downloads.Begin(entry.BuildID)()
+	if responseFormat == "base64" {
+		writeBase64Artifact(r.Context(), w, entry.Path, entry.Filename, entry.ContentType, svc.config.Base64MaxSize, svc.signer)
+		return
+	}
+
+	file, err := os.Open(entry.Path)
+	if err != nil {
+		logger.Error("Failed to open cached artifact", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		logger.Error("Failed to stat cached artifact", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if _, err := setChecksumHeaders(w, svc.signer, file); err != nil {
+		logger.Error("Failed to hash artifact", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	setFileETag(w, info)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filepath.Base(entry.Path)))
+	w.Header().Set("Content-Type", entry.ContentType)
+	http.ServeContent(w, r, entry.Filename, info.ModTime(), file)
+}
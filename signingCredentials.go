@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Locations of the injected signing files relative to the package directory
+const (
+	signingKeystorePath = "credentials/android/keystore.jks"
+	signingCertPath     = "credentials/ios/dist-cert.p12"
+	signingProfilePath  = "credentials/ios/profile.mobileprovision"
+)
+
+// Names of the files expected in a SIGNING_SECRETS_DIR entry
+const (
+	signingSecretKeystore = "keystore.jks"
+	signingSecretCert     = "dist-cert.p12"
+	signingSecretProfile  = "profile.mobileprovision"
+	signingSecretConfig   = "signing.json"
+)
+
+// Magic numbers of Java keystores; PKCS#12 stores start with a DER sequence
+var (
+	jksMagic   = []byte{0xfe, 0xed, 0xfe, 0xed}
+	jceksMagic = []byte{0xce, 0xce, 0xce, 0xce}
+)
+
+var provisioningExpiry = regexp.MustCompile(`<key>ExpirationDate</key>\s*<date>([^<]+)</date>`)
+
+// credentialsError reports unusable signing credentials
+type credentialsError struct {
+	msg string
+}
+
+func (e *credentialsError) Error() string {
+	return e.msg
+}
+
+func credentialsErrorf(format string, args ...interface{}) error {
+	return &credentialsError{msg: fmt.Sprintf(format, args...)}
+}
+
+// SigningCredentials holds the keystore (Android) or the distribution
+// certificate and provisioning profile (iOS) of a signed build
+type SigningCredentials struct {
+	Keystore         string `json:"keystore" secret:"true"`
+	KeystorePassword string `json:"keystore_password" secret:"true"`
+	KeyAlias         string `json:"key_alias"`
+	KeyPassword      string `json:"key_password" secret:"true"`
+
+	DistributionCertificate string `json:"distribution_certificate" secret:"true"`
+	CertificatePassword     string `json:"certificate_password" secret:"true"`
+	ProvisioningProfile     string `json:"provisioning_profile" secret:"true"`
+}
+
+// signingFiles are the decoded and validated credentials of a build
+type signingFiles struct {
+	keystore, cert, profile []byte
+	keystorePassword        string
+	keyAlias, keyPassword   string
+	certPassword            string
+}
+
+// Load the signing credentials for a build, either from the request or from
+// a named entry in the secrets directory, and validate them for the platform.
+// Returns nil when the build doesn't use managed credentials.
+func loadSigningCredentials(config Config, req BuildRequest) (*signingFiles, error) {
+	creds := SigningCredentials{}
+	if req.Signing != nil {
+		creds = *req.Signing
+	}
+
+	files := &signingFiles{
+		keystorePassword: creds.KeystorePassword,
+		keyAlias:         creds.KeyAlias,
+		keyPassword:      creds.KeyPassword,
+		certPassword:     creds.CertificatePassword,
+	}
+	if req.SigningSecret != "" {
+		if err := files.loadSecret(config, req.SigningSecret); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, field := range []struct {
+		name    string
+		encoded string
+		dest    *[]byte
+	}{
+		{"keystore", creds.Keystore, &files.keystore},
+		{"distribution_certificate", creds.DistributionCertificate, &files.cert},
+		{"provisioning_profile", creds.ProvisioningProfile, &files.profile},
+	} {
+		if field.encoded == "" {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(field.encoded)
+		if err != nil {
+			return nil, credentialsErrorf("signing.%s is not valid base64", field.name)
+		}
+		*field.dest = decoded
+	}
+
+	switch req.Platform {
+	case "android":
+		if files.keystore == nil {
+			return nil, nil
+		}
+		return files, files.validateAndroid()
+	case "ios":
+		if files.cert == nil && files.profile == nil {
+			return nil, nil
+		}
+		return files, files.validateIOS()
+	}
+	return nil, nil
+}
+
+// Read credentials from a directory in SIGNING_SECRETS_DIR. signing.json
+// holds the passwords and alias using the same keys as the request.
+func (f *signingFiles) loadSecret(config Config, name string) error {
+	if config.SigningSecretsDir == "" {
+		return credentialsErrorf("signing_secret requires SIGNING_SECRETS_DIR to be configured")
+	}
+	if strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return credentialsErrorf("invalid signing_secret name")
+	}
+	dir := filepath.Join(config.SigningSecretsDir, name)
+	if _, err := os.Stat(dir); err != nil {
+		return credentialsErrorf("unknown signing_secret %q", name)
+	}
+
+	f.keystore, _ = os.ReadFile(filepath.Join(dir, signingSecretKeystore))
+	f.cert, _ = os.ReadFile(filepath.Join(dir, signingSecretCert))
+	f.profile, _ = os.ReadFile(filepath.Join(dir, signingSecretProfile))
+
+	if data, err := os.ReadFile(filepath.Join(dir, signingSecretConfig)); err == nil {
+		var stored SigningCredentials
+		if err := json.Unmarshal(data, &stored); err != nil {
+			return credentialsErrorf("signing_secret %q has an invalid %s: %v", name, signingSecretConfig, err)
+		}
+		// Passwords sent with the request take precedence
+		for _, field := range []struct {
+			dest  *string
+			value string
+		}{
+			{&f.keystorePassword, stored.KeystorePassword},
+			{&f.keyAlias, stored.KeyAlias},
+			{&f.keyPassword, stored.KeyPassword},
+			{&f.certPassword, stored.CertificatePassword},
+		} {
+			if *field.dest == "" {
+				*field.dest = field.value
+			}
+		}
+	}
+	return nil
+}
+
+// Check that the keystore looks like a JKS, JCEKS or PKCS#12 store and that
+// everything needed to unlock it is present
+func (f *signingFiles) validateAndroid() error {
+	if !bytes.HasPrefix(f.keystore, jksMagic) && !bytes.HasPrefix(f.keystore, jceksMagic) && !isDERSequence(f.keystore) {
+		return credentialsErrorf("keystore is not a JKS or PKCS#12 keystore")
+	}
+	if f.keystorePassword == "" || f.keyAlias == "" {
+		return credentialsErrorf("keystore requires keystore_password and key_alias")
+	}
+	if f.keyPassword == "" {
+		f.keyPassword = f.keystorePassword
+	}
+	return nil
+}
+
+// Check that both iOS files are present, the certificate is a PKCS#12 file
+// and the provisioning profile is a signed, unexpired profile
+func (f *signingFiles) validateIOS() error {
+	if f.cert == nil || f.profile == nil {
+		return credentialsErrorf("iOS builds need both distribution_certificate and provisioning_profile")
+	}
+	if !isDERSequence(f.cert) {
+		return credentialsErrorf("distribution_certificate is not a PKCS#12 (.p12) file")
+	}
+	if !isDERSequence(f.profile) || !bytes.Contains(f.profile, []byte("<plist")) {
+		return credentialsErrorf("provisioning_profile is not a signed .mobileprovision file")
+	}
+	match := provisioningExpiry.FindSubmatch(f.profile)
+	if match == nil {
+		return credentialsErrorf("provisioning_profile has no expiration date")
+	}
+	expires, err := time.Parse(time.RFC3339, string(match[1]))
+	if err != nil {
+		return credentialsErrorf("provisioning_profile has an invalid expiration date %q", match[1])
+	}
+	if time.Now().After(expires) {
+		return credentialsErrorf("provisioning_profile expired on %s", expires.Format("2006-01-02"))
+	}
+	return nil
+}
+
+// DER-encoded structures (PKCS#12, CMS) start with a SEQUENCE tag
+func isDERSequence(data []byte) bool {
+	return len(data) > 4 && data[0] == 0x30
+}
+
+// Write the signing files and a credentials.json into the project and switch
+// the build profile to local credentials. The returned function removes
+// everything again and restores the original eas.json.
+func injectSigningCredentials(ctx context.Context, packagePath, platform, profile string, files *signingFiles) (func(), error) {
+	var restores []func()
+	restore := func() {
+		for i := len(restores) - 1; i >= 0; i-- {
+			restores[i]()
+		}
+	}
+	inject := func(relPath string, contents []byte) error {
+		remove, err := injectFile(ctx, packagePath, relPath, contents)
+		if err != nil {
+			return err
+		}
+		restores = append(restores, remove)
+		return nil
+	}
+
+	credentials := map[string]interface{}{}
+	if platform == "android" {
+		if err := inject(signingKeystorePath, files.keystore); err != nil {
+			restore()
+			return nil, err
+		}
+		credentials["android"] = map[string]interface{}{
+			"keystore": map[string]string{
+				"keystorePath":     signingKeystorePath,
+				"keystorePassword": files.keystorePassword,
+				"keyAlias":         files.keyAlias,
+				"keyPassword":      files.keyPassword,
+			},
+		}
+	} else {
+		if err := inject(signingCertPath, files.cert); err != nil {
+			restore()
+			return nil, err
+		}
+		if err := inject(signingProfilePath, files.profile); err != nil {
+			restore()
+			return nil, err
+		}
+		credentials["ios"] = map[string]interface{}{
+			"provisioningProfilePath": signingProfilePath,
+			"distributionCertificate": map[string]string{
+				"path":     signingCertPath,
+				"password": files.certPassword,
+			},
+		}
+	}
+
+	credentialsJSON, err := json.MarshalIndent(credentials, "", "  ")
+	if err != nil {
+		restore()
+		return nil, fmt.Errorf("error encoding credentials.json: %v", err)
+	}
+	if err := inject("credentials.json", credentialsJSON); err != nil {
+		restore()
+		return nil, err
+	}
+
+	easJSON, err := withLocalCredentials(filepath.Join(packagePath, "eas.json"), profile)
+	if err != nil {
+		restore()
+		return nil, err
+	}
+	if err := inject("eas.json", easJSON); err != nil {
+		restore()
+		return nil, err
+	}
+	return restore, nil
+}
+
+// Return eas.json with credentialsSource set to "local" for the profile
+func withLocalCredentials(path, profile string) ([]byte, error) {
+	easConfig := map[string]interface{}{}
+	if data, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(data, &easConfig); err != nil {
+			return nil, fmt.Errorf("error parsing eas.json: %v", err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("error reading eas.json: %v", err)
+	}
+
+	build, _ := easConfig["build"].(map[string]interface{})
+	if build == nil {
+		build = map[string]interface{}{}
+		easConfig["build"] = build
+	}
+	profileConfig, _ := build[profile].(map[string]interface{})
+	if profileConfig == nil {
+		profileConfig = map[string]interface{}{}
+		build[profile] = profileConfig
+	}
+	profileConfig["credentialsSource"] = "local"
+
+	return json.MarshalIndent(easConfig, "", "  ")
+}
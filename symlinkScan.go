@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// What to do with symlinks in a clone that point outside of it
+const (
+	symlinkPolicyReject = "reject" // Fail the build
+	symlinkPolicyRemove = "remove" // Delete the links and continue
+	symlinkPolicyOff    = "off"    // Don't scan
+)
+
+// symlinkError reports symlinks leading out of the clone
+type symlinkError struct {
+	paths []string
+}
+
+func (e *symlinkError) Error() string {
+	return fmt.Sprintf("symlinks point outside the repository: %s", strings.Join(e.paths, ", "))
+}
+
+// Check a SYMLINK_POLICY value
+func validateSymlinkPolicy(policy string) error {
+	switch policy {
+	case symlinkPolicyReject, symlinkPolicyRemove, symlinkPolicyOff:
+		return nil
+	}
+	return fmt.Errorf("unknown symlink policy %q, expected reject, remove or off", policy)
+}
+
+// Report whether the repository is listed in TRUSTED_REPOS
+func isTrustedRepo(config Config, repoURL string) bool {
+	key := normalizeRepoKey(repoURL)
+	for _, trusted := range config.TrustedRepos {
+		if normalizeRepoKey(trusted) == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply the symlink policy to a fresh clone so install and build scripts
+// can't follow links to host files
+func checkCloneSymlinks(root, policy string) error {
+	if policy == symlinkPolicyOff {
+		return nil
+	}
+	escaping, err := findEscapingSymlinks(root)
+	if err != nil {
+		return fmt.Errorf("error scanning for symlinks: %v", err)
+	}
+	if len(escaping) == 0 {
+		return nil
+	}
+	if policy == symlinkPolicyRemove {
+		for _, rel := range escaping {
+			if err := os.Remove(filepath.Join(root, rel)); err != nil {
+				return fmt.Errorf("error removing symlink %s: %v", rel, err)
+			}
+		}
+		return nil
+	}
+	return &symlinkError{paths: escaping}
+}
+
+// List the symlinks under root, relative to it, whose target lies outside
+// root. Links are resolved through the filesystem, so chains of links that
+// only escape together are caught; links that don't resolve are listed too.
+func findEscapingSymlinks(root string) ([]string, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, err
+	}
+
+	var escaping []string
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type()&fs.ModeSymlink == 0 {
+			return nil
+		}
+		if !resolvesWithin(realRoot, path) {
+			relPath, _ := filepath.Rel(root, path)
+			escaping = append(escaping, relPath)
+		}
+		return nil
+	})
+	return escaping, err
+}
+
+// Report whether path, with all symlinks along it resolved, lies inside
+// realRoot, which must already be resolved. A path that doesn't resolve, like
+// a dangling or looping link, is not inside.
+func resolvesWithin(realRoot, path string) bool {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(realRoot, resolved)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
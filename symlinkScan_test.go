@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// Create a clone with safe and escaping symlinks
+func writeSymlinkFixture(t *testing.T) string {
+	t.Helper()
+	root := filepath.Join(t.TempDir(), "clone")
+	for _, dir := range []string{"src/assets", "config", "d"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(root, "src/assets/icon.png"), []byte("png"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{
+		"icon.png":          "src/assets/icon.png",      // Safe, relative
+		"src/assets/self":   "../assets",                // Safe, into a parent inside the clone
+		"config/abs-inside": filepath.Join(root, "src"), // Safe, absolute inside
+		"config/passwd":     "/etc/passwd",              // Escapes, absolute
+		"src/up":            "../../..",                 // Escapes, relative
+		"sibling":           "../other-clone/secret",    // Escapes to a sibling directory
+		"d/y":               "..",                       // Safe, the clone itself
+		"x":                 "d/y/..",                   // Escapes through d/y, though lexically inside
+		"src/dangling":      "missing.png",              // Doesn't resolve
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+var escapingFixtureLinks = []string{"config/passwd", "sibling", "src/dangling", "src/up", "x"}
+
+func TestFindEscapingSymlinks(t *testing.T) {
+	escaping, err := findEscapingSymlinks(writeSymlinkFixture(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make([]string, len(escapingFixtureLinks))
+	for i, link := range escapingFixtureLinks {
+		want[i] = filepath.FromSlash(link)
+	}
+	slices.Sort(escaping)
+	if !slices.Equal(escaping, want) {
+		t.Errorf("got %q, want %q", escaping, want)
+	}
+}
+
+func TestCheckCloneSymlinks(t *testing.T) {
+	t.Run("reject", func(t *testing.T) {
+		root := writeSymlinkFixture(t)
+		err := checkCloneSymlinks(root, symlinkPolicyReject)
+		var linkErr *symlinkError
+		if !errors.As(err, &linkErr) || len(linkErr.paths) != len(escapingFixtureLinks) {
+			t.Fatalf("got %v, want the escaping links", err)
+		}
+		if _, err := os.Lstat(filepath.Join(root, "config/passwd")); err != nil {
+			t.Error("rejecting removed a link")
+		}
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		root := writeSymlinkFixture(t)
+		if err := checkCloneSymlinks(root, symlinkPolicyRemove); err != nil {
+			t.Fatal(err)
+		}
+		for _, link := range escapingFixtureLinks {
+			if _, err := os.Lstat(filepath.Join(root, link)); !os.IsNotExist(err) {
+				t.Errorf("escaping link %s kept", link)
+			}
+		}
+		for _, link := range []string{"icon.png", "src/assets/self", "config/abs-inside", "d/y"} {
+			if _, err := os.Lstat(filepath.Join(root, link)); err != nil {
+				t.Errorf("safe link %s removed", link)
+			}
+		}
+		if escaping, _ := findEscapingSymlinks(root); len(escaping) != 0 {
+			t.Errorf("still escaping after removal: %q", escaping)
+		}
+	})
+
+	t.Run("off", func(t *testing.T) {
+		if err := checkCloneSymlinks(writeSymlinkFixture(t), symlinkPolicyOff); err != nil {
+			t.Errorf("got %v with scanning off", err)
+		}
+	})
+
+	t.Run("only safe links", func(t *testing.T) {
+		root := t.TempDir()
+		if err := os.WriteFile(filepath.Join(root, "README.md"), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink("README.md", filepath.Join(root, "README")); err != nil {
+			t.Fatal(err)
+		}
+		if err := checkCloneSymlinks(root, symlinkPolicyReject); err != nil {
+			t.Errorf("got %v for a safe link", err)
+		}
+	})
+}
+
+func TestValidateSymlinkPolicy(t *testing.T) {
+	for _, policy := range []string{symlinkPolicyReject, symlinkPolicyRemove, symlinkPolicyOff} {
+		if err := validateSymlinkPolicy(policy); err != nil {
+			t.Errorf("policy %q rejected: %v", policy, err)
+		}
+	}
+	if err := validateSymlinkPolicy("follow"); err == nil {
+		t.Error("unknown policy accepted")
+	}
+}
+
+// Trusted repositories match despite trivial differences in their URL
+func TestIsTrustedRepo(t *testing.T) {
+	config := Config{TrustedRepos: []string{"https://github.com/owner/app.git"}}
+	for repo, want := range map[string]bool{
+		"https://github.com/owner/app.git": true,
+		"https://github.com/owner/app":     true,
+		"HTTPS://GitHub.com/Owner/App/":    true,
+		"https://github.com/owner/other":   false,
+	} {
+		if got := isTrustedRepo(config, repo); got != want {
+			t.Errorf("isTrustedRepo(%q) = %v, want %v", repo, got, want)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Build the server TLS configuration from the minimum version and the
+// optional cipher suite allowlist, rejecting anything known to be weak
+func buildTLSConfig(config Config) (*tls.Config, error) {
+	minVersion, ok := tlsVersions[config.TLSMinVersion]
+	if !ok {
+		return nil, fmt.Errorf("unsupported TLS_MIN_VERSION %q, expected 1.2 or 1.3", config.TLSMinVersion)
+	}
+
+	tlsConfig := &tls.Config{MinVersion: minVersion}
+	if len(config.TLSCipherSuites) == 0 {
+		// Go's defaults only include secure cipher suites
+		return tlsConfig, nil
+	}
+
+	secure := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		secure[suite.Name] = suite.ID
+	}
+	insecure := make(map[string]bool)
+	for _, suite := range tls.InsecureCipherSuites() {
+		insecure[suite.Name] = true
+	}
+
+	for _, name := range config.TLSCipherSuites {
+		if insecure[name] {
+			return nil, fmt.Errorf("cipher suite %s is known to be weak and can't be enabled", name)
+		}
+		id, ok := secure[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %s", name)
+		}
+		tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, id)
+	}
+
+	if minVersion == tls.VersionTLS13 {
+		log.Println("TLS_CIPHER_SUITES has no effect with TLS 1.3, whose cipher suites are not configurable")
+	}
+
+	return tlsConfig, nil
+}
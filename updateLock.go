@@ -0,0 +1,33 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// errUpdateRunning is returned by lockUpdate while another update holds the lock
+var errUpdateRunning = errors.New("an update is already running")
+
+// Take the update lock without waiting. The lock is an flock on the file, so
+// the kernel releases it if the service dies mid-update; the returned function
+// releases it otherwise. The descriptor is close-on-exec and isn't inherited
+// by the update script.
+func lockUpdate(path string) (func(), error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("error opening update lock: %v", err)
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, errUpdateRunning
+		}
+		return nil, fmt.Errorf("error locking %s: %v", path, err)
+	}
+	return func() {
+		syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		file.Close()
+	}, nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLockUpdate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "update.lock")
+
+	unlock, err := lockUpdate(path)
+	if err != nil {
+		t.Fatalf("first lock: %v", err)
+	}
+	if _, err := lockUpdate(path); !errors.Is(err, errUpdateRunning) {
+		t.Fatalf("second lock error = %v, want errUpdateRunning", err)
+	}
+
+	unlock()
+	unlock, err = lockUpdate(path)
+	if err != nil {
+		t.Fatalf("lock after unlock: %v", err)
+	}
+	unlock()
+}
+
+func TestLockUpdateUnopenable(t *testing.T) {
+	_, err := lockUpdate(filepath.Join(t.TempDir(), "missing", "update.lock"))
+	if err == nil || errors.Is(err, errUpdateRunning) {
+		t.Fatalf("error = %v, want an open error", err)
+	}
+}
+
+// waitForUpdateLock fails the test unless the lock is released in time
+func waitForUpdateLock(t *testing.T, path string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		unlock, err := lockUpdate(path)
+		if err == nil {
+			unlock()
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("update lock still held: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConcurrentUpdateTriggers(t *testing.T) {
+	dir := t.TempDir()
+	release := filepath.Join(dir, "release")
+	runs := filepath.Join(dir, "runs")
+	script := filepath.Join(dir, "update.sh")
+	// The script records its run and holds the lock until the test releases it
+	body := "#!/bin/sh\necho run >> " + runs + "\nwhile [ ! -f " + release + " ]; do sleep 0.01; done\n"
+	if err := os.WriteFile(script, []byte(body), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	config := Config{UpdateScriptPath: script, UpdateLockFile: filepath.Join(dir, "update.lock")}
+	t.Setenv("UPDATE_AUTH_TOKEN", "update-secret")
+	update := updateHandler(config, nil, nil)
+
+	trigger := func() int {
+		r := httptest.NewRequest(http.MethodPost, "/update", nil)
+		r.Header.Set("Authorization", "Bearer update-secret")
+		w := httptest.NewRecorder()
+		update(w, r)
+		return w.Code
+	}
+
+	const triggers = 5
+	codes := make([]int, triggers)
+	var wg sync.WaitGroup
+	for i := range triggers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes[i] = trigger()
+		}()
+	}
+	wg.Wait()
+
+	started, conflicts := 0, 0
+	for _, code := range codes {
+		switch code {
+		case http.StatusOK:
+			started++
+		case http.StatusConflict:
+			conflicts++
+		default:
+			t.Errorf("unexpected status %d", code)
+		}
+	}
+	if started != 1 || conflicts != triggers-1 {
+		t.Fatalf("statuses = %v, want one start and %d conflicts", codes, triggers-1)
+	}
+
+	// The running update still blocks late triggers
+	if code := trigger(); code != http.StatusConflict {
+		t.Fatalf("trigger during the update = %d, want 409", code)
+	}
+
+	if err := os.WriteFile(release, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	waitForUpdateLock(t, config.UpdateLockFile)
+	output, err := os.ReadFile(runs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(output), "run"); n != 1 {
+		t.Fatalf("the update script ran %d times, want 1", n)
+	}
+}
+
+func TestUpdateLockReleasedAfterFailedScript(t *testing.T) {
+	config := Config{UpdateScriptPath: "/bin/false", UpdateLockFile: filepath.Join(t.TempDir(), "update.lock")}
+	t.Setenv("UPDATE_AUTH_TOKEN", "update-secret")
+	update := updateHandler(config, nil, nil)
+
+	for range 2 {
+		r := httptest.NewRequest(http.MethodPost, "/update", nil)
+		r.Header.Set("Authorization", "Bearer update-secret")
+		w := httptest.NewRecorder()
+		update(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, want 200", w.Code)
+		}
+		waitForUpdateLock(t, config.UpdateLockFile)
+	}
+}
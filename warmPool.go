@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Cache holding the warm pool's prepared workspaces
+const cacheWorkspaces = "workspaces"
+
+// How long preparing a single workspace may take
+const warmPoolPrepareTimeout = 30 * time.Minute
+
+// workspace is a cloned and installed checkout of a warm pool repository
+type workspace struct {
+	repoURL string
+	name    string // Entry name in the workspaces cache
+	path    string
+	release func()
+	broken  bool
+}
+
+// warmPool keeps pre-cloned and installed workspaces of frequently built
+// repositories, so a build only has to fetch its ref and install the
+// dependency delta. Workspaces live in the workspaces cache of CACHE_DIR.
+type warmPool struct {
+	caches *cacheManager
+	opts   cloneOptions
+	mu     sync.Mutex
+	repos  map[string]string       // Cache key -> repository URL
+	idle   map[string][]*workspace // Cache key -> workspaces ready for a build
+}
+
+// Create a warm pool with size workspaces for each repository. Returns nil
+// when no repositories are configured or caching is disabled.
+func newWarmPool(caches *cacheManager, repos []string, size int, opts cloneOptions) *warmPool {
+	if len(repos) == 0 || size <= 0 {
+		return nil
+	}
+	if !caches.Enabled() {
+		log.Println("WARM_POOL_REPOS is set but CACHE_DIR is not, the warm pool is disabled")
+		return nil
+	}
+
+	pool := &warmPool{
+		caches: caches,
+		opts:   opts,
+		repos:  make(map[string]string),
+		idle:   make(map[string][]*workspace),
+	}
+	for _, repoURL := range repos {
+		key := cacheKeyForRepo(repoURL)
+		pool.repos[key] = repoURL
+		for i := 0; i < size; i++ {
+			go pool.prepare(repoURL, fmt.Sprintf("%s-%d", key, i))
+		}
+	}
+	return pool
+}
+
+// Clone and install a workspace in the background and add it to the pool
+func (p *warmPool) prepare(repoURL, name string) {
+	ctx, cancel := context.WithTimeout(context.Background(), warmPoolPrepareTimeout)
+	defer cancel()
+	ctx = withLogger(ctx, slog.Default().With("workspace", name, "repo", redactURLCredentials(repoURL)))
+
+	path, release, err := p.caches.Acquire(cacheWorkspaces, name)
+	if err != nil {
+		loggerFrom(ctx).Error("Failed to prepare warm workspace", "error", err)
+		return
+	}
+	defer release()
+
+	start := time.Now()
+	if _, err := os.Stat(filepath.Join(path, ".git")); err != nil {
+		// Clone into a fresh directory; a leftover partial workspace is discarded
+		if err := os.RemoveAll(path); err != nil {
+			loggerFrom(ctx).Error("Failed to reset warm workspace", "error", err)
+			return
+		}
+		if err := cloneOrUpdateRepo(ctx, repoURL, path, p.opts); err != nil {
+			loggerFrom(ctx).Error("Failed to clone warm workspace", "error", err)
+			return
+		}
+	}
+	if _, err := os.Stat(filepath.Join(path, "package.json")); err == nil {
+		if err := runNpmInstall(ctx, path, p.opts.Env, nil, nil, nil); err != nil {
+			loggerFrom(ctx).Error("Failed to install warm workspace", "error", err)
+			return
+		}
+	}
+	loggerFrom(ctx).Info("Warm workspace ready", "duration", time.Since(start).Round(time.Millisecond).String())
+
+	p.put(&workspace{repoURL: repoURL, name: name, path: path})
+}
+
+func (p *warmPool) put(ws *workspace) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := cacheKeyForRepo(ws.repoURL)
+	p.idle[key] = append(p.idle[key], ws)
+}
+
+// Take an idle workspace for the repository, or nil when none is ready.
+// The workspace must be handed back with Recycle.
+func (p *warmPool) Take(repoURL string) *workspace {
+	if p == nil {
+		return nil
+	}
+	key := cacheKeyForRepo(repoURL)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for len(p.idle[key]) > 0 {
+		ws := p.idle[key][0]
+		p.idle[key] = p.idle[key][1:]
+
+		// Operators may have evicted the workspace while it was idle
+		if _, err := os.Stat(filepath.Join(ws.path, ".git")); err != nil {
+			go p.prepare(p.repos[key], ws.name)
+			continue
+		}
+		_, release, err := p.caches.Acquire(cacheWorkspaces, ws.name)
+		if err != nil {
+			continue
+		}
+		ws.release, ws.broken = release, false
+		return ws
+	}
+	return nil
+}
+
+// Update checks out the requested branch in the workspace, fetching it with
+// the credentials and git settings of the build
+func (p *warmPool) Update(ctx context.Context, ws *workspace, repoURL string, opts cloneOptions) error {
+	for _, step := range []struct {
+		name string
+		args []string
+	}{
+		{"fetch", gitArgs(opts, "fetch", "--depth", "1", "--", repoURL, opts.Branch)},
+		{"checkout", []string{"checkout", "--force", "FETCH_HEAD"}},
+		{"clean", []string{"clean", "-ffdx", "-e", "node_modules"}},
+	} {
+		if output, err := runGit(ctx, ws.path, repoURL, opts, step.args...); err != nil {
+			ws.broken = true
+			return fmt.Errorf("error running git %s: %v, output: %s", step.name, err, output)
+		}
+	}
+	return nil
+}
+
+// Recycle removes everything a build left behind except node_modules and
+// returns the workspace to the pool. Broken workspaces are rebuilt from scratch.
+func (p *warmPool) Recycle(ws *workspace) {
+	defer ws.release()
+
+	if !ws.broken {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		for _, args := range [][]string{{"reset", "--hard"}, {"clean", "-ffdx", "-e", "node_modules"}} {
+			if output, err := runGit(ctx, ws.path, ws.repoURL, p.opts, args...); err != nil {
+				slog.Warn("Failed to recycle warm workspace", "workspace", ws.name, "error", err, "output", output)
+				ws.broken = true
+				break
+			}
+		}
+	}
+
+	if ws.broken {
+		if err := os.RemoveAll(ws.path); err != nil {
+			slog.Error("Failed to remove broken warm workspace", "workspace", ws.name, "error", err)
+		}
+		go p.prepare(ws.repoURL, ws.name)
+		return
+	}
+	p.put(ws)
+}
+
+// Run a git command inside a workspace
+func runGit(ctx context.Context, dir, repoURL string, opts cloneOptions, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	killProcessGroupOnCancel(cmd)
+	cmd.Dir = dir
+	cmd.Env = gitEnv(repoURL, opts)
+
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	err := cmd.Run()
+	return output.String(), err
+}